@@ -135,6 +135,8 @@ def add_channel():
             'name': request.form['name'],
             'logo': request.form['logo'],
             'mpd': request.form['mpd'],
+            'stream_type': request.form.get('stream_type', 'dash'),
+            'mime_type': request.form.get('mime_type', ''),
             'key': request.form['key'],
             'expires_every': int(request.form['expires_every']) if request.form['expires_every'] else 3600,
             'last_refreshed': datetime.now(timezone.utc).isoformat()
@@ -163,8 +165,11 @@ def edit_channel(channel_id):
             'name': request.form['name'],
             'logo': request.form['logo'],
             'mpd': request.form['mpd'],
+            'stream_type': request.form.get('stream_type', 'dash'),
+            'mime_type': request.form.get('mime_type', ''),
             'key': request.form['key'],
-            'expires_every': int(request.form['expires_every']) if request.form['expires_every'] else 3600
+            'expires_every': int(request.form['expires_every']) if request.form['expires_every'] else 3600,
+            'disabled': 'enabled' not in request.form
         }
         success, result = api_client.put(f'/channels/{channel_id}', data)
         if success:
@@ -202,7 +207,8 @@ def add_package():
     if request.method == 'POST':
         data = {
             'name': request.form['name'],
-            'logo': request.form['logo']
+            'logo': request.form['logo'],
+            'kind': request.form.get('kind', 'base')
         }
 
         success, result = api_client.post('/packages', data)
@@ -219,7 +225,8 @@ def edit_package(package_id):
     if request.method == 'POST':
         data = {
             'name': request.form['name'],
-            'logo': request.form['logo']
+            'logo': request.form['logo'],
+            'kind': request.form.get('kind', 'base')
         }
 
         success, result = api_client.put(f'/packages/{package_id}', data)
@@ -346,15 +353,34 @@ def add_subscription():
             'key': request.form['key'] if request.form.get('key') else util.generate_key()
         }
 
+        # With a plan the API computes the end date and amount from the plan and add-ons
+        if request.form.get('plan_id'):
+            del data['end'], data['payed']
+            data['plan_id'] = int(request.form['plan_id'])
+            data['addon_ids'] = [int(id) for id in request.form.getlist('addon_ids')]
+
         success, result = api_client.post('/subscriptions', data)
         if success:
             return redirect(url_for('subscriptions'))
         else:
-            return render_template('add_subscription.html', error=result.get('error'))
+            return render_template('add_subscription.html', error=result.get('error'), **subscription_form_options())
 
-    # Get users for dropdown
+    return render_template('add_subscription.html', **subscription_form_options())
+
+def subscription_form_options():
+    """Users, base package plans and add-on packages for the subscription form"""
     success, users = api_client.get('/users')
-    return render_template('add_subscription.html', users=users if success else [])
+    users = users if success else []
+    success, packages = api_client.get('/packages')
+    packages = packages if success else []
+    success, plans = api_client.get('/plans')
+    plans = plans if success else []
+
+    names = {p['id']: p['name'] for p in packages}
+    base_ids = {p['id'] for p in packages if p.get('kind', 'base') == 'base'}
+    base_plans = [dict(plan, package_name=names.get(plan['package_id'], '')) for plan in plans if plan['package_id'] in base_ids]
+    addons = [p for p in packages if p.get('kind') == 'addon']
+    return {'users': users, 'plans': base_plans, 'addons': addons}
 
 @app.route('/subscriptions/edit/<int:subscription_id>', methods=['GET', 'POST'])
 @require_auth
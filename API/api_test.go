@@ -0,0 +1,496 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
+)
+
+// newTestServer returns a router backed by the GORM services on a temporary database
+func newTestServer(t *testing.T) (*gin.Engine, *gorm.DB) {
+	t.Helper()
+	conn := openTestDB(t)
+	services := newGormServices(conn)
+	if err := services.Admins.EnsureDefault(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return newServer(services).router(), conn
+}
+
+func TestLogin(t *testing.T) {
+	r, _ := newTestServer(t)
+
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"valid credentials", `{"username":"admin","password":"admin123"}`, http.StatusOK},
+		{"wrong password", `{"username":"admin","password":"nope"}`, http.StatusUnauthorized},
+		{"unknown user", `{"username":"root","password":"admin123"}`, http.StatusUnauthorized},
+		{"missing password", `{"username":"admin"}`, http.StatusBadRequest},
+		{"malformed body", `{"username":`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := doRequest(r, http.MethodPost, "/api/login", tt.body, "")
+			if w.Code != tt.want {
+				t.Fatalf("status %d, want %d (body %s)", w.Code, tt.want, w.Body)
+			}
+			if tt.want != http.StatusOK {
+				return
+			}
+
+			var resp struct {
+				Token     string `json:"token"`
+				ExpiresIn int    `json:"expires_in"`
+			}
+			decodeJSON(t, w, &resp)
+			if resp.ExpiresIn != JWT_EXPIRE_HOURS*3600 {
+				t.Errorf("expires_in = %d", resp.ExpiresIn)
+			}
+			if w := doRequest(r, http.MethodGet, "/api/admin/channels", "", resp.Token); w.Code != http.StatusOK {
+				t.Errorf("issued token rejected: status %d", w.Code)
+			}
+		})
+	}
+}
+
+func TestJWTAuthRejections(t *testing.T) {
+	r, _ := newTestServer(t)
+
+	sign := func(claims jwt.MapClaims, secret string) string {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	tests := []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{"missing header", "", "Authorization header required"},
+		{"garbage token", "Bearer not-a-jwt", "Invalid or expired token"},
+		{"wrong secret", "Bearer " + sign(jwt.MapClaims{"username": "admin", "exp": time.Now().Add(time.Hour).Unix()}, "other-secret"), "Invalid or expired token"},
+		{"expired", "Bearer " + sign(jwt.MapClaims{"username": "admin", "exp": time.Now().Add(-time.Hour).Unix()}, JWT_SECRET), "Invalid or expired token"},
+		{"unsigned", "Bearer " + func() string {
+			token, _ := jwt.NewWithClaims(jwt.SigningMethodNone, jwt.MapClaims{"username": "admin"}).SignedString(jwt.UnsafeAllowNoneSignatureType)
+			return token
+		}(), "Invalid or expired token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, "/api/admin/users", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			w := serve(r, req)
+			if w.Code != http.StatusUnauthorized {
+				t.Fatalf("status %d, want 401", w.Code)
+			}
+			var resp struct {
+				Error string `json:"error"`
+			}
+			decodeJSON(t, w, &resp)
+			if resp.Error != tt.want {
+				t.Fatalf("error = %q, want %q", resp.Error, tt.want)
+			}
+		})
+	}
+}
+
+// crudCase describes one admin resource for the shared CRUD test
+type crudCase struct {
+	path      string
+	create    string
+	update    string
+	field     string // JSON field changed by update
+	updated   any
+	canGetOne bool
+}
+
+func runCRUD(t *testing.T, r *gin.Engine, token string, tc crudCase) {
+	t.Helper()
+
+	w := doRequest(r, http.MethodPost, tc.path, tc.create, token)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: status %d, body %s", w.Code, w.Body)
+	}
+	var created map[string]any
+	decodeJSON(t, w, &created)
+	id := fmt.Sprint(created["id"])
+	item := tc.path + "/" + id
+
+	w = doRequest(r, http.MethodPost, tc.path, `{"name":`, token)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("create with malformed body: status %d, want 400", w.Code)
+	}
+
+	var list []map[string]any
+	decodeJSON(t, doRequest(r, http.MethodGet, tc.path, "", token), &list)
+	if len(list) != 1 || fmt.Sprint(list[0]["id"]) != id {
+		t.Fatalf("list after create = %v", list)
+	}
+
+	w = doRequest(r, http.MethodPut, item, tc.update, token)
+	if w.Code != http.StatusOK {
+		t.Fatalf("update: status %d, body %s", w.Code, w.Body)
+	}
+	var updated map[string]any
+	decodeJSON(t, w, &updated)
+	if fmt.Sprint(updated[tc.field]) != fmt.Sprint(tc.updated) {
+		t.Fatalf("updated %s = %v, want %v", tc.field, updated[tc.field], tc.updated)
+	}
+
+	if w := doRequest(r, http.MethodPut, tc.path+"/9999", tc.update, token); w.Code != http.StatusNotFound {
+		t.Fatalf("update missing: status %d, want 404", w.Code)
+	}
+
+	if tc.canGetOne {
+		var got map[string]any
+		w := doRequest(r, http.MethodGet, item, "", token)
+		decodeJSON(t, w, &got)
+		if w.Code != http.StatusOK || fmt.Sprint(got[tc.field]) != fmt.Sprint(tc.updated) {
+			t.Fatalf("get: status %d, body %s", w.Code, w.Body)
+		}
+		if w := doRequest(r, http.MethodGet, tc.path+"/9999", "", token); w.Code != http.StatusNotFound {
+			t.Fatalf("get missing: status %d, want 404", w.Code)
+		}
+	}
+
+	if w := doRequest(r, http.MethodDelete, item, "", token); w.Code != http.StatusOK {
+		t.Fatalf("delete: status %d, body %s", w.Code, w.Body)
+	}
+	decodeJSON(t, doRequest(r, http.MethodGet, tc.path, "", token), &list)
+	if len(list) != 0 {
+		t.Fatalf("list after delete = %v", list)
+	}
+}
+
+func TestAdminCRUD(t *testing.T) {
+	cases := map[string]crudCase{
+		"channels": {
+			path:    "/api/admin/channels",
+			create:  `{"name":"News 24","mpd":"https://cdn.example/news.mpd","key":"00112233445566778899aabbccddeeff:ffeeddccbbaa99887766554433221100","expires_every":3600}`,
+			update:  `{"name":"News 24 HD"}`,
+			field:   "name",
+			updated: "News 24 HD",
+		},
+		"packages": {
+			path:    "/api/admin/packages",
+			create:  `{"name":"Sports","logo":"sports.png"}`,
+			update:  `{"logo":"sports-new.png"}`,
+			field:   "logo",
+			updated: "sports-new.png",
+		},
+		"users": {
+			path:      "/api/admin/users",
+			create:    `{"name":"Alice","tele_username":"@alice"}`,
+			update:    `{"is_hoster":true}`,
+			field:     "is_hoster",
+			updated:   true,
+			canGetOne: true,
+		},
+		"hosters": {
+			path:    "/api/admin/hosters",
+			create:  `{"name":"Acme TV","color_palette":"#000"}`,
+			update:  `{"color_palette":"#fff"}`,
+			field:   "color_palette",
+			updated: "#fff",
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			r, _ := newTestServer(t)
+			runCRUD(t, r, adminToken(t), tc)
+		})
+	}
+
+	t.Run("subscriptions", func(t *testing.T) {
+		r, conn := newTestServer(t)
+		user := User{Name: "Bob"}
+		conn.Create(&user)
+
+		runCRUD(t, r, adminToken(t), crudCase{
+			path:      "/api/admin/subscriptions",
+			create:    fmt.Sprintf(`{"user_id":%d,"key":"SUBKEY1","payed":9.99}`, user.ID),
+			update:    `{"payed":19.99}`,
+			field:     "payed",
+			updated:   19.99,
+			canGetOne: true,
+		})
+	})
+}
+
+func TestAddSubscriptionDefaultsDates(t *testing.T) {
+	r, conn := newTestServer(t)
+	user := User{Name: "Carol"}
+	conn.Create(&user)
+
+	w := doRequest(r, http.MethodPost, "/api/admin/subscriptions", fmt.Sprintf(`{"user_id":%d,"key":"K"}`, user.ID), adminToken(t))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("status %d, body %s", w.Code, w.Body)
+	}
+	var sub Subscription
+	decodeJSON(t, w, &sub)
+	if time.Since(sub.Started) > time.Minute {
+		t.Errorf("started = %v, want now", sub.Started)
+	}
+	if d := sub.End.Sub(sub.Started); d < 27*24*time.Hour || d > 32*24*time.Hour {
+		t.Errorf("end - started = %v, want about one month", d)
+	}
+}
+
+func TestPackageChannelAssociation(t *testing.T) {
+	r, conn := newTestServer(t)
+	token := adminToken(t)
+
+	pkg := Package{Name: "Movies"}
+	channel := Channel{Name: "Cinema 1"}
+	conn.Create(&pkg)
+	conn.Create(&channel)
+	link := fmt.Sprintf("/api/admin/packages/%d/channels/%d", pkg.ID, channel.ID)
+
+	for _, path := range []string{
+		fmt.Sprintf("/api/admin/packages/9999/channels/%d", channel.ID),
+		fmt.Sprintf("/api/admin/packages/%d/channels/9999", pkg.ID),
+	} {
+		if w := doRequest(r, http.MethodPost, path, "", token); w.Code != http.StatusNotFound {
+			t.Fatalf("POST %s: status %d, want 404", path, w.Code)
+		}
+		if w := doRequest(r, http.MethodDelete, path, "", token); w.Code != http.StatusNotFound {
+			t.Fatalf("DELETE %s: status %d, want 404", path, w.Code)
+		}
+	}
+
+	if w := doRequest(r, http.MethodPost, link, "", token); w.Code != http.StatusOK {
+		t.Fatalf("add: status %d, body %s", w.Code, w.Body)
+	}
+	// Adding twice must not duplicate the association
+	doRequest(r, http.MethodPost, link, "", token)
+
+	var packages []Package
+	decodeEncrypted(t, doRequest(r, http.MethodGet, "/api/public/packages", "", ""), &packages)
+	if len(packages) != 1 || len(packages[0].Channels) != 1 || packages[0].Channels[0].Name != "Cinema 1" {
+		t.Fatalf("public packages = %+v", packages)
+	}
+
+	if w := doRequest(r, http.MethodDelete, link, "", token); w.Code != http.StatusOK {
+		t.Fatalf("remove: status %d, body %s", w.Code, w.Body)
+	}
+	var afterRemove []Package
+	decodeJSON(t, doRequest(r, http.MethodGet, "/api/admin/packages", "", token), &afterRemove)
+	if len(afterRemove) != 1 || len(afterRemove[0].Channels) != 0 {
+		t.Fatalf("admin packages after remove = %+v", afterRemove)
+	}
+}
+
+func TestPackageLineupOrder(t *testing.T) {
+	r, conn := newTestServer(t)
+	token := adminToken(t)
+
+	pkg := Package{Name: "Basic"}
+	conn.Create(&pkg)
+	channels := []Channel{
+		{Name: "One", Category: "General", Tags: []string{"hd"}},
+		{Name: "Two"},
+		{Name: "Three"},
+	}
+	for i := range channels {
+		conn.Create(&channels[i])
+	}
+	lineupPath := fmt.Sprintf("/api/admin/packages/%d/channels", pkg.ID)
+	names := func() ([]string, []int) {
+		var packages []Package
+		decodeEncrypted(t, doRequest(r, http.MethodGet, "/api/public/packages", "", ""), &packages)
+		var names []string
+		var numbers []int
+		for _, c := range packages[0].Channels {
+			names = append(names, c.Name)
+			numbers = append(numbers, c.ChannelNumber)
+		}
+		return names, numbers
+	}
+
+	// Channels added one by one keep the order they were added in
+	for _, i := range []int{2, 0} {
+		doRequest(r, http.MethodPost, fmt.Sprintf("%s/%d", lineupPath, channels[i].ID), "", token)
+	}
+	if got, _ := names(); !slices.Equal(got, []string{"Three", "One"}) {
+		t.Fatalf("after adding: %v", got)
+	}
+
+	body := fmt.Sprintf(`[{"channel_id":%d,"channel_number":1},{"channel_id":%d},{"channel_id":%d,"channel_number":3}]`,
+		channels[0].ID, channels[1].ID, channels[2].ID)
+	w := doRequest(r, http.MethodPut, lineupPath, body, token)
+	if w.Code != http.StatusOK {
+		t.Fatalf("set lineup: status %d, body %s", w.Code, w.Body)
+	}
+	got, numbers := names()
+	if !slices.Equal(got, []string{"One", "Two", "Three"}) || !slices.Equal(numbers, []int{1, 0, 3}) {
+		t.Fatalf("after lineup: %v %v", got, numbers)
+	}
+
+	var listed []Channel
+	decodeEncrypted(t, doRequest(r, http.MethodGet, "/api/public/channels", "", ""), &listed)
+	if listed[0].Category != "General" || !slices.Equal(listed[0].Tags, []string{"hd"}) {
+		t.Fatalf("public channel = %+v", listed[0])
+	}
+
+	for name, tc := range map[string]struct {
+		body string
+		want int
+	}{
+		"duplicate channel": {fmt.Sprintf(`[{"channel_id":%d},{"channel_id":%d}]`, channels[0].ID, channels[0].ID), http.StatusBadRequest},
+		"duplicate number":  {fmt.Sprintf(`[{"channel_id":%d,"channel_number":7},{"channel_id":%d,"channel_number":7}]`, channels[0].ID, channels[1].ID), http.StatusBadRequest},
+		"unknown channel":   {`[{"channel_id":9999}]`, http.StatusNotFound},
+	} {
+		if w := doRequest(r, http.MethodPut, lineupPath, tc.body, token); w.Code != tc.want {
+			t.Fatalf("%s: status %d, want %d", name, w.Code, tc.want)
+		}
+	}
+	if got, _ := names(); !slices.Equal(got, []string{"One", "Two", "Three"}) {
+		t.Fatalf("rejected lineups changed the package: %v", got)
+	}
+}
+
+func TestValidateSubscriptionStatus(t *testing.T) {
+	r, conn := newTestServer(t)
+
+	hoster := IPTVHoster{Name: "Acme TV", Logo: "acme.png"}
+	conn.Create(&hoster)
+	user := User{Name: "Dana", IPTVHosterID: &hoster.ID}
+	conn.Create(&user)
+
+	now := time.Now()
+	subscriptions := []Subscription{
+		{UserID: user.ID, Key: "NOTSTARTED", Started: now.Add(24 * time.Hour), End: now.AddDate(0, 1, 0)},
+		{UserID: user.ID, Key: "ACTIVE", Started: now.Add(-time.Hour), End: now.Add(time.Hour)},
+		{UserID: user.ID, Key: "EXPIRED", Started: now.AddDate(0, -1, 0), End: now.Add(-time.Hour)},
+	}
+	for i := range subscriptions {
+		conn.Create(&subscriptions[i])
+	}
+
+	tests := []struct {
+		key    string
+		valid  bool
+		status string
+		code   string // of the error, for unknown keys
+	}{
+		{"NOTSTARTED", false, "not_started", ""},
+		{"ACTIVE", true, "active", ""},
+		{"EXPIRED", false, "expired", ""},
+		{"UNKNOWN", false, "", codeSubscriptionNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			var resp struct {
+				Valid        bool          `json:"valid"`
+				Status       any           `json:"status"` // the HTTP status in errors
+				Code         string        `json:"code"`
+				Error        string        `json:"error"`
+				Subscription *Subscription `json:"subscription"`
+				User         *struct {
+					Name       string         `json:"name"`
+					IPTVHoster map[string]any `json:"iptv_hoster"`
+				} `json:"user"`
+			}
+			decodeEncrypted(t, doRequest(r, http.MethodGet, "/api/public/validate/"+tt.key, "", ""), &resp)
+
+			if tt.code != "" {
+				if resp.Code != tt.code || resp.Status != float64(http.StatusNotFound) || resp.Error == "" {
+					t.Fatalf("error = %+v, want %s", resp, tt.code)
+				}
+				return
+			}
+			if resp.Valid != tt.valid || resp.Status != tt.status || resp.Error != "" {
+				t.Fatalf("valid=%v status=%v error=%q, want %v %q", resp.Valid, resp.Status, resp.Error, tt.valid, tt.status)
+			}
+			if resp.Subscription == nil || resp.Subscription.Key != tt.key {
+				t.Fatalf("subscription = %+v", resp.Subscription)
+			}
+			if resp.User == nil || resp.User.Name != "Dana" || resp.User.IPTVHoster["logo"] != "acme.png" {
+				t.Fatalf("user = %+v", resp.User)
+			}
+		})
+	}
+}
+
+func TestEncryptResponseRoundTrip(t *testing.T) {
+	r, conn := newTestServer(t)
+	conn.Create(&Channel{Name: "Round Trip", MPD: "https://cdn.example/rt.mpd", Keys: []ChannelKey{{System: keySystemClearKey, KID: testKID, Key: testContentKey}}})
+
+	w := doRequest(r, http.MethodGet, "/api/public/channels", "", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d", w.Code)
+	}
+	var envelope EncryptedResponse
+	decodeJSON(t, w, &envelope)
+	if envelope.Data == "" {
+		t.Fatal("empty encrypted payload")
+	}
+
+	plaintext, err := decrypt(envelope.Data, ENCRYPTION_KEY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var channels []Channel
+	if err := json.Unmarshal([]byte(plaintext), &channels); err != nil {
+		t.Fatal(err)
+	}
+	if len(channels) != 1 || channels[0].Name != "Round Trip" || channels[0].Key != testKID+":"+testContentKey {
+		t.Fatalf("decrypted channels = %+v", channels)
+	}
+	if _, err := decrypt("bm90", ENCRYPTION_KEY); err == nil {
+		t.Fatal("short ciphertext decrypted")
+	}
+}
+
+func TestEnvelopeDiagnostics(t *testing.T) {
+	r, _ := newTestServer(t)
+	token := adminToken(t)
+	if w := doRequest(r, http.MethodPost, "/api/decrypt", `{"data":""}`, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("public decrypt endpoint: status %d", w.Code)
+	}
+
+	data, _ := encrypt(`{"ok":true}`, ENCRYPTION_KEY)
+	body := `{"data":"` + data + `"}`
+	if w := doRequest(r, http.MethodPost, "/api/admin/diagnostics/envelope", body, ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("without a token: status %d", w.Code)
+	}
+	var report EnvelopeReport
+	decodeJSON(t, doRequest(r, http.MethodPost, "/api/admin/diagnostics/envelope", body, token), &report)
+	if !report.Valid || !report.JSON || report.PlaintextBytes != 11 || report.Plaintext != "" || report.KeyID != keyID(ENCRYPTION_KEY) {
+		t.Fatalf("report = %+v", report)
+	}
+
+	report = EnvelopeReport{}
+	decodeJSON(t, doRequest(r, http.MethodPost, "/api/admin/diagnostics/envelope", `{"data":"bm90IGVuY3J5cHRlZA=="}`, token), &report)
+	if report.Valid || report.Error == "" || report.CiphertextBytes != 13 {
+		t.Fatalf("garbage report = %+v", report)
+	}
+
+	w := doRequest(r, http.MethodPost, "/api/admin/diagnostics/envelope", `{"data":"`+data+`","reveal":true}`, token)
+	if !debugBuild && !cfg.Diagnostics.RevealPlaintext && w.Code != http.StatusForbidden {
+		t.Fatalf("reveal: status %d", w.Code)
+	}
+}
+
+func serve(r http.Handler, req *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
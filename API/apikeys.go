@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// API keys
+//
+// Scripts authenticate with named API keys instead of an admin password,
+// sending them as "Authorization: Bearer ssk_<prefix>_<secret>". Only the
+// prefix, which tells keys apart, and a hash of the whole key are stored; the
+// key itself is shown once when it is created. A key acts for the admin who
+// created it and is limited to its scopes, each an area of the admin API with
+// read or write access. Keys can expire and be tied to client IPs, and are
+// revoked rather than deleted so the audit log can still name them. Keys
+// cannot reach the key, 2FA and admin account endpoints.
+
+const apiKeyMarker = "ssk_"
+
+// apiKeyContextKey holds the prefix of the API key a request was made with
+const apiKeyContextKey = "api_key"
+
+// apiKeyAreas are the parts of the admin API keys can be scoped to, by the
+// path segment after /api/admin/
+var apiKeyAreas = []string{"channels", "packages", "plans", "bundles", "users", "hosters", "subscriptions", "catalog", "epg", "audit"}
+
+// Access levels of a scope; write includes read
+const (
+	scopeRead  = "read"
+	scopeWrite = "write"
+)
+
+// apiKeyTouchInterval limits how often a key's last use is written
+const apiKeyTouchInterval = time.Minute
+
+// newAPIKey returns a fresh key and its stored prefix
+func newAPIKey() (key, prefix string) {
+	p := make([]byte, 6)
+	rand.Read(p)
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	prefix = hex.EncodeToString(p)
+	return apiKeyMarker + prefix + "_" + base64.RawURLEncoding.EncodeToString(secret), prefix
+}
+
+// validateScopes checks scopes written as "area:read", "area:write", "*:read" or "*"
+func validateScopes(scopes []string) string {
+	if len(scopes) == 0 {
+		return "API keys need at least one scope"
+	}
+	for _, scope := range scopes {
+		if scope == "*" {
+			continue
+		}
+		area, access, _ := strings.Cut(scope, ":")
+		if (area != "*" && !slices.Contains(apiKeyAreas, area)) || (access != scopeRead && access != scopeWrite) {
+			return "Scope " + scope + " must be *, *:read or one of " + strings.Join(apiKeyAreas, ", ") + " followed by :read or :write"
+		}
+	}
+	return ""
+}
+
+// validateAllowedIPs checks and normalises an IP allowlist of addresses and CIDR ranges
+func validateAllowedIPs(allowed []string) string {
+	for i, entry := range allowed {
+		if prefix, err := netip.ParsePrefix(entry); err == nil {
+			allowed[i] = prefix.Masked().String()
+		} else if addr, err := netip.ParseAddr(entry); err == nil {
+			allowed[i] = addr.String()
+		} else {
+			return "Allowed IP " + entry + " must be an IP address or CIDR range"
+		}
+	}
+	return ""
+}
+
+// requiredScope returns the scope a request needs, empty when keys cannot make it
+func requiredScope(method, route string) string {
+	area, _, _ := strings.Cut(strings.TrimPrefix(route, "/api/admin/"), "/")
+	if !slices.Contains(apiKeyAreas, area) {
+		return ""
+	}
+	if method == "GET" || method == "HEAD" {
+		return area + ":" + scopeRead
+	}
+	return area + ":" + scopeWrite
+}
+
+// allows reports whether the key's scopes grant the required one
+func (k *APIKey) allows(required string) bool {
+	area, access, _ := strings.Cut(required, ":")
+	for _, scope := range k.Scopes {
+		a, acc, _ := strings.Cut(scope, ":")
+		if scope == "*" || ((a == "*" || a == area) && (acc == access || acc == scopeWrite)) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsIP reports whether the client IP is on the key's allowlist, if it has one
+func (k *APIKey) allowsIP(ip string) bool {
+	if len(k.AllowedIPs) == 0 {
+		return true
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, entry := range k.AllowedIPs {
+		if prefix, err := netip.ParsePrefix(entry); err == nil && prefix.Contains(addr) {
+			return true
+		}
+		if allowed, err := netip.ParseAddr(entry); err == nil && allowed == addr {
+			return true
+		}
+	}
+	return false
+}
+
+var errInvalidAPIKey = errors.New("invalid API key")
+
+// authenticateAPIKey checks a key sent by a client and returns it with the
+// username of the admin it acts for
+func (s *Server) authenticateAPIKey(c *gin.Context, raw string) (*APIKey, string, error) {
+	prefix, _, ok := strings.Cut(strings.TrimPrefix(raw, apiKeyMarker), "_")
+	if !ok {
+		return nil, "", errInvalidAPIKey
+	}
+	ctx := c.Request.Context()
+	key, err := s.services.APIKeys.GetByPrefix(ctx, prefix)
+	if err != nil {
+		return nil, "", errInvalidAPIKey
+	}
+	now := time.Now()
+	ip := c.ClientIP()
+	switch {
+	case subtle.ConstantTimeCompare([]byte(key.Hash), []byte(plainLookupHash(raw))) != 1:
+		return nil, "", errInvalidAPIKey
+	case key.RevokedAt != nil:
+		return nil, "", errors.New("API key revoked")
+	case key.ExpiresAt != nil && !now.Before(*key.ExpiresAt):
+		return nil, "", errors.New("API key expired")
+	case !key.allowsIP(ip):
+		return nil, "", errors.New("API key not allowed from this IP")
+	}
+	admin, err := s.services.Admins.Get(ctx, key.AdminID)
+	if err != nil {
+		return nil, "", errors.New("API key owner no longer exists")
+	}
+
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) >= apiKeyTouchInterval {
+		if err := s.services.APIKeys.Touch(context.WithoutCancel(ctx), key.ID, now, ip); err != nil {
+			slog.WarnContext(ctx, "failed to record API key use", "api_key", key.Prefix, "error", err)
+		}
+	}
+	return key, admin.Username, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPIKeyScopes(t *testing.T) {
+	key := APIKey{Scopes: []string{"channels:write", "*:read"}, AllowedIPs: []string{"10.0.0.0/8", "192.0.2.7"}}
+	for required, want := range map[string]bool{
+		"channels:write": true, "channels:read": true, "users:read": true, "users:write": false,
+	} {
+		if key.allows(required) != want {
+			t.Errorf("allows(%s) = %v", required, !want)
+		}
+	}
+	for ip, want := range map[string]bool{"10.1.2.3": true, "192.0.2.7": true, "::ffff:10.0.0.1": true, "192.0.2.8": false, "": false} {
+		if key.allowsIP(ip) != want {
+			t.Errorf("allowsIP(%q) = %v", ip, !want)
+		}
+	}
+	if scope := requiredScope(http.MethodPut, "/api/admin/subscriptions/:id"); scope != "subscriptions:write" {
+		t.Fatalf("requiredScope = %q", scope)
+	}
+	if scope := requiredScope(http.MethodPost, "/api/admin/api-keys"); scope != "" {
+		t.Fatalf("key management reachable with scope %q", scope)
+	}
+	if msg := validateScopes([]string{"channels:delete"}); msg == "" {
+		t.Fatal("invalid scope accepted")
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	r, _ := newTestServer(t)
+	token := adminToken(t)
+
+	if w := doRequest(r, http.MethodPost, "/api/admin/api-keys", `{"name":"ci","scopes":["channels:write"],"allowed_ips":["nonsense"]}`, token); w.Code != http.StatusBadRequest {
+		t.Fatalf("invalid allowlist: status %d", w.Code)
+	}
+	var created struct {
+		APIKey
+		Key string `json:"key"`
+	}
+	w := doRequest(r, http.MethodPost, "/api/admin/api-keys", `{"name":"ci","scopes":["channels:write","audit:read"]}`, token)
+	decodeJSON(t, w, &created)
+	if w.Code != http.StatusCreated || !strings.HasPrefix(created.Key, apiKeyMarker+created.Prefix+"_") {
+		t.Fatalf("create: status %d, %s", w.Code, w.Body)
+	}
+
+	// The key works within its scopes and the audit log names it
+	if w := doRequest(r, http.MethodPost, "/api/admin/channels", `{"name":"Scripted"}`, created.Key); w.Code != http.StatusCreated {
+		t.Fatalf("create channel with key: status %d, %s", w.Code, w.Body)
+	}
+	if w := doRequest(r, http.MethodGet, "/api/admin/users", "", created.Key); w.Code != http.StatusForbidden {
+		t.Fatalf("users with channel key: status %d", w.Code)
+	}
+	if w := doRequest(r, http.MethodGet, "/api/admin/api-keys", "", created.Key); w.Code != http.StatusForbidden {
+		t.Fatalf("key management with key: status %d", w.Code)
+	}
+	if w := doRequest(r, http.MethodGet, "/api/admin/channels", "", created.Key[:len(created.Key)-2]+"xx"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong secret: status %d", w.Code)
+	}
+	var events []AuditEvent
+	decodeJSON(t, doRequest(r, http.MethodGet, "/api/admin/audit?entity_type=channel", "", created.Key), &events)
+	if len(events) != 1 || events[0].Admin != defaultAdminUsername || events[0].APIKey != created.Prefix {
+		t.Fatalf("audit events = %+v", events)
+	}
+
+	var keys []APIKey
+	decodeJSON(t, doRequest(r, http.MethodGet, "/api/admin/api-keys", "", token), &keys)
+	if len(keys) != 1 || keys[0].LastUsedAt == nil || keys[0].LastUsedIP == "" || strings.Contains(fmt.Sprint(keys), created.Key) {
+		t.Fatalf("keys = %+v", keys)
+	}
+
+	path := fmt.Sprintf("/api/admin/api-keys/%d", created.ID)
+	var revoked APIKey
+	decodeJSON(t, doRequest(r, http.MethodDelete, path, "", token), &revoked)
+	if revoked.RevokedAt == nil {
+		t.Fatalf("revoked key = %+v", revoked)
+	}
+	if w := doRequest(r, http.MethodGet, "/api/admin/channels", "", created.Key); w.Code != http.StatusUnauthorized {
+		t.Fatalf("revoked key: status %d", w.Code)
+	}
+
+	// Keys are refused once expired or from other IPs
+	expires := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	for body, status := range map[string]int{
+		`{"name":"office","scopes":["*"],"allowed_ips":["198.51.100.0/24"]}`:      http.StatusUnauthorized,
+		`{"name":"temporary","scopes":["*:read"],"expires_at":"` + expires + `"}`: http.StatusOK,
+	} {
+		decodeJSON(t, doRequest(r, http.MethodPost, "/api/admin/api-keys", body, token), &created)
+		if w := doRequest(r, http.MethodGet, "/api/admin/channels", "", created.Key); w.Code != status {
+			t.Fatalf("%s: status %d, want %d", body, w.Code, status)
+		}
+	}
+	if w := doRequest(r, http.MethodPost, "/api/admin/api-keys", `{"name":"old","scopes":["*"],"expires_at":"2020-01-01T00:00:00Z"}`, token); w.Code != http.StatusBadRequest {
+		t.Fatalf("expired on creation: status %d", w.Code)
+	}
+}
+
+func TestAPIKeyAllowlistIgnoresSpoofedForwardedFor(t *testing.T) {
+	services := newMemoryServices()
+	services.Admins.EnsureDefault(context.Background())
+	var created struct {
+		Key string `json:"key"`
+	}
+	decodeJSON(t, doRequest(newServer(services).router(), http.MethodPost, "/api/admin/api-keys",
+		`{"name":"office","scopes":["*"],"allowed_ips":["203.0.113.9"]}`, adminToken(t)), &created)
+
+	// httptest requests come from 192.0.2.1
+	list := func(trustedProxies ...string) int {
+		s := newServer(services)
+		s.limits.TrustedProxies = trustedProxies
+		req := httptest.NewRequest(http.MethodGet, "/api/admin/channels", nil)
+		req.Header.Set("Authorization", "Bearer "+created.Key)
+		req.Header.Set("X-Forwarded-For", "203.0.113.9")
+		return serve(s.router(), req).Code
+	}
+	if code := list(); code != http.StatusUnauthorized {
+		t.Fatalf("spoofed X-Forwarded-For from an untrusted peer: status %d", code)
+	}
+	if code := list("192.0.2.1"); code != http.StatusOK {
+		t.Fatalf("X-Forwarded-For from a trusted proxy: status %d", code)
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"reflect"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Audit log
+//
+// Every successful admin mutation is recorded as an AuditEvent: which admin
+// did it, from where, what kind of change it was, and how the entity's fields
+// differed before and after. Routes declare what they change with
+// Server.audited; the entity is loaded before and after the handler runs, or
+// taken from the response for creations and imports. Secret fields only show that they
+// changed. Events older than AUDIT_RETENTION are pruned in the background.
+
+// Audit actions besides the route specific ones such as add_channel
+const (
+	auditCreate = "create"
+	auditUpdate = "update"
+	auditDelete = "delete"
+	auditImport = "import"
+)
+
+// auditSkipKey marks a request whose mutation was not carried out, such as a dry run
+const auditSkipKey = "audit_skip"
+
+// auditEntityKey holds the ID of the entity changed by a request whose route
+// does not name it, such as the logged in admin's 2FA settings
+const auditEntityKey = "audit_entity"
+
+// auditRedacted lists the fields whose values never appear in the audit log
+var auditRedacted = map[string]bool{"key": true, "keys": true, "password": true, "playlist_token": true}
+
+// AuditFilter narrows the audit log; zero values match everything
+type AuditFilter struct {
+	Admin      string
+	Action     string
+	EntityType string
+	EntityID   uint
+	From       time.Time
+	To         time.Time
+	Limit      int
+	Offset     int
+}
+
+// matches reports whether the event passes the filter, ignoring paging
+func (f AuditFilter) matches(e AuditEvent) bool {
+	return (f.Admin == "" || e.Admin == f.Admin) &&
+		(f.Action == "" || e.Action == f.Action) &&
+		(f.EntityType == "" || e.EntityType == f.EntityType) &&
+		(f.EntityID == 0 || e.EntityID == f.EntityID) &&
+		(f.From.IsZero() || !e.CreatedAt.Before(f.From)) &&
+		(f.To.IsZero() || e.CreatedAt.Before(f.To))
+}
+
+// capturingWriter passes the response through and keeps a copy of its body
+type capturingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *capturingWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *capturingWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// audited records the request's change to an entity type once the handler has
+// succeeded. The entity is identified by the route's :id parameter, or by the
+// id in the response when it is created.
+func (s *Server) audited(entityType, action string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		id := idParam(c, "id")
+		var before map[string]any
+		if id != 0 {
+			before = s.auditState(ctx, entityType, id)
+		}
+		writer := &capturingWriter{ResponseWriter: c.Writer}
+		c.Writer = writer
+
+		c.Next()
+
+		if c.Writer.Status() >= 400 || c.GetBool(auditSkipKey) {
+			return
+		}
+		var after map[string]any
+		switch {
+		case id == 0 && c.GetUint(auditEntityKey) != 0:
+			// Recorded without changes, the state before was not loaded
+			id = c.GetUint(auditEntityKey)
+		case action == auditDelete:
+		case id != 0:
+			after = s.auditState(ctx, entityType, id)
+		case action == auditCreate || action == auditImport:
+			after = map[string]any{}
+			json.Unmarshal(writer.body.Bytes(), &after)
+			if v, ok := after["id"].(float64); ok && action == auditCreate {
+				id = uint(v)
+			}
+		}
+
+		event := &AuditEvent{
+			Admin:      c.GetString("username"),
+			Action:     action,
+			EntityType: entityType,
+			EntityID:   id,
+			Changes:    auditChanges(before, after),
+			APIKey:     c.GetString(apiKeyContextKey),
+			IP:         c.ClientIP(),
+			UserAgent:  c.Request.UserAgent(),
+		}
+		if err := s.services.Audit.Record(context.WithoutCancel(ctx), event); err != nil {
+			slog.ErrorContext(ctx, "failed to record audit event", "action", action, "entity_type", entityType, "entity_id", id, "admin", event.Admin, "error", err)
+		}
+	}
+}
+
+// auditState loads an entity as the audit log compares it, nil when it does not exist
+func (s *Server) auditState(ctx context.Context, entityType string, id uint) map[string]any {
+	var entity any
+	var err error
+	switch entityType {
+	case "channel":
+		entity, err = s.services.Channels.Get(ctx, id)
+	case "channel_sources":
+		var sources []StreamSource
+		sources, err = s.services.Sources.ForChannel(ctx, id)
+		entity = gin.H{"sources": sources}
+	case "package":
+		entity, err = s.services.Packages.Get(ctx, id)
+	case "plan":
+		entity, err = s.services.Plans.Get(ctx, id)
+	case "bundle":
+		entity, err = s.services.Bundles.Get(ctx, id)
+	case "user":
+		entity, err = s.services.Users.Get(ctx, id)
+	case "hoster":
+		entity, err = s.services.Hosters.Get(ctx, id)
+	case "subscription":
+		entity, err = s.services.Subscriptions.Get(ctx, id)
+	case "admin":
+		entity, err = s.services.Admins.Get(ctx, id)
+	case "api_key":
+		entity, err = s.services.APIKeys.Get(ctx, id)
+	default:
+		return nil
+	}
+	if err != nil {
+		return nil
+	}
+
+	state := map[string]any{}
+	data, err := json.Marshal(entity)
+	if err != nil || json.Unmarshal(data, &state) != nil {
+		return nil
+	}
+	return state
+}
+
+// auditChanges lists the fields that differ between two states of an entity
+func auditChanges(before, after map[string]any) map[string]FieldChange {
+	changes := map[string]FieldChange{}
+	record := func(field string) {
+		from, inBefore := before[field]
+		to, inAfter := after[field]
+		if inBefore == inAfter && reflect.DeepEqual(from, to) {
+			return
+		}
+		if auditRedacted[field] {
+			from, to = redacted, redacted
+		}
+		changes[field] = FieldChange{redactNested(from), redactNested(to)}
+	}
+	for field := range before {
+		record(field)
+	}
+	for field := range after {
+		if _, ok := before[field]; !ok {
+			record(field)
+		}
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	return changes
+}
+
+// redactNested hides secret fields of the entities nested in a value, such as
+// the channels of a package
+func redactNested(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for field, nested := range v {
+			if auditRedacted[field] {
+				out[field] = redacted
+			} else {
+				out[field] = redactNested(nested)
+			}
+		}
+		return out
+	case []any:
+		out := make([]any, len(v))
+		for i, nested := range v {
+			out[i] = redactNested(nested)
+		}
+		return out
+	default:
+		return value
+	}
+}
+
+// runAuditPruning deletes audit events older than the retention period every
+// day until ctx is cancelled
+func runAuditPruning(ctx context.Context, audit AuditService, retention time.Duration) {
+	ticker := time.NewTicker(24 * time.Hour)
+	defer ticker.Stop()
+
+	for {
+		if n, err := audit.Prune(ctx, time.Now().Add(-retention)); err != nil {
+			slog.ErrorContext(ctx, "audit log pruning failed", "error", err)
+		} else if n > 0 {
+			slog.InfoContext(ctx, "audit log pruned", "events", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
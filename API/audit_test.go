@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestAuditLog(t *testing.T) {
+	r, _ := newTestServer(t)
+	token := adminToken(t)
+
+	var channel Channel
+	decodeJSON(t, doRequest(r, http.MethodPost, "/api/admin/channels", `{"name":"News","keys":[{"kid":"`+testKID+`","key":"`+testContentKey+`"}]}`, token), &channel)
+	path := fmt.Sprintf("/api/admin/channels/%d", channel.ID)
+	doRequest(r, http.MethodPut, path, `{"name":"World News","keys":[]}`, token)
+	if w := doRequest(r, http.MethodPut, path, `{"stream_type":"rtmp"}`, token); w.Code != http.StatusBadRequest {
+		t.Fatalf("invalid update: status %d", w.Code)
+	}
+	doRequest(r, http.MethodPost, "/api/admin/catalog/import?dry_run=true", `{"channels":[{"name":"Dry"}]}`, token)
+	doRequest(r, http.MethodDelete, path, "", token)
+
+	var events []AuditEvent
+	decodeJSON(t, doRequest(r, http.MethodGet, "/api/admin/audit", "", token), &events)
+	if len(events) != 3 {
+		t.Fatalf("events = %+v", events)
+	}
+	deleted, updated, created := events[0], events[1], events[2]
+	if created.Action != auditCreate || created.Admin != defaultAdminUsername || created.EntityType != "channel" ||
+		created.EntityID != channel.ID || created.Changes["name"].To != "News" || created.IP == "" {
+		t.Fatalf("create event = %+v", created)
+	}
+	if updated.Action != auditUpdate || updated.Changes["name"] != (FieldChange{"News", "World News"}) ||
+		updated.Changes["keys"] != (FieldChange{redacted, redacted}) || updated.Changes["key"].From != redacted {
+		t.Fatalf("update event = %+v", updated)
+	}
+	if _, ok := updated.Changes["created_at"]; ok {
+		t.Fatalf("unchanged field logged: %+v", updated.Changes)
+	}
+	if deleted.Action != auditDelete || deleted.Changes["name"].From != "World News" || deleted.Changes["name"].To != nil {
+		t.Fatalf("delete event = %+v", deleted)
+	}
+
+	for query, want := range map[string]int{
+		"action=update":                         1,
+		"entity_type=channel&entity_id=99":      0,
+		fmt.Sprintf("entity_id=%d", channel.ID): 3,
+		"admin=someone":                         0,
+		"limit=2&offset=2":                      1,
+		"from=" + time.Now().Add(time.Hour).UTC().Format(time.RFC3339): 0,
+	} {
+		var filtered []AuditEvent
+		decodeJSON(t, doRequest(r, http.MethodGet, "/api/admin/audit?"+query, "", token), &filtered)
+		if len(filtered) != want {
+			t.Errorf("%s: %d events, want %d", query, len(filtered), want)
+		}
+	}
+	if w := doRequest(r, http.MethodGet, "/api/admin/audit?limit=5000", "", token); w.Code != http.StatusBadRequest {
+		t.Fatalf("oversized limit: status %d", w.Code)
+	}
+}
+
+func TestAuditPrune(t *testing.T) {
+	ctx := context.Background()
+	for name, services := range map[string]Services{"gorm": newGormServices(openTestDB(t)), "memory": newMemoryServices()} {
+		old := AuditEvent{Admin: "admin", Action: auditDelete, EntityType: "plan", CreatedAt: time.Now().Add(-48 * time.Hour)}
+		recent := AuditEvent{Admin: "admin", Action: auditCreate, EntityType: "plan"}
+		services.Audit.Record(ctx, &old)
+		services.Audit.Record(ctx, &recent)
+
+		n, err := services.Audit.Prune(ctx, time.Now().Add(-24*time.Hour))
+		events, _ := services.Audit.List(ctx, AuditFilter{})
+		if err != nil || n != 1 || len(events) != 1 || events[0].ID != recent.ID {
+			t.Fatalf("%s: pruned %d (%v), left %+v", name, n, err, events)
+		}
+	}
+}
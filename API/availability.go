@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// Channel availability
+//
+// Disabled channels are hidden from subscribers. A channel with availability
+// windows is only listed while one of them is open, so event channels appear
+// and disappear without an admin having to toggle them. Channels without
+// windows are always available.
+
+// AvailabilityWindow is a period a channel is listed in. From and Until bound it
+// in absolute time; Start and End ("15:04") narrow it to a daily slot on the
+// given Days (0 = Sunday, every day when empty) in Timezone. A slot whose End is
+// not after its Start runs past midnight and counts for the day it starts on.
+type AvailabilityWindow struct {
+	From     *time.Time `json:"from,omitempty"`
+	Until    *time.Time `json:"until,omitempty"`
+	Days     []int      `json:"days,omitempty"`
+	Start    string     `json:"start,omitempty"`
+	End      string     `json:"end,omitempty"`
+	Timezone string     `json:"timezone,omitempty"` // IANA name, UTC when empty
+}
+
+// Available reports whether subscribers see the channel at now
+func (c *Channel) Available(now time.Time) bool {
+	if c.Disabled {
+		return false
+	}
+	if len(c.Availability) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(c.Availability, func(w AvailabilityWindow) bool { return w.open(now) })
+}
+
+func (w AvailabilityWindow) open(now time.Time) bool {
+	if w.From != nil && now.Before(*w.From) {
+		return false
+	}
+	if w.Until != nil && !now.Before(*w.Until) {
+		return false
+	}
+	if w.Start == "" {
+		return true
+	}
+
+	loc, err := time.LoadLocation(w.Timezone)
+	if err != nil {
+		loc = time.UTC
+	}
+	local := now.In(loc)
+	start, _ := minuteOfDay(w.Start)
+	end, _ := minuteOfDay(w.End)
+	minute := local.Hour()*60 + local.Minute()
+
+	day := local.Weekday()
+	switch {
+	case start < end:
+		if minute < start || minute >= end {
+			return false
+		}
+	case minute >= start:
+	case minute < end:
+		day = (day + 6) % 7 // the slot started yesterday
+	default:
+		return false
+	}
+	return len(w.Days) == 0 || slices.Contains(w.Days, int(day))
+}
+
+// validate checks the window's bounds, days, daily slot and time zone
+func (w AvailabilityWindow) validate() error {
+	if w.From != nil && w.Until != nil && !w.Until.After(*w.From) {
+		return errors.New("until must be after from")
+	}
+	for _, d := range w.Days {
+		if d < 0 || d > 6 {
+			return fmt.Errorf("day %d is not between 0 (Sunday) and 6 (Saturday)", d)
+		}
+	}
+	if (w.Start == "") != (w.End == "") {
+		return errors.New("start and end must be given together")
+	}
+	if w.Start == "" {
+		if len(w.Days) > 0 {
+			return errors.New("days need a daily start and end")
+		}
+	} else {
+		start, err := minuteOfDay(w.Start)
+		if err != nil {
+			return err
+		}
+		end, err := minuteOfDay(w.End)
+		if err != nil {
+			return err
+		}
+		if start == end {
+			return errors.New("start and end must differ")
+		}
+	}
+	if _, err := time.LoadLocation(w.Timezone); err != nil {
+		return fmt.Errorf("unknown time zone %q", w.Timezone)
+	}
+	return nil
+}
+
+func minuteOfDay(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("time of day %q is not HH:MM", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// validateAvailability reports the first invalid window of a channel
+func validateAvailability(windows []AvailabilityWindow) error {
+	for i, w := range windows {
+		if err := w.validate(); err != nil {
+			return fmt.Errorf("availability window %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// availableChannels returns the channels subscribers see at now
+func availableChannels(channels []Channel, now time.Time) []Channel {
+	available := make([]Channel, 0, len(channels))
+	for _, c := range channels {
+		if c.Available(now) {
+			available = append(available, c)
+		}
+	}
+	return available
+}
+
+// availablePackages returns the packages with only the channels subscribers see at now
+func availablePackages(packages []Package, now time.Time) []Package {
+	available := make([]Package, len(packages))
+	for i, pkg := range packages {
+		pkg.Channels = availableChannels(pkg.Channels, now)
+		available[i] = pkg
+	}
+	return available
+}
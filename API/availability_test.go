@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestAvailabilityWindows(t *testing.T) {
+	at := func(value string) time.Time {
+		t.Helper()
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+	from, until := at("2026-06-01T00:00:00Z"), at("2026-07-01T00:00:00Z")
+
+	for _, tc := range []struct {
+		name    string
+		channel Channel
+		now     string
+		want    bool
+	}{
+		{"no windows", Channel{}, "2026-01-01T00:00:00Z", true},
+		{"disabled", Channel{Disabled: true}, "2026-01-01T00:00:00Z", false},
+		{"before event", Channel{Availability: []AvailabilityWindow{{From: &from, Until: &until}}}, "2026-05-31T23:59:00Z", false},
+		{"during event", Channel{Availability: []AvailabilityWindow{{From: &from, Until: &until}}}, "2026-06-15T12:00:00Z", true},
+		{"event over", Channel{Availability: []AvailabilityWindow{{From: &from, Until: &until}}}, "2026-07-01T00:00:00Z", false},
+		// Saturdays 20:00-02:00 Berlin time, which is UTC+2 in summer
+		{"saturday night", Channel{Availability: []AvailabilityWindow{{Days: []int{6}, Start: "20:00", End: "02:00", Timezone: "Europe/Berlin"}}}, "2026-06-06T19:00:00Z", true},
+		{"after midnight", Channel{Availability: []AvailabilityWindow{{Days: []int{6}, Start: "20:00", End: "02:00", Timezone: "Europe/Berlin"}}}, "2026-06-06T23:30:00Z", true},
+		{"sunday night", Channel{Availability: []AvailabilityWindow{{Days: []int{6}, Start: "20:00", End: "02:00", Timezone: "Europe/Berlin"}}}, "2026-06-07T19:00:00Z", false},
+		{"saturday afternoon", Channel{Availability: []AvailabilityWindow{{Days: []int{6}, Start: "20:00", End: "02:00", Timezone: "Europe/Berlin"}}}, "2026-06-06T12:00:00Z", false},
+		{"daily slot within event", Channel{Availability: []AvailabilityWindow{{From: &from, Until: &until, Start: "09:00", End: "17:00"}}}, "2026-06-02T09:00:00Z", true},
+		{"second window", Channel{Availability: []AvailabilityWindow{{Until: &from}, {From: &until}}}, "2026-08-01T00:00:00Z", true},
+	} {
+		if got := tc.channel.Available(at(tc.now)); got != tc.want {
+			t.Errorf("%s: available = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+
+	for _, w := range []AvailabilityWindow{
+		{From: &until, Until: &from},
+		{Days: []int{7}, Start: "10:00", End: "11:00"},
+		{Start: "10:00"},
+		{Days: []int{1}},
+		{Start: "25:00", End: "11:00"},
+		{Start: "10:00", End: "10:00"},
+		{Start: "10:00", End: "11:00", Timezone: "Mars/Olympus"},
+	} {
+		if err := w.validate(); err == nil {
+			t.Errorf("window %+v validated", w)
+		}
+	}
+}
+
+func TestPublicCatalogHidesUnavailableChannels(t *testing.T) {
+	r, conn := newTestServer(t)
+	token := adminToken(t)
+
+	live := Channel{ExternalID: "live", Name: "Live", MPD: "https://cdn.example/live.mpd"}
+	conn.Create(&live)
+	pkg := Package{Name: "Events", Channels: []Channel{live}}
+	conn.Create(&pkg)
+
+	ended := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	w := doRequest(r, http.MethodPost, "/api/admin/channels", `{"external_id":"event","name":"Event","availability":[{"until":"`+ended+`"}]}`, token)
+	var event Channel
+	decodeJSON(t, w, &event)
+	doRequest(r, http.MethodPost, fmt.Sprintf("/api/admin/packages/%d/channels/%d", pkg.ID, event.ID), "", token)
+	w = doRequest(r, http.MethodPost, "/api/admin/channels", `{"external_id":"off","name":"Off","disabled":true}`, token)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create disabled channel: status %d, body %s", w.Code, w.Body)
+	}
+
+	var channels []Channel
+	decodeEncrypted(t, doRequest(r, http.MethodGet, "/api/public/channels", "", ""), &channels)
+	if len(channels) != 1 || channels[0].ExternalID != "live" {
+		t.Fatalf("public channels = %+v", channels)
+	}
+	var packages []Package
+	decodeEncrypted(t, doRequest(r, http.MethodGet, "/api/public/packages", "", ""), &packages)
+	if len(packages) != 1 || len(packages[0].Channels) != 1 {
+		t.Fatalf("public packages = %+v", packages)
+	}
+
+	// Admins still see every channel, and reopening the window lists it again
+	w = doRequest(r, http.MethodGet, "/api/admin/channels", "", token)
+	decodeJSON(t, w, &channels)
+	if len(channels) != 3 {
+		t.Fatalf("%d admin channels, want 3", len(channels))
+	}
+	w = doRequest(r, http.MethodPut, fmt.Sprintf("/api/admin/channels/%d", event.ID), `{"availability":[]}`, token)
+	if w.Code != http.StatusOK {
+		t.Fatalf("update: status %d, body %s", w.Code, w.Body)
+	}
+	decodeEncrypted(t, doRequest(r, http.MethodGet, "/api/public/packages", "", ""), &packages)
+	if len(packages[0].Channels) != 2 {
+		t.Fatalf("public packages after reopening = %+v", packages)
+	}
+
+	w = doRequest(r, http.MethodPut, fmt.Sprintf("/api/admin/channels/%d", event.ID), `{"availability":[{"start":"10:00"}]}`, token)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("invalid window: status %d, want 400", w.Code)
+	}
+}
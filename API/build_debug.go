@@ -0,0 +1,7 @@
+//go:build debug
+
+package main
+
+// debugBuild enables development only endpoints such as /api/admin/decrypt.
+// Build with -tags debug to turn it on.
+const debugBuild = true
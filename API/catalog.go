@@ -0,0 +1,652 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Catalog import and export
+//
+// A catalog is the full channel lineup: channels, packages and which channels
+// each package contains. Records are matched by their external ID so the same
+// file can be imported repeatedly. Imports only create and update; records
+// missing from the file are left untouched.
+type Catalog struct {
+	Channels []CatalogChannel `json:"channels"`
+	Packages []CatalogPackage `json:"packages"`
+}
+
+type CatalogChannel struct {
+	Row          int                  `json:"-"`
+	ExternalID   string               `json:"external_id"`
+	Name         string               `json:"name"`
+	Logo         string               `json:"logo"`
+	MPD          string               `json:"mpd"`
+	Keys         []ChannelKey         `json:"keys,omitempty"`
+	Key          string               `json:"key,omitempty"` // deprecated kid:key form, read when keys is empty
+	ExpiresEvery int64                `json:"expires_every"`
+	EPGID        string               `json:"epg_id"`
+	Category     string               `json:"category"`
+	Tags         []string             `json:"tags"`
+	StreamType   string               `json:"stream_type"` // dash when empty
+	MimeType     string               `json:"mime_type,omitempty"`
+	LowLatency   bool                 `json:"low_latency,omitempty"`
+	Disabled     bool                 `json:"disabled,omitempty"`
+	Availability []AvailabilityWindow `json:"availability,omitempty"`
+}
+
+// stream returns the channel's stream fields for validateStream
+func (c CatalogChannel) stream() Channel {
+	return Channel{MPD: c.MPD, Keys: c.Keys, StreamType: c.StreamType, MimeType: c.MimeType, LowLatency: c.LowLatency}
+}
+
+type CatalogPackage struct {
+	Row        int      `json:"-"`
+	ExternalID string   `json:"external_id"`
+	Name       string   `json:"name"`
+	Logo       string   `json:"logo"`
+	Kind       string   `json:"kind"` // base when empty
+	Tier       int      `json:"tier,omitempty"`
+	Channels   []string `json:"channels"` // channel external IDs, in lineup order
+	// ChannelNumbers maps channel external IDs to their logical channel number
+	ChannelNumbers map[string]int `json:"channel_numbers,omitempty"`
+}
+
+// uniqueChannels returns the package's channel IDs in order, without repeats
+func (p CatalogPackage) uniqueChannels() []string {
+	ids := []string{}
+	for _, id := range p.Channels {
+		if !slices.Contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// lineup turns the package's channel list into lineup entries
+func (p CatalogPackage) lineup(channelID func(externalID string) uint) []PackageChannel {
+	lineup := []PackageChannel{}
+	for i, id := range p.uniqueChannels() {
+		lineup = append(lineup, PackageChannel{ChannelID: channelID(id), SortOrder: i + 1, ChannelNumber: p.ChannelNumbers[id]})
+	}
+	return lineup
+}
+
+const (
+	importCreate    = "create"
+	importUpdate    = "update"
+	importUnchanged = "unchanged"
+	importError     = "error"
+)
+
+type FieldChange struct {
+	From any `json:"from"`
+	To   any `json:"to"`
+}
+
+type ImportRow struct {
+	Row        int                    `json:"row"`
+	Type       string                 `json:"type"`
+	ExternalID string                 `json:"external_id"`
+	Action     string                 `json:"action"`
+	Changes    map[string]FieldChange `json:"changes,omitempty"`
+	Error      string                 `json:"error,omitempty"`
+}
+
+type ImportReport struct {
+	DryRun    bool        `json:"dry_run"`
+	Applied   bool        `json:"applied"`
+	Created   int         `json:"created"`
+	Updated   int         `json:"updated"`
+	Unchanged int         `json:"unchanged"`
+	Errors    int         `json:"errors"`
+	Rows      []ImportRow `json:"rows"`
+}
+
+func (r *ImportReport) add(row ImportRow) {
+	switch row.Action {
+	case importCreate:
+		r.Created++
+	case importUpdate:
+		r.Updated++
+	case importUnchanged:
+		r.Unchanged++
+	case importError:
+		r.Errors++
+	}
+	r.Rows = append(r.Rows, row)
+}
+
+// catalogPlan is the outcome of comparing an incoming catalog with the stored one
+type catalogPlan struct {
+	report   ImportReport
+	channels []plannedChannel
+	packages []plannedPackage
+}
+
+type plannedChannel struct {
+	existing *Channel // nil when the channel is created
+	incoming CatalogChannel
+}
+
+type plannedPackage struct {
+	existing        *Package // nil when the package is created
+	incoming        CatalogPackage
+	channelsChanged bool
+}
+
+const redacted = "[redacted]"
+
+// planCatalogImport validates the incoming catalog against the existing
+// channels and packages (with their channels loaded) and works out what to change.
+func planCatalogImport(existingChannels []Channel, existingPackages []Package, incoming *Catalog) *catalogPlan {
+	plan := &catalogPlan{}
+
+	channelsByID := map[string]*Channel{}
+	for i := range existingChannels {
+		channelsByID[existingChannels[i].ExternalID] = &existingChannels[i]
+	}
+	packagesByID := map[string]*Package{}
+	packagesByName := map[string]*Package{}
+	for i := range existingPackages {
+		packagesByID[existingPackages[i].ExternalID] = &existingPackages[i]
+		packagesByName[existingPackages[i].Name] = &existingPackages[i]
+	}
+
+	seenChannels := map[string]bool{}
+	for _, in := range incoming.Channels {
+		row := ImportRow{Row: in.Row, Type: "channel", ExternalID: in.ExternalID}
+		var keysError string
+		if len(in.Keys) == 0 && in.Key != "" {
+			keys, err := parseKeys(in.Key)
+			if err != nil {
+				keysError = err.Error()
+			}
+			in.Keys = keys
+		}
+		in.Keys = slices.Clone(in.Keys)
+		stream := in.stream()
+		streamError := validateStream(&stream)
+		in.StreamType = stream.StreamType
+		switch {
+		case in.ExternalID == "":
+			row.Error = "external_id is required"
+		case in.Name == "":
+			row.Error = "name is required"
+		case seenChannels[in.ExternalID]:
+			row.Error = "duplicate external_id in import"
+		case keysError != "":
+			row.Error = keysError
+		case streamError != "":
+			row.Error = streamError
+		default:
+			if err := validateAvailability(in.Availability); err != nil {
+				row.Error = err.Error()
+			}
+		}
+		seenChannels[in.ExternalID] = true
+		if row.Error != "" {
+			row.Action = importError
+			plan.report.add(row)
+			continue
+		}
+
+		existing := channelsByID[in.ExternalID]
+		if existing == nil {
+			row.Action = importCreate
+		} else {
+			row.Changes = channelChanges(existing, in)
+			row.Action = importUnchanged
+			if len(row.Changes) > 0 {
+				row.Action = importUpdate
+			}
+		}
+		plan.report.add(row)
+		if row.Action != importUnchanged {
+			plan.channels = append(plan.channels, plannedChannel{existing: existing, incoming: in})
+		}
+	}
+
+	seenPackages := map[string]bool{}
+	seenNames := map[string]string{}
+	for _, in := range incoming.Packages {
+		row := ImportRow{Row: in.Row, Type: "package", ExternalID: in.ExternalID}
+		existing := packagesByID[in.ExternalID]
+		if in.Kind == "" {
+			in.Kind = packageBase
+		}
+		switch {
+		case in.ExternalID == "":
+			row.Error = "external_id is required"
+		case in.Name == "":
+			row.Error = "name is required"
+		case seenPackages[in.ExternalID]:
+			row.Error = "duplicate external_id in import"
+		case seenNames[in.Name] != "":
+			row.Error = fmt.Sprintf("name %q is also used by package %q in this import", in.Name, seenNames[in.Name])
+		case packagesByName[in.Name] != nil && packagesByName[in.Name] != existing:
+			row.Error = fmt.Sprintf("name %q is already used by package %q", in.Name, packagesByName[in.Name].ExternalID)
+		case !validPackageKind(in.Kind):
+			row.Error = "kind must be base or addon"
+		}
+		seenPackages[in.ExternalID] = true
+		if in.Name != "" && seenNames[in.Name] == "" {
+			seenNames[in.Name] = in.ExternalID
+		}
+		if row.Error == "" {
+			for _, channelID := range in.Channels {
+				if !seenChannels[channelID] && channelsByID[channelID] == nil {
+					row.Error = fmt.Sprintf("unknown channel %q", channelID)
+					break
+				}
+			}
+		}
+		if row.Error == "" {
+			row.Error = channelNumbersError(in)
+		}
+		if row.Error != "" {
+			row.Action = importError
+			plan.report.add(row)
+			continue
+		}
+
+		planned := plannedPackage{existing: existing, incoming: in}
+		if existing == nil {
+			row.Action = importCreate
+			planned.channelsChanged = len(in.Channels) > 0
+		} else {
+			row.Changes = packageChanges(existing, in)
+			_, channels := row.Changes["channels"]
+			_, numbers := row.Changes["channel_numbers"]
+			planned.channelsChanged = channels || numbers
+			row.Action = importUnchanged
+			if len(row.Changes) > 0 {
+				row.Action = importUpdate
+			}
+		}
+		plan.report.add(row)
+		if row.Action != importUnchanged {
+			plan.packages = append(plan.packages, planned)
+		}
+	}
+
+	return plan
+}
+
+// channelNumbersError checks that numbered channels are in the package and numbers are unique
+func channelNumbersError(in CatalogPackage) string {
+	numbered := map[int]string{}
+	for _, id := range slices.Sorted(maps.Keys(in.ChannelNumbers)) {
+		number := in.ChannelNumbers[id]
+		switch {
+		case !slices.Contains(in.Channels, id):
+			return fmt.Sprintf("channel %q has a number but is not in the package", id)
+		case number < 0:
+			return fmt.Sprintf("channel %q has a negative number", id)
+		case number > 0 && numbered[number] != "":
+			return fmt.Sprintf("channels %q and %q share number %d", numbered[number], id, number)
+		}
+		if number > 0 {
+			numbered[number] = id
+		}
+	}
+	return ""
+}
+
+func channelChanges(existing *Channel, in CatalogChannel) map[string]FieldChange {
+	changes := map[string]FieldChange{}
+	if existing.Name != in.Name {
+		changes["name"] = FieldChange{existing.Name, in.Name}
+	}
+	if existing.Logo != in.Logo {
+		changes["logo"] = FieldChange{existing.Logo, in.Logo}
+	}
+	if existing.MPD != in.MPD {
+		changes["mpd"] = FieldChange{existing.MPD, in.MPD}
+	}
+	if !sameKeys(existing.Keys, in.Keys) {
+		changes["keys"] = FieldChange{redacted, redacted}
+	}
+	if existing.ExpiresEvery != in.ExpiresEvery {
+		changes["expires_every"] = FieldChange{existing.ExpiresEvery, in.ExpiresEvery}
+	}
+	if existing.EPGID != in.EPGID {
+		changes["epg_id"] = FieldChange{existing.EPGID, in.EPGID}
+	}
+	if existing.Category != in.Category {
+		changes["category"] = FieldChange{existing.Category, in.Category}
+	}
+	if !slices.Equal(existing.Tags, in.Tags) {
+		changes["tags"] = FieldChange{existing.Tags, in.Tags}
+	}
+	if existing.StreamType != in.StreamType {
+		changes["stream_type"] = FieldChange{existing.StreamType, in.StreamType}
+	}
+	if existing.MimeType != in.MimeType {
+		changes["mime_type"] = FieldChange{existing.MimeType, in.MimeType}
+	}
+	if existing.LowLatency != in.LowLatency {
+		changes["low_latency"] = FieldChange{existing.LowLatency, in.LowLatency}
+	}
+	if existing.Disabled != in.Disabled {
+		changes["disabled"] = FieldChange{existing.Disabled, in.Disabled}
+	}
+	if !sameAvailability(existing.Availability, in.Availability) {
+		changes["availability"] = FieldChange{existing.Availability, in.Availability}
+	}
+	return changes
+}
+
+// sameAvailability compares windows by their JSON form, which does not depend
+// on the time zone their times were parsed in
+func sameAvailability(a, b []AvailabilityWindow) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return len(a) == len(b)
+	}
+	x, _ := json.Marshal(a)
+	y, _ := json.Marshal(b)
+	return string(x) == string(y)
+}
+
+func packageChanges(existing *Package, in CatalogPackage) map[string]FieldChange {
+	changes := map[string]FieldChange{}
+	if existing.Name != in.Name {
+		changes["name"] = FieldChange{existing.Name, in.Name}
+	}
+	if existing.Logo != in.Logo {
+		changes["logo"] = FieldChange{existing.Logo, in.Logo}
+	}
+	if existing.Kind != in.Kind {
+		changes["kind"] = FieldChange{existing.Kind, in.Kind}
+	}
+	if existing.Tier != in.Tier {
+		changes["tier"] = FieldChange{existing.Tier, in.Tier}
+	}
+
+	current := make([]string, 0, len(existing.Channels))
+	currentNumbers := map[string]int{}
+	for _, c := range existing.Channels {
+		current = append(current, c.ExternalID)
+		if c.ChannelNumber != 0 {
+			currentNumbers[c.ExternalID] = c.ChannelNumber
+		}
+	}
+	wanted := in.uniqueChannels()
+	wantedNumbers := map[string]int{}
+	for _, id := range wanted {
+		if number := in.ChannelNumbers[id]; number != 0 {
+			wantedNumbers[id] = number
+		}
+	}
+	if !slices.Equal(current, wanted) {
+		changes["channels"] = FieldChange{current, wanted}
+	}
+	if !maps.Equal(currentNumbers, wantedNumbers) {
+		changes["channel_numbers"] = FieldChange{currentNumbers, wantedNumbers}
+	}
+	return changes
+}
+
+// buildCatalog converts stored channels and packages (with channels loaded) into a catalog
+func buildCatalog(channels []Channel, packages []Package) *Catalog {
+	catalog := &Catalog{Channels: []CatalogChannel{}, Packages: []CatalogPackage{}}
+	for _, c := range channels {
+		catalog.Channels = append(catalog.Channels, CatalogChannel{
+			ExternalID:   c.ExternalID,
+			Name:         c.Name,
+			Logo:         c.Logo,
+			MPD:          c.MPD,
+			Keys:         c.Keys,
+			ExpiresEvery: c.ExpiresEvery,
+			EPGID:        c.EPGID,
+			Category:     c.Category,
+			Tags:         c.Tags,
+			StreamType:   c.StreamType,
+			MimeType:     c.MimeType,
+			LowLatency:   c.LowLatency,
+			Disabled:     c.Disabled,
+			Availability: c.Availability,
+		})
+	}
+	for _, p := range packages {
+		channelIDs := []string{}
+		var numbers map[string]int
+		for _, c := range p.Channels {
+			channelIDs = append(channelIDs, c.ExternalID)
+			if c.ChannelNumber != 0 {
+				if numbers == nil {
+					numbers = map[string]int{}
+				}
+				numbers[c.ExternalID] = c.ChannelNumber
+			}
+		}
+		catalog.Packages = append(catalog.Packages, CatalogPackage{
+			ExternalID:     p.ExternalID,
+			Name:           p.Name,
+			Logo:           p.Logo,
+			Kind:           p.Kind,
+			Tier:           p.Tier,
+			Channels:       channelIDs,
+			ChannelNumbers: numbers,
+		})
+	}
+	return catalog
+}
+
+// Catalog file formats
+const (
+	catalogJSON = "json"
+	catalogCSV  = "csv"
+)
+
+var catalogCSVHeader = []string{"type", "external_id", "name", "logo", "mpd", "key", "expires_every", "epg_id", "category", "tags", "stream_type", "mime_type", "low_latency", "channels", "channel_numbers", "kind", "tier", "disabled", "availability"}
+
+func writeCatalog(w io.Writer, catalog *Catalog, format string) error {
+	switch format {
+	case catalogJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(catalog)
+	case catalogCSV:
+		cw := csv.NewWriter(w)
+		cw.Write(catalogCSVHeader)
+		for _, c := range catalog.Channels {
+			var availability string
+			if len(c.Availability) > 0 {
+				b, err := json.Marshal(c.Availability)
+				if err != nil {
+					return err
+				}
+				availability = string(b)
+			}
+			cw.Write([]string{"channel", c.ExternalID, c.Name, c.Logo, c.MPD, formatKeys(c.Keys), strconv.FormatInt(c.ExpiresEvery, 10), c.EPGID, c.Category, strings.Join(c.Tags, ";"), c.StreamType, c.MimeType, strconv.FormatBool(c.LowLatency), "", "", "", "", strconv.FormatBool(c.Disabled), availability})
+		}
+		for _, p := range catalog.Packages {
+			var numbers []string
+			for _, id := range p.Channels {
+				if number, ok := p.ChannelNumbers[id]; ok {
+					numbers = append(numbers, id+"="+strconv.Itoa(number))
+				}
+			}
+			cw.Write([]string{"package", p.ExternalID, p.Name, p.Logo, "", "", "", "", "", "", "", "", "", strings.Join(p.Channels, ";"), strings.Join(numbers, ";"), p.Kind, strconv.Itoa(p.Tier), "", ""})
+		}
+		cw.Flush()
+		return cw.Error()
+	default:
+		return fmt.Errorf("unsupported catalog format %q", format)
+	}
+}
+
+// readCatalog parses a catalog file. Rows are numbered from 1 in the order they
+// appear; for CSV the header line is not counted.
+func readCatalog(r io.Reader, format string) (*Catalog, error) {
+	switch format {
+	case catalogJSON:
+		var catalog Catalog
+		if err := json.NewDecoder(r).Decode(&catalog); err != nil {
+			return nil, fmt.Errorf("invalid JSON catalog: %w", err)
+		}
+		for i := range catalog.Channels {
+			catalog.Channels[i].Row = i + 1
+		}
+		for i := range catalog.Packages {
+			catalog.Packages[i].Row = len(catalog.Channels) + i + 1
+		}
+		return &catalog, nil
+	case catalogCSV:
+		return readCatalogCSV(r)
+	default:
+		return nil, fmt.Errorf("unsupported catalog format %q", format)
+	}
+}
+
+func readCatalogCSV(r io.Reader) (*Catalog, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("invalid CSV catalog: %w", err)
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.TrimSpace(strings.ToLower(name))] = i
+	}
+	for _, required := range []string{"type", "external_id", "name"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("invalid CSV catalog: missing %q column", required)
+		}
+	}
+
+	catalog := &Catalog{}
+	for row := 1; ; row++ {
+		record, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid CSV catalog: %w", err)
+		}
+
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+
+		switch strings.ToLower(field("type")) {
+		case "channel":
+			var expires int64
+			if v := field("expires_every"); v != "" {
+				if expires, err = strconv.ParseInt(v, 10, 64); err != nil {
+					return nil, fmt.Errorf("invalid CSV catalog: row %d: expires_every %q is not a number", row, v)
+				}
+			}
+			var lowLatency bool
+			if v := field("low_latency"); v != "" {
+				if lowLatency, err = strconv.ParseBool(v); err != nil {
+					return nil, fmt.Errorf("invalid CSV catalog: row %d: low_latency %q is not true or false", row, v)
+				}
+			}
+			var disabled bool
+			if v := field("disabled"); v != "" {
+				if disabled, err = strconv.ParseBool(v); err != nil {
+					return nil, fmt.Errorf("invalid CSV catalog: row %d: disabled %q is not true or false", row, v)
+				}
+			}
+			var availability []AvailabilityWindow
+			if v := field("availability"); v != "" {
+				if err := json.Unmarshal([]byte(v), &availability); err != nil {
+					return nil, fmt.Errorf("invalid CSV catalog: row %d: availability is not a JSON list of windows", row)
+				}
+			}
+			keys, err := parseKeys(field("key"))
+			if err != nil {
+				return nil, fmt.Errorf("invalid CSV catalog: row %d: %v", row, err)
+			}
+			catalog.Channels = append(catalog.Channels, CatalogChannel{
+				Row:          row,
+				ExternalID:   field("external_id"),
+				Name:         field("name"),
+				Logo:         field("logo"),
+				MPD:          field("mpd"),
+				Keys:         keys,
+				ExpiresEvery: expires,
+				EPGID:        field("epg_id"),
+				Category:     field("category"),
+				Tags:         splitList(field("tags")),
+				StreamType:   field("stream_type"),
+				MimeType:     field("mime_type"),
+				LowLatency:   lowLatency,
+				Disabled:     disabled,
+				Availability: availability,
+			})
+		case "package":
+			var numbers map[string]int
+			for _, pair := range splitList(field("channel_numbers")) {
+				id, value, _ := strings.Cut(pair, "=")
+				number, err := strconv.Atoi(strings.TrimSpace(value))
+				if err != nil {
+					return nil, fmt.Errorf("invalid CSV catalog: row %d: channel number %q is not id=number", row, pair)
+				}
+				if numbers == nil {
+					numbers = map[string]int{}
+				}
+				numbers[strings.TrimSpace(id)] = number
+			}
+			var tier int
+			if v := field("tier"); v != "" {
+				if tier, err = strconv.Atoi(v); err != nil {
+					return nil, fmt.Errorf("invalid CSV catalog: row %d: tier %q is not a number", row, v)
+				}
+			}
+			catalog.Packages = append(catalog.Packages, CatalogPackage{
+				Row:            row,
+				ExternalID:     field("external_id"),
+				Name:           field("name"),
+				Logo:           field("logo"),
+				Kind:           field("kind"),
+				Tier:           tier,
+				Channels:       splitList(field("channels")),
+				ChannelNumbers: numbers,
+			})
+		default:
+			return nil, fmt.Errorf("invalid CSV catalog: row %d: type must be channel or package", row)
+		}
+	}
+	return catalog, nil
+}
+
+// splitList splits a ";" separated CSV cell, dropping empty entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ";") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// catalogFormat picks the format from an explicit value or a file name / content type hint
+func catalogFormat(explicit, hint string) (string, error) {
+	switch strings.ToLower(explicit) {
+	case catalogJSON, catalogCSV:
+		return strings.ToLower(explicit), nil
+	case "":
+	default:
+		return "", fmt.Errorf("unsupported catalog format %q", explicit)
+	}
+	if strings.Contains(strings.ToLower(hint), "csv") {
+		return catalogCSV, nil
+	}
+	return catalogJSON, nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const testCatalog = `{
+  "channels": [
+    {"external_id": "news", "name": "News", "mpd": "https://cdn.example/news.mpd", "expires_every": 3600, "disabled": true},
+    {"external_id": "sport", "name": "Sport", "mpd": "https://cdn.example/sport.mpd", "category": "Sports", "tags": ["live", "hd"],
+     "availability": [{"days": [5, 6], "start": "18:00", "end": "23:00", "timezone": "Europe/Berlin"}]}
+  ],
+  "packages": [
+    {"external_id": "basic", "name": "Basic", "tier": 2, "channels": ["sport", "news"], "channel_numbers": {"sport": 5}}
+  ]
+}`
+
+func importCatalog(t *testing.T, r http.Handler, query, contentType, body string) (int, ImportReport) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodPost, "/api/admin/catalog/import"+query, strings.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Authorization", "Bearer "+adminToken(t))
+	w := serve(r, req)
+
+	var report ImportReport
+	decodeJSON(t, w, &report)
+	return w.Code, report
+}
+
+func TestCatalogImportIsIdempotent(t *testing.T) {
+	r, conn := newTestServer(t)
+
+	status, report := importCatalog(t, r, "", "application/json", testCatalog)
+	if status != http.StatusOK || !report.Applied || report.Created != 3 {
+		t.Fatalf("first import: status %d, report %+v", status, report)
+	}
+
+	var pkg Package
+	conn.Preload("Channels").Where(&Package{ExternalID: "basic"}).First(&pkg)
+	if len(pkg.Channels) != 2 {
+		t.Fatalf("package channels = %+v", pkg.Channels)
+	}
+
+	status, report = importCatalog(t, r, "", "application/json", testCatalog)
+	if status != http.StatusOK || report.Unchanged != 3 || report.Created+report.Updated != 0 {
+		t.Fatalf("second import: status %d, report %+v", status, report)
+	}
+}
+
+func TestCatalogDryRunReportsDiffWithoutWriting(t *testing.T) {
+	r, conn := newTestServer(t)
+	importCatalog(t, r, "", "application/json", testCatalog)
+
+	changed := strings.Replace(testCatalog, `"name": "Sport"`, `"name": "Sport HD"`, 1)
+	changed = strings.Replace(changed, `["sport", "news"], "channel_numbers": {"sport": 5}`, `["news"]`, 1)
+	status, report := importCatalog(t, r, "?dry_run=true", "application/json", changed)
+	if status != http.StatusOK || report.Applied || !report.DryRun || report.Updated != 2 {
+		t.Fatalf("dry run: status %d, report %+v", status, report)
+	}
+	if change := report.Rows[1].Changes["name"]; change.From != "Sport" || change.To != "Sport HD" {
+		t.Fatalf("name change = %+v", change)
+	}
+	if _, ok := report.Rows[2].Changes["channels"]; !ok {
+		t.Fatalf("package row has no channels change: %+v", report.Rows[2])
+	}
+
+	var channel Channel
+	conn.Where(&Channel{ExternalID: "sport"}).First(&channel)
+	if channel.Name != "Sport" {
+		t.Fatalf("dry run renamed channel to %q", channel.Name)
+	}
+}
+
+func TestCatalogImportRollsBackOnRowErrors(t *testing.T) {
+	r, conn := newTestServer(t)
+
+	body := `{
+  "channels": [
+    {"external_id": "ok", "name": "Fine"},
+    {"external_id": "", "name": "No ID"},
+    {"external_id": "ok", "name": "Duplicate"}
+  ],
+  "packages": [
+    {"external_id": "p", "name": "P", "channels": ["missing"]}
+  ]
+}`
+	status, report := importCatalog(t, r, "", "application/json", body)
+	if status != http.StatusUnprocessableEntity || report.Applied || report.Errors != 3 {
+		t.Fatalf("status %d, report %+v", status, report)
+	}
+	wantErrors := map[int]string{
+		2: "external_id is required",
+		3: "duplicate external_id in import",
+		4: `unknown channel "missing"`,
+	}
+	for _, row := range report.Rows {
+		if want := wantErrors[row.Row]; row.Error != want {
+			t.Errorf("row %d error = %q, want %q", row.Row, row.Error, want)
+		}
+	}
+
+	var count int64
+	conn.Model(&Channel{}).Count(&count)
+	if count != 0 {
+		t.Fatalf("%d channels written despite row errors", count)
+	}
+}
+
+func TestCatalogCSVRoundTrip(t *testing.T) {
+	r, conn := newTestServer(t)
+	importCatalog(t, r, "", "application/json", testCatalog)
+	conn.Model(&Package{}).Where(&Package{ExternalID: "basic"}).Update("kind", packageAddon)
+
+	w := doRequest(r, http.MethodGet, "/api/admin/catalog/export?format=csv", "", adminToken(t))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "text/csv" {
+		t.Fatalf("export: status %d, content type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	exported := w.Body.String()
+	if !strings.Contains(exported, "channel,news,News,,https://cdn.example/news.mpd,,3600,,,,dash,,false,,,,,true,\n") ||
+		!strings.Contains(exported, `channel,sport,Sport,,https://cdn.example/sport.mpd,,0,,Sports,live;hd,dash,,false,,,,,false,"[{""days"":[5,6],""start"":""18:00"",""end"":""23:00"",""timezone"":""Europe/Berlin""}]"`+"\n") ||
+		!strings.Contains(exported, "package,basic,Basic,,,,,,,,,,,sport;news,sport=5,addon,2,,\n") {
+		t.Fatalf("unexpected CSV export:\n%s", exported)
+	}
+
+	// Importing the export into a fresh database recreates the same catalog
+	fresh, freshConn := newTestServer(t)
+	status, report := importCatalog(t, fresh, "", "text/csv", exported)
+	if status != http.StatusOK || report.Created != 3 {
+		t.Fatalf("import: status %d, report %+v", status, report)
+	}
+	var pkg Package
+	freshConn.Where(&Package{ExternalID: "basic"}).First(&pkg)
+	if pkg.Kind != packageAddon || pkg.Tier != 2 {
+		t.Fatalf("imported package kind %q, tier %d", pkg.Kind, pkg.Tier)
+	}
+	var news, sport Channel
+	freshConn.Where(&Channel{ExternalID: "news"}).First(&news)
+	freshConn.Where(&Channel{ExternalID: "sport"}).First(&sport)
+	if !news.Disabled || sport.Disabled || len(sport.Availability) != 1 || sport.Availability[0].Timezone != "Europe/Berlin" {
+		t.Fatalf("imported channels %+v and %+v", news, sport)
+	}
+	w = doRequest(fresh, http.MethodGet, "/api/admin/catalog/export?format=csv", "", adminToken(t))
+	if w.Body.String() != exported {
+		t.Fatalf("re-export differs:\n%s\nwant:\n%s", w.Body, exported)
+	}
+}
+
+func TestCatalogImportSizeLimit(t *testing.T) {
+	r, _ := newTestServer(t)
+	previous := cfg.Catalog
+	cfg.Catalog.MaxImportBytes = 64
+	t.Cleanup(func() { cfg.Catalog = previous })
+
+	csvCatalog := "type,external_id,name\n" + strings.Repeat("channel,news,News\n", 10)
+	for contentType, body := range map[string]string{"application/json": testCatalog, "text/csv": csvCatalog} {
+		req, _ := http.NewRequest(http.MethodPost, "/api/admin/catalog/import", strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("Authorization", "Bearer "+adminToken(t))
+		w := serve(r, req)
+		var problem Problem
+		decodeJSON(t, w, &problem)
+		if w.Code != http.StatusRequestEntityTooLarge || problem.Code != codeTooLarge {
+			t.Fatalf("%s: status %d, %+v", contentType, w.Code, problem)
+		}
+	}
+}
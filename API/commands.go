@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// Command line subcommands. Running the binary without arguments starts the API server.
+func runCommand(args []string) int {
+	switch args[0] {
+	case "migrate":
+		return runMigrateCommand(args[1:])
+	case "catalog":
+		return runCatalogCommand(args[1:])
+	case "epg":
+		return runEPGCommand(args[1:])
+	case "secrets":
+		return runSecretsCommand(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", args[0])
+		fmt.Fprintln(os.Stderr, "usage: api [migrate status|up [version]|down [steps]]")
+		fmt.Fprintln(os.Stderr, "       api [catalog export|import ...]")
+		fmt.Fprintln(os.Stderr, "       api [epg import path|url]")
+		fmt.Fprintln(os.Stderr, "       api [secrets rotate]")
+		return 2
+	}
+}
+
+func runCatalogCommand(args []string) int {
+	const usage = "usage: api catalog export [-format json|csv] [-o file]\n       api catalog import [-format json|csv] [-dry-run] file"
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+
+	flags := flag.NewFlagSet("catalog "+args[0], flag.ContinueOnError)
+	format := flags.String("format", "", "catalog format, json or csv (default: from file extension)")
+	output := flags.String("o", "", "export to this file instead of stdout")
+	dryRun := flags.Bool("dry-run", false, "report what an import would change without writing anything")
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	switch args[0] {
+	case "export":
+		f, err := catalogFormat(*format, *output)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		if err := initCommandDB(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+
+		catalog, err := newGormServices(db).Catalog.Export(context.Background())
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+
+		out := os.Stdout
+		if *output != "" {
+			if out, err = os.Create(*output); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+			defer out.Close()
+		}
+		if err := writeCatalog(out, catalog, f); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+
+	case "import":
+		if flags.NArg() != 1 {
+			fmt.Fprintln(os.Stderr, usage)
+			return 2
+		}
+		f, err := catalogFormat(*format, flags.Arg(0))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+
+		in, err := os.Open(flags.Arg(0))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer in.Close()
+		catalog, err := readCatalog(in, f)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+
+		if err := initCommandDB(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		report, err := newGormServices(db).Catalog.Import(context.Background(), catalog, *dryRun)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+		if report.Errors > 0 {
+			return 1
+		}
+		return 0
+
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+}
+
+func runEPGCommand(args []string) int {
+	if len(args) != 2 || args[0] != "import" {
+		fmt.Fprintln(os.Stderr, "usage: api epg import path|url")
+		return 2
+	}
+
+	if err := initCommandDB(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	c := cfg.EPG
+	c.Source = args[1]
+	report, err := importGuide(context.Background(), newGormServices(db).EPG, c)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+	return 0
+}
+
+// runSecretsCommand re-encrypts stored secrets with the current master key
+func runSecretsCommand(args []string) int {
+	if len(args) != 1 || args[0] != "rotate" {
+		fmt.Fprintln(os.Stderr, "usage: api secrets rotate")
+		return 2
+	}
+
+	if err := initCommandDB(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if !secrets.enabled() {
+		fmt.Fprintln(os.Stderr, "warning: SECRETS_MASTER_KEY is not set, secrets will be stored unencrypted")
+	}
+	report, err := reencryptSecrets(context.Background(), db)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+	return 0
+}
+
+// initCommandDB opens the database for commands that need an up-to-date schema
+func initCommandDB() error {
+	if err := openDB(); err != nil {
+		return err
+	}
+	if _, err := migrateUp(db, 0); err != nil {
+		return err
+	}
+	return nil
+}
+
+func runMigrateCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: api migrate status|up [version]|down [steps]")
+		return 2
+	}
+
+	if err := openDB(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	switch args[0] {
+	case "status":
+		states, err := migrationStatus(db)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		current, _ := currentSchemaVersion(db)
+		pending, _ := pendingMigrations(context.Background(), db)
+		fmt.Printf("current version: %d, latest version: %d, %d pending\n", current, latestSchemaVersion(), pending)
+		for _, s := range states {
+			if s.Applied {
+				fmt.Printf("  [x] %04d %s (applied %s)\n", s.Version, s.Name, s.AppliedAt.Format("2006-01-02 15:04:05"))
+			} else {
+				fmt.Printf("  [ ] %04d %s\n", s.Version, s.Name)
+			}
+		}
+		if current > latestSchemaVersion() {
+			fmt.Println("warning: database schema is ahead of this binary")
+		}
+		return 0
+
+	case "up":
+		target := 0
+		if len(args) > 1 {
+			v, err := strconv.Atoi(args[1])
+			if err != nil || v < 0 {
+				fmt.Fprintf(os.Stderr, "invalid version %q\n", args[1])
+				return 2
+			}
+			target = v
+		}
+		done, err := migrateUp(db, target)
+		for _, m := range done {
+			fmt.Printf("applied %04d %s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if len(done) == 0 {
+			fmt.Println("no pending migrations")
+		}
+		return 0
+
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				fmt.Fprintf(os.Stderr, "invalid step count %q\n", args[1])
+				return 2
+			}
+			steps = n
+		}
+		done, err := migrateDown(db, steps)
+		for _, m := range done {
+			fmt.Printf("rolled back %04d %s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if len(done) == 0 {
+			fmt.Println("nothing to roll back")
+		}
+		return 0
+
+	default:
+		fmt.Fprintf(os.Stderr, "unknown migrate command %q\n", args[0])
+		return 2
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// Runtime configuration read from the environment
+type DatabaseConfig struct {
+	Driver          string        // sqlite, postgres or mysql
+	DSN             string        // file path for sqlite, connection string otherwise
+	MaxOpenConns    int           // 0 means unlimited
+	MaxIdleConns    int           // 0 keeps the database/sql default
+	ConnMaxLifetime time.Duration // 0 means connections are reused forever
+	ConnMaxIdleTime time.Duration // 0 means idle connections are never closed for age
+}
+
+// EPGConfig controls the scheduled XMLTV import. It is disabled when Source is empty.
+type EPGConfig struct {
+	Source          string        // local file path or http(s) URL of an XMLTV file
+	RefreshInterval time.Duration // time between imports
+	Retention       time.Duration // programmes that ended longer ago are deleted, 0 keeps them
+	MaxImportBytes  int64         // largest XMLTV file accepted over HTTP
+}
+
+// CatalogConfig controls bulk catalog imports
+type CatalogConfig struct {
+	MaxImportBytes int64 // largest catalog accepted over HTTP
+}
+
+// HealthConfig controls the background stream health checker. It is disabled
+// when Interval is 0.
+type HealthConfig struct {
+	Interval    time.Duration // time between checks of every channel
+	Timeout     time.Duration // per manifest request
+	Concurrency int           // manifests fetched at the same time
+}
+
+// SecretsConfig holds the master keys for secrets stored in the database. Secrets
+// are stored unencrypted when MasterKey is empty.
+type SecretsConfig struct {
+	MasterKey    string   // base64 or hex encoded 256-bit key new secrets are encrypted with
+	PreviousKeys []string // retired master keys still accepted for reading until rotated
+}
+
+// AuditConfig controls how long the audit log is kept
+type AuditConfig struct {
+	Retention time.Duration // events recorded longer ago are deleted, 0 keeps them
+}
+
+// RateLimitConfig controls rate limiting of logins and subscription validation
+type RateLimitConfig struct {
+	RedisURL         string        // state is shared through Redis when set, kept in memory otherwise
+	TrustedProxies   []string      // proxies whose X-Forwarded-For client IPs are believed, none when empty
+	LoginPerIP       RateLimit     // login attempts per client IP
+	LoginPerUser     RateLimit     // login attempts per admin username
+	ValidatePerIP    RateLimit     // subscription validations per client IP
+	ValidatePerKey   RateLimit     // validations per subscription key
+	LockoutThreshold int           // failed logins before an admin is locked out, 0 disables lockouts
+	LockoutBase      time.Duration // first lockout, doubled with each further failed login
+	LockoutMax       time.Duration // longest lockout
+}
+
+// DiagnosticsConfig controls the admin diagnostics endpoints
+type DiagnosticsConfig struct {
+	RevealPlaintext bool // envelope diagnostics may return the decrypted response
+}
+
+// ServerConfig controls the HTTP server
+type ServerConfig struct {
+	Addr              string        // address to listen on
+	PublicURL         string        // base URL clients reach the API at, taken from each request when empty
+	ReadHeaderTimeout time.Duration // for a request's headers
+	ReadTimeout       time.Duration // for a whole request, body included
+	WriteTimeout      time.Duration // from the end of the request headers to the end of the response
+	IdleTimeout       time.Duration // keep-alive connections waiting for their next request
+	ShutdownTimeout   time.Duration // how long in-flight requests may take to finish on shutdown
+	ShutdownDelay     time.Duration // how long /readyz fails before connections stop being accepted
+}
+
+// MetricsConfig controls the Prometheus endpoint
+type MetricsConfig struct {
+	Token string // bearer token scrapers must send; when empty /metrics is open to anyone who can reach the API
+}
+
+// LogConfig controls logging
+type LogConfig struct {
+	Level     slog.Level    // debug also logs every database query
+	Format    string        // json or text
+	SlowQuery time.Duration // queries taking longer are logged as warnings, 0 disables
+}
+
+type Config struct {
+	Server      ServerConfig
+	Database    DatabaseConfig
+	EPG         EPGConfig
+	Catalog     CatalogConfig
+	Health      HealthConfig
+	Secrets     SecretsConfig
+	Audit       AuditConfig
+	RateLimit   RateLimitConfig
+	Diagnostics DiagnosticsConfig
+	Log         LogConfig
+	Metrics     MetricsConfig
+}
+
+var cfg = loadConfig()
+
+func loadConfig() Config {
+	return Config{
+		Server: ServerConfig{
+			Addr:              getEnv("LISTEN_ADDR", ":65000"),
+			PublicURL:         os.Getenv("PUBLIC_URL"),
+			ReadHeaderTimeout: getEnvDuration("SERVER_READ_HEADER_TIMEOUT", 10*time.Second),
+			ReadTimeout:       getEnvDuration("SERVER_READ_TIMEOUT", 30*time.Second),
+			WriteTimeout:      getEnvDuration("SERVER_WRITE_TIMEOUT", 2*time.Minute),
+			IdleTimeout:       getEnvDuration("SERVER_IDLE_TIMEOUT", 2*time.Minute),
+			ShutdownTimeout:   getEnvDuration("SERVER_SHUTDOWN_TIMEOUT", 30*time.Second),
+			ShutdownDelay:     getEnvDuration("SERVER_SHUTDOWN_DELAY", 0),
+		},
+		Database: DatabaseConfig{
+			Driver:          getEnv("DB_DRIVER", "sqlite"),
+			DSN:             getEnv("DB_DSN", "iptv.db"),
+			MaxOpenConns:    getEnvInt("DB_MAX_OPEN_CONNS", 0),
+			MaxIdleConns:    getEnvInt("DB_MAX_IDLE_CONNS", 0),
+			ConnMaxLifetime: getEnvDuration("DB_CONN_MAX_LIFETIME", 0),
+			ConnMaxIdleTime: getEnvDuration("DB_CONN_MAX_IDLE_TIME", 0),
+		},
+		EPG: EPGConfig{
+			Source:          os.Getenv("EPG_SOURCE"),
+			RefreshInterval: getEnvDuration("EPG_REFRESH_INTERVAL", 6*time.Hour),
+			Retention:       getEnvDuration("EPG_RETENTION", 24*time.Hour),
+			MaxImportBytes:  int64(getEnvInt("EPG_IMPORT_MAX_BYTES", 64<<20)),
+		},
+		Catalog: CatalogConfig{
+			MaxImportBytes: int64(getEnvInt("CATALOG_IMPORT_MAX_BYTES", 32<<20)),
+		},
+		Health: HealthConfig{
+			Interval:    getEnvDuration("HEALTH_CHECK_INTERVAL", 5*time.Minute),
+			Timeout:     getEnvDuration("HEALTH_CHECK_TIMEOUT", 10*time.Second),
+			Concurrency: getEnvInt("HEALTH_CHECK_CONCURRENCY", 4),
+		},
+		Secrets: SecretsConfig{
+			MasterKey:    os.Getenv("SECRETS_MASTER_KEY"),
+			PreviousKeys: strings.FieldsFunc(os.Getenv("SECRETS_PREVIOUS_KEYS"), func(r rune) bool { return r == ',' }),
+		},
+		Audit: AuditConfig{
+			Retention: getEnvDuration("AUDIT_RETENTION", 90*24*time.Hour),
+		},
+		RateLimit: RateLimitConfig{
+			RedisURL:         os.Getenv("RATE_LIMIT_REDIS_URL"),
+			TrustedProxies:   strings.FieldsFunc(os.Getenv("TRUSTED_PROXIES"), func(r rune) bool { return r == ',' }),
+			LoginPerIP:       getEnvRateLimit("RATE_LIMIT_LOGIN_IP", RateLimit{Burst: 10, Per: time.Minute}),
+			LoginPerUser:     getEnvRateLimit("RATE_LIMIT_LOGIN_USER", RateLimit{Burst: 5, Per: time.Minute}),
+			ValidatePerIP:    getEnvRateLimit("RATE_LIMIT_VALIDATE_IP", RateLimit{Burst: 60, Per: time.Minute}),
+			ValidatePerKey:   getEnvRateLimit("RATE_LIMIT_VALIDATE_KEY", RateLimit{Burst: 30, Per: time.Minute}),
+			LockoutThreshold: getEnvInt("LOGIN_LOCKOUT_THRESHOLD", 5),
+			LockoutBase:      getEnvDuration("LOGIN_LOCKOUT_BASE", time.Minute),
+			LockoutMax:       getEnvDuration("LOGIN_LOCKOUT_MAX", time.Hour),
+		},
+		Diagnostics: DiagnosticsConfig{
+			RevealPlaintext: getEnvBool("DIAGNOSTICS_REVEAL_PLAINTEXT", false),
+		},
+		Log: LogConfig{
+			Level:     getEnvLogLevel("LOG_LEVEL", slog.LevelInfo),
+			Format:    getEnv("LOG_FORMAT", "json"),
+			SlowQuery: getEnvDuration("LOG_SLOW_QUERY", 200*time.Millisecond),
+		},
+		Metrics: MetricsConfig{
+			Token: os.Getenv("METRICS_TOKEN"),
+		},
+	}
+}
+
+func getEnv(name, fallback string) string {
+	if value, ok := os.LookupEnv(name); ok && value != "" {
+		return value
+	}
+	return fallback
+}
+
+func getEnvInt(name string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+func getEnvBool(name string, fallback bool) bool {
+	value, err := strconv.ParseBool(os.Getenv(name))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+func getEnvDuration(name string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(name))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+// getEnvLogLevel reads a level name such as "debug" or "warn", see slog.Level
+func getEnvLogLevel(name string, fallback slog.Level) slog.Level {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(os.Getenv(name))); err != nil {
+		return fallback
+	}
+	return level
+}
+
+// getEnvRateLimit reads a limit such as "10/1m", see parseRateLimit
+func getEnvRateLimit(name string, fallback RateLimit) RateLimit {
+	limit, err := parseRateLimit(os.Getenv(name))
+	if err != nil {
+		return fallback
+	}
+	return limit
+}
+
+// dialector returns the GORM driver for the configured database
+func (c DatabaseConfig) dialector() (gorm.Dialector, error) {
+	switch c.Driver {
+	case "sqlite", "sqlite3":
+		return sqlite.Open(c.DSN), nil
+	case "postgres", "postgresql":
+		return postgres.Open(c.DSN), nil
+	case "mysql":
+		return mysql.Open(c.DSN), nil
+	default:
+		return nil, fmt.Errorf("unsupported database driver %q", c.Driver)
+	}
+}
+
+// openDatabase connects to the configured database and applies the pool settings
+func openDatabase(c DatabaseConfig) (*gorm.DB, error) {
+	dialector, err := c.dialector()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := gorm.Open(dialector, &gorm.Config{Logger: gormLogger{slowQuery: cfg.Log.SlowQuery}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s database: %w", c.Driver, err)
+	}
+
+	sqlDB, err := conn.DB()
+	if err != nil {
+		return nil, err
+	}
+	if c.MaxOpenConns > 0 {
+		sqlDB.SetMaxOpenConns(c.MaxOpenConns)
+	}
+	if c.MaxIdleConns > 0 {
+		sqlDB.SetMaxIdleConns(c.MaxIdleConns)
+	}
+	if c.ConnMaxLifetime > 0 {
+		sqlDB.SetConnMaxLifetime(c.ConnMaxLifetime)
+	}
+	if c.ConnMaxIdleTime > 0 {
+		sqlDB.SetConnMaxIdleTime(c.ConnMaxIdleTime)
+	}
+
+	return conn, nil
+}
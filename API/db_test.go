@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// openTestDB returns a freshly migrated database for a single test.
+//
+// By default every test gets its own temporary SQLite file. Set TEST_DB_DRIVER
+// and TEST_DB_DSN to run the same tests against a server database, e.g.
+//
+//	docker run --rm -d -p 5432:5432 -e POSTGRES_PASSWORD=test postgres:16
+//	TEST_DB_DRIVER=postgres TEST_DB_DSN="host=localhost user=postgres password=test dbname=postgres sslmode=disable" go test ./...
+//
+// Server databases are shared, so their schema is rolled back before and after each test.
+func openTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+
+	config := DatabaseConfig{
+		Driver: os.Getenv("TEST_DB_DRIVER"),
+		DSN:    os.Getenv("TEST_DB_DSN"),
+	}
+	if config.Driver == "" {
+		config.Driver = "sqlite"
+		config.DSN = filepath.Join(t.TempDir(), "test.db")
+	}
+
+	conn, err := openDatabase(config)
+	if err != nil {
+		t.Fatalf("open %s test database: %v", config.Driver, err)
+	}
+	// Expected "record not found" lookups would otherwise flood the test output
+	conn.Logger = logger.Discard
+
+	reset := func() {
+		if _, err := migrateDown(conn, len(migrations)); err != nil {
+			t.Fatalf("reset test database: %v", err)
+		}
+	}
+	reset()
+	if _, err := migrateUp(conn, 0); err != nil {
+		t.Fatalf("migrate test database: %v", err)
+	}
+
+	t.Cleanup(func() {
+		reset()
+		if sqlDB, err := conn.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return conn
+}
+
+func TestMigrationsRollBackAndReapply(t *testing.T) {
+	conn := openTestDB(t)
+
+	current, err := currentSchemaVersion(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current != latestSchemaVersion() {
+		t.Fatalf("current version = %d, want %d", current, latestSchemaVersion())
+	}
+
+	done, err := migrateDown(conn, len(migrations))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(done) != len(migrations) {
+		t.Fatalf("rolled back %d migrations, want %d", len(done), len(migrations))
+	}
+	if conn.Migrator().HasTable("channels") {
+		t.Fatal("channels table still exists after rolling back every migration")
+	}
+
+	states, err := migrationStatus(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range states {
+		if s.Applied {
+			t.Fatalf("migration %d still marked as applied", s.Version)
+		}
+	}
+
+	if _, err := migrateUp(conn, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !conn.Migrator().HasTable("channels") {
+		t.Fatal("channels table missing after re-applying migrations")
+	}
+}
+
+func TestSchemaAheadOfBinaryIsRefused(t *testing.T) {
+	conn := openTestDB(t)
+
+	future := SchemaMigration{Version: latestSchemaVersion() + 1, Name: "from_the_future", AppliedAt: time.Now()}
+	if err := conn.Create(&future).Error; err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Delete(&future) })
+
+	if err := checkSchemaVersion(conn); !errors.Is(err, errSchemaAhead) {
+		t.Fatalf("checkSchemaVersion error = %v, want errSchemaAhead", err)
+	}
+	if _, err := migrateUp(conn, 0); !errors.Is(err, errSchemaAhead) {
+		t.Fatalf("migrateUp error = %v, want errSchemaAhead", err)
+	}
+}
+
+func TestSubscriptionLookupByKey(t *testing.T) {
+	conn := openTestDB(t)
+
+	user := User{Name: "Viewer"}
+	if err := conn.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"KEY-ONE", "KEY-TWO"} {
+		sub := Subscription{UserID: user.ID, Key: key, Started: time.Now(), End: time.Now().AddDate(0, 1, 0)}
+		if err := conn.Create(&sub).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// "key" and "end" are reserved words in some dialects, so lookups must be quoted.
+	var found Subscription
+	if err := conn.Where(&Subscription{Key: "KEY-TWO"}).Preload("User").First(&found).Error; err != nil {
+		t.Fatal(err)
+	}
+	if found.Key != "KEY-TWO" || found.User.Name != "Viewer" {
+		t.Fatalf("found %+v", found)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Response encryption diagnostics
+//
+// Public endpoints answer with an envelope holding the response encrypted with
+// ENCRYPTION_KEY (see envelope.go). When a client cannot read one, admins can
+// post it to /api/admin/diagnostics/envelope to learn whether it is well
+// formed and decrypts under the server's key, without the plaintext being
+// shown. The plaintext is only returned when asked for, and only in debug
+// builds or with DIAGNOSTICS_REVEAL_PLAINTEXT set.
+
+// EnvelopeReport describes an encrypted response envelope
+type EnvelopeReport struct {
+	Version         int    `json:"version"`
+	Algorithm       string `json:"algorithm"`
+	Chunks          int    `json:"chunks,omitempty"` // of version 2 envelopes
+	KeyID           string `json:"key_id"`           // fingerprint of the key the envelope was checked against
+	Valid           bool   `json:"valid"`            // decrypts and authenticates under that key
+	Error           string `json:"error,omitempty"`
+	CiphertextBytes int    `json:"ciphertext_bytes"`
+	PlaintextBytes  int    `json:"plaintext_bytes,omitempty"`
+	JSON            bool   `json:"json,omitempty"`      // the plaintext is JSON, as responses are
+	Plaintext       string `json:"plaintext,omitempty"` // only when revealed
+}
+
+// keyID fingerprints an encryption key without giving it away
+func keyID(key string) string {
+	sum := sha256.Sum256([]byte("streamsauce key id\x00" + key))
+	return hex.EncodeToString(sum[:8])
+}
+
+// inspectEnvelope checks an envelope against the response key
+func inspectEnvelope(envelope EncryptedResponse) (EnvelopeReport, string) {
+	report := EnvelopeReport{Version: max(envelope.Version, 1), Algorithm: "AES-256-GCM", KeyID: keyID(ENCRYPTION_KEY)}
+	sealed := []string{envelope.Data}
+	if report.Version > 1 {
+		sealed = envelope.Chunks
+		report.Chunks = len(sealed)
+	}
+	for _, data := range sealed {
+		raw, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			report.Error = "data is not base64"
+			return report, ""
+		}
+		report.CiphertextBytes += len(raw)
+	}
+
+	plaintext, err := openEnvelope(envelope, ENCRYPTION_KEY)
+	if err != nil {
+		report.Error = "does not decrypt under key " + report.KeyID + ": " + err.Error()
+		return report, ""
+	}
+	report.Valid = true
+	report.PlaintextBytes = len(plaintext)
+	report.JSON = json.Valid([]byte(plaintext))
+	return report, plaintext
+}
+
+// diagnoseEnvelope reports on a posted response envelope, with its plaintext
+// when the request sets reveal and revealing is allowed
+func (s *Server) diagnoseEnvelope(c *gin.Context) {
+	var req struct {
+		EncryptedResponse
+		Reveal bool `json:"reveal"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		bindError(c, err)
+		return
+	}
+	if req.Data == "" && len(req.Chunks) == 0 {
+		fieldError(c, "data", "data or chunks is required")
+		return
+	}
+	if req.Reveal && !debugBuild && !cfg.Diagnostics.RevealPlaintext {
+		writeError(c, http.StatusForbidden, codeForbidden, "Revealing plaintext needs a debug build or DIAGNOSTICS_REVEAL_PLAINTEXT")
+		return
+	}
+
+	report, plaintext := inspectEnvelope(req.EncryptedResponse)
+	if req.Reveal && report.Valid {
+		slog.WarnContext(c.Request.Context(), "encrypted response plaintext revealed", "admin", c.GetString("username"))
+		report.Plaintext = plaintext
+	}
+	c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// DRM keys
+//
+// A channel's DRM configuration is a list of keys. ClearKey entries hold a KID
+// and content key pair, and a channel can have several, say for separate audio
+// and video keys; Widevine and PlayReady entries name the license server
+// players request keys from. KIDs and keys are 16 bytes, accepted in hex, as a
+// UUID or in base64, and stored as lowercase hex. The public catalog turns the
+// list into a drm block players can use as is. The deprecated key field keeps
+// the first ClearKey pair as "kid:key" for clients that still split it.
+
+// Key systems
+const (
+	keySystemClearKey  = "clearkey"
+	keySystemWidevine  = "widevine"
+	keySystemPlayReady = "playready"
+)
+
+// keySystemIDs maps key systems to the names EME based players know them by
+var keySystemIDs = map[string]string{
+	keySystemClearKey:  "org.w3.clearkey",
+	keySystemWidevine:  "com.widevine.alpha",
+	keySystemPlayReady: "com.microsoft.playready",
+}
+
+// DRMConfig is a channel's DRM setup as the public catalog shows it, in the
+// shape Shaka Player and dash.js take
+type DRMConfig struct {
+	ClearKeys map[string]string `json:"clear_keys,omitempty"` // hex KID to hex key
+	Servers   map[string]string `json:"servers,omitempty"`    // EME key system to license server URL
+}
+
+// decodeKeyBytes normalises a 16 byte KID or key given in hex, as a UUID or in
+// base64 to lowercase hex
+func decodeKeyBytes(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if b, err := hex.DecodeString(strings.ReplaceAll(value, "-", "")); err == nil && len(b) == 16 {
+		return hex.EncodeToString(b), nil
+	}
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if b, err := enc.DecodeString(value); err == nil && len(b) == 16 {
+			return hex.EncodeToString(b), nil
+		}
+	}
+	return "", errors.New("must be 16 bytes in hex or base64")
+}
+
+// validateKeys checks a channel's keys and normalises KIDs and keys to hex
+func validateKeys(keys []ChannelKey) string {
+	kids := map[string]bool{}
+	servers := map[string]bool{}
+	for i := range keys {
+		k := &keys[i]
+		position := "Key " + strconv.Itoa(i+1)
+		if k.System == "" {
+			k.System = keySystemClearKey
+		}
+		if _, ok := keySystemIDs[k.System]; !ok {
+			return position + " must have system clearkey, widevine or playready"
+		}
+		if k.KID != "" {
+			kid, err := decodeKeyBytes(k.KID)
+			if err != nil {
+				return position + ": kid " + err.Error()
+			}
+			k.KID = kid
+		}
+
+		if k.System == keySystemClearKey {
+			switch {
+			case k.KID == "" || k.Key == "":
+				return position + ": ClearKey keys need a kid and a key"
+			case k.LicenseURL != "":
+				return position + ": ClearKey keys cannot have a license_url"
+			case kids[k.KID]:
+				return position + " repeats kid " + k.KID
+			}
+			key, err := decodeKeyBytes(k.Key)
+			if err != nil {
+				return position + ": key " + err.Error()
+			}
+			k.Key = key
+			kids[k.KID] = true
+			continue
+		}
+
+		u, err := url.Parse(k.LicenseURL)
+		switch {
+		case k.Key != "":
+			return position + ": only ClearKey keys carry a key, " + k.System + " needs a license_url"
+		case err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "":
+			return position + ": " + k.System + " needs an http(s) license_url"
+		case servers[k.System]:
+			return position + " repeats the " + k.System + " license server"
+		}
+		servers[k.System] = true
+	}
+	return ""
+}
+
+// legacyKey returns the first ClearKey pair in the deprecated "kid:key" form
+func legacyKey(keys []ChannelKey) string {
+	for _, k := range keys {
+		if k.System == keySystemClearKey || k.System == "" {
+			return k.KID + ":" + k.Key
+		}
+	}
+	return ""
+}
+
+// applyLegacyKey lets clients that only know the deprecated key field set a
+// channel's ClearKey pair: when the field differs from previous, its value
+// replaces the channel's ClearKey keys
+func applyLegacyKey(channel *Channel, previous string) string {
+	if channel.Key == previous {
+		return ""
+	}
+	keys := slices.DeleteFunc(slices.Clone(channel.Keys), func(k ChannelKey) bool { return k.System == keySystemClearKey || k.System == "" })
+	if channel.Key != "" {
+		parsed, err := parseKeys(channel.Key)
+		if err != nil {
+			return err.Error()
+		}
+		keys = append(parsed, keys...)
+	}
+	channel.Keys = keys
+	return ""
+}
+
+// parseKeys reads keys in their compact text form, as used by the CSV
+// catalog: entries separated by ";", each a ClearKey "kid:key" pair or a
+// "system=license URL"
+func parseKeys(value string) ([]ChannelKey, error) {
+	keys := []ChannelKey{}
+	for _, entry := range splitList(value) {
+		if system, licenseURL, ok := strings.Cut(entry, "="); ok && keySystemIDs[system] != "" {
+			keys = append(keys, ChannelKey{System: system, LicenseURL: licenseURL})
+			continue
+		}
+		kid, key, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, errors.New("keys must be kid:key pairs or system=license URL entries")
+		}
+		keys = append(keys, ChannelKey{System: keySystemClearKey, KID: kid, Key: key})
+	}
+	return keys, nil
+}
+
+// formatKeys writes keys in the compact text form read by parseKeys
+func formatKeys(keys []ChannelKey) string {
+	entries := make([]string, 0, len(keys))
+	for _, k := range keys {
+		if k.System == keySystemClearKey {
+			entries = append(entries, k.KID+":"+k.Key)
+		} else {
+			entries = append(entries, k.System+"="+k.LicenseURL)
+		}
+	}
+	return strings.Join(entries, ";")
+}
+
+// sameKeys reports whether two key lists hold the same keys in the same order
+func sameKeys(a, b []ChannelKey) bool {
+	return slices.EqualFunc(a, b, func(x, y ChannelKey) bool {
+		return x.System == y.System && x.KID == y.KID && x.Key == y.Key && x.LicenseURL == y.LicenseURL
+	})
+}
+
+// drmConfig builds the public DRM block from a channel's keys, nil without keys
+func drmConfig(keys []ChannelKey) *DRMConfig {
+	if len(keys) == 0 {
+		return nil
+	}
+	drm := &DRMConfig{}
+	for _, k := range keys {
+		if k.System == keySystemClearKey {
+			if drm.ClearKeys == nil {
+				drm.ClearKeys = map[string]string{}
+			}
+			drm.ClearKeys[k.KID] = k.Key
+			continue
+		}
+		if drm.Servers == nil {
+			drm.Servers = map[string]string{}
+		}
+		drm.Servers[keySystemIDs[k.System]] = k.LicenseURL
+	}
+	return drm
+}
+
+// withDRM replaces every channel's key list with the public DRM block
+func withDRM(channels []Channel) {
+	for i := range channels {
+		channels[i].DRM = drmConfig(channels[i].Keys)
+		channels[i].Keys = nil
+	}
+}
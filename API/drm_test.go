@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const (
+	testKID        = "00112233445566778899aabbccddeeff"
+	testContentKey = "ffeeddccbbaa99887766554433221100"
+)
+
+func TestValidateKeys(t *testing.T) {
+	keys := []ChannelKey{
+		{KID: "00112233-4455-6677-8899-AABBCCDDEEFF", Key: "/+7dzLuqmYh3ZlVEMyIRAA=="},
+		{System: keySystemWidevine, KID: "ABEiM0RVZneImaq7zN3u_w", LicenseURL: "https://license.example/wv"},
+	}
+	if msg := validateKeys(keys); msg != "" {
+		t.Fatal(msg)
+	}
+	if keys[0].System != keySystemClearKey || keys[0].KID != testKID || keys[0].Key != testContentKey || keys[1].KID != testKID {
+		t.Fatalf("normalised keys = %+v", keys)
+	}
+
+	for _, tc := range []struct {
+		keys []ChannelKey
+		want string
+	}{
+		{[]ChannelKey{{KID: "aa", Key: testContentKey}}, "kid must be 16 bytes"},
+		{[]ChannelKey{{KID: testKID, Key: "not a key"}}, "key must be 16 bytes"},
+		{[]ChannelKey{{KID: testKID}}, "need a kid and a key"},
+		{[]ChannelKey{{KID: testKID, Key: testContentKey}, {KID: strings.ToUpper(testKID), Key: testContentKey}}, "repeats kid"},
+		{[]ChannelKey{{System: keySystemPlayReady}}, "needs an http(s) license_url"},
+		{[]ChannelKey{{System: keySystemWidevine, Key: testContentKey, LicenseURL: "https://license.example"}}, "only ClearKey keys carry a key"},
+		{[]ChannelKey{{System: "fairplay", LicenseURL: "https://license.example"}}, "must have system"},
+	} {
+		if got := validateKeys(tc.keys); !strings.Contains(got, tc.want) || got == "" {
+			t.Errorf("%+v: error %q, want %q", tc.keys, got, tc.want)
+		}
+	}
+
+	parsed, err := parseKeys(testKID + ":" + testContentKey + "; widevine=https://license.example/wv?a=b")
+	if err != nil || formatKeys(parsed) != testKID+":"+testContentKey+";widevine=https://license.example/wv?a=b" {
+		t.Fatalf("parseKeys = %+v, %v", parsed, err)
+	}
+}
+
+func TestChannelKeys(t *testing.T) {
+	r, _ := newTestServer(t)
+	token := adminToken(t)
+	audioKID := strings.Repeat("11", 16)
+
+	w := doRequest(r, http.MethodPost, "/api/admin/channels", `{"name":"Movies","mpd":"https://cdn.example/movies.mpd","keys":[
+		{"system":"clearkey","kid":"`+testKID+`","key":"`+testContentKey+`"},
+		{"kid":"`+audioKID+`","key":"`+testContentKey+`"},
+		{"system":"widevine","license_url":"https://license.example/wv"}]}`, token)
+	var channel Channel
+	decodeJSON(t, w, &channel)
+	if w.Code != http.StatusCreated || len(channel.Keys) != 3 || channel.Key != testKID+":"+testContentKey {
+		t.Fatalf("create: status %d, channel %+v", w.Code, channel)
+	}
+	w = doRequest(r, http.MethodPost, "/api/admin/channels", `{"name":"Bad","keys":[{"kid":"`+testKID+`","key":"xyz"}]}`, token)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("invalid key: status %d, want 400", w.Code)
+	}
+
+	// The public catalog shows a DRM block instead of the key list
+	var public []Channel
+	decodeEncrypted(t, doRequest(r, http.MethodGet, "/api/public/channels", "", ""), &public)
+	drm := public[0].DRM
+	if len(public[0].Keys) != 0 || drm == nil || len(drm.ClearKeys) != 2 || drm.ClearKeys[audioKID] != testContentKey ||
+		drm.Servers["com.widevine.alpha"] != "https://license.example/wv" || public[0].Key != testKID+":"+testContentKey {
+		t.Fatalf("public channel = %+v, drm %+v", public[0], drm)
+	}
+
+	// Updates without keys keep them; the deprecated key field replaces the ClearKey pairs
+	path := fmt.Sprintf("/api/admin/channels/%d", channel.ID)
+	var renamed, legacy, cleared Channel
+	decodeJSON(t, doRequest(r, http.MethodPut, path, `{"name":"Movies HD"}`, token), &renamed)
+	if len(renamed.Keys) != 3 {
+		t.Fatalf("keys after rename = %+v", renamed.Keys)
+	}
+	w = doRequest(r, http.MethodPut, path, `{"key":"`+audioKID+`:`+testKID+`"}`, token)
+	decodeJSON(t, w, &legacy)
+	if w.Code != http.StatusOK || len(legacy.Keys) != 2 || legacy.Keys[0].KID != audioKID || legacy.Keys[1].System != keySystemWidevine {
+		t.Fatalf("legacy key update: status %d, keys %+v", w.Code, legacy.Keys)
+	}
+	decodeJSON(t, doRequest(r, http.MethodPut, path, `{"keys":[]}`, token), &cleared)
+	if len(cleared.Keys) != 0 || cleared.Key != "" {
+		t.Fatalf("keys after clearing = %+v", cleared)
+	}
+}
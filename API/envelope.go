@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Encrypted responses
+//
+// Public endpoints answer with their JSON encrypted under ENCRYPTION_KEY, with
+// the handler's own status code and headers. Responses up to
+// envelopeBufferLimit are sealed whole into a version 1 envelope:
+//
+//	{"data": base64(nonce || AES-256-GCM ciphertext)}
+//
+// Larger responses, and those a handler flushes while streaming, are sent as
+// they are written in a version 2 envelope of separately sealed chunks of at
+// most envelopeChunkSize bytes:
+//
+//	{"version": 2, "nonce": base64(7 byte prefix), "chunks": [base64(ciphertext), ...]}
+//
+// Chunk i is sealed with the nonce prefix || uint32 i || last, where last is 1
+// for the final chunk only, so chunks cannot be reordered, dropped or cut off
+// without failing to decrypt. The plaintext is the chunks' plaintexts joined.
+// Empty responses, such as 204s, are passed through untouched.
+
+const (
+	envelopeBufferLimit = 1 << 20 // largest response sealed whole
+	envelopeChunkSize   = 64 << 10
+	envelopePrefixSize  = 7
+)
+
+// EncryptedResponse is an envelope of either version
+type EncryptedResponse struct {
+	Data    string   `json:"data,omitempty"`
+	Version int      `json:"version,omitempty"`
+	Nonce   string   `json:"nonce,omitempty"`
+	Chunks  []string `json:"chunks,omitempty"`
+}
+
+func newGCM(key string) (cipher.AEAD, error) {
+	block, err := aes.NewCipher([]byte(key))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce is the nonce of the i-th chunk of a version 2 envelope
+func chunkNonce(prefix []byte, i uint32, last bool) []byte {
+	nonce := make([]byte, 0, envelopePrefixSize+5)
+	nonce = append(nonce, prefix...)
+	nonce = binary.BigEndian.AppendUint32(nonce, i)
+	if last {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+// openEnvelope decrypts an envelope of either version
+func openEnvelope(envelope EncryptedResponse, key string) (string, error) {
+	if envelope.Version < 2 {
+		return decrypt(envelope.Data, key)
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	prefix, err := base64.StdEncoding.DecodeString(envelope.Nonce)
+	if err != nil || len(prefix) != envelopePrefixSize {
+		return "", errors.New("invalid nonce prefix")
+	}
+	var plaintext []byte
+	for i, chunk := range envelope.Chunks {
+		sealed, err := base64.StdEncoding.DecodeString(chunk)
+		if err != nil {
+			return "", err
+		}
+		nonce := chunkNonce(prefix, uint32(i), i == len(envelope.Chunks)-1)
+		if plaintext, err = gcm.Open(plaintext, nonce, sealed, nil); err != nil {
+			return "", errors.New("chunk " + strconv.Itoa(i) + ": " + err.Error())
+		}
+	}
+	if len(envelope.Chunks) == 0 {
+		return "", errors.New("no chunks")
+	}
+	return string(plaintext), nil
+}
+
+// Middleware for encrypted responses
+func encryptResponse() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		writer := &encryptingWriter{ResponseWriter: c.Writer, key: ENCRYPTION_KEY, status: http.StatusOK}
+		c.Writer = writer
+		c.Next()
+		c.Writer = writer.ResponseWriter
+
+		if err := writer.finish(); err != nil {
+			metrics.encryptionErrors.Inc()
+			c.Error(err)
+			// Once streaming, the status is out and the client sees a cut off envelope
+			if writer.stream == nil {
+				writeError(c, http.StatusInternalServerError, codeEncryptionFailed, "Response could not be encrypted")
+			}
+		}
+	}
+}
+
+// encryptingWriter holds back the status and body a handler writes, buffering
+// up to envelopeBufferLimit and streaming chunks past it
+type encryptingWriter struct {
+	gin.ResponseWriter
+	key    string
+	status int
+	size   int
+	buf    bytes.Buffer
+	stream *envelopeStream // once the body is streamed
+}
+
+func (w *encryptingWriter) WriteHeader(code int) {
+	if code > 0 && w.stream == nil {
+		w.status = code
+	}
+}
+
+// WriteHeaderNow does nothing: the status goes out with the envelope
+func (w *encryptingWriter) WriteHeaderNow() {}
+
+func (w *encryptingWriter) Status() int   { return w.status }
+func (w *encryptingWriter) Size() int     { return w.size }
+func (w *encryptingWriter) Written() bool { return w.size > 0 }
+
+func (w *encryptingWriter) Write(b []byte) (int, error) {
+	w.size += len(b)
+	if w.stream != nil {
+		return len(b), w.stream.write(b)
+	}
+	w.buf.Write(b)
+	if w.buf.Len() > envelopeBufferLimit {
+		if err := w.startStream(); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+func (w *encryptingWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// Flush sends what has been written so far, switching to a chunked envelope
+func (w *encryptingWriter) Flush() {
+	if w.stream == nil {
+		if err := w.startStream(); err != nil {
+			return
+		}
+	}
+	w.stream.flush()
+	w.ResponseWriter.Flush()
+}
+
+// header prepares the real response's headers for an envelope
+func (w *encryptingWriter) header() {
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.ResponseWriter.WriteHeader(w.status)
+}
+
+func (w *encryptingWriter) startStream() error {
+	gcm, err := newGCM(w.key)
+	if err != nil {
+		return err
+	}
+	prefix := make([]byte, envelopePrefixSize)
+	if _, err := io.ReadFull(rand.Reader, prefix); err != nil {
+		return err
+	}
+	w.header()
+	w.stream = &envelopeStream{out: w.ResponseWriter, gcm: gcm, prefix: prefix}
+	w.stream.out.Write([]byte(`{"version":2,"nonce":"` + base64.StdEncoding.EncodeToString(prefix) + `","chunks":[`))
+	err = w.stream.write(w.buf.Bytes())
+	w.buf = bytes.Buffer{}
+	return err
+}
+
+// finish sends the envelope, or passes an empty response through
+func (w *encryptingWriter) finish() error {
+	if w.stream != nil {
+		return w.stream.close()
+	}
+	if w.buf.Len() == 0 {
+		w.ResponseWriter.WriteHeader(w.status)
+		return nil
+	}
+	encrypted, err := encrypt(w.buf.String(), w.key)
+	if err != nil {
+		return err
+	}
+	body, _ := json.Marshal(EncryptedResponse{Data: encrypted})
+	w.header()
+	_, err = w.ResponseWriter.Write(body)
+	return err
+}
+
+// envelopeStream writes the chunks of a version 2 envelope
+type envelopeStream struct {
+	out     io.Writer
+	gcm     cipher.AEAD
+	prefix  []byte
+	pending bytes.Buffer
+	count   uint32
+	err     error
+}
+
+// write seals full chunks, keeping back the last one since only close knows
+// whether it ends the response
+func (s *envelopeStream) write(b []byte) error {
+	s.pending.Write(b)
+	for s.pending.Len() > envelopeChunkSize {
+		s.seal(s.pending.Next(envelopeChunkSize), false)
+	}
+	return s.err
+}
+
+// flush seals whatever is pending as a short chunk
+func (s *envelopeStream) flush() {
+	if s.pending.Len() > 0 {
+		s.seal(s.pending.Next(s.pending.Len()), false)
+	}
+}
+
+func (s *envelopeStream) close() error {
+	s.seal(s.pending.Next(s.pending.Len()), true)
+	if s.err == nil {
+		_, s.err = s.out.Write([]byte("]}"))
+	}
+	return s.err
+}
+
+func (s *envelopeStream) seal(chunk []byte, last bool) {
+	if s.err != nil {
+		return
+	}
+	sealed := s.gcm.Seal(nil, chunkNonce(s.prefix, s.count, last), chunk, nil)
+	item := `"` + base64.StdEncoding.EncodeToString(sealed) + `"`
+	if s.count > 0 {
+		item = "," + item
+	}
+	s.count++
+	_, s.err = s.out.Write([]byte(item))
+}
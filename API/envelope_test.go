@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestEncryptResponseKeepsStatus(t *testing.T) {
+	r, _ := newTestServer(t)
+
+	w := doRequest(r, http.MethodGet, "/api/public/validate/UNKNOWN", "", "")
+	var problem Problem
+	decodeEncrypted(t, w, &problem)
+	if w.Code != http.StatusNotFound || problem.Code != codeSubscriptionNotFound {
+		t.Fatalf("status %d, problem %+v", w.Code, problem)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") || w.Header().Get("X-Request-ID") == "" {
+		t.Fatalf("headers %v", w.Header())
+	}
+}
+
+func TestEncryptResponseStreams(t *testing.T) {
+	big := strings.Repeat("0123456789abcdef", 3<<20/16) // 3 MiB
+	r := gin.New()
+	r.Use(encryptResponse())
+	r.GET("/big", func(c *gin.Context) {
+		c.Header("X-Total", "3")
+		c.String(http.StatusCreated, big)
+	})
+	r.GET("/stream", func(c *gin.Context) {
+		c.String(http.StatusAccepted, "first,")
+		c.Writer.Flush()
+		c.Writer.WriteString("second")
+	})
+	r.GET("/empty", func(c *gin.Context) { c.Status(http.StatusNoContent) })
+	r.GET("/small", func(c *gin.Context) { c.JSON(http.StatusTeapot, gin.H{"ok": true}) })
+
+	open := func(w *httptest.ResponseRecorder) (EncryptedResponse, string) {
+		t.Helper()
+		var envelope EncryptedResponse
+		decodeJSON(t, w, &envelope)
+		plaintext, err := openEnvelope(envelope, ENCRYPTION_KEY)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return envelope, plaintext
+	}
+
+	w := doRequest(r, http.MethodGet, "/big", "", "")
+	envelope, plaintext := open(w)
+	if w.Code != http.StatusCreated || w.Header().Get("X-Total") != "3" || envelope.Version != 2 || len(envelope.Chunks) != 3<<20/envelopeChunkSize || plaintext != big {
+		t.Fatalf("big: status %d, version %d, %d chunks, %d bytes", w.Code, envelope.Version, len(envelope.Chunks), len(plaintext))
+	}
+
+	// Chunks cannot be dropped or reordered
+	for _, chunks := range [][]string{envelope.Chunks[:len(envelope.Chunks)-1], append([]string{envelope.Chunks[1], envelope.Chunks[0]}, envelope.Chunks[2:]...)} {
+		if _, err := openEnvelope(EncryptedResponse{Version: 2, Nonce: envelope.Nonce, Chunks: chunks}, ENCRYPTION_KEY); err == nil {
+			t.Fatal("tampered envelope opened")
+		}
+	}
+
+	w = doRequest(r, http.MethodGet, "/stream", "", "")
+	if envelope, plaintext := open(w); w.Code != http.StatusAccepted || len(envelope.Chunks) != 2 || plaintext != "first,second" {
+		t.Fatalf("stream: status %d, %+v, %q", w.Code, envelope, plaintext)
+	}
+
+	w = doRequest(r, http.MethodGet, "/small", "", "")
+	if envelope, plaintext := open(w); w.Code != http.StatusTeapot || envelope.Version != 0 || !json.Valid([]byte(plaintext)) {
+		t.Fatalf("small: status %d, %+v", w.Code, envelope)
+	}
+
+	w = doRequest(r, http.MethodGet, "/empty", "", "")
+	if w.Code != http.StatusNoContent || w.Body.Len() != 0 {
+		t.Fatalf("empty: status %d, %q", w.Code, w.Body)
+	}
+	if !slices.Equal(chunkNonce([]byte("prefix!"), 1, true), []byte("prefix!\x00\x00\x00\x01\x01")) {
+		t.Fatal("chunk nonce layout changed")
+	}
+}
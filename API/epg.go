@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Electronic programme guide
+//
+// Guide data comes in as XMLTV. Programmes are matched to channels by the
+// channel's GuideID (its EPG ID, or its external ID when none is set), so one
+// XMLTV channel can feed several channels such as SD and HD variants.
+
+// xmltvTimeLayout is the XMLTV date format; the offset is optional on input
+const xmltvTimeLayout = "20060102150405 -0700"
+
+type xmltvDocument struct {
+	XMLName       xml.Name         `xml:"tv"`
+	GeneratorName string           `xml:"generator-info-name,attr,omitempty"`
+	Channels      []xmltvChannel   `xml:"channel"`
+	Programmes    []xmltvProgramme `xml:"programme"`
+}
+
+type xmltvChannel struct {
+	ID           string     `xml:"id,attr"`
+	DisplayNames []string   `xml:"display-name"`
+	Icon         *xmltvIcon `xml:"icon,omitempty"`
+}
+
+type xmltvIcon struct {
+	Src string `xml:"src,attr"`
+}
+
+type xmltvText struct {
+	Lang  string `xml:"lang,attr,omitempty"`
+	Value string `xml:",chardata"`
+}
+
+type xmltvProgramme struct {
+	Start    string      `xml:"start,attr"`
+	Stop     string      `xml:"stop,attr,omitempty"`
+	Channel  string      `xml:"channel,attr"`
+	Title    []xmltvText `xml:"title"`
+	SubTitle []xmltvText `xml:"sub-title,omitempty"`
+	Desc     []xmltvText `xml:"desc,omitempty"`
+	Category []xmltvText `xml:"category,omitempty"`
+	Icon     *xmltvIcon  `xml:"icon,omitempty"`
+}
+
+// Guide is a parsed XMLTV file whose programmes are not yet matched to channels
+type Guide struct {
+	Programmes []GuideProgramme
+	Skipped    int // programmes without a channel, title or valid times
+}
+
+type GuideProgramme struct {
+	GuideID   string // XMLTV channel id
+	Programme Programme
+}
+
+// EPGImportReport summarises what a guide import matched and stored
+type EPGImportReport struct {
+	Channels   int      `json:"channels"`   // channels that received programmes
+	Programmes int      `json:"programmes"` // programmes stored, counted per channel
+	Skipped    int      `json:"skipped"`
+	Unmatched  []string `json:"unmatched"` // XMLTV channel ids without a matching channel
+}
+
+// channelGuide holds the programmes an import stores for one channel, replacing
+// whatever was stored between From and To
+type channelGuide struct {
+	ChannelID  uint
+	From, To   time.Time
+	Programmes []Programme
+}
+
+// planGuideImport matches guide programmes to channels by guide id and fills in
+// the report's counts
+func planGuideImport(channels []Channel, guide *Guide, report *EPGImportReport) []channelGuide {
+	byGuideID := map[string][]uint{}
+	for _, c := range channels {
+		byGuideID[c.GuideID()] = append(byGuideID[c.GuideID()], c.ID)
+	}
+
+	planned := map[uint]*channelGuide{}
+	unmatched := map[string]bool{}
+	for _, gp := range guide.Programmes {
+		ids, ok := byGuideID[gp.GuideID]
+		if !ok {
+			unmatched[gp.GuideID] = true
+			continue
+		}
+		for _, id := range ids {
+			cg, ok := planned[id]
+			if !ok {
+				cg = &channelGuide{ChannelID: id, From: gp.Programme.Start, To: gp.Programme.Stop}
+				planned[id] = cg
+			}
+			p := gp.Programme
+			p.ChannelID = id
+			cg.Programmes = append(cg.Programmes, p)
+			if p.Start.Before(cg.From) {
+				cg.From = p.Start
+			}
+			if p.Stop.After(cg.To) {
+				cg.To = p.Stop
+			}
+		}
+	}
+
+	var plan []channelGuide
+	for _, cg := range planned {
+		plan = append(plan, *cg)
+		report.Programmes += len(cg.Programmes)
+	}
+	sort.Slice(plan, func(i, j int) bool { return plan[i].ChannelID < plan[j].ChannelID })
+	report.Channels = len(plan)
+
+	report.Unmatched = []string{}
+	for id := range unmatched {
+		report.Unmatched = append(report.Unmatched, id)
+	}
+	sort.Strings(report.Unmatched)
+	return plan
+}
+
+// parseXMLTV reads an XMLTV document. Programmes without a stop time end when the
+// next programme on the same channel starts; the last one on a channel is dropped.
+func parseXMLTV(r io.Reader) (*Guide, error) {
+	var doc xmltvDocument
+	if err := xml.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("invalid XMLTV: %w", err)
+	}
+
+	guide := &Guide{}
+	byChannel := map[string][]GuideProgramme{}
+	var order []string
+	for _, p := range doc.Programmes {
+		start, err := parseXMLTVTime(p.Start)
+		title := xmltvFirst(p.Title)
+		if p.Channel == "" || title == "" || err != nil {
+			guide.Skipped++
+			continue
+		}
+		var stop time.Time
+		if p.Stop != "" {
+			if stop, err = parseXMLTVTime(p.Stop); err != nil || !stop.After(start) {
+				guide.Skipped++
+				continue
+			}
+		}
+
+		programme := Programme{
+			Start:       start,
+			Stop:        stop,
+			Title:       title,
+			SubTitle:    xmltvFirst(p.SubTitle),
+			Description: xmltvFirst(p.Desc),
+			Category:    xmltvFirst(p.Category),
+		}
+		if p.Icon != nil {
+			programme.Icon = p.Icon.Src
+		}
+		if _, ok := byChannel[p.Channel]; !ok {
+			order = append(order, p.Channel)
+		}
+		byChannel[p.Channel] = append(byChannel[p.Channel], GuideProgramme{GuideID: p.Channel, Programme: programme})
+	}
+
+	for _, id := range order {
+		programmes := byChannel[id]
+		sort.SliceStable(programmes, func(i, j int) bool { return programmes[i].Programme.Start.Before(programmes[j].Programme.Start) })
+		for i := range programmes {
+			p := &programmes[i].Programme
+			if p.Stop.IsZero() {
+				if i+1 == len(programmes) || !programmes[i+1].Programme.Start.After(p.Start) {
+					guide.Skipped++
+					continue
+				}
+				p.Stop = programmes[i+1].Programme.Start
+			}
+			guide.Programmes = append(guide.Programmes, programmes[i])
+		}
+	}
+	return guide, nil
+}
+
+func parseXMLTVTime(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	for _, layout := range []string{xmltvTimeLayout, "20060102150405-0700", "20060102150405", "200601021504"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid XMLTV time %q", value)
+}
+
+func xmltvFirst(texts []xmltvText) string {
+	for _, t := range texts {
+		if v := strings.TrimSpace(t.Value); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// renderXMLTV writes the guide for the given channels. Channels sharing a guide
+// id are listed once, with the programmes of the first of them.
+func renderXMLTV(w io.Writer, channels []Channel, programmes []Programme) error {
+	doc := xmltvDocument{GeneratorName: "streamsauce"}
+
+	guideIDs := map[uint]string{}
+	listed := map[string]bool{}
+	for _, c := range channels {
+		id := c.GuideID()
+		if listed[id] {
+			continue
+		}
+		listed[id] = true
+		guideIDs[c.ID] = id
+
+		channel := xmltvChannel{ID: id, DisplayNames: []string{c.Name}}
+		if c.Logo != "" {
+			channel.Icon = &xmltvIcon{Src: c.Logo}
+		}
+		doc.Channels = append(doc.Channels, channel)
+	}
+
+	for _, p := range programmes {
+		id, ok := guideIDs[p.ChannelID]
+		if !ok {
+			continue
+		}
+		programme := xmltvProgramme{
+			Start:    p.Start.Format(xmltvTimeLayout),
+			Stop:     p.Stop.Format(xmltvTimeLayout),
+			Channel:  id,
+			Title:    []xmltvText{{Value: p.Title}},
+			SubTitle: xmltvTexts(p.SubTitle),
+			Desc:     xmltvTexts(p.Description),
+			Category: xmltvTexts(p.Category),
+		}
+		if p.Icon != "" {
+			programme.Icon = &xmltvIcon{Src: p.Icon}
+		}
+		doc.Programmes = append(doc.Programmes, programme)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+func xmltvTexts(value string) []xmltvText {
+	if value == "" {
+		return nil
+	}
+	return []xmltvText{{Value: value}}
+}
+
+// nowAndNext picks the programme airing at now and the one after it from a
+// channel's programmes ordered by start time
+func nowAndNext(programmes []Programme, now time.Time) (current, next *Programme) {
+	for i := range programmes {
+		p := &programmes[i]
+		switch {
+		case !p.Start.After(now) && p.Stop.After(now):
+			current = p
+		case p.Start.After(now):
+			return current, p
+		}
+	}
+	return current, nil
+}
+
+// uniqueChannels returns each channel of the packages once, in package order
+func uniqueChannels(packages []Package) []Channel {
+	seen := map[uint]bool{}
+	var channels []Channel
+	for _, pkg := range packages {
+		for _, channel := range pkg.Channels {
+			if !seen[channel.ID] {
+				seen[channel.ID] = true
+				channels = append(channels, channel)
+			}
+		}
+	}
+	return channels
+}
+
+func channelIDs(channels []Channel) []uint {
+	ids := make([]uint, 0, len(channels))
+	for _, c := range channels {
+		ids = append(ids, c.ID)
+	}
+	return ids
+}
+
+// openGuideSource opens an XMLTV file from a local path or an http(s) URL
+func openGuideSource(ctx context.Context, source string) (io.ReadCloser, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		return os.Open(source)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("fetching %s: %s", source, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// importGuide imports the XMLTV source and prunes programmes older than the retention period
+func importGuide(ctx context.Context, epg EPGService, c EPGConfig) (*EPGImportReport, error) {
+	src, err := openGuideSource(ctx, c.Source)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	guide, err := parseXMLTV(src)
+	if err != nil {
+		return nil, err
+	}
+	report, err := epg.Import(ctx, guide)
+	if err != nil {
+		return nil, err
+	}
+	if c.Retention > 0 {
+		if _, err := epg.Prune(ctx, time.Now().Add(-c.Retention)); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// runGuideRefresh imports the configured XMLTV source immediately and then on
+// every refresh interval until ctx is cancelled. Without an interval it imports once.
+func runGuideRefresh(ctx context.Context, epg EPGService, c EPGConfig) {
+	var tick <-chan time.Time
+	if c.RefreshInterval > 0 {
+		ticker := time.NewTicker(c.RefreshInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		report, err := importGuide(ctx, epg, c)
+		if err != nil {
+			slog.ErrorContext(ctx, "EPG refresh failed", "source", c.Source, "error", err)
+		} else {
+			slog.InfoContext(ctx, "EPG refreshed", "programmes", report.Programmes, "channels", report.Channels,
+				"skipped", report.Skipped, "unmatched_channels", len(report.Unmatched))
+		}
+
+		if tick == nil {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick:
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseXMLTV(t *testing.T) {
+	guide, err := parseXMLTV(strings.NewReader(`<?xml version="1.0" encoding="UTF-8"?>
+<tv>
+  <channel id="one.example"><display-name>One</display-name></channel>
+  <programme start="20260101200000 +0100" channel="one.example"><title lang="en">Late</title></programme>
+  <programme start="20260101180000 +0100" stop="20260101190000 +0100" channel="one.example">
+    <title lang="en">Early</title><desc lang="en">First</desc><category>News</category>
+  </programme>
+  <programme start="20260101190000 +0100" channel="one.example"><title>Middle</title></programme>
+  <programme start="garbage" channel="one.example"><title>Broken</title></programme>
+  <programme start="20260101180000 +0000" stop="20260101170000 +0000" channel="one.example"><title>Backwards</title></programme>
+  <programme start="20260101180000 +0000" channel="one.example"></programme>
+</tv>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Late has no stop and nothing after it; the last three are invalid
+	if guide.Skipped != 4 || len(guide.Programmes) != 2 {
+		t.Fatalf("skipped %d, parsed %+v", guide.Skipped, guide.Programmes)
+	}
+	early, middle := guide.Programmes[0].Programme, guide.Programmes[1].Programme
+	if early.Title != "Early" || early.Description != "First" || early.Category != "News" ||
+		!early.Start.Equal(time.Date(2026, 1, 1, 17, 0, 0, 0, time.UTC)) {
+		t.Fatalf("early = %+v", early)
+	}
+	if middle.Title != "Middle" || !middle.Stop.Equal(time.Date(2026, 1, 1, 19, 0, 0, 0, time.UTC)) {
+		t.Fatalf("middle = %+v, want it to end when Late starts", middle)
+	}
+
+	if _, err := parseXMLTV(strings.NewReader("<tv><programme")); err == nil {
+		t.Fatal("expected an error for malformed XML")
+	}
+}
+
+// xmltvFixture builds a guide around now: a programme that is on air and the
+// one after it, on every given XMLTV channel
+func xmltvFixture(now time.Time, prefix string, channels ...string) string {
+	at := func(d time.Duration) string { return now.Add(d).Format(xmltvTimeLayout) }
+	var b strings.Builder
+	b.WriteString("<tv>")
+	for _, id := range channels {
+		fmt.Fprintf(&b, `<programme start="%s" stop="%s" channel="%s"><title>%s current</title></programme>`, at(-30*time.Minute), at(30*time.Minute), id, prefix)
+		fmt.Fprintf(&b, `<programme start="%s" stop="%s" channel="%s"><title>%s next</title></programme>`, at(30*time.Minute), at(90*time.Minute), id, prefix)
+	}
+	b.WriteString("</tv>")
+	return b.String()
+}
+
+func TestEPGImportAndGuideEndpoints(t *testing.T) {
+	r, conn := newTestServer(t)
+	token := adminToken(t)
+	now := time.Now().UTC().Truncate(time.Minute)
+
+	news := Channel{ExternalID: "news", Name: "News", EPGID: "news.example", MPD: "https://cdn.example/news.mpd"}
+	newsHD := Channel{ExternalID: "news-hd", Name: "News HD", EPGID: "news.example", MPD: "https://cdn.example/news-hd.mpd"}
+	sport := Channel{ExternalID: "sport", Name: "Sport", MPD: "https://cdn.example/sport.mpd"}
+	for _, c := range []*Channel{&news, &newsHD, &sport} {
+		conn.Create(c)
+	}
+	conn.Create(&Package{Name: "News", Channels: []Channel{news, newsHD}})
+	premium := Package{Name: "Sport", Channels: []Channel{sport}}
+	conn.Create(&premium)
+
+	user := User{Name: "Grace"}
+	conn.Create(&user)
+	sub := Subscription{UserID: user.ID, Key: "GRACE", Started: now.Add(-time.Hour), End: now.Add(time.Hour)}
+	conn.Create(&sub)
+
+	// sport is matched by its external ID since it has no EPG ID
+	w := doRequest(r, http.MethodPost, "/api/admin/epg/import", xmltvFixture(now, "Old", "news.example", "sport", "radio.example"), token)
+	var report EPGImportReport
+	decodeJSON(t, w, &report)
+	if w.Code != http.StatusOK || report.Channels != 3 || report.Programmes != 6 || len(report.Unmatched) != 1 {
+		t.Fatalf("import: status %d, report %+v", w.Code, report)
+	}
+
+	// Importing again replaces the overlapping programmes rather than adding to them
+	w = doRequest(r, http.MethodPost, "/api/admin/epg/import", xmltvFixture(now, "New", "news.example", "sport"), token)
+	if w.Code != http.StatusOK {
+		t.Fatalf("re-import: status %d, body %s", w.Code, w.Body)
+	}
+	var count int64
+	conn.Model(&Programme{}).Count(&count)
+	if count != 6 {
+		t.Fatalf("%d programmes stored after re-import, want 6", count)
+	}
+
+	w = doRequest(r, http.MethodGet, "/api/public/epg/GRACE/now", "", "")
+	var nowNext struct {
+		Channels []struct {
+			ExternalID string     `json:"external_id"`
+			Now        *Programme `json:"now"`
+			Next       *Programme `json:"next"`
+		} `json:"channels"`
+	}
+	decodeEncrypted(t, w, &nowNext)
+	if len(nowNext.Channels) != 3 {
+		t.Fatalf("now/next for %d channels, want 3", len(nowNext.Channels))
+	}
+	for _, c := range nowNext.Channels {
+		if c.Now == nil || c.Now.Title != "New current" || c.Next == nil || c.Next.Title != "New next" {
+			t.Fatalf("now/next for %s = %+v, %+v", c.ExternalID, c.Now, c.Next)
+		}
+	}
+
+	// Restricted to the Sport package the guide only covers sport
+	conn.Model(&sub).Association("Packages").Append(&premium)
+	from := now.Add(time.Hour).Format(time.RFC3339)
+	w = doRequest(r, http.MethodGet, "/api/public/epg/GRACE/grid?from="+from, "", "")
+	var grid struct {
+		Channels []struct {
+			ExternalID string      `json:"external_id"`
+			Programmes []Programme `json:"programmes"`
+		} `json:"channels"`
+	}
+	decodeEncrypted(t, w, &grid)
+	if len(grid.Channels) != 1 || grid.Channels[0].ExternalID != "sport" ||
+		len(grid.Channels[0].Programmes) != 1 || grid.Channels[0].Programmes[0].Title != "New next" {
+		t.Fatalf("grid = %+v", grid)
+	}
+
+	w = doRequest(r, http.MethodGet, "/api/public/epg/GRACE/grid?from="+from+"&to="+now.Add(72*time.Hour).Format(time.RFC3339), "", "")
+	var failure struct {
+		Error string `json:"error"`
+	}
+	decodeEncrypted(t, w, &failure)
+	if !strings.Contains(failure.Error, "may not exceed") {
+		t.Fatalf("oversized grid: %+v", failure)
+	}
+
+	w = doRequest(r, http.MethodGet, "/api/epg/"+sub.PlaylistToken+".xml", "", "")
+	body := w.Body.String()
+	if w.Code != http.StatusOK || !strings.Contains(body, `<channel id="sport">`) ||
+		strings.Contains(body, "news.example") || strings.Count(body, "<programme ") != 2 {
+		t.Fatalf("XMLTV export: status %d, body %s", w.Code, body)
+	}
+
+	// The admin export lists a shared guide id once
+	w = doRequest(r, http.MethodGet, "/api/admin/epg/export", "", token)
+	body = w.Body.String()
+	if w.Code != http.StatusOK || strings.Count(body, `<channel id="news.example">`) != 1 || strings.Count(body, "<programme ") != 4 {
+		t.Fatalf("admin XMLTV export: status %d, body %s", w.Code, body)
+	}
+	guide, err := parseXMLTV(strings.NewReader(body))
+	if err != nil || len(guide.Programmes) != 4 {
+		t.Fatalf("admin export does not parse back: %v", err)
+	}
+
+	// Deleting a channel drops its guide
+	doRequest(r, http.MethodDelete, fmt.Sprintf("/api/admin/channels/%d", sport.ID), "", token)
+	conn.Model(&Programme{}).Count(&count)
+	if count != 4 {
+		t.Fatalf("%d programmes stored after deleting sport, want 4", count)
+	}
+
+	// Oversized uploads are refused before they are parsed
+	previous := cfg.EPG
+	cfg.EPG.MaxImportBytes = 64
+	defer func() { cfg.EPG = previous }()
+	w = doRequest(r, http.MethodPost, "/api/admin/epg/import", xmltvFixture(now, "Big", "news.example"), token)
+	var problem Problem
+	decodeJSON(t, w, &problem)
+	if w.Code != http.StatusRequestEntityTooLarge || problem.Code != codeTooLarge {
+		t.Fatalf("oversized import: status %d, %+v", w.Code, problem)
+	}
+}
+
+func TestEPGWithMemoryServices(t *testing.T) {
+	r, services := newMemoryServer(t)
+	token := adminToken(t)
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Minute)
+
+	channel := Channel{ExternalID: "news", Name: "News", MPD: "https://cdn.example/news.mpd"}
+	pkg := Package{Name: "Basic"}
+	services.Channels.Create(ctx, &channel)
+	services.Packages.Create(ctx, &pkg)
+	services.Packages.AddChannel(ctx, pkg.ID, channel.ID)
+	services.Subscriptions.Create(ctx, &Subscription{Key: "MEM", Started: now.Add(-time.Hour), End: now.Add(time.Hour)})
+
+	w := doRequest(r, http.MethodPost, "/api/admin/epg/import", xmltvFixture(now, "Mem", "news"), token)
+	if w.Code != http.StatusOK {
+		t.Fatalf("import: status %d, body %s", w.Code, w.Body)
+	}
+
+	w = doRequest(r, http.MethodGet, "/api/public/epg/MEM/now", "", "")
+	var nowNext struct {
+		Channels []struct {
+			Now *Programme `json:"now"`
+		} `json:"channels"`
+	}
+	decodeEncrypted(t, w, &nowNext)
+	if len(nowNext.Channels) != 1 || nowNext.Channels[0].Now == nil || nowNext.Channels[0].Now.Title != "Mem current" {
+		t.Fatalf("now/next = %+v", nowNext)
+	}
+
+	if n, _ := services.EPG.Prune(ctx, now.Add(2*time.Hour)); n != 2 {
+		t.Fatalf("pruned %d programmes, want 2", n)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+)
+
+// Errors
+//
+// Every error response is a problem details object (RFC 9457) sent as
+// application/problem+json:
+//
+//	{"type": "urn:streamsauce:error:not_found", "title": "Not Found", "status": 404,
+//	 "code": "not_found", "detail": "Channel not found", "request_id": "...",
+//	 "errors": [{"field": "name", "code": "required", "message": "name is required"}]}
+//
+// code is stable and meant for programs; detail is for people and may change.
+// Field errors are only present for invalid request bodies and parameters.
+// request_id matches the X-Request-ID response header. The detail is repeated
+// in an error member for clients written before this format. Internal
+// failures never include the underlying error, which is attached to the
+// request for the log instead. The M3U playlist and XMLTV endpoints keep
+// answering with plain text, which is what players read.
+
+// Error codes
+const (
+	codeInvalidRequest         = "invalid_request"   // malformed body or parameters
+	codeValidation             = "validation_failed" // well formed but not acceptable
+	codeUnauthorized           = "unauthorized"      // no credentials
+	codeInvalidCredentials     = "invalid_credentials"
+	codeInvalidToken           = "invalid_token"
+	codeInvalidAPIKey          = "invalid_api_key"
+	codeInvalidTwoFactorCode   = "invalid_two_factor_code"
+	codeForbidden              = "forbidden"
+	codeInsufficientScope      = "insufficient_scope"
+	codeNotFound               = "not_found"
+	codeConflict               = "conflict"
+	codeTooLarge               = "request_too_large"
+	codeRateLimited            = "rate_limited"
+	codeSubscriptionNotFound   = "subscription_not_found"
+	codeSubscriptionNotStarted = "subscription_not_started"
+	codeSubscriptionExpired    = "subscription_expired"
+	codeEncryptionFailed       = "encryption_failed"
+	codeInternal               = "internal_error"
+)
+
+const problemContentType = "application/problem+json"
+
+// Problem is the body of every error response
+type Problem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Code      string       `json:"code"`
+	Detail    string       `json:"detail"`
+	RequestID string       `json:"request_id,omitempty"`
+	Errors    []FieldError `json:"errors,omitempty"`
+	Error     string       `json:"error"` // same as Detail, for older clients
+}
+
+// FieldError describes one invalid field of a request
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// newProblem builds the problem for a response to the request
+func newProblem(c *gin.Context, status int, code, detail string, fields ...FieldError) Problem {
+	return Problem{
+		Type:      "urn:streamsauce:error:" + code,
+		Title:     http.StatusText(status),
+		Status:    status,
+		Code:      code,
+		Detail:    detail,
+		RequestID: c.GetString(requestIDKey),
+		Errors:    fields,
+		Error:     detail,
+	}
+}
+
+// writeError answers with a problem. Middleware aborts the chain itself.
+func writeError(c *gin.Context, status int, code, detail string, fields ...FieldError) {
+	c.Header("Content-Type", problemContentType)
+	c.JSON(status, newProblem(c, status, code, detail, fields...))
+}
+
+// fieldError answers 400 for a single invalid field
+func fieldError(c *gin.Context, field, detail string) {
+	writeError(c, http.StatusBadRequest, codeValidation, detail, FieldError{Field: field, Code: "invalid", Message: detail})
+}
+
+// internalError answers 500 with the message, keeping err for the log
+func internalError(c *gin.Context, err error, detail string) {
+	if err != nil {
+		c.Error(err)
+	}
+	writeError(c, http.StatusInternalServerError, codeInternal, detail)
+}
+
+// bodyTooLarge answers 413 and returns true when err comes from reading past
+// the limit http.MaxBytesReader put on the request body
+func bodyTooLarge(c *gin.Context, err error) bool {
+	var tooLarge *http.MaxBytesError
+	if !errors.As(err, &tooLarge) {
+		return false
+	}
+	writeError(c, http.StatusRequestEntityTooLarge, codeTooLarge, "Request body is larger than "+strconv.FormatInt(tooLarge.Limit, 10)+" bytes")
+	return true
+}
+
+// bindError answers 400 for a request body that could not be bound, naming
+// the offending fields by their JSON names rather than Go's
+func bindError(c *gin.Context, err error) {
+	var invalid validator.ValidationErrors
+	var typeErr *json.UnmarshalTypeError
+	var syntaxErr *json.SyntaxError
+	switch {
+	case errors.As(err, &invalid):
+		fields := make([]FieldError, 0, len(invalid))
+		for _, fe := range invalid {
+			fields = append(fields, FieldError{Field: fe.Field(), Code: fe.Tag(), Message: validationMessage(fe)})
+		}
+		writeError(c, http.StatusBadRequest, codeValidation, fields[0].Message, fields...)
+	case errors.As(err, &typeErr):
+		message := typeErr.Field + " must be " + jsonTypeName(typeErr.Type)
+		writeError(c, http.StatusBadRequest, codeInvalidRequest, message, FieldError{Field: typeErr.Field, Code: "type", Message: message})
+	case errors.As(err, &syntaxErr), errors.Is(err, io.ErrUnexpectedEOF):
+		writeError(c, http.StatusBadRequest, codeInvalidRequest, "Request body is not valid JSON")
+	case errors.Is(err, io.EOF):
+		writeError(c, http.StatusBadRequest, codeInvalidRequest, "Request body is empty")
+	default:
+		// Errors of the models' own decoding, such as invalid times
+		writeError(c, http.StatusBadRequest, codeInvalidRequest, err.Error())
+	}
+}
+
+func validationMessage(fe validator.FieldError) string {
+	switch fe.Tag() {
+	case "required":
+		return fe.Field() + " is required"
+	}
+	return fe.Field() + " failed the " + fe.Tag() + " check"
+}
+
+// jsonTypeName names a Go type the way a JSON client would see it
+func jsonTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.String:
+		return "a string"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	}
+	return "an object"
+}
+
+func init() {
+	// Report binding errors with JSON field names
+	if v, ok := binding.Validator.Engine().(*validator.Validate); ok {
+		v.RegisterTagNameFunc(func(f reflect.StructField) string {
+			name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if name == "-" {
+				return ""
+			}
+			if name == "" {
+				return f.Name
+			}
+			return name
+		})
+	}
+}
+
+// noRoute answers unknown paths with a problem rather than Gin's plain text
+func noRoute(c *gin.Context) {
+	writeError(c, http.StatusNotFound, codeNotFound, "No such endpoint")
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestErrorResponses(t *testing.T) {
+	r, _ := newTestServer(t)
+	token := adminToken(t)
+
+	tests := []struct {
+		name, method, path, body string
+		status                   int
+		code, field              string
+	}{
+		{"unknown route", http.MethodGet, "/api/nowhere", "", http.StatusNotFound, codeNotFound, ""},
+		{"no token", http.MethodGet, "/api/admin/channels", "", http.StatusUnauthorized, codeUnauthorized, ""},
+		{"missing record", http.MethodGet, "/api/admin/users/999", "", http.StatusNotFound, codeNotFound, ""},
+		{"broken json", http.MethodPost, "/api/admin/plans", `{"months":`, http.StatusBadRequest, codeInvalidRequest, ""},
+		{"wrong type", http.MethodPost, "/api/admin/plans", `{"months":"six"}`, http.StatusBadRequest, codeInvalidRequest, "months"},
+		{"required field", http.MethodPost, "/api/admin/subscriptions/quote", `{}`, http.StatusBadRequest, codeValidation, "plan_id"},
+		{"invalid field", http.MethodPost, "/api/admin/plans", `{"months":2}`, http.StatusBadRequest, codeValidation, "months"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth := token
+			if tt.code == codeUnauthorized {
+				auth = ""
+			}
+			w := doRequest(r, tt.method, tt.path, tt.body, auth)
+			var problem Problem
+			decodeJSON(t, w, &problem)
+			if w.Code != tt.status || problem.Status != tt.status || problem.Code != tt.code || problem.Detail == "" || problem.Error != problem.Detail {
+				t.Fatalf("status %d, problem %+v", w.Code, problem)
+			}
+			if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, problemContentType) {
+				t.Fatalf("Content-Type %q", ct)
+			}
+			if problem.RequestID == "" || problem.RequestID != w.Header().Get("X-Request-ID") {
+				t.Fatalf("request ID %q, header %q", problem.RequestID, w.Header().Get("X-Request-ID"))
+			}
+			if tt.field != "" && (len(problem.Errors) != 1 || problem.Errors[0].Field != tt.field) {
+				t.Fatalf("field errors = %+v, want %s", problem.Errors, tt.field)
+			}
+			if strings.Contains(w.Body.String(), "Error:Field validation") {
+				t.Fatalf("validator message leaked: %s", w.Body)
+			}
+		})
+	}
+
+	// Callers' request IDs are kept and panics answer with a problem
+	r.GET("/api/panic", func(c *gin.Context) { panic("boom") })
+	req := httptest.NewRequest(http.MethodGet, "/api/panic", nil)
+	req.Header.Set("X-Request-ID", "trace-123")
+	w := serve(r, req)
+	var problem Problem
+	decodeJSON(t, w, &problem)
+	if w.Code != http.StatusInternalServerError || problem.Code != codeInternal || problem.RequestID != "trace-123" || strings.Contains(w.Body.String(), "boom") {
+		t.Fatalf("panic: status %d, %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,853 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// GORM backed services
+func newGormServices(conn *gorm.DB) Services {
+	return Services{
+		Channels:      &gormChannelService{gormCRUD[Channel]{db: conn, preloads: []string{"Keys"}}},
+		Packages:      &gormPackageService{gormCRUD[Package]{db: conn}},
+		Users:         &gormUserService{gormCRUD[User]{db: conn, preloads: []string{"IPTVHoster", "Subscriptions"}}},
+		Hosters:       &gormHosterService{gormCRUD[IPTVHoster]{db: conn}},
+		Subscriptions: &gormSubscriptionService{gormCRUD[Subscription]{db: conn, preloads: []string{"User", "Packages"}}},
+		Admins:        &gormAdminService{db: conn},
+		Catalog:       &gormCatalogService{db: conn},
+		EPG:           &gormEPGService{db: conn},
+		Plans:         &gormPlanService{gormCRUD[Plan]{db: conn, order: "package_id, months"}},
+		Bundles:       &gormBundleRuleService{gormCRUD[BundleRule]{db: conn}},
+		Health:        &gormHealthService{db: conn},
+		Sources:       &gormSourceService{db: conn},
+		Audit:         &gormAuditService{db: conn},
+		APIKeys:       &gormAPIKeyService{gormCRUD[APIKey]{db: conn}},
+	}
+}
+
+// gormCRUD implements the list/get/create/update/delete methods shared by every model.
+type gormCRUD[T any] struct {
+	db       *gorm.DB
+	preloads []string
+	order    string // List order, primary key when empty
+}
+
+func (r gormCRUD[T]) query(ctx context.Context) *gorm.DB {
+	q := r.db.WithContext(ctx)
+	for _, p := range r.preloads {
+		q = q.Preload(p)
+	}
+	return q
+}
+
+func (r gormCRUD[T]) List(ctx context.Context) ([]T, error) {
+	var items []T
+	q := r.query(ctx)
+	if r.order != "" {
+		q = q.Order(r.order)
+	}
+	if err := q.Find(&items).Error; err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+func (r gormCRUD[T]) Get(ctx context.Context, id uint) (*T, error) {
+	var item T
+	if err := r.query(ctx).First(&item, id).Error; err != nil {
+		return nil, notFound(err)
+	}
+	return &item, nil
+}
+
+func (r gormCRUD[T]) Create(ctx context.Context, item *T) error {
+	return r.db.WithContext(ctx).Create(item).Error
+}
+
+// Update saves the record's own columns; associations are managed separately
+func (r gormCRUD[T]) Update(ctx context.Context, item *T) error {
+	return r.db.WithContext(ctx).Omit(clause.Associations).Save(item).Error
+}
+
+func (r gormCRUD[T]) Delete(ctx context.Context, id uint) error {
+	var item T
+	return r.db.WithContext(ctx).Delete(&item, id).Error
+}
+
+// notFound maps GORM's missing record error to ErrNotFound
+func notFound(err error) error {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// notFoundAs is like notFound but names the missing entity
+func notFoundAs(entity string, err error) error {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return &NotFoundError{Entity: entity}
+	}
+	return err
+}
+
+type gormChannelService struct {
+	gormCRUD[Channel]
+}
+
+// Update saves the channel's own columns and replaces its keys
+func (s *gormChannelService) Update(ctx context.Context, channel *Channel) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit(clause.Associations).Save(channel).Error; err != nil {
+			return err
+		}
+		return replaceChannelKeys(tx, channel.ID, channel.Keys)
+	})
+}
+
+// replaceChannelKeys stores keys as the channel's complete key list
+func replaceChannelKeys(tx *gorm.DB, channelID uint, keys []ChannelKey) error {
+	if err := tx.Where("channel_id = ?", channelID).Delete(&ChannelKey{}).Error; err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	for i := range keys {
+		keys[i].ID, keys[i].ChannelID = 0, channelID
+	}
+	return tx.Create(&keys).Error
+}
+
+// Delete also removes the channel from every package and drops its keys,
+// programme guide, health and stream sources
+func (s *gormChannelService) Delete(ctx context.Context, id uint) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for _, model := range []any{&ChannelKey{}, &Programme{}, &ChannelHealth{}, &StreamSource{}} {
+			if err := tx.Where("channel_id = ?", id).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Select("Packages").Delete(&Channel{ID: id}).Error
+	})
+}
+
+type gormPackageService struct {
+	gormCRUD[Package]
+}
+
+// Delete also removes the package's plans and its channel, subscription and bundle associations
+func (s *gormPackageService) Delete(ctx context.Context, id uint) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("DELETE FROM subscription_packages WHERE package_id = ?", id).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("package_id = ?", id).Delete(&BundleRulePackage{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("package_id = ?", id).Delete(&Plan{}).Error; err != nil {
+			return err
+		}
+		return tx.Select("Channels").Delete(&Package{ID: id}).Error
+	})
+}
+
+func (s *gormPackageService) List(ctx context.Context) ([]Package, error) {
+	packages, err := s.gormCRUD.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return packages, withLineups(s.db.WithContext(ctx), packages)
+}
+
+func (s *gormPackageService) Get(ctx context.Context, id uint) (*Package, error) {
+	pkg, err := s.gormCRUD.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	packages := []Package{*pkg}
+	if err := withLineups(s.db.WithContext(ctx), packages); err != nil {
+		return nil, err
+	}
+	return &packages[0], nil
+}
+
+func (s *gormPackageService) AddChannel(ctx context.Context, packageID, channelID uint) error {
+	if _, _, err := s.packageAndChannel(ctx, packageID, channelID); err != nil {
+		return err
+	}
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Model(&PackageChannel{}).Where("package_id = ? AND channel_id = ?", packageID, channelID).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return nil
+		}
+
+		var last int
+		if err := tx.Model(&PackageChannel{}).Where("package_id = ?", packageID).Select("COALESCE(MAX(sort_order), 0)").Scan(&last).Error; err != nil {
+			return err
+		}
+		return tx.Create(&PackageChannel{PackageID: packageID, ChannelID: channelID, SortOrder: last + 1}).Error
+	})
+}
+
+func (s *gormPackageService) RemoveChannel(ctx context.Context, packageID, channelID uint) error {
+	if _, _, err := s.packageAndChannel(ctx, packageID, channelID); err != nil {
+		return err
+	}
+	return s.db.WithContext(ctx).Where("package_id = ? AND channel_id = ?", packageID, channelID).Delete(&PackageChannel{}).Error
+}
+
+func (s *gormPackageService) SetLineup(ctx context.Context, packageID uint, lineup []PackageChannel) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&Package{}, packageID).Error; err != nil {
+			return notFoundAs("Package", err)
+		}
+
+		ids := make([]uint, 0, len(lineup))
+		for _, entry := range lineup {
+			ids = append(ids, entry.ChannelID)
+		}
+		var found int64
+		if len(ids) > 0 {
+			if err := tx.Model(&Channel{}).Where("id IN ?", ids).Count(&found).Error; err != nil {
+				return err
+			}
+		}
+		if int(found) != len(slices.Compact(slices.Sorted(slices.Values(ids)))) {
+			return &NotFoundError{Entity: "Channel"}
+		}
+		return replaceLineup(tx, packageID, lineup)
+	})
+}
+
+// replaceLineup swaps a package's channels for the given entries
+func replaceLineup(tx *gorm.DB, packageID uint, lineup []PackageChannel) error {
+	if err := tx.Where("package_id = ?", packageID).Delete(&PackageChannel{}).Error; err != nil {
+		return err
+	}
+	if len(lineup) == 0 {
+		return nil
+	}
+	entries := slices.Clone(lineup)
+	for i := range entries {
+		entries[i].PackageID = packageID
+	}
+	return tx.Create(&entries).Error
+}
+
+// withLineups loads each package's channels in lineup order and sets their channel numbers
+func withLineups(tx *gorm.DB, packages []Package) error {
+	if len(packages) == 0 {
+		return nil
+	}
+	index := map[uint]int{}
+	packageIDs := make([]uint, 0, len(packages))
+	for i, p := range packages {
+		index[p.ID] = i
+		packageIDs = append(packageIDs, p.ID)
+		packages[i].Channels = []Channel{}
+	}
+
+	var entries []PackageChannel
+	if err := tx.Where("package_id IN ?", packageIDs).Order("package_id, sort_order, channel_id").Find(&entries).Error; err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	channelIDs := make([]uint, 0, len(entries))
+	for _, e := range entries {
+		channelIDs = append(channelIDs, e.ChannelID)
+	}
+	var channels []Channel
+	if err := tx.Preload("Keys").Where("id IN ?", slices.Compact(slices.Sorted(slices.Values(channelIDs)))).Find(&channels).Error; err != nil {
+		return err
+	}
+	byID := map[uint]Channel{}
+	for _, c := range channels {
+		byID[c.ID] = c
+	}
+
+	for _, e := range entries {
+		channel, ok := byID[e.ChannelID]
+		if !ok {
+			continue
+		}
+		channel.ChannelNumber = e.ChannelNumber
+		i := index[e.PackageID]
+		packages[i].Channels = append(packages[i].Channels, channel)
+	}
+	return nil
+}
+
+func (s *gormPackageService) packageAndChannel(ctx context.Context, packageID, channelID uint) (*Package, *Channel, error) {
+	var pkg Package
+	if err := s.db.WithContext(ctx).First(&pkg, packageID).Error; err != nil {
+		return nil, nil, notFoundAs("Package", err)
+	}
+
+	var channel Channel
+	if err := s.db.WithContext(ctx).First(&channel, channelID).Error; err != nil {
+		return nil, nil, notFoundAs("Channel", err)
+	}
+	return &pkg, &channel, nil
+}
+
+type gormUserService struct {
+	gormCRUD[User]
+}
+
+type gormHosterService struct {
+	gormCRUD[IPTVHoster]
+}
+
+type gormSubscriptionService struct {
+	gormCRUD[Subscription]
+}
+
+func (s *gormSubscriptionService) GetByKey(ctx context.Context, key string) (*Subscription, error) {
+	// Keys are stored encrypted, so they are found by their lookup hash
+	var candidates []Subscription
+	err := s.query(ctx).Where("key_hash IN ?", secrets.lookupHashes(key)).Preload("User.IPTVHoster").Find(&candidates).Error
+	if err != nil {
+		return nil, err
+	}
+	for i := range candidates {
+		if key != "" && candidates[i].Key == key {
+			return &candidates[i], nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *gormSubscriptionService) GetByPlaylistToken(ctx context.Context, token string) (*Subscription, error) {
+	var subscription Subscription
+	if err := s.query(ctx).Where(&Subscription{PlaylistToken: token}).First(&subscription).Error; err != nil {
+		return nil, notFound(err)
+	}
+	return &subscription, nil
+}
+
+// Create links the subscription's packages without saving the packages themselves
+func (s *gormSubscriptionService) Create(ctx context.Context, subscription *Subscription) error {
+	return s.db.WithContext(ctx).Omit("User", "Packages.*").Create(subscription).Error
+}
+
+// Delete also removes the subscription's package associations
+func (s *gormSubscriptionService) Delete(ctx context.Context, id uint) error {
+	return s.db.WithContext(ctx).Select("Packages").Delete(&Subscription{ID: id}).Error
+}
+
+func (s *gormSubscriptionService) CountActive(ctx context.Context, now time.Time) (int64, error) {
+	var n int64
+	err := s.db.WithContext(ctx).Model(&Subscription{}).Clauses(
+		clause.Lt{Column: clause.Column{Name: "started"}, Value: now},
+		clause.Gt{Column: clause.Column{Name: "end"}, Value: now},
+	).Count(&n).Error
+	return n, err
+}
+
+func (s *gormSubscriptionService) AddPackage(ctx context.Context, subscriptionID, packageID uint) error {
+	subscription, pkg, err := s.subscriptionAndPackage(ctx, subscriptionID, packageID)
+	if err != nil {
+		return err
+	}
+	return s.db.WithContext(ctx).Model(subscription).Association("Packages").Append(pkg)
+}
+
+func (s *gormSubscriptionService) RemovePackage(ctx context.Context, subscriptionID, packageID uint) error {
+	subscription, pkg, err := s.subscriptionAndPackage(ctx, subscriptionID, packageID)
+	if err != nil {
+		return err
+	}
+	return s.db.WithContext(ctx).Model(subscription).Association("Packages").Delete(pkg)
+}
+
+func (s *gormSubscriptionService) subscriptionAndPackage(ctx context.Context, subscriptionID, packageID uint) (*Subscription, *Package, error) {
+	var subscription Subscription
+	if err := s.db.WithContext(ctx).First(&subscription, subscriptionID).Error; err != nil {
+		return nil, nil, notFoundAs("Subscription", err)
+	}
+
+	var pkg Package
+	if err := s.db.WithContext(ctx).First(&pkg, packageID).Error; err != nil {
+		return nil, nil, notFoundAs("Package", err)
+	}
+	return &subscription, &pkg, nil
+}
+
+func (s *gormSubscriptionService) Entitlements(ctx context.Context, subscription *Subscription) ([]Package, error) {
+	var ids []uint
+	err := s.db.WithContext(ctx).Table("subscription_packages").Where("subscription_id = ?", subscription.ID).Pluck("package_id", &ids).Error
+	if err != nil {
+		return nil, err
+	}
+
+	q := s.db.WithContext(ctx)
+	if len(ids) > 0 {
+		q = q.Where("id IN ?", ids)
+	}
+	var packages []Package
+	if err := q.Find(&packages).Error; err != nil {
+		return nil, err
+	}
+	return packages, withLineups(s.db.WithContext(ctx), packages)
+}
+
+type gormAdminService struct {
+	db *gorm.DB
+}
+
+func (s *gormAdminService) List(ctx context.Context) ([]Admin, error) {
+	var admins []Admin
+	err := s.db.WithContext(ctx).Order("id").Find(&admins).Error
+	return admins, err
+}
+
+func (s *gormAdminService) Get(ctx context.Context, id uint) (*Admin, error) {
+	var admin Admin
+	if err := s.db.WithContext(ctx).First(&admin, id).Error; err != nil {
+		return nil, notFound(err)
+	}
+	return &admin, nil
+}
+
+func (s *gormAdminService) GetByUsername(ctx context.Context, username string) (*Admin, error) {
+	var admin Admin
+	if err := s.db.WithContext(ctx).Where("username = ?", username).First(&admin).Error; err != nil {
+		return nil, notFound(err)
+	}
+	return &admin, nil
+}
+
+func (s *gormAdminService) Authenticate(ctx context.Context, username, password string) (*Admin, error) {
+	var admin Admin
+	err := s.db.WithContext(ctx).Where("username = ? AND password = ?", username, password).First(&admin).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &admin, nil
+}
+
+func (s *gormAdminService) Update(ctx context.Context, admin *Admin) error {
+	return s.db.WithContext(ctx).Model(admin).
+		Select("IsOwner", "TOTPSecret", "TOTPEnabled", "TOTPLastStep", "RecoveryCodes").
+		Updates(admin).Error
+}
+
+// EnsureDefault creates the default admin account, the owner, if it does not exist yet
+func (s *gormAdminService) EnsureDefault(ctx context.Context) error {
+	var admin Admin
+	err := s.db.WithContext(ctx).Where("username = ?", defaultAdminUsername).First(&admin).Error
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+
+	return s.db.WithContext(ctx).Create(&Admin{
+		Username:  defaultAdminUsername,
+		Password:  defaultAdminPassword, // In production, hash this password
+		IsOwner:   true,
+		CreatedAt: time.Now(),
+	}).Error
+}
+
+type gormCatalogService struct {
+	db *gorm.DB
+}
+
+// errRollback aborts a transaction without reporting a failure
+var errRollback = errors.New("rollback")
+
+func (s *gormCatalogService) Export(ctx context.Context) (*Catalog, error) {
+	var channels []Channel
+	if err := s.db.WithContext(ctx).Preload("Keys").Find(&channels).Error; err != nil {
+		return nil, err
+	}
+	var packages []Package
+	if err := s.db.WithContext(ctx).Find(&packages).Error; err != nil {
+		return nil, err
+	}
+	if err := withLineups(s.db.WithContext(ctx), packages); err != nil {
+		return nil, err
+	}
+	return buildCatalog(channels, packages), nil
+}
+
+func (s *gormCatalogService) Import(ctx context.Context, catalog *Catalog, dryRun bool) (*ImportReport, error) {
+	var report *ImportReport
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var channels []Channel
+		if err := tx.Preload("Keys").Find(&channels).Error; err != nil {
+			return err
+		}
+		var packages []Package
+		if err := tx.Find(&packages).Error; err != nil {
+			return err
+		}
+		if err := withLineups(tx, packages); err != nil {
+			return err
+		}
+
+		plan := planCatalogImport(channels, packages, catalog)
+		report = &plan.report
+		report.DryRun = dryRun
+		if dryRun || report.Errors > 0 {
+			return errRollback
+		}
+
+		channelsByID := map[string]Channel{}
+		for _, c := range channels {
+			channelsByID[c.ExternalID] = c
+		}
+		for _, p := range plan.channels {
+			channel := Channel{
+				ExternalID:   p.incoming.ExternalID,
+				Name:         p.incoming.Name,
+				Logo:         p.incoming.Logo,
+				MPD:          p.incoming.MPD,
+				ExpiresEvery: p.incoming.ExpiresEvery,
+				EPGID:        p.incoming.EPGID,
+				Category:     p.incoming.Category,
+				Tags:         p.incoming.Tags,
+				StreamType:   p.incoming.StreamType,
+				MimeType:     p.incoming.MimeType,
+				LowLatency:   p.incoming.LowLatency,
+				Disabled:     p.incoming.Disabled,
+				Availability: p.incoming.Availability,
+			}
+			if p.existing == nil {
+				channel.LastRefreshed = time.Now()
+				if err := tx.Omit(clause.Associations).Create(&channel).Error; err != nil {
+					return fmt.Errorf("channel %q: %w", channel.ExternalID, err)
+				}
+			} else {
+				channel.ID = p.existing.ID
+				err := tx.Model(&Channel{ID: p.existing.ID}).Select("name", "logo", "mpd", "expires_every", "epg_id", "category", "tags", "stream_type", "mime_type", "low_latency", "disabled", "availability").Updates(&channel).Error
+				if err != nil {
+					return fmt.Errorf("channel %q: %w", channel.ExternalID, err)
+				}
+			}
+			if p.existing == nil || !sameKeys(p.existing.Keys, p.incoming.Keys) {
+				if err := replaceChannelKeys(tx, channel.ID, slices.Clone(p.incoming.Keys)); err != nil {
+					return fmt.Errorf("channel %q keys: %w", channel.ExternalID, err)
+				}
+			}
+			channelsByID[channel.ExternalID] = channel
+		}
+
+		for _, p := range plan.packages {
+			pkg := Package{ExternalID: p.incoming.ExternalID, Name: p.incoming.Name, Logo: p.incoming.Logo, Kind: p.incoming.Kind, Tier: p.incoming.Tier}
+			if p.existing == nil {
+				if err := tx.Omit(clause.Associations).Create(&pkg).Error; err != nil {
+					return fmt.Errorf("package %q: %w", pkg.ExternalID, err)
+				}
+			} else {
+				pkg.ID = p.existing.ID
+				if err := tx.Model(&Package{ID: pkg.ID}).Select("name", "logo", "kind", "tier").Updates(&pkg).Error; err != nil {
+					return fmt.Errorf("package %q: %w", pkg.ExternalID, err)
+				}
+			}
+
+			if p.channelsChanged {
+				lineup := p.incoming.lineup(func(id string) uint { return channelsByID[id].ID })
+				if err := replaceLineup(tx, pkg.ID, lineup); err != nil {
+					return fmt.Errorf("package %q channels: %w", pkg.ExternalID, err)
+				}
+			}
+		}
+
+		report.Applied = true
+		return nil
+	})
+	if err != nil && !errors.Is(err, errRollback) {
+		return nil, err
+	}
+	return report, nil
+}
+
+type gormPlanService struct {
+	gormCRUD[Plan]
+}
+
+type gormBundleRuleService struct {
+	gormCRUD[BundleRule]
+}
+
+func (s *gormBundleRuleService) List(ctx context.Context) ([]BundleRule, error) {
+	rules, err := s.gormCRUD.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return rules, s.withPackageIDs(ctx, rules)
+}
+
+func (s *gormBundleRuleService) Get(ctx context.Context, id uint) (*BundleRule, error) {
+	rule, err := s.gormCRUD.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	rules := []BundleRule{*rule}
+	if err := s.withPackageIDs(ctx, rules); err != nil {
+		return nil, err
+	}
+	return &rules[0], nil
+}
+
+func (s *gormBundleRuleService) withPackageIDs(ctx context.Context, rules []BundleRule) error {
+	var links []BundleRulePackage
+	if err := s.db.WithContext(ctx).Order("bundle_rule_id, package_id").Find(&links).Error; err != nil {
+		return err
+	}
+	for i := range rules {
+		rules[i].PackageIDs = []uint{}
+		for _, link := range links {
+			if link.BundleRuleID == rules[i].ID {
+				rules[i].PackageIDs = append(rules[i].PackageIDs, link.PackageID)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *gormBundleRuleService) Create(ctx context.Context, rule *BundleRule) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(rule).Error; err != nil {
+			return err
+		}
+		return s.savePackageIDs(tx, rule)
+	})
+}
+
+func (s *gormBundleRuleService) Update(ctx context.Context, rule *BundleRule) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(rule).Error; err != nil {
+			return err
+		}
+		return s.savePackageIDs(tx, rule)
+	})
+}
+
+func (s *gormBundleRuleService) Delete(ctx context.Context, id uint) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("bundle_rule_id = ?", id).Delete(&BundleRulePackage{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&BundleRule{}, id).Error
+	})
+}
+
+func (s *gormBundleRuleService) savePackageIDs(tx *gorm.DB, rule *BundleRule) error {
+	if err := tx.Where("bundle_rule_id = ?", rule.ID).Delete(&BundleRulePackage{}).Error; err != nil {
+		return err
+	}
+	for _, packageID := range rule.PackageIDs {
+		if err := tx.Create(&BundleRulePackage{BundleRuleID: rule.ID, PackageID: packageID}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type gormEPGService struct {
+	db *gorm.DB
+}
+
+func (s *gormEPGService) Import(ctx context.Context, guide *Guide) (*EPGImportReport, error) {
+	report := &EPGImportReport{Skipped: guide.Skipped}
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var channels []Channel
+		if err := tx.Find(&channels).Error; err != nil {
+			return err
+		}
+
+		for _, cg := range planGuideImport(channels, guide, report) {
+			err := tx.Where("channel_id = ? AND start < ? AND stop > ?", cg.ChannelID, cg.To, cg.From).Delete(&Programme{}).Error
+			if err != nil {
+				return err
+			}
+			if err := tx.CreateInBatches(cg.Programmes, 500).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func (s *gormEPGService) Programmes(ctx context.Context, channelIDs []uint, from, to time.Time) ([]Programme, error) {
+	programmes := []Programme{}
+	if len(channelIDs) == 0 {
+		return programmes, nil
+	}
+	err := s.db.WithContext(ctx).
+		Where("channel_id IN ? AND start < ? AND stop > ?", channelIDs, to.UTC(), from.UTC()).
+		Order("channel_id, start").
+		Find(&programmes).Error
+	if err != nil {
+		return nil, err
+	}
+	return programmes, nil
+}
+
+func (s *gormEPGService) Prune(ctx context.Context, before time.Time) (int64, error) {
+	result := s.db.WithContext(ctx).Where("stop < ?", before.UTC()).Delete(&Programme{})
+	return result.RowsAffected, result.Error
+}
+
+type gormHealthService struct{ db *gorm.DB }
+
+func (s *gormHealthService) List(ctx context.Context) ([]ChannelHealth, error) {
+	var results []ChannelHealth
+	err := s.db.WithContext(ctx).Order("channel_id").Find(&results).Error
+	return results, err
+}
+
+func (s *gormHealthService) Record(ctx context.Context, health *ChannelHealth) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if health.LastOKAt == nil {
+			var previous ChannelHealth
+			err := tx.Where("channel_id = ?", health.ChannelID).Take(&previous).Error
+			switch {
+			case err == nil:
+				health.LastOKAt = previous.LastOKAt
+			case !errors.Is(err, gorm.ErrRecordNotFound):
+				return err
+			}
+		}
+		return tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(health).Error
+	})
+}
+
+type gormSourceService struct{ db *gorm.DB }
+
+func (s *gormSourceService) List(ctx context.Context) ([]StreamSource, error) {
+	var sources []StreamSource
+	err := s.db.WithContext(ctx).Order("channel_id, priority, id").Find(&sources).Error
+	return sources, err
+}
+
+func (s *gormSourceService) ForChannel(ctx context.Context, channelID uint) ([]StreamSource, error) {
+	var sources []StreamSource
+	err := s.db.WithContext(ctx).Where("channel_id = ?", channelID).Order("priority, id").Find(&sources).Error
+	return sources, err
+}
+
+func (s *gormSourceService) Replace(ctx context.Context, channelID uint, sources []StreamSource) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&Channel{}, channelID).Error; err != nil {
+			return notFoundAs("Channel", err)
+		}
+		var existing []StreamSource
+		if err := tx.Where("channel_id = ?", channelID).Find(&existing).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("channel_id = ?", channelID).Delete(&StreamSource{}).Error; err != nil {
+			return err
+		}
+		for i := range sources {
+			sources[i] = keepSourceHealth(sources[i], existing)
+			sources[i].ID = 0
+			sources[i].ChannelID = channelID
+			if err := tx.Create(&sources[i]).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *gormSourceService) RecordCheck(ctx context.Context, id uint, result ChannelHealth) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var source StreamSource
+		if err := tx.First(&source, id).Error; err != nil {
+			return notFoundAs("Stream source", err)
+		}
+		source.recordCheck(result)
+		return tx.Select("status", "last_error", "latency_ms", "failures", "checked_at").Updates(&source).Error
+	})
+}
+
+type gormAuditService struct{ db *gorm.DB }
+
+func (s *gormAuditService) Record(ctx context.Context, event *AuditEvent) error {
+	return s.db.WithContext(ctx).Create(event).Error
+}
+
+func (s *gormAuditService) List(ctx context.Context, filter AuditFilter) ([]AuditEvent, error) {
+	q := s.db.WithContext(ctx).Order("created_at DESC, id DESC")
+	if filter.Admin != "" {
+		q = q.Where("admin = ?", filter.Admin)
+	}
+	if filter.Action != "" {
+		q = q.Where("action = ?", filter.Action)
+	}
+	if filter.EntityType != "" {
+		q = q.Where("entity_type = ?", filter.EntityType)
+	}
+	if filter.EntityID != 0 {
+		q = q.Where("entity_id = ?", filter.EntityID)
+	}
+	if !filter.From.IsZero() {
+		q = q.Where("created_at >= ?", filter.From)
+	}
+	if !filter.To.IsZero() {
+		q = q.Where("created_at < ?", filter.To)
+	}
+	if filter.Limit > 0 {
+		q = q.Limit(filter.Limit)
+	}
+	if filter.Offset > 0 {
+		q = q.Offset(filter.Offset)
+	}
+	var events []AuditEvent
+	err := q.Find(&events).Error
+	return events, err
+}
+
+func (s *gormAuditService) Prune(ctx context.Context, before time.Time) (int64, error) {
+	res := s.db.WithContext(ctx).Where("created_at < ?", before).Delete(&AuditEvent{})
+	return res.RowsAffected, res.Error
+}
+
+type gormAPIKeyService struct{ gormCRUD[APIKey] }
+
+func (s *gormAPIKeyService) GetByPrefix(ctx context.Context, prefix string) (*APIKey, error) {
+	var key APIKey
+	if err := s.db.WithContext(ctx).Where("prefix = ?", prefix).First(&key).Error; err != nil {
+		return nil, notFound(err)
+	}
+	return &key, nil
+}
+
+func (s *gormAPIKeyService) Revoke(ctx context.Context, id uint, at time.Time) error {
+	res := s.db.WithContext(ctx).Model(&APIKey{}).Where("id = ? AND revoked_at IS NULL", id).Update("revoked_at", at)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		if _, err := s.Get(ctx, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *gormAPIKeyService) Touch(ctx context.Context, id uint, at time.Time, ip string) error {
+	return s.db.WithContext(ctx).Model(&APIKey{}).Where("id = ?", id).
+		Updates(map[string]any{"last_used_at": at, "last_used_ip": ip}).Error
+}
@@ -0,0 +1,1651 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Server holds the services the HTTP handlers depend on
+type Server struct {
+	services Services
+	limiter  RateLimiter
+	limits   RateLimitConfig
+	db       *gorm.DB // for readiness and connection pool metrics, nil with other services
+	draining atomic.Bool
+}
+
+// newServer keeps rate limiting state in memory; set limiter to share it
+func newServer(services Services) *Server {
+	return &Server{services: services, limiter: newMemoryRateLimiter(), limits: cfg.RateLimit}
+}
+
+// idParam parses a numeric path parameter. Invalid values yield 0, which never matches a record.
+func idParam(c *gin.Context, name string) uint {
+	id, _ := strconv.ParseUint(c.Param(name), 10, 0)
+	return uint(id)
+}
+
+// Auth endpoints
+func (s *Server) login(c *gin.Context) {
+	if !s.allow(c, "login:ip:"+c.ClientIP(), s.limits.LoginPerIP) {
+		return
+	}
+	var req LoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		bindError(c, err)
+		return
+	}
+	if !s.allow(c, "login:user:"+req.Username, s.limits.LoginPerUser) || s.lockedOut(c, req.Username) {
+		return
+	}
+
+	admin, err := s.services.Admins.Authenticate(c.Request.Context(), req.Username, req.Password)
+	if err != nil {
+		s.loginFailed(c.Request.Context(), req.Username, "password")
+		writeError(c, http.StatusUnauthorized, codeInvalidCredentials, "Invalid credentials")
+		return
+	}
+
+	// Failed logins are only cleared once the second factor is in too
+	if admin.TOTPEnabled {
+		challenge, err := generateChallengeJWT(admin.Username)
+		if err != nil {
+			internalError(c, err, "Token generation failed")
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"two_factor_required": true,
+			"challenge":           challenge,
+			"expires_in":          int(challengeExpiry.Seconds()),
+		})
+		return
+	}
+	s.loginSucceeded(c.Request.Context(), admin.Username)
+	issueToken(c, admin.Username)
+}
+
+// twoFactorLoginRequest completes a login with a TOTP or recovery code
+type twoFactorLoginRequest struct {
+	Challenge    string `json:"challenge" binding:"required"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// loginTwoFactor exchanges the challenge of a correct password and a second
+// factor for the JWT
+func (s *Server) loginTwoFactor(c *gin.Context) {
+	if !s.allow(c, "login:ip:"+c.ClientIP(), s.limits.LoginPerIP) {
+		return
+	}
+	var req twoFactorLoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		bindError(c, err)
+		return
+	}
+	username, err := validateChallengeJWT(req.Challenge)
+	if err != nil {
+		writeError(c, http.StatusUnauthorized, codeInvalidToken, "Invalid or expired challenge")
+		return
+	}
+	if !s.allow(c, "login:user:"+username, s.limits.LoginPerUser) || s.lockedOut(c, username) {
+		return
+	}
+
+	ctx := c.Request.Context()
+	admin, err := s.services.Admins.GetByUsername(ctx, username)
+	if err != nil || !admin.TOTPEnabled {
+		writeError(c, http.StatusUnauthorized, codeInvalidToken, "Invalid or expired challenge")
+		return
+	}
+	if !secondFactor(admin, req.Code, req.RecoveryCode, time.Now()) {
+		s.loginFailed(ctx, username, "two_factor")
+		writeError(c, http.StatusUnauthorized, codeInvalidTwoFactorCode, "Invalid code")
+		return
+	}
+	if err := s.services.Admins.Update(ctx, admin); err != nil {
+		internalError(c, err, "Failed to save two-factor state")
+		return
+	}
+	s.loginSucceeded(ctx, username)
+	issueToken(c, username)
+}
+
+// issueToken answers with a JWT for the admin
+func issueToken(c *gin.Context, username string) {
+	token, err := generateJWT(username)
+	if err != nil {
+		internalError(c, err, "Token generation failed")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"token":      token,
+		"expires_in": JWT_EXPIRE_HOURS * 3600,
+	})
+}
+
+// currentAdmin loads the authenticated admin, answering 401 when it no longer exists
+func (s *Server) currentAdmin(c *gin.Context) (*Admin, bool) {
+	admin, err := s.services.Admins.GetByUsername(c.Request.Context(), c.GetString("username"))
+	if err != nil {
+		writeError(c, http.StatusUnauthorized, codeInvalidToken, "Admin account not found")
+		return nil, false
+	}
+	c.Set(auditEntityKey, admin.ID)
+	return admin, true
+}
+
+// twoFactorCodeRequest carries a TOTP or recovery code confirming a 2FA change
+type twoFactorCodeRequest struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+func (s *Server) getTwoFactor(c *gin.Context) {
+	admin, ok := s.currentAdmin(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"enabled":             admin.TOTPEnabled,
+		"recovery_codes_left": len(admin.RecoveryCodes),
+	})
+}
+
+// enrollTwoFactor starts enrolment with a new secret, replacing any unconfirmed one
+func (s *Server) enrollTwoFactor(c *gin.Context) {
+	admin, ok := s.currentAdmin(c)
+	if !ok {
+		return
+	}
+	if admin.TOTPEnabled {
+		writeError(c, http.StatusConflict, codeConflict, "Two-factor authentication is already enabled")
+		return
+	}
+
+	admin.TOTPSecret = newTOTPSecret()
+	if err := s.services.Admins.Update(c.Request.Context(), admin); err != nil {
+		internalError(c, err, "Failed to save two-factor state")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"secret":      admin.TOTPSecret,
+		"otpauth_url": totpURI(admin.Username, admin.TOTPSecret),
+	})
+}
+
+// confirmTwoFactor enables 2FA once a code from the enrolled app checks out and
+// returns the recovery codes, which are shown only this once
+func (s *Server) confirmTwoFactor(c *gin.Context) {
+	admin, ok := s.currentAdmin(c)
+	if !ok {
+		return
+	}
+	var req twoFactorCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		bindError(c, err)
+		return
+	}
+	switch {
+	case admin.TOTPEnabled:
+		writeError(c, http.StatusConflict, codeConflict, "Two-factor authentication is already enabled")
+		return
+	case admin.TOTPSecret == "":
+		writeError(c, http.StatusConflict, codeConflict, "Start enrolment first")
+		return
+	}
+	step, ok := verifyTOTP(admin.TOTPSecret, req.Code, time.Now(), 0)
+	if !ok {
+		writeError(c, http.StatusBadRequest, codeInvalidTwoFactorCode, "Invalid code")
+		return
+	}
+
+	codes, hashes := newRecoveryCodes()
+	admin.TOTPEnabled, admin.TOTPLastStep, admin.RecoveryCodes = true, step, hashes
+	if err := s.services.Admins.Update(c.Request.Context(), admin); err != nil {
+		internalError(c, err, "Failed to save two-factor state")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"enabled": true, "recovery_codes": codes})
+}
+
+// regenerateRecoveryCodes replaces the recovery codes after checking a code
+func (s *Server) regenerateRecoveryCodes(c *gin.Context) {
+	admin, ok := s.enabledTwoFactor(c)
+	if !ok {
+		return
+	}
+	codes, hashes := newRecoveryCodes()
+	admin.RecoveryCodes = hashes
+	if err := s.services.Admins.Update(c.Request.Context(), admin); err != nil {
+		internalError(c, err, "Failed to save two-factor state")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+}
+
+// disableTwoFactor turns 2FA off after checking a code
+func (s *Server) disableTwoFactor(c *gin.Context) {
+	admin, ok := s.enabledTwoFactor(c)
+	if !ok {
+		return
+	}
+	resetTwoFactor(admin)
+	if err := s.services.Admins.Update(c.Request.Context(), admin); err != nil {
+		internalError(c, err, "Failed to save two-factor state")
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// enabledTwoFactor loads the authenticated admin and checks the TOTP or recovery
+// code in the request, answering with an error and returning false otherwise
+func (s *Server) enabledTwoFactor(c *gin.Context) (*Admin, bool) {
+	admin, ok := s.currentAdmin(c)
+	if !ok {
+		return nil, false
+	}
+	var req twoFactorCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		bindError(c, err)
+		return nil, false
+	}
+	if !admin.TOTPEnabled {
+		writeError(c, http.StatusConflict, codeConflict, "Two-factor authentication is not enabled")
+		return nil, false
+	}
+	if !secondFactor(admin, req.Code, req.RecoveryCode, time.Now()) {
+		writeError(c, http.StatusBadRequest, codeInvalidTwoFactorCode, "Invalid code")
+		return nil, false
+	}
+	return admin, true
+}
+
+func resetTwoFactor(admin *Admin) {
+	admin.TOTPSecret, admin.TOTPEnabled, admin.TOTPLastStep, admin.RecoveryCodes = "", false, 0, nil
+}
+
+// apiKeyRequest creates an API key
+type apiKeyRequest struct {
+	Name       string     `json:"name" binding:"required"`
+	Scopes     []string   `json:"scopes"`
+	AllowedIPs []string   `json:"allowed_ips"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+}
+
+func (s *Server) getAllAPIKeys(c *gin.Context) {
+	keys, err := s.services.APIKeys.List(c.Request.Context())
+	if err != nil {
+		internalError(c, err, "Failed to load API keys")
+		return
+	}
+	c.JSON(http.StatusOK, keys)
+}
+
+// addAPIKey creates a key acting for the logged in admin. The key is only
+// part of this response.
+func (s *Server) addAPIKey(c *gin.Context) {
+	admin, ok := s.currentAdmin(c)
+	if !ok {
+		return
+	}
+	var req apiKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		bindError(c, err)
+		return
+	}
+	if msg := validateScopes(req.Scopes); msg != "" {
+		fieldError(c, "scopes", msg)
+		return
+	}
+	if msg := validateAllowedIPs(req.AllowedIPs); msg != "" {
+		fieldError(c, "allowed_ips", msg)
+		return
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		fieldError(c, "expires_at", "expires_at must be in the future")
+		return
+	}
+
+	raw, prefix := newAPIKey()
+	key := APIKey{
+		Name:       req.Name,
+		Prefix:     prefix,
+		Hash:       plainLookupHash(raw),
+		Scopes:     req.Scopes,
+		AllowedIPs: req.AllowedIPs,
+		AdminID:    admin.ID,
+		ExpiresAt:  req.ExpiresAt,
+	}
+	if err := s.services.APIKeys.Create(c.Request.Context(), &key); err != nil {
+		internalError(c, err, "Failed to create API key")
+		return
+	}
+	c.JSON(http.StatusCreated, struct {
+		APIKey
+		Key string `json:"key"`
+	}{key, raw})
+}
+
+func (s *Server) revokeAPIKey(c *gin.Context) {
+	ctx := c.Request.Context()
+	id := idParam(c, "id")
+	if err := s.services.APIKeys.Revoke(ctx, id, time.Now()); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			writeError(c, http.StatusNotFound, codeNotFound, "API key not found")
+			return
+		}
+		internalError(c, err, "Failed to revoke API key")
+		return
+	}
+	key, err := s.services.APIKeys.Get(ctx, id)
+	if err != nil {
+		internalError(c, err, "Failed to load API key")
+		return
+	}
+	c.JSON(http.StatusOK, key)
+}
+
+func (s *Server) getAllAdmins(c *gin.Context) {
+	admins, err := s.services.Admins.List(c.Request.Context())
+	if err != nil {
+		internalError(c, err, "Failed to load admins")
+		return
+	}
+	c.JSON(http.StatusOK, admins)
+}
+
+// resetAdminTwoFactor lets an owner admin turn off another admin's 2FA, say
+// after a lost phone. The admin can enrol again after logging in with the password.
+func (s *Server) resetAdminTwoFactor(c *gin.Context) {
+	owner, ok := s.currentAdmin(c)
+	if !ok {
+		return
+	}
+	if !owner.IsOwner {
+		writeError(c, http.StatusForbidden, codeForbidden, "Only owner admins can reset two-factor authentication")
+		return
+	}
+	admin, err := s.services.Admins.Get(c.Request.Context(), idParam(c, "id"))
+	if err != nil {
+		writeError(c, http.StatusNotFound, codeNotFound, "Admin not found")
+		return
+	}
+
+	resetTwoFactor(admin)
+	if err := s.services.Admins.Update(c.Request.Context(), admin); err != nil {
+		internalError(c, err, "Failed to save two-factor state")
+		return
+	}
+	c.JSON(http.StatusOK, admin)
+}
+
+// Public encrypted endpoints
+// Disabled channels and channels outside their availability windows are left out.
+// Each channel lists its stream sources, healthiest first.
+func (s *Server) getAllChannels(c *gin.Context) {
+	channels, err := s.services.Channels.List(c.Request.Context())
+	if err != nil {
+		internalError(c, err, "Failed to load channels")
+		return
+	}
+	sources, err := s.services.Sources.List(c.Request.Context())
+	if err != nil {
+		internalError(c, err, "Failed to load stream sources")
+		return
+	}
+	channels = availableChannels(channels, time.Now())
+	withPlaybackSources(channels, sources)
+	withDRM(channels)
+	c.JSON(http.StatusOK, channels)
+}
+
+func (s *Server) getAllPackages(c *gin.Context) {
+	packages, err := s.services.Packages.List(c.Request.Context())
+	if err != nil {
+		internalError(c, err, "Failed to load packages")
+		return
+	}
+	sources, err := s.services.Sources.List(c.Request.Context())
+	if err != nil {
+		internalError(c, err, "Failed to load stream sources")
+		return
+	}
+	packages = availablePackages(packages, time.Now())
+	for _, pkg := range packages {
+		withPlaybackSources(pkg.Channels, sources)
+		withDRM(pkg.Channels)
+	}
+	c.JSON(http.StatusOK, packages)
+}
+
+// Admin Channel endpoints
+func (s *Server) addChannel(c *gin.Context) {
+	var channel Channel
+	if err := c.ShouldBindJSON(&channel); err != nil {
+		bindError(c, err)
+		return
+	}
+	if msg := applyLegacyKey(&channel, ""); msg != "" {
+		fieldError(c, "key", msg)
+		return
+	}
+	if msg := validateStream(&channel); msg != "" {
+		writeError(c, http.StatusBadRequest, codeValidation, msg)
+		return
+	}
+	channel.Key = legacyKey(channel.Keys)
+	if err := validateAvailability(channel.Availability); err != nil {
+		fieldError(c, "availability", err.Error())
+		return
+	}
+
+	channel.CreatedAt = time.Now()
+	if channel.LastRefreshed.IsZero() {
+		channel.LastRefreshed = time.Now()
+	}
+
+	if err := s.services.Channels.Create(c.Request.Context(), &channel); err != nil {
+		internalError(c, err, "Failed to create channel")
+		return
+	}
+
+	c.JSON(http.StatusCreated, channel)
+}
+
+// Admins see every channel with the result of its latest stream health check
+func (s *Server) getAdminChannels(c *gin.Context) {
+	channels, err := s.services.Channels.List(c.Request.Context())
+	if err != nil {
+		internalError(c, err, "Failed to load channels")
+		return
+	}
+	results, err := s.services.Health.List(c.Request.Context())
+	if err != nil {
+		internalError(c, err, "Failed to load channel health")
+		return
+	}
+	withHealth(channels, results)
+	c.JSON(http.StatusOK, channels)
+}
+
+func (s *Server) updateChannel(c *gin.Context) {
+	channel, err := s.services.Channels.Get(c.Request.Context(), idParam(c, "id"))
+	if err != nil {
+		writeError(c, http.StatusNotFound, codeNotFound, "Channel not found")
+		return
+	}
+
+	// Keys are replaced when the request lists them and kept otherwise
+	keys, previousKey := channel.Keys, channel.Key
+	channel.Keys = nil
+	if err := c.ShouldBindJSON(channel); err != nil {
+		bindError(c, err)
+		return
+	}
+	if channel.Keys == nil {
+		channel.Keys = keys
+	}
+	if msg := applyLegacyKey(channel, previousKey); msg != "" {
+		fieldError(c, "key", msg)
+		return
+	}
+	if msg := validateStream(channel); msg != "" {
+		writeError(c, http.StatusBadRequest, codeValidation, msg)
+		return
+	}
+	channel.Key = legacyKey(channel.Keys)
+	if err := validateAvailability(channel.Availability); err != nil {
+		fieldError(c, "availability", err.Error())
+		return
+	}
+
+	if err := s.services.Channels.Update(c.Request.Context(), channel); err != nil {
+		internalError(c, err, "Failed to update channel")
+		return
+	}
+	c.JSON(http.StatusOK, channel)
+}
+
+// A channel's stream sources with their health state, in priority order
+func (s *Server) getChannelSources(c *gin.Context) {
+	channel, err := s.services.Channels.Get(c.Request.Context(), idParam(c, "id"))
+	if err != nil {
+		writeError(c, http.StatusNotFound, codeNotFound, "Channel not found")
+		return
+	}
+	sources, err := s.services.Sources.ForChannel(c.Request.Context(), channel.ID)
+	if err != nil {
+		internalError(c, err, "Failed to load stream sources")
+		return
+	}
+	c.JSON(http.StatusOK, sources)
+}
+
+// Replace a channel's stream sources with a list of {"url", "format", "priority", "weight"} entries
+func (s *Server) setChannelSources(c *gin.Context) {
+	var sources []StreamSource
+	if err := c.ShouldBindJSON(&sources); err != nil {
+		bindError(c, err)
+		return
+	}
+	if msg := validateSources(sources); msg != "" {
+		writeError(c, http.StatusBadRequest, codeValidation, msg)
+		return
+	}
+
+	if err := s.services.Sources.Replace(c.Request.Context(), idParam(c, "id"), sources); err != nil {
+		associationError(c, err, "Failed to update stream sources")
+		return
+	}
+	s.getChannelSources(c)
+}
+
+func (s *Server) deleteChannel(c *gin.Context) {
+	if err := s.services.Channels.Delete(c.Request.Context(), idParam(c, "id")); err != nil {
+		internalError(c, err, "Failed to delete channel")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Channel deleted successfully"})
+}
+
+// Admin Package endpoints
+func (s *Server) getAdminPackages(c *gin.Context) {
+	packages, err := s.services.Packages.List(c.Request.Context())
+	if err != nil {
+		internalError(c, err, "Failed to load packages")
+		return
+	}
+	c.JSON(http.StatusOK, packages)
+}
+
+func (s *Server) addPackage(c *gin.Context) {
+	var pkg Package
+	if err := c.ShouldBindJSON(&pkg); err != nil {
+		bindError(c, err)
+		return
+	}
+	if !validPackageKind(pkg.Kind) {
+		fieldError(c, "kind", "Package kind must be base or addon")
+		return
+	}
+
+	pkg.CreatedAt = time.Now()
+	if err := s.services.Packages.Create(c.Request.Context(), &pkg); err != nil {
+		internalError(c, err, "Failed to create package")
+		return
+	}
+
+	c.JSON(http.StatusCreated, pkg)
+}
+
+func (s *Server) updatePackage(c *gin.Context) {
+	pkg, err := s.services.Packages.Get(c.Request.Context(), idParam(c, "id"))
+	if err != nil {
+		writeError(c, http.StatusNotFound, codeNotFound, "Package not found")
+		return
+	}
+
+	if err := c.ShouldBindJSON(pkg); err != nil {
+		bindError(c, err)
+		return
+	}
+	if !validPackageKind(pkg.Kind) {
+		fieldError(c, "kind", "Package kind must be base or addon")
+		return
+	}
+
+	if err := s.services.Packages.Update(c.Request.Context(), pkg); err != nil {
+		internalError(c, err, "Failed to update package")
+		return
+	}
+	c.JSON(http.StatusOK, pkg)
+}
+
+func (s *Server) deletePackage(c *gin.Context) {
+	if err := s.services.Packages.Delete(c.Request.Context(), idParam(c, "id")); err != nil {
+		internalError(c, err, "Failed to delete package")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Package deleted successfully"})
+}
+
+// validPackageKind accepts the package kinds; empty defaults to base on create
+func validPackageKind(kind string) bool {
+	return kind == "" || kind == packageBase || kind == packageAddon
+}
+
+// Admin Plan endpoints
+func (s *Server) getAllPlans(c *gin.Context) {
+	plans, err := s.services.Plans.List(c.Request.Context())
+	if err != nil {
+		internalError(c, err, "Failed to load plans")
+		return
+	}
+	c.JSON(http.StatusOK, plans)
+}
+
+func (s *Server) addPlan(c *gin.Context) {
+	var plan Plan
+	if err := c.ShouldBindJSON(&plan); err != nil {
+		bindError(c, err)
+		return
+	}
+	if !s.validatePlan(c, &plan) {
+		return
+	}
+
+	plan.CreatedAt = time.Now()
+	if err := s.services.Plans.Create(c.Request.Context(), &plan); err != nil {
+		internalError(c, err, "Failed to create plan")
+		return
+	}
+
+	c.JSON(http.StatusCreated, plan)
+}
+
+func (s *Server) updatePlan(c *gin.Context) {
+	plan, err := s.services.Plans.Get(c.Request.Context(), idParam(c, "id"))
+	if err != nil {
+		writeError(c, http.StatusNotFound, codeNotFound, "Plan not found")
+		return
+	}
+
+	if err := c.ShouldBindJSON(plan); err != nil {
+		bindError(c, err)
+		return
+	}
+	if !s.validatePlan(c, plan) {
+		return
+	}
+
+	if err := s.services.Plans.Update(c.Request.Context(), plan); err != nil {
+		internalError(c, err, "Failed to update plan")
+		return
+	}
+	c.JSON(http.StatusOK, plan)
+}
+
+func (s *Server) deletePlan(c *gin.Context) {
+	if err := s.services.Plans.Delete(c.Request.Context(), idParam(c, "id")); err != nil {
+		internalError(c, err, "Failed to delete plan")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Plan deleted successfully"})
+}
+
+// validatePlan checks the duration, price and package of a plan and that its
+// package has no other plan for the same duration
+func (s *Server) validatePlan(c *gin.Context, plan *Plan) bool {
+	if !slices.Contains(planDurations, plan.Months) {
+		fieldError(c, "months", "Plans can only run for 1, 3, 6 or 12 months")
+		return false
+	}
+	if plan.Price < 0 {
+		fieldError(c, "price", "Price cannot be negative")
+		return false
+	}
+	if _, err := s.services.Packages.Get(c.Request.Context(), plan.PackageID); err != nil {
+		fieldError(c, "package_id", "Package "+strconv.Itoa(int(plan.PackageID))+" does not exist")
+		return false
+	}
+
+	plans, err := s.services.Plans.List(c.Request.Context())
+	if err != nil {
+		internalError(c, err, "Failed to load plans")
+		return false
+	}
+	for _, other := range plans {
+		if other.PackageID == plan.PackageID && other.Months == plan.Months && other.ID != plan.ID {
+			writeError(c, http.StatusConflict, codeConflict, "The package already has a "+strconv.Itoa(plan.Months)+" month plan")
+			return false
+		}
+	}
+	return true
+}
+
+// Admin Bundle endpoints
+func (s *Server) getAllBundles(c *gin.Context) {
+	rules, err := s.services.Bundles.List(c.Request.Context())
+	if err != nil {
+		internalError(c, err, "Failed to load bundles")
+		return
+	}
+	c.JSON(http.StatusOK, rules)
+}
+
+func (s *Server) addBundle(c *gin.Context) {
+	var rule BundleRule
+	if err := c.ShouldBindJSON(&rule); err != nil {
+		bindError(c, err)
+		return
+	}
+	if !s.validateBundle(c, &rule) {
+		return
+	}
+
+	rule.CreatedAt = time.Now()
+	if err := s.services.Bundles.Create(c.Request.Context(), &rule); err != nil {
+		internalError(c, err, "Failed to create bundle")
+		return
+	}
+
+	c.JSON(http.StatusCreated, rule)
+}
+
+func (s *Server) updateBundle(c *gin.Context) {
+	rule, err := s.services.Bundles.Get(c.Request.Context(), idParam(c, "id"))
+	if err != nil {
+		writeError(c, http.StatusNotFound, codeNotFound, "Bundle not found")
+		return
+	}
+
+	if err := c.ShouldBindJSON(rule); err != nil {
+		bindError(c, err)
+		return
+	}
+	if !s.validateBundle(c, rule) {
+		return
+	}
+
+	if err := s.services.Bundles.Update(c.Request.Context(), rule); err != nil {
+		internalError(c, err, "Failed to update bundle")
+		return
+	}
+	c.JSON(http.StatusOK, rule)
+}
+
+func (s *Server) deleteBundle(c *gin.Context) {
+	if err := s.services.Bundles.Delete(c.Request.Context(), idParam(c, "id")); err != nil {
+		internalError(c, err, "Failed to delete bundle")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Bundle deleted successfully"})
+}
+
+// validateBundle checks a bundle rule's name and discount and that it names at
+// least two existing packages, each once
+func (s *Server) validateBundle(c *gin.Context, rule *BundleRule) bool {
+	switch {
+	case strings.TrimSpace(rule.Name) == "":
+		fieldError(c, "name", "Bundle name is required")
+		return false
+	case rule.DiscountPercent <= 0 || rule.DiscountPercent > 100:
+		fieldError(c, "discount_percent", "Discount must be more than 0 and at most 100 percent")
+		return false
+	}
+
+	slices.Sort(rule.PackageIDs)
+	rule.PackageIDs = slices.Compact(rule.PackageIDs)
+	if len(rule.PackageIDs) < 2 {
+		fieldError(c, "package_ids", "A bundle needs at least two packages")
+		return false
+	}
+	for _, id := range rule.PackageIDs {
+		if _, err := s.services.Packages.Get(c.Request.Context(), id); err != nil {
+			fieldError(c, "package_ids", "Package "+strconv.Itoa(int(id))+" does not exist")
+			return false
+		}
+	}
+	return true
+}
+
+// Admin User endpoints
+func (s *Server) getAllUsers(c *gin.Context) {
+	users, err := s.services.Users.List(c.Request.Context())
+	if err != nil {
+		internalError(c, err, "Failed to load users")
+		return
+	}
+	c.JSON(http.StatusOK, users)
+}
+
+func (s *Server) getUser(c *gin.Context) {
+	user, err := s.services.Users.Get(c.Request.Context(), idParam(c, "id"))
+	if err != nil {
+		writeError(c, http.StatusNotFound, codeNotFound, "User not found")
+		return
+	}
+
+	c.JSON(http.StatusOK, user)
+}
+
+func (s *Server) addUser(c *gin.Context) {
+	var user User
+	if err := c.ShouldBindJSON(&user); err != nil {
+		bindError(c, err)
+		return
+	}
+
+	user.CreatedAt = time.Now()
+	if err := s.services.Users.Create(c.Request.Context(), &user); err != nil {
+		internalError(c, err, "Failed to create user")
+		return
+	}
+
+	c.JSON(http.StatusCreated, user)
+}
+
+func (s *Server) updateUser(c *gin.Context) {
+	user, err := s.services.Users.Get(c.Request.Context(), idParam(c, "id"))
+	if err != nil {
+		writeError(c, http.StatusNotFound, codeNotFound, "User not found")
+		return
+	}
+
+	if err := c.ShouldBindJSON(user); err != nil {
+		bindError(c, err)
+		return
+	}
+
+	if err := s.services.Users.Update(c.Request.Context(), user); err != nil {
+		internalError(c, err, "Failed to update user")
+		return
+	}
+	c.JSON(http.StatusOK, user)
+}
+
+func (s *Server) deleteUser(c *gin.Context) {
+	if err := s.services.Users.Delete(c.Request.Context(), idParam(c, "id")); err != nil {
+		internalError(c, err, "Failed to delete user")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "User deleted successfully"})
+}
+
+// Admin IPTV Hoster endpoints
+func (s *Server) getAllHosters(c *gin.Context) {
+	hosters, err := s.services.Hosters.List(c.Request.Context())
+	if err != nil {
+		internalError(c, err, "Failed to load hosters")
+		return
+	}
+	c.JSON(http.StatusOK, hosters)
+}
+
+func (s *Server) addHoster(c *gin.Context) {
+	var hoster IPTVHoster
+	if err := c.ShouldBindJSON(&hoster); err != nil {
+		bindError(c, err)
+		return
+	}
+
+	hoster.CreatedAt = time.Now()
+	if err := s.services.Hosters.Create(c.Request.Context(), &hoster); err != nil {
+		internalError(c, err, "Failed to create hoster")
+		return
+	}
+
+	c.JSON(http.StatusCreated, hoster)
+}
+
+func (s *Server) updateHoster(c *gin.Context) {
+	hoster, err := s.services.Hosters.Get(c.Request.Context(), idParam(c, "id"))
+	if err != nil {
+		writeError(c, http.StatusNotFound, codeNotFound, "Hoster not found")
+		return
+	}
+
+	if err := c.ShouldBindJSON(hoster); err != nil {
+		bindError(c, err)
+		return
+	}
+
+	if err := s.services.Hosters.Update(c.Request.Context(), hoster); err != nil {
+		internalError(c, err, "Failed to update hoster")
+		return
+	}
+	c.JSON(http.StatusOK, hoster)
+}
+
+func (s *Server) deleteHoster(c *gin.Context) {
+	if err := s.services.Hosters.Delete(c.Request.Context(), idParam(c, "id")); err != nil {
+		internalError(c, err, "Failed to delete hoster")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Hoster deleted successfully"})
+}
+
+// Subscription endpoints
+func (s *Server) getAllSubscriptions(c *gin.Context) {
+	subscriptions, err := s.services.Subscriptions.List(c.Request.Context())
+	if err != nil {
+		internalError(c, err, "Failed to load subscriptions")
+		return
+	}
+	c.JSON(http.StatusOK, subscriptions)
+}
+
+func (s *Server) getSubscription(c *gin.Context) {
+	subscription, err := s.services.Subscriptions.Get(c.Request.Context(), idParam(c, "id"))
+	if err != nil {
+		writeError(c, http.StatusNotFound, codeNotFound, "Subscription not found")
+		return
+	}
+
+	c.JSON(http.StatusOK, subscription)
+}
+
+// subscriptionRequest is a new subscription, optionally sold from a plan with add-ons
+type subscriptionRequest struct {
+	Subscription
+	AddonIDs []uint `json:"addon_ids"`
+}
+
+// quoteRequest selects a base plan and add-on packages to price
+type quoteRequest struct {
+	PlanID   uint   `json:"plan_id" binding:"required"`
+	AddonIDs []uint `json:"addon_ids"`
+}
+
+// With a plan the subscription runs for the plan's months from its start, is
+// charged the quoted total and is limited to the base package and add-ons.
+func (s *Server) addSubscription(c *gin.Context) {
+	var req subscriptionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		bindError(c, err)
+		return
+	}
+	subscription := req.Subscription
+
+	// Set creation time
+	subscription.CreatedAt = time.Now()
+
+	// Validate dates
+	if subscription.Started.IsZero() {
+		subscription.Started = time.Now()
+	}
+	switch {
+	case subscription.PlanID != nil:
+		quote, packages, ok := s.quote(c, *subscription.PlanID, req.AddonIDs)
+		if !ok {
+			return
+		}
+		subscription.End = subscription.Started.AddDate(0, quote.Months, 0)
+		subscription.Payed = quote.Total
+		subscription.Packages = packages
+	case len(req.AddonIDs) > 0:
+		fieldError(c, "addon_ids", "Add-ons can only be sold with a plan")
+		return
+	case subscription.End.IsZero():
+		subscription.End = time.Now().AddDate(0, 1, 0) // Default to 1 month from now
+	}
+
+	if err := s.services.Subscriptions.Create(c.Request.Context(), &subscription); err != nil {
+		internalError(c, err, "Failed to create subscription")
+		return
+	}
+
+	c.JSON(http.StatusCreated, subscription)
+}
+
+// Price a plan with add-ons without creating a subscription
+func (s *Server) quoteSubscription(c *gin.Context) {
+	var req quoteRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		bindError(c, err)
+		return
+	}
+
+	quote, _, ok := s.quote(c, req.PlanID, req.AddonIDs)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, quote)
+}
+
+// quote prices a plan with add-ons and returns the quoted packages, without
+// their channels. It writes the error response itself when the selection is invalid.
+func (s *Server) quote(c *gin.Context, planID uint, addonIDs []uint) (*Quote, []Package, bool) {
+	ctx := c.Request.Context()
+	plan, err := s.services.Plans.Get(ctx, planID)
+	if err != nil {
+		fieldError(c, "plan_id", "Plan "+strconv.Itoa(int(planID))+" does not exist")
+		return nil, nil, false
+	}
+
+	packages, err := s.services.Packages.List(ctx)
+	if err != nil {
+		internalError(c, err, "Failed to load packages")
+		return nil, nil, false
+	}
+	plans, err := s.services.Plans.List(ctx)
+	if err != nil {
+		internalError(c, err, "Failed to load plans")
+		return nil, nil, false
+	}
+	rules, err := s.services.Bundles.List(ctx)
+	if err != nil {
+		internalError(c, err, "Failed to load bundles")
+		return nil, nil, false
+	}
+
+	quote, err := quoteSubscription(*plan, addonIDs, packages, plans, rules)
+	if err != nil {
+		writeError(c, http.StatusBadRequest, codeValidation, err.Error())
+		return nil, nil, false
+	}
+
+	var quoted []Package
+	for _, id := range quote.PackageIDs() {
+		for _, pkg := range packages {
+			if pkg.ID == id {
+				pkg.Channels = nil
+				quoted = append(quoted, pkg)
+			}
+		}
+	}
+	return quote, quoted, true
+}
+
+func (s *Server) updateSubscription(c *gin.Context) {
+	subscription, err := s.services.Subscriptions.Get(c.Request.Context(), idParam(c, "id"))
+	if err != nil {
+		writeError(c, http.StatusNotFound, codeNotFound, "Subscription not found")
+		return
+	}
+
+	if err := c.ShouldBindJSON(subscription); err != nil {
+		bindError(c, err)
+		return
+	}
+
+	if err := s.services.Subscriptions.Update(c.Request.Context(), subscription); err != nil {
+		internalError(c, err, "Failed to update subscription")
+		return
+	}
+	c.JSON(http.StatusOK, subscription)
+}
+
+func (s *Server) deleteSubscription(c *gin.Context) {
+	if err := s.services.Subscriptions.Delete(c.Request.Context(), idParam(c, "id")); err != nil {
+		internalError(c, err, "Failed to delete subscription")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Subscription deleted successfully"})
+}
+
+// Enhanced subscription validation endpoint with user and hoster info. Known keys
+// always get a result, whose status tells why an invalid subscription is not
+// valid; only unknown keys are errors.
+func (s *Server) validateSubscription(c *gin.Context) {
+	key := c.Param("key")
+	if key == "" {
+		writeError(c, http.StatusBadRequest, codeInvalidRequest, "Subscription key is required")
+		return
+	}
+	if !s.allowKeyLookup(c, key) {
+		metrics.validations.WithLabelValues("rate_limited").Inc()
+		return
+	}
+
+	subscription, err := s.services.Subscriptions.GetByKey(c.Request.Context(), key)
+	if err != nil {
+		metrics.validations.WithLabelValues("not_found").Inc()
+		writeError(c, http.StatusNotFound, codeSubscriptionNotFound, "Subscription not found")
+		return
+	}
+
+	// Check if subscription is still active
+	status := subscription.Status(time.Now())
+	metrics.validations.WithLabelValues(status).Inc()
+
+	response := gin.H{
+		"valid":        status == statusActive,
+		"subscription": subscription,
+		"status":       status,
+	}
+
+	// Include user info (without sensitive data)
+	if subscription.User.ID > 0 {
+		userInfo := gin.H{
+			"id":            subscription.User.ID,
+			"name":          subscription.User.Name,
+			"avatar":        subscription.User.Avatar,
+			"tele_username": subscription.User.TeleUsername,
+			"is_hoster":     subscription.User.IsHoster,
+		}
+
+		// Include IPTV hoster info for branding
+		if subscription.User.IPTVHoster != nil {
+			userInfo["iptv_hoster"] = gin.H{
+				"id":            subscription.User.IPTVHoster.ID,
+				"name":          subscription.User.IPTVHoster.Name,
+				"logo":          subscription.User.IPTVHoster.Logo,
+				"color_palette": subscription.User.IPTVHoster.ColorPalette,
+			}
+		}
+
+		response["user"] = userInfo
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// Helper endpoint to add channels to a package
+func (s *Server) addChannelToPackage(c *gin.Context) {
+	err := s.services.Packages.AddChannel(c.Request.Context(), idParam(c, "id"), idParam(c, "channelId"))
+	if err != nil {
+		associationError(c, err, "Failed to add channel to package")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Channel added to package successfully"})
+}
+
+// Remove channel from package
+func (s *Server) removeChannelFromPackage(c *gin.Context) {
+	err := s.services.Packages.RemoveChannel(c.Request.Context(), idParam(c, "id"), idParam(c, "channelId"))
+	if err != nil {
+		associationError(c, err, "Failed to remove channel from package")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Channel removed from package successfully"})
+}
+
+// Replace a package's channels with an ordered lineup of {"channel_id", "channel_number"} entries
+func (s *Server) setPackageLineup(c *gin.Context) {
+	var lineup []PackageChannel
+	if err := c.ShouldBindJSON(&lineup); err != nil {
+		bindError(c, err)
+		return
+	}
+
+	channels := map[uint]bool{}
+	numbers := map[int]uint{}
+	for i := range lineup {
+		entry := &lineup[i]
+		switch {
+		case channels[entry.ChannelID]:
+			fieldError(c, "["+strconv.Itoa(i)+"].channel_id", "Channel "+strconv.Itoa(int(entry.ChannelID))+" is listed more than once")
+			return
+		case entry.ChannelNumber < 0:
+			fieldError(c, "["+strconv.Itoa(i)+"].channel_number", "Channel numbers cannot be negative")
+			return
+		case entry.ChannelNumber > 0 && numbers[entry.ChannelNumber] != 0:
+			fieldError(c, "["+strconv.Itoa(i)+"].channel_number", "Channel number "+strconv.Itoa(entry.ChannelNumber)+" is used more than once")
+			return
+		}
+		channels[entry.ChannelID] = true
+		if entry.ChannelNumber > 0 {
+			numbers[entry.ChannelNumber] = entry.ChannelID
+		}
+		entry.SortOrder = i + 1
+	}
+
+	if err := s.services.Packages.SetLineup(c.Request.Context(), idParam(c, "id"), lineup); err != nil {
+		associationError(c, err, "Failed to update package channels")
+		return
+	}
+
+	pkg, err := s.services.Packages.Get(c.Request.Context(), idParam(c, "id"))
+	if err != nil {
+		internalError(c, err, "Failed to load package")
+		return
+	}
+	c.JSON(http.StatusOK, pkg)
+}
+
+// associationError reports which side of an association is missing
+func associationError(c *gin.Context, err error, message string) {
+	var missing *NotFoundError
+	if errors.As(err, &missing) {
+		writeError(c, http.StatusNotFound, codeNotFound, missing.Error())
+		return
+	}
+	internalError(c, err, message)
+}
+
+// Grant a subscription access to a package. Subscriptions without packages can watch everything.
+func (s *Server) addPackageToSubscription(c *gin.Context) {
+	err := s.services.Subscriptions.AddPackage(c.Request.Context(), idParam(c, "id"), idParam(c, "packageId"))
+	if err != nil {
+		associationError(c, err, "Failed to add package to subscription")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Package added to subscription successfully"})
+}
+
+func (s *Server) removePackageFromSubscription(c *gin.Context) {
+	err := s.services.Subscriptions.RemovePackage(c.Request.Context(), idParam(c, "id"), idParam(c, "packageId"))
+	if err != nil {
+		associationError(c, err, "Failed to remove package from subscription")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Package removed from subscription successfully"})
+}
+
+// Issue a new playlist token, invalidating the old playlist URL
+func (s *Server) regeneratePlaylistToken(c *gin.Context) {
+	subscription, err := s.services.Subscriptions.Get(c.Request.Context(), idParam(c, "id"))
+	if err != nil {
+		writeError(c, http.StatusNotFound, codeNotFound, "Subscription not found")
+		return
+	}
+
+	subscription.PlaylistToken = newPlaylistToken()
+	if err := s.services.Subscriptions.Update(c.Request.Context(), subscription); err != nil {
+		internalError(c, err, "Failed to update subscription")
+		return
+	}
+	c.JSON(http.StatusOK, subscription)
+}
+
+// M3U playlist of the subscription's entitled channels, authenticated by its playlist token
+func (s *Server) getPlaylist(c *gin.Context) {
+	token, packages, ok := s.playlistEntitlements(c, ".m3u8", ".m3u")
+	if !ok {
+		return
+	}
+
+	c.Header("Content-Disposition", `inline; filename="playlist.m3u"`)
+	c.Data(http.StatusOK, "audio/x-mpegurl; charset=utf-8", []byte(renderM3U(packages, s.guideURL(c, token))))
+}
+
+// playlistEntitlements resolves the playlist token in the URL, minus any of the given
+// file extensions, to the packages of an active subscription. It answers with a plain
+// text error and returns false otherwise.
+func (s *Server) playlistEntitlements(c *gin.Context, extensions ...string) (string, []Package, bool) {
+	token := c.Param("token")
+	for _, ext := range extensions {
+		token = strings.TrimSuffix(token, ext)
+	}
+
+	subscription, err := s.services.Subscriptions.GetByPlaylistToken(c.Request.Context(), token)
+	if err != nil {
+		c.String(http.StatusNotFound, "Playlist not found\n")
+		return "", nil, false
+	}
+
+	switch subscription.Status(time.Now()) {
+	case statusNotStarted:
+		c.String(http.StatusForbidden, "Subscription has not started yet\n")
+		return "", nil, false
+	case statusExpired:
+		c.String(http.StatusForbidden, "Subscription has expired\n")
+		return "", nil, false
+	}
+
+	packages, err := s.services.Subscriptions.Entitlements(c.Request.Context(), subscription)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Failed to load playlist\n")
+		return "", nil, false
+	}
+	return token, availablePackages(packages, time.Now()), true
+}
+
+// guideURL is the absolute XMLTV URL players should pair with a playlist. It
+// is built from PUBLIC_URL when set, and from the request otherwise.
+func (s *Server) guideURL(c *gin.Context, token string) string {
+	base := strings.TrimSuffix(cfg.Server.PublicURL, "/")
+	if base == "" {
+		scheme := "http"
+		if c.Request.TLS != nil || (s.fromTrustedProxy(c) && c.GetHeader("X-Forwarded-Proto") == "https") {
+			scheme = "https"
+		}
+		base = scheme + "://" + c.Request.Host
+	}
+	return base + "/api/epg/" + token + ".xml"
+}
+
+// fromTrustedProxy reports whether the request's peer is one of TRUSTED_PROXIES
+func (s *Server) fromTrustedProxy(c *gin.Context) bool {
+	peer, err := netip.ParseAddr(c.RemoteIP())
+	if err != nil {
+		return false
+	}
+	peer = peer.Unmap()
+	for _, proxy := range s.limits.TrustedProxies {
+		if prefix, err := netip.ParsePrefix(proxy); err == nil {
+			if prefix.Contains(peer) {
+				return true
+			}
+		} else if addr, err := netip.ParseAddr(proxy); err == nil && addr.Unmap() == peer {
+			return true
+		}
+	}
+	return false
+}
+
+// Programme guide windows
+const (
+	guideGridSpan    = 6 * time.Hour  // default grid length
+	guideMaxSpan     = 48 * time.Hour // longest grid a client may request
+	guideExportPast  = 6 * time.Hour  // XMLTV exports start this long before now
+	guideExportAhead = 7 * 24 * time.Hour
+)
+
+// guideWindow reads the optional RFC 3339 from/to query parameters. A from without
+// a to keeps the default window length.
+func guideWindow(c *gin.Context, from, to time.Time) (time.Time, time.Time, error) {
+	var err error
+	if v := c.Query("from"); v != "" {
+		span := to.Sub(from)
+		if from, err = time.Parse(time.RFC3339, v); err != nil {
+			return from, to, errors.New("from must be an RFC 3339 time")
+		}
+		to = from.Add(span)
+	}
+	if v := c.Query("to"); v != "" {
+		if to, err = time.Parse(time.RFC3339, v); err != nil {
+			return from, to, errors.New("to must be an RFC 3339 time")
+		}
+	}
+	if !to.After(from) {
+		return from, to, errors.New("to must be after from")
+	}
+	return from, to, nil
+}
+
+// entitledChannels resolves the subscription key in the URL to the channels of an
+// active subscription. It answers with an error and returns false otherwise.
+func (s *Server) entitledChannels(c *gin.Context) ([]Channel, bool) {
+	if !s.allowKeyLookup(c, c.Param("key")) {
+		return nil, false
+	}
+	subscription, err := s.services.Subscriptions.GetByKey(c.Request.Context(), c.Param("key"))
+	if err != nil {
+		writeError(c, http.StatusNotFound, codeSubscriptionNotFound, "Subscription not found")
+		return nil, false
+	}
+
+	switch subscription.Status(time.Now()) {
+	case statusNotStarted:
+		writeError(c, http.StatusForbidden, codeSubscriptionNotStarted, "Subscription has not started yet")
+		return nil, false
+	case statusExpired:
+		writeError(c, http.StatusForbidden, codeSubscriptionExpired, "Subscription has expired")
+		return nil, false
+	}
+
+	packages, err := s.services.Subscriptions.Entitlements(c.Request.Context(), subscription)
+	if err != nil {
+		internalError(c, err, "Failed to load channels")
+		return nil, false
+	}
+	return uniqueChannels(availablePackages(packages, time.Now())), true
+}
+
+// programmesByChannel groups programmes, ordered by start time, per channel
+func programmesByChannel(programmes []Programme) map[uint][]Programme {
+	grouped := map[uint][]Programme{}
+	for _, p := range programmes {
+		grouped[p.ChannelID] = append(grouped[p.ChannelID], p)
+	}
+	return grouped
+}
+
+// What is on now and next on each of the subscription's channels
+func (s *Server) getNowNext(c *gin.Context) {
+	channels, ok := s.entitledChannels(c)
+	if !ok {
+		return
+	}
+
+	now := time.Now().UTC()
+	programmes, err := s.services.EPG.Programmes(c.Request.Context(), channelIDs(channels), now, now.Add(guideMaxSpan))
+	if err != nil {
+		internalError(c, err, "Failed to load programme guide")
+		return
+	}
+
+	grouped := programmesByChannel(programmes)
+	entries := []gin.H{}
+	for _, channel := range channels {
+		current, next := nowAndNext(grouped[channel.ID], now)
+		entries = append(entries, gin.H{
+			"channel_id":  channel.ID,
+			"external_id": channel.ExternalID,
+			"name":        channel.Name,
+			"now":         current,
+			"next":        next,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"time": now, "channels": entries})
+}
+
+// Programme grid of the subscription's channels for a time window
+func (s *Server) getGuideGrid(c *gin.Context) {
+	channels, ok := s.entitledChannels(c)
+	if !ok {
+		return
+	}
+
+	now := time.Now().UTC()
+	from, to, err := guideWindow(c, now, now.Add(guideGridSpan))
+	if err != nil {
+		writeError(c, http.StatusBadRequest, codeValidation, err.Error())
+		return
+	}
+	if to.Sub(from) > guideMaxSpan {
+		writeError(c, http.StatusBadRequest, codeValidation, "Guide window may not exceed "+guideMaxSpan.String())
+		return
+	}
+
+	programmes, err := s.services.EPG.Programmes(c.Request.Context(), channelIDs(channels), from, to)
+	if err != nil {
+		internalError(c, err, "Failed to load programme guide")
+		return
+	}
+
+	grouped := programmesByChannel(programmes)
+	entries := []gin.H{}
+	for _, channel := range channels {
+		entries = append(entries, gin.H{
+			"channel_id":  channel.ID,
+			"external_id": channel.ExternalID,
+			"name":        channel.Name,
+			"programmes":  append([]Programme{}, grouped[channel.ID]...),
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"from": from, "to": to, "channels": entries})
+}
+
+// XMLTV guide of the subscription's channels, authenticated by its playlist token
+func (s *Server) getGuideXMLTV(c *gin.Context) {
+	_, packages, ok := s.playlistEntitlements(c, ".xml")
+	if !ok {
+		return
+	}
+	s.writeXMLTV(c, uniqueChannels(packages))
+}
+
+func (s *Server) writeXMLTV(c *gin.Context, channels []Channel) {
+	now := time.Now().UTC()
+	from, to, err := guideWindow(c, now.Add(-guideExportPast), now.Add(guideExportAhead))
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error()+"\n")
+		return
+	}
+
+	programmes, err := s.services.EPG.Programmes(c.Request.Context(), channelIDs(channels), from, to)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Failed to load programme guide\n")
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := renderXMLTV(&buf, channels, programmes); err != nil {
+		c.String(http.StatusInternalServerError, "Failed to render programme guide\n")
+		return
+	}
+	c.Data(http.StatusOK, "application/xml; charset=utf-8", buf.Bytes())
+}
+
+// Import an uploaded XMLTV file
+func (s *Server) importEPG(c *gin.Context) {
+	guide, err := parseXMLTV(http.MaxBytesReader(c.Writer, c.Request.Body, cfg.EPG.MaxImportBytes))
+	if bodyTooLarge(c, err) {
+		return
+	}
+	if err != nil {
+		writeError(c, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+
+	report, err := s.services.EPG.Import(c.Request.Context(), guide)
+	if err != nil {
+		internalError(c, err, "Failed to import programme guide")
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// XMLTV guide of every channel
+func (s *Server) exportEPG(c *gin.Context) {
+	channels, err := s.services.Channels.List(c.Request.Context())
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Failed to load channels\n")
+		return
+	}
+	s.writeXMLTV(c, channels)
+}
+
+// Catalog bulk export as JSON or CSV
+func (s *Server) exportCatalog(c *gin.Context) {
+	format, err := catalogFormat(c.Query("format"), c.GetHeader("Accept"))
+	if err != nil {
+		writeError(c, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+
+	catalog, err := s.services.Catalog.Export(c.Request.Context())
+	if err != nil {
+		internalError(c, err, "Failed to export catalog")
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := writeCatalog(&buf, catalog, format); err != nil {
+		internalError(c, err, "Failed to export catalog")
+		return
+	}
+
+	contentType := "application/json"
+	if format == catalogCSV {
+		contentType = "text/csv"
+	}
+	c.Header("Content-Disposition", `attachment; filename="catalog.`+format+`"`)
+	c.Data(http.StatusOK, contentType, buf.Bytes())
+}
+
+// Catalog bulk import. Nothing is written on dry runs or when any row has an error.
+func (s *Server) importCatalog(c *gin.Context) {
+	format, err := catalogFormat(c.Query("format"), c.ContentType())
+	if err != nil {
+		writeError(c, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	dryRun, _ := strconv.ParseBool(c.Query("dry_run"))
+	if dryRun {
+		c.Set(auditSkipKey, true)
+	}
+
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, cfg.Catalog.MaxImportBytes)
+	catalog, err := readCatalog(body, format)
+	if bodyTooLarge(c, err) {
+		return
+	}
+	if err != nil {
+		writeError(c, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+
+	report, err := s.services.Catalog.Import(c.Request.Context(), catalog, dryRun)
+	if err != nil {
+		internalError(c, err, "Failed to import catalog")
+		return
+	}
+
+	status := http.StatusOK
+	if report.Errors > 0 {
+		status = http.StatusUnprocessableEntity
+	}
+	c.JSON(status, report)
+}
+
+// Audit log paging
+const (
+	auditPageSize    = 100
+	auditMaxPageSize = 1000
+)
+
+// getAuditEvents lists the audit log newest first, filtered by the admin, action,
+// entity_type, entity_id and RFC 3339 from/to query parameters
+func (s *Server) getAuditEvents(c *gin.Context) {
+	filter := AuditFilter{
+		Admin:      c.Query("admin"),
+		Action:     c.Query("action"),
+		EntityType: c.Query("entity_type"),
+		Limit:      auditPageSize,
+	}
+	var err error
+	if v := c.Query("entity_id"); v != "" {
+		id, err := strconv.ParseUint(v, 10, 0)
+		if err != nil {
+			fieldError(c, "entity_id", "entity_id must be a number")
+			return
+		}
+		filter.EntityID = uint(id)
+	}
+	if v := c.Query("from"); v != "" {
+		if filter.From, err = time.Parse(time.RFC3339, v); err != nil {
+			fieldError(c, "from", "from must be an RFC 3339 time")
+			return
+		}
+	}
+	if v := c.Query("to"); v != "" {
+		if filter.To, err = time.Parse(time.RFC3339, v); err != nil {
+			fieldError(c, "to", "to must be an RFC 3339 time")
+			return
+		}
+	}
+	if v := c.Query("limit"); v != "" {
+		if filter.Limit, err = strconv.Atoi(v); err != nil || filter.Limit < 1 || filter.Limit > auditMaxPageSize {
+			fieldError(c, "limit", "limit must be between 1 and "+strconv.Itoa(auditMaxPageSize))
+			return
+		}
+	}
+	if v := c.Query("offset"); v != "" {
+		if filter.Offset, err = strconv.Atoi(v); err != nil || filter.Offset < 0 {
+			fieldError(c, "offset", "offset must be a non-negative number")
+			return
+		}
+	}
+
+	events, err := s.services.Audit.List(c.Request.Context(), filter)
+	if err != nil {
+		internalError(c, err, "Failed to load audit log")
+		return
+	}
+	c.JSON(http.StatusOK, events)
+}
+
+// Decrypt endpoint for testing, only in debug builds
+func decryptData(c *gin.Context) {
+	var req struct {
+		Data string `json:"data"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		bindError(c, err)
+		return
+	}
+
+	decrypted, err := decrypt(req.Data, ENCRYPTION_KEY)
+	if err != nil {
+		writeError(c, http.StatusBadRequest, codeInvalidRequest, "Decryption failed")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"decrypted": decrypted})
+}
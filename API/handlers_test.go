@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// newMemoryServer returns a router backed by in-memory services
+func newMemoryServer(t *testing.T) (*gin.Engine, Services) {
+	t.Helper()
+	services := newMemoryServices()
+	if err := services.Admins.EnsureDefault(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return newServer(services).router(), services
+}
+
+func doRequest(r http.Handler, method, path, body, token string) *httptest.ResponseRecorder {
+	var req *http.Request
+	if body != "" {
+		req = httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+	} else {
+		req = httptest.NewRequest(method, path, nil)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func decodeJSON(t *testing.T, w *httptest.ResponseRecorder, v any) {
+	t.Helper()
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("decode %q: %v", w.Body.String(), err)
+	}
+}
+
+// decodeEncrypted unwraps a response from the encrypted public endpoints
+func decodeEncrypted(t *testing.T, w *httptest.ResponseRecorder, v any) {
+	t.Helper()
+	var envelope EncryptedResponse
+	decodeJSON(t, w, &envelope)
+	plaintext, err := openEnvelope(envelope, ENCRYPTION_KEY)
+	if err != nil {
+		t.Fatalf("decrypt response: %v", err)
+	}
+	if err := json.Unmarshal([]byte(plaintext), v); err != nil {
+		t.Fatalf("decode decrypted %q: %v", plaintext, err)
+	}
+}
+
+func adminToken(t *testing.T) string {
+	t.Helper()
+	token, err := generateJWT(defaultAdminUsername)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestLoginWithMemoryServices(t *testing.T) {
+	r, _ := newMemoryServer(t)
+
+	w := doRequest(r, http.MethodPost, "/api/login", `{"username":"admin","password":"wrong"}`, "")
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong password: status %d, want 401", w.Code)
+	}
+
+	w = doRequest(r, http.MethodPost, "/api/login", `{"username":"admin","password":"admin123"}`, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("login: status %d, body %s", w.Code, w.Body)
+	}
+	var resp struct {
+		Token string `json:"token"`
+	}
+	decodeJSON(t, w, &resp)
+	if token, err := validateJWT(resp.Token); err != nil || !token.Valid {
+		t.Fatalf("login returned invalid token: %v", err)
+	}
+}
+
+func TestPackageChannelHandlersWithMemoryServices(t *testing.T) {
+	r, services := newMemoryServer(t)
+	token := adminToken(t)
+	ctx := context.Background()
+
+	channel := Channel{Name: "News"}
+	pkg := Package{Name: "Basic"}
+	services.Channels.Create(ctx, &channel)
+	services.Packages.Create(ctx, &pkg)
+
+	w := doRequest(r, http.MethodPost, "/api/admin/packages/999/channels/1", "", token)
+	if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "Package not found") {
+		t.Fatalf("missing package: status %d, body %s", w.Code, w.Body)
+	}
+
+	w = doRequest(r, http.MethodPost, "/api/admin/packages/"+itoa(pkg.ID)+"/channels/999", "", token)
+	if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "Channel not found") {
+		t.Fatalf("missing channel: status %d, body %s", w.Code, w.Body)
+	}
+
+	w = doRequest(r, http.MethodPost, "/api/admin/packages/"+itoa(pkg.ID)+"/channels/"+itoa(channel.ID), "", token)
+	if w.Code != http.StatusOK {
+		t.Fatalf("add channel: status %d, body %s", w.Code, w.Body)
+	}
+
+	got, _ := services.Packages.Get(ctx, pkg.ID)
+	if len(got.Channels) != 1 || got.Channels[0].Name != "News" {
+		t.Fatalf("package channels = %+v", got.Channels)
+	}
+}
+
+func TestValidateSubscriptionWithMemoryServices(t *testing.T) {
+	r, services := newMemoryServer(t)
+	ctx := context.Background()
+
+	hoster := IPTVHoster{Name: "Acme TV"}
+	services.Hosters.Create(ctx, &hoster)
+	user := User{Name: "Viewer", IPTVHosterID: &hoster.ID}
+	services.Users.Create(ctx, &user)
+	services.Subscriptions.Create(ctx, &Subscription{
+		UserID:  user.ID,
+		Key:     "EXPIRED",
+		Started: time.Now().AddDate(0, -2, 0),
+		End:     time.Now().AddDate(0, -1, 0),
+	})
+
+	var resp struct {
+		Valid  bool   `json:"valid"`
+		Status string `json:"status"`
+		User   struct {
+			Name       string `json:"name"`
+			IPTVHoster struct {
+				Name string `json:"name"`
+			} `json:"iptv_hoster"`
+		} `json:"user"`
+	}
+	w := doRequest(r, http.MethodGet, "/api/public/validate/EXPIRED", "", "")
+	decodeEncrypted(t, w, &resp)
+	if resp.Valid || resp.Status != "expired" {
+		t.Fatalf("valid = %v, status = %q, want expired", resp.Valid, resp.Status)
+	}
+	if resp.User.Name != "Viewer" || resp.User.IPTVHoster.Name != "Acme TV" {
+		t.Fatalf("user info = %+v", resp.User)
+	}
+}
+
+func itoa(id uint) string {
+	return strconv.FormatUint(uint64(id), 10)
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Stream health
+//
+// A background worker periodically fetches every channel's MPD manifest and
+// its stream sources, and records whether they could be loaded and parsed as
+// DASH or HLS. The latest result per channel is shown to admins alongside the
+// channel; sources keep their own state, which orders them for failover.
+
+// Health check results
+const (
+	healthOK    = "ok"
+	healthError = "error"
+)
+
+// maxManifestSize bounds how much of a manifest is read; real MPDs are far smaller
+const maxManifestSize = 8 << 20
+
+// dashMPD is the part of a DASH manifest the health check looks at
+type dashMPD struct {
+	XMLName xml.Name `xml:"MPD"`
+	Type    string   `xml:"type,attr"`
+	Periods []struct {
+		AdaptationSets []struct {
+			Representations []struct {
+				ID string `xml:"id,attr"`
+			} `xml:"Representation"`
+		} `xml:"AdaptationSet"`
+	} `xml:"Period"`
+}
+
+// representations counts the representations across every period and adaptation set
+func (m *dashMPD) representations() int {
+	n := 0
+	for _, period := range m.Periods {
+		for _, set := range period.AdaptationSets {
+			n += len(set.Representations)
+		}
+	}
+	return n
+}
+
+// parseDASH reads a DASH manifest and returns its number of representations. A
+// manifest without any is an error since nothing could be played.
+func parseDASH(r io.Reader) (int, error) {
+	var mpd dashMPD
+	if err := xml.NewDecoder(r).Decode(&mpd); err != nil {
+		return 0, fmt.Errorf("invalid DASH manifest: %w", err)
+	}
+	n := mpd.representations()
+	if n == 0 {
+		return 0, errors.New("DASH manifest has no representations")
+	}
+	return n, nil
+}
+
+// parseHLS reads an HLS playlist and returns its number of variant streams, 1
+// for a media playlist with segments
+func parseHLS(r io.Reader) (int, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64<<10), maxManifestSize)
+	if !scanner.Scan() || strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "\ufeff")) != "#EXTM3U" {
+		return 0, errors.New("invalid HLS playlist: missing #EXTM3U header")
+	}
+	variants, segments := 0, 0
+	for scanner.Scan() {
+		switch line := scanner.Text(); {
+		case strings.HasPrefix(line, "#EXT-X-STREAM-INF"):
+			variants++
+		case strings.HasPrefix(line, "#EXTINF"):
+			segments++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, fmt.Errorf("invalid HLS playlist: %w", err)
+	}
+	switch {
+	case variants > 0:
+		return variants, nil
+	case segments > 0:
+		return 1, nil
+	default:
+		return 0, errors.New("HLS playlist has no variants or segments")
+	}
+}
+
+// checkStream fetches and parses one channel's stream URL as its declared type
+func checkStream(ctx context.Context, client *http.Client, channel Channel) ChannelHealth {
+	health := checkManifest(ctx, client, channel.MPD, channel.StreamType)
+	health.ChannelID = channel.ID
+	return health
+}
+
+// checkManifest fetches a DASH manifest or HLS playlist and parses it in the given
+// format, failing when the response is of another stream type. Progressive
+// streams are only checked for a response that is not a manifest.
+func checkManifest(ctx context.Context, client *http.Client, manifestURL, format string) ChannelHealth {
+	health := ChannelHealth{Status: healthError, CheckedAt: time.Now()}
+	fail := func(err error) ChannelHealth {
+		health.LastError = err.Error()
+		return health
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, manifestURL, nil)
+	if err != nil {
+		return fail(err)
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return fail(err)
+	}
+	defer resp.Body.Close()
+
+	health.StatusCode = resp.StatusCode
+	if resp.StatusCode != http.StatusOK {
+		health.LatencyMS = time.Since(start).Milliseconds()
+		return fail(fmt.Errorf("manifest request returned %s", resp.Status))
+	}
+	body := bufio.NewReader(io.LimitReader(resp.Body, maxManifestSize))
+	head, _ := body.Peek(512)
+	if detected := detectFormat(resp.Header.Get("Content-Type"), head); detected != "" && detected != format {
+		health.LatencyMS = time.Since(start).Milliseconds()
+		return fail(fmt.Errorf("stream is %s but declared as %s", detected, format))
+	}
+
+	n := 1
+	switch format {
+	case formatDASH:
+		n, err = parseDASH(body)
+	case formatHLS:
+		n, err = parseHLS(body)
+	}
+	health.LatencyMS = time.Since(start).Milliseconds()
+	if err != nil {
+		return fail(err)
+	}
+
+	health.Status = healthOK
+	health.Representations = n
+	checked := health.CheckedAt
+	health.LastOKAt = &checked
+	return health
+}
+
+// healthResult is a finished check of a channel's MPD URL or of one of its sources
+type healthResult struct {
+	sourceID uint // 0 for the channel's MPD URL
+	health   ChannelHealth
+}
+
+// checkChannels checks every channel with a manifest URL and every stream
+// source, at most concurrency at a time, and records the results. It returns
+// the number of failing manifests.
+func checkChannels(ctx context.Context, services Services, client *http.Client, concurrency int) (int, error) {
+	channels, err := services.Channels.List(ctx)
+	if err != nil {
+		return 0, err
+	}
+	sources, err := services.Sources.List(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	results := make(chan healthResult)
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	check := func(sourceID uint, run func() ChannelHealth) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			results <- healthResult{sourceID, run()}
+		}()
+	}
+	for _, channel := range channels {
+		if channel.MPD != "" {
+			check(0, func() ChannelHealth { return checkStream(ctx, client, channel) })
+		}
+	}
+	for _, source := range sources {
+		check(source.ID, func() ChannelHealth { return checkManifest(ctx, client, source.URL, source.Format) })
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	failing := 0
+	var recordErr error
+	for result := range results {
+		if result.health.Status != healthOK {
+			failing++
+		}
+		if result.sourceID != 0 {
+			err = services.Sources.RecordCheck(ctx, result.sourceID, result.health)
+		} else {
+			err = services.Health.Record(ctx, &result.health)
+		}
+		if err != nil && recordErr == nil {
+			recordErr = err
+		}
+	}
+	return failing, recordErr
+}
+
+// runHealthChecks checks every channel's stream immediately and then on every
+// interval until ctx is cancelled
+func runHealthChecks(ctx context.Context, services Services, c HealthConfig) {
+	client := &http.Client{Timeout: c.Timeout}
+	ticker := time.NewTicker(c.Interval)
+	defer ticker.Stop()
+
+	for {
+		failing, err := checkChannels(ctx, services, client, c.Concurrency)
+		if err != nil {
+			slog.ErrorContext(ctx, "stream health check failed", "error", err)
+		} else if failing > 0 {
+			slog.WarnContext(ctx, "stream manifests failing", "failing", failing)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// withHealth attaches the latest health check result to each channel
+func withHealth(channels []Channel, results []ChannelHealth) {
+	byChannel := map[uint]ChannelHealth{}
+	for _, h := range results {
+		byChannel[h.ChannelID] = h
+	}
+	for i := range channels {
+		if h, ok := byChannel[channels[i].ID]; ok {
+			channels[i].Health = &h
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testMPD = `<?xml version="1.0"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" type="dynamic">
+  <Period id="1">
+    <AdaptationSet mimeType="video/mp4">
+      <Representation id="720p" bandwidth="3000000"/>
+      <Representation id="1080p" bandwidth="6000000"/>
+    </AdaptationSet>
+    <AdaptationSet mimeType="audio/mp4">
+      <Representation id="audio" bandwidth="128000"/>
+    </AdaptationSet>
+  </Period>
+</MPD>`
+
+// fakeCDN serves a valid manifest, an empty one, something that is not DASH, an
+// HLS master playlist and a 404
+func fakeCDN(t *testing.T) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/good.mpd", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(testMPD)) })
+	mux.HandleFunc("/empty.mpd", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(`<MPD><Period/></MPD>`)) })
+	mux.HandleFunc("/html.mpd", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(`<html><body>oops</body></html>`)) })
+	mux.HandleFunc("/live.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=3000000\n720p.m3u8\n#EXT-X-STREAM-INF:BANDWIDTH=6000000\n1080p.m3u8\n"))
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestStreamHealthChecks(t *testing.T) {
+	cdn := fakeCDN(t)
+	ctx := context.Background()
+
+	for name, newRouter := range map[string]func(t *testing.T) (http.Handler, Services){
+		"gorm": func(t *testing.T) (http.Handler, Services) {
+			conn := openTestDB(t)
+			services := newGormServices(conn)
+			return newServer(services).router(), services
+		},
+		"memory": func(t *testing.T) (http.Handler, Services) { return newMemoryServer(t) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			r, services := newRouter(t)
+			for _, c := range []*Channel{
+				{ExternalID: "good", Name: "Good", MPD: cdn.URL + "/good.mpd"},
+				{ExternalID: "empty", Name: "Empty", MPD: cdn.URL + "/empty.mpd"},
+				{ExternalID: "html", Name: "HTML", MPD: cdn.URL + "/html.mpd"},
+				{ExternalID: "gone", Name: "Gone", MPD: cdn.URL + "/gone.mpd"},
+				{ExternalID: "none", Name: "No stream"},
+			} {
+				services.Channels.Create(ctx, c)
+			}
+
+			failing, err := checkChannels(ctx, services, cdn.Client(), 2)
+			if err != nil || failing != 3 {
+				t.Fatalf("checkChannels = %d failing, %v; want 3", failing, err)
+			}
+
+			// A failed check keeps the time of the last successful one
+			channels, _ := services.Channels.List(ctx)
+			channels[0].MPD = cdn.URL + "/gone.mpd"
+			services.Channels.Update(ctx, &channels[0])
+			if _, err := checkChannels(ctx, services, cdn.Client(), 2); err != nil {
+				t.Fatal(err)
+			}
+
+			w := doRequest(r, http.MethodGet, "/api/admin/channels", "", adminToken(t))
+			decodeJSON(t, w, &channels)
+			health := map[string]*ChannelHealth{}
+			for _, c := range channels {
+				health[c.ExternalID] = c.Health
+			}
+
+			if h := health["good"]; h == nil || h.Status != healthError || h.StatusCode != http.StatusNotFound || h.LastOKAt == nil {
+				t.Errorf("good after it broke = %+v", h)
+			}
+			if h := health["empty"]; h == nil || h.Status != healthError || !strings.Contains(h.LastError, "no representations") {
+				t.Errorf("empty = %+v", h)
+			}
+			if h := health["html"]; h == nil || h.Status != healthError || !strings.Contains(h.LastError, "invalid DASH manifest") {
+				t.Errorf("html = %+v", h)
+			}
+			if h := health["gone"]; h == nil || h.StatusCode != http.StatusNotFound || h.LastOKAt != nil {
+				t.Errorf("gone = %+v", h)
+			}
+			if h := health["none"]; h != nil {
+				t.Errorf("channel without a manifest was checked: %+v", h)
+			}
+		})
+	}
+}
+
+func TestParseDASH(t *testing.T) {
+	n, err := parseDASH(strings.NewReader(testMPD))
+	if err != nil || n != 3 {
+		t.Fatalf("parseDASH = %d, %v; want 3 representations", n, err)
+	}
+	if _, err := parseDASH(strings.NewReader("#EXTM3U\n")); err == nil {
+		t.Fatal("expected an error for an HLS playlist")
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Health, readiness and shutdown
+//
+// GET /healthz answers 200 while the process is serving at all; orchestrators
+// restart it when it does not. GET /readyz answers 200 only while the database
+// can be reached and has every migration this binary knows of, and 503 with
+// the failing checks otherwise, so that traffic is held back rather than
+// failed. On SIGTERM or SIGINT /readyz starts failing, new connections stop
+// being accepted after SERVER_SHUTDOWN_DELAY, requests in flight get up to
+// SERVER_SHUTDOWN_TIMEOUT to finish, and the background workers are stopped
+// before the database is closed.
+
+// readinessTimeout bounds the database checks of /readyz
+const readinessTimeout = 2 * time.Second
+
+// Readiness is the body of /readyz
+type Readiness struct {
+	Status string            `json:"status"` // ready, not_ready or draining
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// healthz reports that the process is alive
+func healthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// readyz reports whether the server should be sent traffic
+func (s *Server) readyz(c *gin.Context) {
+	if s.draining.Load() {
+		c.JSON(http.StatusServiceUnavailable, Readiness{Status: "draining"})
+		return
+	}
+	if s.db == nil {
+		c.JSON(http.StatusOK, Readiness{Status: "ready"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), readinessTimeout)
+	defer cancel()
+	checks := map[string]string{"database": "ok", "migrations": "ok"}
+	ready := true
+	sqlDB, err := s.db.DB()
+	if err == nil {
+		err = sqlDB.PingContext(ctx)
+	}
+	if err != nil {
+		c.Error(err)
+		checks["database"], checks["migrations"] = "unreachable", "unknown"
+		ready = false
+	} else if pending, err := pendingMigrations(ctx, s.db); err != nil {
+		c.Error(err)
+		checks["migrations"] = "unknown"
+		if errors.Is(err, errSchemaAhead) {
+			checks["migrations"] = "ahead of this binary"
+		}
+		ready = false
+	} else if pending > 0 {
+		checks["migrations"] = strconv.Itoa(pending) + " pending"
+		ready = false
+	}
+
+	if !ready {
+		c.JSON(http.StatusServiceUnavailable, Readiness{Status: "not_ready", Checks: checks})
+		return
+	}
+	c.JSON(http.StatusOK, Readiness{Status: "ready", Checks: checks})
+}
+
+// newHTTPServer serves handler with the configured timeouts
+func newHTTPServer(handler http.Handler, c ServerConfig) *http.Server {
+	return &http.Server{
+		Addr:              c.Addr,
+		Handler:           handler,
+		ReadHeaderTimeout: c.ReadHeaderTimeout,
+		ReadTimeout:       c.ReadTimeout,
+		WriteTimeout:      c.WriteTimeout,
+		IdleTimeout:       c.IdleTimeout,
+		ErrorLog:          slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+	}
+}
+
+// serve runs srv on ln until ctx is done, then drains it: /readyz fails for
+// the shutdown delay, after which the listener is closed and requests in
+// flight get until the shutdown timeout to finish
+func (s *Server) serve(ctx context.Context, srv *http.Server, ln net.Listener, c ServerConfig) error {
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(ln) }()
+
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("shutting down", "delay", c.ShutdownDelay, "timeout", c.ShutdownTimeout)
+	s.draining.Store(true)
+	time.Sleep(c.ShutdownDelay)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), c.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		srv.Close()
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestProbes(t *testing.T) {
+	conn := openTestDB(t)
+	s := newServer(newGormServices(conn))
+	s.db = conn
+	r := s.router()
+
+	if w := doRequest(r, http.MethodGet, "/healthz", "", ""); w.Code != http.StatusOK {
+		t.Fatalf("healthz: status %d", w.Code)
+	}
+	var readiness Readiness
+	if w := doRequest(r, http.MethodGet, "/readyz", "", ""); w.Code != http.StatusOK {
+		t.Fatalf("readyz: status %d: %s", w.Code, w.Body)
+	}
+
+	// A missing migration holds traffic back
+	latest := latestSchemaVersion()
+	if err := conn.Delete(&SchemaMigration{}, latest).Error; err != nil {
+		t.Fatal(err)
+	}
+	w := doRequest(r, http.MethodGet, "/readyz", "", "")
+	decodeJSON(t, w, &readiness)
+	if w.Code != http.StatusServiceUnavailable || readiness.Status != "not_ready" ||
+		readiness.Checks["database"] != "ok" || readiness.Checks["migrations"] != "1 pending" {
+		t.Fatalf("readyz with a pending migration: status %d, %+v", w.Code, readiness)
+	}
+	conn.Create(&SchemaMigration{Version: latest, Name: "restored", AppliedAt: time.Now()})
+
+	// Once the database is gone
+	closed, err := openDatabase(DatabaseConfig{Driver: "sqlite", DSN: filepath.Join(t.TempDir(), "closed.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, _ := closed.DB()
+	sqlDB.Close()
+	s.db = closed
+	w = doRequest(r, http.MethodGet, "/readyz", "", "")
+	decodeJSON(t, w, &readiness)
+	if w.Code != http.StatusServiceUnavailable || readiness.Checks["database"] != "unreachable" {
+		t.Fatalf("readyz without a database: status %d, %+v", w.Code, readiness)
+	}
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	s := newServer(newMemoryServices())
+	release := make(chan struct{})
+	r := s.router()
+	r.GET("/slow", func(c *gin.Context) {
+		<-release
+		c.String(http.StatusOK, "done")
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := ServerConfig{ShutdownDelay: 500 * time.Millisecond, ShutdownTimeout: 5 * time.Second}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() { stopped <- s.serve(ctx, newHTTPServer(r, config), ln, config) }()
+
+	base := "http://" + ln.Addr().String()
+	responses := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.Get(base + "/slow")
+		if err != nil {
+			t.Error(err)
+		}
+		responses <- resp
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	// Draining fails readiness while requests in flight are answered
+	time.Sleep(10 * time.Millisecond)
+	if resp, err := http.Get(base + "/readyz"); err != nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("readyz while draining: %v, %v", resp, err)
+	}
+	close(release)
+	if resp := <-responses; resp == nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("request in flight: %v", resp)
+	}
+	if err := <-stopped; err != nil {
+		t.Fatalf("serve: %v", err)
+	}
+	if _, err := http.Get(base + "/healthz"); err == nil {
+		t.Fatal("still serving after shutdown")
+	}
+}
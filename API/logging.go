@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
+)
+
+// Logging
+//
+// The service logs through log/slog, as JSON lines by default. Every request
+// gets an ID, taken from its X-Request-ID header when it sends a reasonable one
+// and made up otherwise, which is echoed in the response header, in problem
+// bodies and on every line logged while handling it, including database
+// queries. Each request is logged once when it completes, with the errors
+// attached to it, such as the database error behind a 500. Attributes named
+// like secrets (passwords, tokens, keys, Authorization headers) are redacted,
+// as are values that look like bearer tokens or API keys, subscription keys
+// and playlist tokens in paths, and sensitive query parameters. Queries are
+// logged at debug level, without their parameters; slow queries are warnings
+// and failed ones errors.
+
+// sensitiveNames are attribute, header and query parameter names whose values are never logged
+var sensitiveNames = map[string]bool{
+	"authorization": true, "cookie": true, "set-cookie": true, "x-api-key": true,
+	"password": true, "token": true, "challenge": true, "secret": true, "totp_secret": true,
+	"code": true, "recovery_code": true, "key": true, "keys": true, "playlist_token": true,
+}
+
+// sensitiveParams are path parameters holding credentials
+var sensitiveParams = map[string]bool{"key": true, "token": true}
+
+// newLogger builds the service's logger, writing to w
+func newLogger(c LogConfig, w io.Writer) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: c.Level, ReplaceAttr: redactAttr}
+	var handler slog.Handler = slog.NewJSONHandler(w, opts)
+	if c.Format == "text" {
+		handler = slog.NewTextHandler(w, opts)
+	}
+	return slog.New(requestIDHandler{handler})
+}
+
+// redactAttr hides the values of sensitive attributes
+func redactAttr(_ []string, a slog.Attr) slog.Attr {
+	if sensitiveNames[strings.ToLower(a.Key)] {
+		return slog.String(a.Key, redacted)
+	}
+	if a.Value.Kind() == slog.KindString {
+		v := a.Value.String()
+		if strings.HasPrefix(v, "Bearer ") || strings.HasPrefix(v, apiKeyMarker) {
+			return slog.String(a.Key, redacted)
+		}
+	}
+	return a
+}
+
+type requestIDContextKey struct{}
+
+// requestIDHandler adds the ID of the request being handled to records logged with its context
+type requestIDHandler struct{ slog.Handler }
+
+func (h requestIDHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id, ok := ctx.Value(requestIDContextKey{}).(string); ok {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h requestIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIDHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIDHandler) WithGroup(name string) slog.Handler {
+	return requestIDHandler{h.Handler.WithGroup(name)}
+}
+
+// requestIDKey holds the ID of the request, also sent as X-Request-ID
+const requestIDKey = "request_id"
+
+// requestID takes the caller's X-Request-ID when it is reasonable and makes one up
+// otherwise, adding it to the request's context for the log
+func requestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader("X-Request-ID")
+		if len(id) == 0 || len(id) > 128 || strings.ContainsFunc(id, func(r rune) bool { return r <= ' ' || r > '~' }) {
+			b := make([]byte, 16)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+		c.Set(requestIDKey, id)
+		c.Header("X-Request-ID", id)
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), requestIDContextKey{}, id))
+		c.Next()
+	}
+}
+
+// requestLogger logs every request once it has been handled
+func requestLogger() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		status := c.Writer.Status()
+		level := slog.LevelInfo
+		switch {
+		case status >= 500:
+			level = slog.LevelError
+		case status >= 400:
+			level = slog.LevelWarn
+		}
+		attrs := []slog.Attr{
+			slog.String("method", c.Request.Method),
+			slog.String("path", redactedPath(c)),
+			slog.String("route", c.FullPath()),
+			slog.Int("status", status),
+			slog.Duration("duration", time.Since(start)),
+			slog.Int("bytes", max(c.Writer.Size(), 0)),
+			slog.String("client_ip", c.ClientIP()),
+			slog.String("user_agent", c.Request.UserAgent()),
+		}
+		if q := redactedQuery(c.Request.URL.Query()); q != "" {
+			attrs = append(attrs, slog.String("query", q))
+		}
+		if admin := c.GetString("username"); admin != "" {
+			attrs = append(attrs, slog.String("admin", admin))
+		}
+		if prefix := c.GetString(apiKeyContextKey); prefix != "" {
+			attrs = append(attrs, slog.String("api_key", prefix))
+		}
+		if len(c.Errors) > 0 {
+			attrs = append(attrs, slog.Any("errors", c.Errors.Errors()))
+		}
+		slog.LogAttrs(c.Request.Context(), level, "request", attrs...)
+	}
+}
+
+// redactedPath is the request path with credentials in path parameters hidden
+func redactedPath(c *gin.Context) string {
+	path := c.Request.URL.Path
+	for _, p := range c.Params {
+		if sensitiveParams[p.Key] && p.Value != "" {
+			path = strings.Replace(path, "/"+p.Value, "/"+redacted, 1)
+		}
+	}
+	return path
+}
+
+// redactedQuery is the query string with the values of sensitive parameters hidden
+func redactedQuery(q url.Values) string {
+	for name := range q {
+		if sensitiveNames[strings.ToLower(name)] {
+			q[name] = []string{redacted}
+		}
+	}
+	return q.Encode()
+}
+
+// recovered answers a handler panic with a problem and logs it with its stack
+func recovered(c *gin.Context, err any) {
+	slog.ErrorContext(c.Request.Context(), "panic", "error", fmt.Sprint(err), "stack", string(debug.Stack()))
+	writeError(c, http.StatusInternalServerError, codeInternal, "Internal server error")
+	c.Abort()
+}
+
+// gormLogger routes GORM's logging through slog. Query parameters are never
+// logged since they include secrets, hashes and subscription keys.
+type gormLogger struct {
+	slowQuery time.Duration // queries taking longer are warnings, 0 disables
+}
+
+func (l gormLogger) LogMode(gormlogger.LogLevel) gormlogger.Interface { return l }
+
+func (l gormLogger) Info(ctx context.Context, msg string, data ...any) {
+	slog.InfoContext(ctx, fmt.Sprintf(msg, data...))
+}
+
+func (l gormLogger) Warn(ctx context.Context, msg string, data ...any) {
+	slog.WarnContext(ctx, fmt.Sprintf(msg, data...))
+}
+
+func (l gormLogger) Error(ctx context.Context, msg string, data ...any) {
+	slog.ErrorContext(ctx, fmt.Sprintf(msg, data...))
+}
+
+func (l gormLogger) Trace(ctx context.Context, begin time.Time, fc func() (string, int64), err error) {
+	elapsed := time.Since(begin)
+	outcome := "ok"
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		outcome = "error"
+	}
+	metrics.queries.WithLabelValues(outcome).Observe(elapsed.Seconds())
+	switch {
+	case err != nil && !errors.Is(err, gorm.ErrRecordNotFound):
+		sql, rows := fc()
+		slog.ErrorContext(ctx, "query failed", "error", err.Error(), "sql", sql, "rows", rows, "duration", elapsed)
+	case l.slowQuery > 0 && elapsed > l.slowQuery:
+		sql, rows := fc()
+		slog.WarnContext(ctx, "slow query", "sql", sql, "rows", rows, "duration", elapsed)
+	case slog.Default().Enabled(ctx, slog.LevelDebug):
+		sql, rows := fc()
+		slog.DebugContext(ctx, "query", "sql", sql, "rows", rows, "duration", elapsed)
+	}
+}
+
+// ParamsFilter leaves the placeholders of logged queries unfilled
+func (l gormLogger) ParamsFilter(_ context.Context, sql string, _ ...any) (string, []any) {
+	return sql, nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// captureLogs sends the default logger's JSON lines to a buffer for the rest of the test
+func captureLogs(t *testing.T, level slog.Level) *bytes.Buffer {
+	var buf bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(newLogger(LogConfig{Level: level}, &buf))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return &buf
+}
+
+func logLines(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	t.Helper()
+	var lines []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var record map[string]any
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("log line %q: %v", line, err)
+		}
+		lines = append(lines, record)
+	}
+	return lines
+}
+
+func TestLogRedaction(t *testing.T) {
+	buf := captureLogs(t, slog.LevelInfo)
+	slog.Info("login", "password", "hunter2", "Authorization", "Bearer abc", "header", "Bearer abc",
+		"forwarded", apiKeyMarker+"abc_def", "admin", "admin")
+	record := logLines(t, buf)[0]
+	for _, name := range []string{"password", "Authorization", "header", "forwarded"} {
+		if record[name] != redacted {
+			t.Errorf("%s = %v", name, record[name])
+		}
+	}
+	if record["admin"] != "admin" {
+		t.Fatalf("admin = %v", record["admin"])
+	}
+	if q := redactedQuery(map[string][]string{"token": {"t0k3n"}, "limit": {"5"}}); q != "limit=5&token=%5Bredacted%5D" {
+		t.Fatalf("query = %s", q)
+	}
+}
+
+func TestRequestLogging(t *testing.T) {
+	r, conn := newTestServer(t)
+	conn.Logger = gormLogger{}
+	buf := captureLogs(t, slog.LevelDebug)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/public/validate/SECRETKEY", nil)
+	req.Header.Set("X-Request-ID", "trace-42")
+	if w := serve(r, req); w.Header().Get("X-Request-ID") != "trace-42" {
+		t.Fatalf("X-Request-ID = %q", w.Header().Get("X-Request-ID"))
+	}
+	if strings.Contains(buf.String(), "SECRETKEY") {
+		t.Fatalf("subscription key logged: %s", buf)
+	}
+
+	var queries, requests int
+	for _, record := range logLines(t, buf) {
+		if record["request_id"] != "trace-42" {
+			t.Fatalf("record without the request ID: %v", record)
+		}
+		switch record["msg"] {
+		case "query":
+			queries++
+		case "request":
+			requests++
+			if record["path"] != "/api/public/validate/"+redacted || record["route"] != "/api/public/validate/:key" ||
+				record["status"] != float64(http.StatusNotFound) || record["level"] != "WARN" {
+				t.Fatalf("request record %v", record)
+			}
+		}
+	}
+	if queries == 0 || requests != 1 {
+		t.Fatalf("%d queries and %d requests logged", queries, requests)
+	}
+
+	// Failed queries are errors
+	buf.Reset()
+	gormLogger{}.Trace(context.Background(), time.Now(), func() (string, int64) { return "SELECT ?", 0 }, errors.New("disk I/O error"))
+	if record := logLines(t, buf)[0]; record["level"] != "ERROR" || record["error"] != "disk I/O error" {
+		t.Fatalf("query error record %v", record)
+	}
+}
@@ -1,21 +1,24 @@
 package main
 
 import (
-	"bytes"
-	"crypto/aes"
-	"crypto/cipher"
+	"context"
 	"crypto/rand"
 	"encoding/base64"
+	"errors"
 	"io"
+	"log/slog"
+	"net"
 	"net/http"
-	"strconv"
+	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
-	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
 
@@ -24,111 +27,43 @@ const (
 	ENCRYPTION_KEY   = "EvMimti9L6yB7As37tH2VdjzLoBxYHts" // Must be 32 characters
 	JWT_SECRET       = "12d0db4611a7405dde7c901713fa2ba1"
 	JWT_EXPIRE_HOURS = 24
-)
-
-// Database models
-type IPTVHoster struct {
-	ID           uint      `json:"id" gorm:"primaryKey"`
-	Name         string    `json:"name" gorm:"unique;not null"`
-	Logo         string    `json:"logo"`
-	ColorPalette string    `json:"color_palette"`
-	CreatedAt    time.Time `json:"created_at"`
-}
-
-type User struct {
-	ID            uint           `json:"id" gorm:"primaryKey"`
-	Name          string         `json:"name" gorm:"not null"`
-	Avatar        string         `json:"avatar"`
-	TeleUsername  string         `json:"tele_username"`
-	Reference     string         `json:"reference"`
-	IsAdmin       bool           `json:"is_admin" gorm:"default:false"`
-	IsHoster      bool           `json:"is_hoster" gorm:"default:false"`
-	IPTVHosterID  *uint          `json:"iptv_hoster_id"`
-	IPTVHoster    *IPTVHoster    `json:"iptv_hoster,omitempty" gorm:"foreignKey:IPTVHosterID"`
-	Subscriptions []Subscription `json:"subscriptions,omitempty"`
-	CreatedAt     time.Time      `json:"created_at"`
-}
-
-type Admin struct {
-	ID        uint      `json:"id" gorm:"primaryKey"`
-	Username  string    `json:"username" gorm:"unique;not null"`
-	Password  string    `json:"-" gorm:"not null"` // Hidden from JSON
-	CreatedAt time.Time `json:"created_at"`
-}
-
-type Subscription struct {
-	ID        uint      `json:"id" gorm:"primaryKey"`
-	UserID    uint      `json:"user_id"`
-	User      User      `json:"user,omitempty" gorm:"foreignKey:UserID"`
-	Started   time.Time `json:"started"`
-	End       time.Time `json:"end"`
-	Payed     float64   `json:"payed"`
-	Key       string    `json:"key"`
-	CreatedAt time.Time `json:"created_at"`
-}
 
-type Package struct {
-	ID        uint      `json:"id" gorm:"primaryKey"`
-	Name      string    `json:"name" gorm:"unique;not null"`
-	Logo      string    `json:"logo"`
-	Channels  []Channel `json:"channels,omitempty" gorm:"many2many:package_channels;"`
-	CreatedAt time.Time `json:"created_at"`
-}
-
-type Channel struct {
-	ID            uint      `json:"id" gorm:"primaryKey"`
-	Name          string    `json:"name" gorm:"not null"`
-	Logo          string    `json:"logo"`
-	MPD           string    `json:"mpd"`
-	Key           string    `json:"key"`
-	LastRefreshed time.Time `json:"last_refreshed"`
-	ExpiresEvery  int64     `json:"expires_every"`
-	Packages      []Package `json:"packages,omitempty" gorm:"many2many:package_channels;"`
-	CreatedAt     time.Time `json:"created_at"`
-}
+	defaultAdminUsername = "admin"
+	defaultAdminPassword = "admin123"
+)
 
-type LoginRequest struct {
-	Username string `json:"username" binding:"required"`
-	Password string `json:"password" binding:"required"`
-}
+var db *gorm.DB
 
-type EncryptedResponse struct {
-	Data string `json:"data"`
+// Open the database connection and load the master keys for the secrets stored in it
+func openDB() error {
+	var err error
+	if secrets, err = newSecretBox(cfg.Secrets); err != nil {
+		return err
+	}
+	db, err = openDatabase(cfg.Database)
+	return err
 }
 
-var db *gorm.DB
-
 // Initialize database
 func initDB() {
-	var err error
-	db, err = gorm.Open(sqlite.Open("iptv.db"), &gorm.Config{})
-	if err != nil {
-		panic("Failed to connect to database")
+	if err := openDB(); err != nil {
+		panic(err)
 	}
 
-	// Auto migrate tables
-	db.AutoMigrate(&IPTVHoster{}, &User{}, &Subscription{}, &Package{}, &Channel{}, &Admin{})
+	// Apply pending schema migrations, refusing to start if the schema is newer than this binary
+	if _, err := migrateUp(db, 0); err != nil {
+		panic(err)
+	}
 
 	// Create default admin if not exists
-	var admin Admin
-	if db.Where("username = ?", "admin").First(&admin).Error != nil {
-		defaultAdmin := Admin{
-			Username:  "admin",
-			Password:  "admin123", // In production, hash this password
-			CreatedAt: time.Now(),
-		}
-		db.Create(&defaultAdmin)
+	if err := newGormServices(db).Admins.EnsureDefault(context.Background()); err != nil {
+		panic(err)
 	}
 }
 
 // Encryption functions
 func encrypt(plaintext, key string) (string, error) {
-	block, err := aes.NewCipher([]byte(key))
-	if err != nil {
-		return "", err
-	}
-
-	gcm, err := cipher.NewGCM(block)
+	gcm, err := newGCM(key)
 	if err != nil {
 		return "", err
 	}
@@ -148,17 +83,15 @@ func decrypt(ciphertext, key string) (string, error) {
 		return "", err
 	}
 
-	block, err := aes.NewCipher([]byte(key))
-	if err != nil {
-		return "", err
-	}
-
-	gcm, err := cipher.NewGCM(block)
+	gcm, err := newGCM(key)
 	if err != nil {
 		return "", err
 	}
 
 	nonceSize := gcm.NonceSize()
+	if len(data) < nonceSize+gcm.Overhead() {
+		return "", errors.New("ciphertext too short")
+	}
 	nonce, cipherData := data[:nonceSize], data[nonceSize:]
 
 	plaintext, err := gcm.Open(nil, nonce, cipherData, nil)
@@ -180,78 +113,68 @@ func generateJWT(username string) (string, error) {
 	return token.SignedString([]byte(JWT_SECRET))
 }
 
-func validateJWT(tokenString string) (*jwt.Token, error) {
-	return jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		return []byte(JWT_SECRET), nil
-	})
-}
-
-// Middleware for encrypted responses
-func encryptResponse() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		// Create a buffer to capture the response
-		writer := &responseWriter{
-			ResponseWriter: c.Writer,
-			body:          bytes.NewBuffer([]byte{}),
-		}
-		c.Writer = writer
+// challengeExpiry is how long a correct password waits for the second factor
+const challengeExpiry = 5 * time.Minute
 
-		c.Next()
+// generateChallengeJWT returns the token that stands for a correct password
+// while the second factor is pending. jwtAuth does not accept it.
+func generateChallengeJWT(username string) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"username": username,
+		"purpose":  "2fa",
+		"exp":      time.Now().Add(challengeExpiry).Unix(),
+		"iat":      time.Now().Unix(),
+	})
 
-		// Check if we have content to encrypt
-		if writer.body.Len() > 0 {
-			encrypted, err := encrypt(writer.body.String(), ENCRYPTION_KEY)
-			if err != nil {
-				// Restore original writer and send error
-				c.Writer = writer.ResponseWriter
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Encryption failed: " + err.Error()})
-				return
-			}
-			
-			// Restore original writer and send encrypted response
-			c.Writer = writer.ResponseWriter
-			c.Header("Content-Type", "application/json")
-			c.JSON(http.StatusOK, EncryptedResponse{Data: encrypted})
-		} else {
-			// If no content, restore writer and let the original response through
-			c.Writer = writer.ResponseWriter
-		}
-	}
+	return token.SignedString([]byte(JWT_SECRET))
 }
 
-// Custom response writer to capture response body
-type responseWriter struct {
-	gin.ResponseWriter
-	body *bytes.Buffer
+// validateChallengeJWT returns the username of a challenge token
+func validateChallengeJWT(tokenString string) (string, error) {
+	token, err := validateJWT(tokenString)
+	if err != nil {
+		return "", err
+	}
+	claims, _ := token.Claims.(jwt.MapClaims)
+	username, _ := claims["username"].(string)
+	if claims["purpose"] != "2fa" || username == "" {
+		return "", errors.New("not a challenge token")
+	}
+	return username, nil
 }
 
-func (w *responseWriter) Write(b []byte) (int, error) {
-	// Only capture the body, don't write to original response yet
-	return w.body.Write(b)
+func validateJWT(tokenString string) (*jwt.Token, error) {
+	return jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		return []byte(JWT_SECRET), nil
+	})
 }
 
-// JWT Authentication middleware
-func jwtAuth() gin.HandlerFunc {
+// JWT Authentication middleware, also accepting API keys
+func (s *Server) jwtAuth() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization header required"})
+			writeError(c, http.StatusUnauthorized, codeUnauthorized, "Authorization header required")
 			c.Abort()
 			return
 		}
 
 		tokenString := strings.Replace(authHeader, "Bearer ", "", 1)
+		if strings.HasPrefix(tokenString, apiKeyMarker) {
+			s.apiKeyAuth(c, tokenString)
+			return
+		}
 		token, err := validateJWT(tokenString)
 
 		if err != nil || !token.Valid {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired token"})
+			writeError(c, http.StatusUnauthorized, codeInvalidToken, "Invalid or expired token")
 			c.Abort()
 			return
 		}
 
 		claims, ok := token.Claims.(jwt.MapClaims)
-		if !ok {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token claims"})
+		if !ok || claims["purpose"] != nil {
+			writeError(c, http.StatusUnauthorized, codeInvalidToken, "Invalid token claims")
 			c.Abort()
 			return
 		}
@@ -261,534 +184,234 @@ func jwtAuth() gin.HandlerFunc {
 	}
 }
 
-// Auth endpoints
-func login(c *gin.Context) {
-	var req LoginRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
-
-	var admin Admin
-	if db.Where("username = ? AND password = ?", req.Username, req.Password).First(&admin).Error != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
-		return
-	}
-
-	token, err := generateJWT(admin.Username)
+// apiKeyAuth authenticates a request made with an API key and checks its scopes
+func (s *Server) apiKeyAuth(c *gin.Context, raw string) {
+	key, username, err := s.authenticateAPIKey(c, raw)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Token generation failed"})
-		return
-	}
-
-	c.JSON(http.StatusOK, gin.H{
-		"token":      token,
-		"expires_in": JWT_EXPIRE_HOURS * 3600,
-	})
-}
-
-// Public encrypted endpoints
-func getAllChannels(c *gin.Context) {
-	var channels []Channel
-	db.Find(&channels)
-	c.JSON(http.StatusOK, channels)
-}
-
-func getAllPackages(c *gin.Context) {
-	var packages []Package
-	db.Preload("Channels").Find(&packages)
-	c.JSON(http.StatusOK, packages)
-}
-
-// Admin Channel endpoints
-func addChannel(c *gin.Context) {
-	var channel Channel
-	if err := c.ShouldBindJSON(&channel); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
-
-	channel.CreatedAt = time.Now()
-	if channel.LastRefreshed.IsZero() {
-		channel.LastRefreshed = time.Now()
-	}
-
-	if result := db.Create(&channel); result.Error != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create channel"})
-		return
-	}
-
-	c.JSON(http.StatusCreated, channel)
-}
-
-func getAdminChannels(c *gin.Context) {
-	var channels []Channel
-	db.Find(&channels)
-	c.JSON(http.StatusOK, channels)
-}
-
-func updateChannel(c *gin.Context) {
-	id := c.Param("id")
-	var channel Channel
-
-	if db.First(&channel, id).Error != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Channel not found"})
-		return
-	}
-
-	if err := c.ShouldBindJSON(&channel); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
-
-	db.Save(&channel)
-	c.JSON(http.StatusOK, channel)
-}
-
-func deleteChannel(c *gin.Context) {
-	id := c.Param("id")
-	if result := db.Delete(&Channel{}, id); result.Error != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete channel"})
-		return
-	}
-	c.JSON(http.StatusOK, gin.H{"message": "Channel deleted successfully"})
-}
-
-// Admin Package endpoints
-func getAdminPackages(c *gin.Context) {
-	var packages []Package
-	db.Preload("Channels").Find(&packages)
-	c.JSON(http.StatusOK, packages)
-}
-
-func addPackage(c *gin.Context) {
-	var pkg Package
-	if err := c.ShouldBindJSON(&pkg); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
-
-	pkg.CreatedAt = time.Now()
-	if result := db.Create(&pkg); result.Error != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create package"})
-		return
-	}
-
-	c.JSON(http.StatusCreated, pkg)
-}
-
-func updatePackage(c *gin.Context) {
-	id := c.Param("id")
-	var pkg Package
-
-	if db.First(&pkg, id).Error != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Package not found"})
-		return
-	}
-
-	if err := c.ShouldBindJSON(&pkg); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
-
-	db.Save(&pkg)
-	c.JSON(http.StatusOK, pkg)
-}
-
-func deletePackage(c *gin.Context) {
-	id := c.Param("id")
-	if result := db.Delete(&Package{}, id); result.Error != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete package"})
-		return
-	}
-	c.JSON(http.StatusOK, gin.H{"message": "Package deleted successfully"})
-}
-
-// Admin User endpoints
-func getAllUsers(c *gin.Context) {
-	var users []User
-	db.Preload("IPTVHoster").Preload("Subscriptions").Find(&users)
-	c.JSON(http.StatusOK, users)
-}
-
-func getUser(c *gin.Context) {
-	id := c.Param("id")
-	var user User
-
-	if db.Preload("IPTVHoster").Preload("Subscriptions").First(&user, id).Error != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
-		return
-	}
-
-	c.JSON(http.StatusOK, user)
-}
-
-func addUser(c *gin.Context) {
-	var user User
-	if err := c.ShouldBindJSON(&user); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
-
-	user.CreatedAt = time.Now()
-	if result := db.Create(&user); result.Error != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
-		return
-	}
-
-	c.JSON(http.StatusCreated, user)
-}
-
-func updateUser(c *gin.Context) {
-	id := c.Param("id")
-	var user User
-
-	if db.First(&user, id).Error != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
-		return
-	}
-
-	if err := c.ShouldBindJSON(&user); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
-
-	db.Save(&user)
-	c.JSON(http.StatusOK, user)
-}
-
-func deleteUser(c *gin.Context) {
-	id := c.Param("id")
-	if result := db.Delete(&User{}, id); result.Error != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete user"})
-		return
-	}
-	c.JSON(http.StatusOK, gin.H{"message": "User deleted successfully"})
-}
-
-// Admin IPTV Hoster endpoints
-func getAllHosters(c *gin.Context) {
-	var hosters []IPTVHoster
-	db.Find(&hosters)
-	c.JSON(http.StatusOK, hosters)
-}
-
-func addHoster(c *gin.Context) {
-	var hoster IPTVHoster
-	if err := c.ShouldBindJSON(&hoster); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
-
-	hoster.CreatedAt = time.Now()
-	if result := db.Create(&hoster); result.Error != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create hoster"})
-		return
-	}
-
-	c.JSON(http.StatusCreated, hoster)
-}
-
-func updateHoster(c *gin.Context) {
-	id := c.Param("id")
-	var hoster IPTVHoster
-
-	if db.First(&hoster, id).Error != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Hoster not found"})
-		return
-	}
-
-	if err := c.ShouldBindJSON(&hoster); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
-
-	db.Save(&hoster)
-	c.JSON(http.StatusOK, hoster)
-}
-
-func deleteHoster(c *gin.Context) {
-	id := c.Param("id")
-	if result := db.Delete(&IPTVHoster{}, id); result.Error != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete hoster"})
-		return
-	}
-	c.JSON(http.StatusOK, gin.H{"message": "Hoster deleted successfully"})
-}
-
-// Subscription endpoints
-func getAllSubscriptions(c *gin.Context) {
-	var subscriptions []Subscription
-	db.Preload("User").Find(&subscriptions)
-	c.JSON(http.StatusOK, subscriptions)
-}
-
-func getSubscription(c *gin.Context) {
-	id := c.Param("id")
-	var subscription Subscription
-
-	if db.Preload("User").First(&subscription, id).Error != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Subscription not found"})
-		return
-	}
-
-	c.JSON(http.StatusOK, subscription)
-}
-
-func addSubscription(c *gin.Context) {
-	var subscription Subscription
-	if err := c.ShouldBindJSON(&subscription); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
-	
-	// Set creation time
-	subscription.CreatedAt = time.Now()
-	
-	// Validate dates
-	if subscription.Started.IsZero() {
-		subscription.Started = time.Now()
-	}
-	if subscription.End.IsZero() {
-		subscription.End = time.Now().AddDate(0, 1, 0) // Default to 1 month from now
-	}
-	
-	if result := db.Create(&subscription); result.Error != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create subscription"})
-		return
-	}
-	
-	c.JSON(http.StatusCreated, subscription)
-}
-
-func updateSubscription(c *gin.Context) {
-	id := c.Param("id")
-	var subscription Subscription
-
-	if db.First(&subscription, id).Error != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Subscription not found"})
-		return
-	}
-
-	if err := c.ShouldBindJSON(&subscription); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
-
-	db.Save(&subscription)
-	c.JSON(http.StatusOK, subscription)
-}
-
-func deleteSubscription(c *gin.Context) {
-	id := c.Param("id")
-	if result := db.Delete(&Subscription{}, id); result.Error != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete subscription"})
-		return
-	}
-	c.JSON(http.StatusOK, gin.H{"message": "Subscription deleted successfully"})
-}
-
-// Enhanced subscription validation endpoint with user and hoster info
-func validateSubscription(c *gin.Context) {
-	key := c.Param("key")
-	if key == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Subscription key is required"})
-		return
-	}
-
-	var subscription Subscription
-	if db.Where("key = ?", key).Preload("User").Preload("User.IPTVHoster").First(&subscription).Error != nil {
-		c.JSON(http.StatusNotFound, gin.H{
-			"valid": false,
-			"error": "Subscription not found",
-		})
+		writeError(c, http.StatusUnauthorized, codeInvalidAPIKey, err.Error())
+		c.Abort()
 		return
 	}
-
-	// Check if subscription is still active
-	now := time.Now()
-	isActive := now.After(subscription.Started) && now.Before(subscription.End)
-
-	response := gin.H{
-		"valid":        isActive,
-		"subscription": subscription,
-		"status":       "active",
-	}
-
-	// Include user info (without sensitive data)
-	if subscription.User.ID > 0 {
-		userInfo := gin.H{
-			"id":            subscription.User.ID,
-			"name":          subscription.User.Name,
-			"avatar":        subscription.User.Avatar,
-			"tele_username": subscription.User.TeleUsername,
-			"is_hoster":     subscription.User.IsHoster,
-		}
-
-		// Include IPTV hoster info for branding
-		if subscription.User.IPTVHoster != nil {
-			userInfo["iptv_hoster"] = gin.H{
-				"id":            subscription.User.IPTVHoster.ID,
-				"name":          subscription.User.IPTVHoster.Name,
-				"logo":          subscription.User.IPTVHoster.Logo,
-				"color_palette": subscription.User.IPTVHoster.ColorPalette,
-			}
-		}
-
-		response["user"] = userInfo
-	}
-
-	if !isActive {
-		if now.Before(subscription.Started) {
-			response["status"] = "not_started"
-			response["error"] = "Subscription has not started yet"
-		} else {
-			response["status"] = "expired"
-			response["error"] = "Subscription has expired"
-		}
-		response["valid"] = false
-	}
-
-	c.JSON(http.StatusOK, response)
-}
-
-// Helper endpoint to add channels to a package
-func addChannelToPackage(c *gin.Context) {
-	packageID, _ := strconv.Atoi(c.Param("id"))
-	channelID, _ := strconv.Atoi(c.Param("channelId"))
-
-	var pkg Package
-	var channel Channel
-
-	if db.First(&pkg, packageID).Error != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Package not found"})
+	scope := requiredScope(c.Request.Method, c.FullPath())
+	if scope == "" {
+		writeError(c, http.StatusForbidden, codeInsufficientScope, "Not available to API keys")
+		c.Abort()
 		return
 	}
-
-	if db.First(&channel, channelID).Error != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Channel not found"})
+	if !key.allows(scope) {
+		writeError(c, http.StatusForbidden, codeInsufficientScope, "API key lacks the "+scope+" scope")
+		c.Abort()
 		return
 	}
 
-	db.Model(&pkg).Association("Channels").Append(&channel)
-	c.JSON(http.StatusOK, gin.H{"message": "Channel added to package successfully"})
+	c.Set("username", username)
+	c.Set(apiKeyContextKey, key.Prefix)
+	c.Next()
 }
 
-// Remove channel from package
-func removeChannelFromPackage(c *gin.Context) {
-	packageID, _ := strconv.Atoi(c.Param("id"))
-	channelID, _ := strconv.Atoi(c.Param("channelId"))
-
-	var pkg Package
-	var channel Channel
-
-	if db.First(&pkg, packageID).Error != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Package not found"})
-		return
+// router builds the Gin engine with every API route
+func (s *Server) router() *gin.Engine {
+	r := gin.New()
+	r.Use(requestID(), instrument(), requestLogger(), gin.CustomRecoveryWithWriter(io.Discard, recovered))
+	r.NoRoute(noRoute)
+	// Without trusted proxies X-Forwarded-For is ignored and the peer is the client
+	if err := r.SetTrustedProxies(s.limits.TrustedProxies); err != nil {
+		panic(err)
 	}
 
-	if db.First(&channel, channelID).Error != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Channel not found"})
-		return
-	}
-
-	db.Model(&pkg).Association("Channels").Delete(&channel)
-	c.JSON(http.StatusOK, gin.H{"message": "Channel removed from package successfully"})
-}
-
-// Decrypt endpoint for testing
-func decryptData(c *gin.Context) {
-	var req struct {
-		Data string `json:"data"`
-	}
-
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
-
-	decrypted, err := decrypt(req.Data, ENCRYPTION_KEY)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Decryption failed"})
-		return
-	}
-
-	c.JSON(http.StatusOK, gin.H{"decrypted": decrypted})
-}
-
-func main() {
-	// Initialize database
-	initDB()
-
-	// Initialize Gin router
-	r := gin.Default()
-
 	// CORS middleware to allow requests from Python web panel
 	r.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{"http://localhost:5000", "http://127.0.0.1:5000"},
 		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization"},
-		ExposeHeaders:    []string{"Content-Length"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization", "X-Request-ID"},
+		ExposeHeaders:    []string{"Content-Length", "X-Request-ID"},
 		AllowCredentials: true,
 	}))
 
+	r.GET("/healthz", healthz)
+	r.GET("/readyz", s.readyz)
+	r.GET("/metrics", s.metricsHandler())
+
 	// API routes
 	api := r.Group("/api")
 	{
 		// Auth endpoint
-		api.POST("/login", login)
+		api.POST("/login", s.login)
+		api.POST("/login/2fa", s.loginTwoFactor)
 
 		// Public encrypted endpoints
 		public := api.Group("/public")
 		public.Use(encryptResponse())
 		{
-			public.GET("/channels", getAllChannels)
-			public.GET("/packages", getAllPackages)
-			public.GET("/validate/:key", validateSubscription)
+			public.GET("/channels", s.getAllChannels)
+			public.GET("/packages", s.getAllPackages)
+			public.GET("/validate/:key", s.validateSubscription)
+			public.GET("/epg/:key/now", s.getNowNext)
+			public.GET("/epg/:key/grid", s.getGuideGrid)
 		}
 
+		// M3U playlist and XMLTV guide for standard IPTV players, authenticated by the subscription's playlist token
+		api.GET("/playlist/:token", s.getPlaylist)
+		api.GET("/epg/:token", s.getGuideXMLTV)
+
 		// Admin endpoints with JWT auth
 		admin := api.Group("/admin")
-		admin.Use(jwtAuth())
+		admin.Use(s.jwtAuth())
 		{
 			// Channel management
-			admin.GET("/channels", getAdminChannels)
-			admin.POST("/channels", addChannel)
-			admin.PUT("/channels/:id", updateChannel)
-			admin.DELETE("/channels/:id", deleteChannel)
+			admin.GET("/channels", s.getAdminChannels)
+			admin.POST("/channels", s.audited("channel", auditCreate), s.addChannel)
+			admin.PUT("/channels/:id", s.audited("channel", auditUpdate), s.updateChannel)
+			admin.DELETE("/channels/:id", s.audited("channel", auditDelete), s.deleteChannel)
+			admin.GET("/channels/:id/sources", s.getChannelSources)
+			admin.PUT("/channels/:id/sources", s.audited("channel_sources", auditUpdate), s.setChannelSources)
 
 			// Package management
-			admin.GET("/packages", getAdminPackages)
-			admin.POST("/packages", addPackage)
-			admin.PUT("/packages/:id", updatePackage)
-			admin.DELETE("/packages/:id", deletePackage)
-			admin.POST("/packages/:id/channels/:channelId", addChannelToPackage)
-            admin.DELETE("/packages/:id/channels/:channelId", removeChannelFromPackage)
+			admin.GET("/packages", s.getAdminPackages)
+			admin.POST("/packages", s.audited("package", auditCreate), s.addPackage)
+			admin.PUT("/packages/:id", s.audited("package", auditUpdate), s.updatePackage)
+			admin.DELETE("/packages/:id", s.audited("package", auditDelete), s.deletePackage)
+			admin.POST("/packages/:id/channels/:channelId", s.audited("package", "add_channel"), s.addChannelToPackage)
+			admin.DELETE("/packages/:id/channels/:channelId", s.audited("package", "remove_channel"), s.removeChannelFromPackage)
+			admin.PUT("/packages/:id/channels", s.audited("package", "update_lineup"), s.setPackageLineup)
+
+			// Plan management
+			admin.GET("/plans", s.getAllPlans)
+			admin.POST("/plans", s.audited("plan", auditCreate), s.addPlan)
+			admin.PUT("/plans/:id", s.audited("plan", auditUpdate), s.updatePlan)
+			admin.DELETE("/plans/:id", s.audited("plan", auditDelete), s.deletePlan)
+
+			// Bundle management
+			admin.GET("/bundles", s.getAllBundles)
+			admin.POST("/bundles", s.audited("bundle", auditCreate), s.addBundle)
+			admin.PUT("/bundles/:id", s.audited("bundle", auditUpdate), s.updateBundle)
+			admin.DELETE("/bundles/:id", s.audited("bundle", auditDelete), s.deleteBundle)
 
 			// User management
-			admin.GET("/users", getAllUsers)
-			admin.GET("/users/:id", getUser)
-			admin.POST("/users", addUser)
-			admin.PUT("/users/:id", updateUser)
-			admin.DELETE("/users/:id", deleteUser)
+			admin.GET("/users", s.getAllUsers)
+			admin.GET("/users/:id", s.getUser)
+			admin.POST("/users", s.audited("user", auditCreate), s.addUser)
+			admin.PUT("/users/:id", s.audited("user", auditUpdate), s.updateUser)
+			admin.DELETE("/users/:id", s.audited("user", auditDelete), s.deleteUser)
 
 			// IPTV Hoster management
-			admin.GET("/hosters", getAllHosters)
-			admin.POST("/hosters", addHoster)
-			admin.PUT("/hosters/:id", updateHoster)
-			admin.DELETE("/hosters/:id", deleteHoster)
+			admin.GET("/hosters", s.getAllHosters)
+			admin.POST("/hosters", s.audited("hoster", auditCreate), s.addHoster)
+			admin.PUT("/hosters/:id", s.audited("hoster", auditUpdate), s.updateHoster)
+			admin.DELETE("/hosters/:id", s.audited("hoster", auditDelete), s.deleteHoster)
 
 			// Subscription management
-			admin.GET("/subscriptions", getAllSubscriptions)
-			admin.GET("/subscriptions/:id", getSubscription)
-			admin.POST("/subscriptions", addSubscription)
-			admin.PUT("/subscriptions/:id", updateSubscription)
-			admin.DELETE("/subscriptions/:id", deleteSubscription)
+			admin.GET("/subscriptions", s.getAllSubscriptions)
+			admin.GET("/subscriptions/:id", s.getSubscription)
+			admin.POST("/subscriptions", s.audited("subscription", auditCreate), s.addSubscription)
+			admin.POST("/subscriptions/quote", s.quoteSubscription)
+			admin.PUT("/subscriptions/:id", s.audited("subscription", auditUpdate), s.updateSubscription)
+			admin.DELETE("/subscriptions/:id", s.audited("subscription", auditDelete), s.deleteSubscription)
+			admin.POST("/subscriptions/:id/packages/:packageId", s.audited("subscription", "add_package"), s.addPackageToSubscription)
+			admin.DELETE("/subscriptions/:id/packages/:packageId", s.audited("subscription", "remove_package"), s.removePackageFromSubscription)
+			admin.POST("/subscriptions/:id/playlist-token", s.audited("subscription", "regenerate_playlist_token"), s.regeneratePlaylistToken)
+
+			// Catalog bulk import/export
+			admin.GET("/catalog/export", s.exportCatalog)
+			admin.POST("/catalog/import", s.audited("catalog", auditImport), s.importCatalog)
+
+			// Programme guide
+			admin.POST("/epg/import", s.audited("epg", auditImport), s.importEPG)
+			admin.GET("/epg/export", s.exportEPG)
+
+			// Two-factor authentication of the logged in admin
+			admin.GET("/2fa", s.getTwoFactor)
+			admin.POST("/2fa/enroll", s.enrollTwoFactor)
+			admin.POST("/2fa/confirm", s.audited("admin", "enable_2fa"), s.confirmTwoFactor)
+			admin.POST("/2fa/recovery-codes", s.audited("admin", "regenerate_recovery_codes"), s.regenerateRecoveryCodes)
+			admin.DELETE("/2fa", s.audited("admin", "disable_2fa"), s.disableTwoFactor)
+
+			// API keys for scripts
+			admin.GET("/api-keys", s.getAllAPIKeys)
+			admin.POST("/api-keys", s.audited("api_key", auditCreate), s.addAPIKey)
+			admin.DELETE("/api-keys/:id", s.audited("api_key", "revoke"), s.revokeAPIKey)
+
+			// Admin accounts
+			admin.GET("/admins", s.getAllAdmins)
+			admin.DELETE("/admins/:id/2fa", s.audited("admin", "reset_2fa"), s.resetAdminTwoFactor)
+
+			// Audit log of the changes above
+			admin.GET("/audit", s.getAuditEvents)
+
+			// Diagnostics
+			admin.POST("/diagnostics/envelope", s.diagnoseEnvelope)
+			if debugBuild {
+				admin.POST("/decrypt", decryptData)
+			}
 		}
+	}
+
+	return r
+}
+
+func main() {
+	slog.SetDefault(newLogger(cfg.Log, os.Stderr))
+	// Gin's debug mode prints plain text route and warning lines to stdout
+	if os.Getenv(gin.EnvGinMode) == "" {
+		gin.SetMode(gin.ReleaseMode)
+	}
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
 
-		// Utility endpoint for testing decryption
-		api.POST("/decrypt", decryptData)
+	// Initialize database
+	initDB()
+
+	// SIGTERM and SIGINT stop the server and the background workers
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	var workers sync.WaitGroup
+	start := func(run func(context.Context)) {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			run(ctx)
+		}()
 	}
 
-	r.Run(":65000")
+	services := newGormServices(db)
+	if cfg.EPG.Source != "" {
+		start(func(ctx context.Context) { runGuideRefresh(ctx, services.EPG, cfg.EPG) })
+	}
+	if cfg.Health.Interval > 0 {
+		start(func(ctx context.Context) { runHealthChecks(ctx, services, cfg.Health) })
+	}
+	if cfg.Audit.Retention > 0 {
+		start(func(ctx context.Context) { runAuditPruning(ctx, services.Audit, cfg.Audit.Retention) })
+	}
+
+	server := newServer(services)
+	server.db = db
+	if cfg.RateLimit.RedisURL != "" {
+		limiter, err := newRedisRateLimiter(cfg.RateLimit.RedisURL)
+		if err != nil {
+			panic(err)
+		}
+		server.limiter = limiter
+	}
+
+	ln, err := net.Listen("tcp", cfg.Server.Addr)
+	if err != nil {
+		panic(err)
+	}
+	if cfg.Metrics.Token == "" {
+		slog.Warn("METRICS_TOKEN is not set, /metrics is open to anyone who can reach the API")
+	}
+	slog.Info("listening", "addr", ln.Addr().String())
+	err = server.serve(ctx, newHTTPServer(server.router(), cfg.Server), ln, cfg.Server)
+	stop()
+	workers.Wait()
+	if sqlDB, dbErr := db.DB(); dbErr == nil {
+		sqlDB.Close()
+	}
+	if err != nil {
+		slog.Error("server stopped", "error", err)
+		os.Exit(1)
+	}
+	slog.Info("stopped")
 }
@@ -0,0 +1,1074 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// In-memory services
+//
+// memoryStore keeps every model in maps guarded by a single mutex. It mirrors
+// the behaviour of the GORM services closely enough for handler tests, including
+// preloaded relations and unique names, without needing a database.
+type memoryStore struct {
+	mu               sync.Mutex
+	nextID           uint
+	channels         map[uint]Channel
+	packages         map[uint]Package
+	packageChannels  map[uint][]PackageChannel // package ID -> lineup, in order
+	subscriptionPkgs map[uint][]uint           // subscription ID -> package IDs
+	users            map[uint]User
+	hosters          map[uint]IPTVHoster
+	subscriptions    map[uint]Subscription
+	admins           map[uint]Admin
+	programmes       map[uint]Programme
+	plans            map[uint]Plan
+	bundles          map[uint]BundleRule
+	health           map[uint]ChannelHealth
+	sources          map[uint]StreamSource
+	audits           map[uint]AuditEvent
+	apiKeys          map[uint]APIKey
+}
+
+func newMemoryServices() Services {
+	store := &memoryStore{
+		channels:         map[uint]Channel{},
+		packages:         map[uint]Package{},
+		packageChannels:  map[uint][]PackageChannel{},
+		subscriptionPkgs: map[uint][]uint{},
+		users:            map[uint]User{},
+		hosters:          map[uint]IPTVHoster{},
+		subscriptions:    map[uint]Subscription{},
+		admins:           map[uint]Admin{},
+		programmes:       map[uint]Programme{},
+		plans:            map[uint]Plan{},
+		bundles:          map[uint]BundleRule{},
+		health:           map[uint]ChannelHealth{},
+		sources:          map[uint]StreamSource{},
+		audits:           map[uint]AuditEvent{},
+		apiKeys:          map[uint]APIKey{},
+	}
+	return Services{
+		Channels:      &memoryChannelService{store},
+		Packages:      &memoryPackageService{store},
+		Users:         &memoryUserService{store},
+		Hosters:       &memoryHosterService{store},
+		Subscriptions: &memorySubscriptionService{store},
+		Admins:        &memoryAdminService{store},
+		Catalog:       &memoryCatalogService{store},
+		EPG:           &memoryEPGService{store},
+		Plans:         &memoryPlanService{store},
+		Bundles:       &memoryBundleRuleService{store},
+		Health:        &memoryHealthService{store},
+		Sources:       &memorySourceService{store},
+		Audit:         &memoryAuditService{store},
+		APIKeys:       &memoryAPIKeyService{store},
+	}
+}
+
+func (s *memoryStore) assignID(id *uint, createdAt *time.Time) {
+	if *id == 0 {
+		s.nextID++
+		*id = s.nextID
+	} else if *id > s.nextID {
+		s.nextID = *id
+	}
+	if createdAt.IsZero() {
+		*createdAt = time.Now()
+	}
+}
+
+// sortedValues returns the map values ordered by primary key, like an unordered SQL query.
+func sortedValues[T any](m map[uint]T) []T {
+	ids := make([]uint, 0, len(m))
+	for id := range m {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	values := make([]T, 0, len(ids))
+	for _, id := range ids {
+		values = append(values, m[id])
+	}
+	return values
+}
+
+func (s *memoryStore) packageWithChannels(pkg Package) Package {
+	pkg.Channels = []Channel{}
+	for _, entry := range s.packageChannels[pkg.ID] {
+		if channel, ok := s.channels[entry.ChannelID]; ok {
+			channel.ChannelNumber = entry.ChannelNumber
+			pkg.Channels = append(pkg.Channels, channel)
+		}
+	}
+	return pkg
+}
+
+func (s *memoryStore) userWithRelations(user User) User {
+	user.IPTVHoster = nil
+	if user.IPTVHosterID != nil {
+		if hoster, ok := s.hosters[*user.IPTVHosterID]; ok {
+			user.IPTVHoster = &hoster
+		}
+	}
+
+	user.Subscriptions = []Subscription{}
+	for _, subscription := range sortedValues(s.subscriptions) {
+		if subscription.UserID == user.ID {
+			user.Subscriptions = append(user.Subscriptions, subscription)
+		}
+	}
+	return user
+}
+
+func (s *memoryStore) subscriptionWithUser(subscription Subscription, withHoster bool) Subscription {
+	subscription.Packages = []Package{}
+	for _, packageID := range s.subscriptionPkgs[subscription.ID] {
+		if pkg, ok := s.packages[packageID]; ok {
+			subscription.Packages = append(subscription.Packages, pkg)
+		}
+	}
+
+	subscription.User = User{}
+	if user, ok := s.users[subscription.UserID]; ok {
+		if withHoster && user.IPTVHosterID != nil {
+			if hoster, ok := s.hosters[*user.IPTVHosterID]; ok {
+				user.IPTVHoster = &hoster
+			}
+		}
+		subscription.User = user
+	}
+	return subscription
+}
+
+type memoryChannelService struct{ store *memoryStore }
+
+func (s *memoryChannelService) List(ctx context.Context) ([]Channel, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	return sortedValues(s.store.channels), nil
+}
+
+func (s *memoryChannelService) Get(ctx context.Context, id uint) (*Channel, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	channel, ok := s.store.channels[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &channel, nil
+}
+
+func (s *memoryChannelService) save(channel *Channel) {
+	if channel.ExternalID == "" {
+		channel.ExternalID = newExternalID("channel")
+	}
+	if channel.StreamType == "" {
+		channel.StreamType = formatDASH
+	}
+	s.store.assignID(&channel.ID, &channel.CreatedAt)
+	stored := *channel
+	stored.Keys = slices.Clone(channel.Keys)
+	stored.Key = legacyKey(channel.Keys)
+	stored.Packages = nil
+	stored.ChannelNumber = 0
+	s.store.channels[channel.ID] = stored
+}
+
+func (s *memoryChannelService) Create(ctx context.Context, channel *Channel) error {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	s.save(channel)
+	return nil
+}
+
+func (s *memoryChannelService) Update(ctx context.Context, channel *Channel) error {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	s.save(channel)
+	return nil
+}
+
+func (s *memoryChannelService) Delete(ctx context.Context, id uint) error {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	delete(s.store.channels, id)
+	for packageID, lineup := range s.store.packageChannels {
+		s.store.packageChannels[packageID] = slices.DeleteFunc(lineup, func(e PackageChannel) bool { return e.ChannelID == id })
+	}
+	maps.DeleteFunc(s.store.programmes, func(_ uint, p Programme) bool { return p.ChannelID == id })
+	delete(s.store.health, id)
+	maps.DeleteFunc(s.store.sources, func(_ uint, source StreamSource) bool { return source.ChannelID == id })
+	return nil
+}
+
+type memoryPackageService struct{ store *memoryStore }
+
+func (s *memoryPackageService) List(ctx context.Context) ([]Package, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	packages := sortedValues(s.store.packages)
+	for i := range packages {
+		packages[i] = s.store.packageWithChannels(packages[i])
+	}
+	return packages, nil
+}
+
+func (s *memoryPackageService) Get(ctx context.Context, id uint) (*Package, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	pkg, ok := s.store.packages[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	pkg = s.store.packageWithChannels(pkg)
+	return &pkg, nil
+}
+
+func (s *memoryPackageService) save(pkg *Package) error {
+	for _, existing := range s.store.packages {
+		if existing.Name == pkg.Name && existing.ID != pkg.ID {
+			return fmt.Errorf("package name %q already exists", pkg.Name)
+		}
+	}
+	if pkg.ExternalID == "" {
+		pkg.ExternalID = newExternalID("package")
+	}
+	if pkg.Kind == "" {
+		pkg.Kind = packageBase
+	}
+	s.store.assignID(&pkg.ID, &pkg.CreatedAt)
+	stored := *pkg
+	stored.Channels = nil
+	s.store.packages[pkg.ID] = stored
+	return nil
+}
+
+func (s *memoryPackageService) Create(ctx context.Context, pkg *Package) error {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	return s.save(pkg)
+}
+
+func (s *memoryPackageService) Update(ctx context.Context, pkg *Package) error {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	return s.save(pkg)
+}
+
+func (s *memoryPackageService) Delete(ctx context.Context, id uint) error {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	delete(s.store.packages, id)
+	delete(s.store.packageChannels, id)
+	for subscriptionID, packageIDs := range s.store.subscriptionPkgs {
+		s.store.subscriptionPkgs[subscriptionID] = slices.DeleteFunc(packageIDs, func(p uint) bool { return p == id })
+	}
+	maps.DeleteFunc(s.store.plans, func(_ uint, p Plan) bool { return p.PackageID == id })
+	for ruleID, rule := range s.store.bundles {
+		rule.PackageIDs = slices.DeleteFunc(rule.PackageIDs, func(p uint) bool { return p == id })
+		s.store.bundles[ruleID] = rule
+	}
+	return nil
+}
+
+func (s *memoryPackageService) AddChannel(ctx context.Context, packageID, channelID uint) error {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	if err := s.check(packageID, channelID); err != nil {
+		return err
+	}
+	lineup := s.store.packageChannels[packageID]
+	if !slices.ContainsFunc(lineup, func(e PackageChannel) bool { return e.ChannelID == channelID }) {
+		s.store.packageChannels[packageID] = append(lineup, PackageChannel{PackageID: packageID, ChannelID: channelID, SortOrder: len(lineup) + 1})
+	}
+	return nil
+}
+
+func (s *memoryPackageService) RemoveChannel(ctx context.Context, packageID, channelID uint) error {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	if err := s.check(packageID, channelID); err != nil {
+		return err
+	}
+	s.store.packageChannels[packageID] = slices.DeleteFunc(s.store.packageChannels[packageID], func(e PackageChannel) bool { return e.ChannelID == channelID })
+	return nil
+}
+
+func (s *memoryPackageService) SetLineup(ctx context.Context, packageID uint, lineup []PackageChannel) error {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	if _, ok := s.store.packages[packageID]; !ok {
+		return &NotFoundError{Entity: "Package"}
+	}
+	for _, entry := range lineup {
+		if _, ok := s.store.channels[entry.ChannelID]; !ok {
+			return &NotFoundError{Entity: "Channel"}
+		}
+	}
+	s.store.setLineup(packageID, lineup)
+	return nil
+}
+
+// setLineup stores the lineup sorted the way the database lists it
+func (s *memoryStore) setLineup(packageID uint, lineup []PackageChannel) {
+	entries := slices.Clone(lineup)
+	for i := range entries {
+		entries[i].PackageID = packageID
+	}
+	slices.SortStableFunc(entries, func(a, b PackageChannel) int {
+		if a.SortOrder != b.SortOrder {
+			return a.SortOrder - b.SortOrder
+		}
+		return int(a.ChannelID) - int(b.ChannelID)
+	})
+	s.packageChannels[packageID] = entries
+}
+
+func (s *memoryPackageService) check(packageID, channelID uint) error {
+	if _, ok := s.store.packages[packageID]; !ok {
+		return &NotFoundError{Entity: "Package"}
+	}
+	if _, ok := s.store.channels[channelID]; !ok {
+		return &NotFoundError{Entity: "Channel"}
+	}
+	return nil
+}
+
+type memoryUserService struct{ store *memoryStore }
+
+func (s *memoryUserService) List(ctx context.Context) ([]User, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	users := sortedValues(s.store.users)
+	for i := range users {
+		users[i] = s.store.userWithRelations(users[i])
+	}
+	return users, nil
+}
+
+func (s *memoryUserService) Get(ctx context.Context, id uint) (*User, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	user, ok := s.store.users[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	user = s.store.userWithRelations(user)
+	return &user, nil
+}
+
+func (s *memoryUserService) save(user *User) {
+	s.store.assignID(&user.ID, &user.CreatedAt)
+	stored := *user
+	stored.IPTVHoster = nil
+	stored.Subscriptions = nil
+	s.store.users[user.ID] = stored
+}
+
+func (s *memoryUserService) Create(ctx context.Context, user *User) error {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	s.save(user)
+	return nil
+}
+
+func (s *memoryUserService) Update(ctx context.Context, user *User) error {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	s.save(user)
+	return nil
+}
+
+func (s *memoryUserService) Delete(ctx context.Context, id uint) error {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	delete(s.store.users, id)
+	return nil
+}
+
+type memoryHosterService struct{ store *memoryStore }
+
+func (s *memoryHosterService) List(ctx context.Context) ([]IPTVHoster, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	return sortedValues(s.store.hosters), nil
+}
+
+func (s *memoryHosterService) Get(ctx context.Context, id uint) (*IPTVHoster, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	hoster, ok := s.store.hosters[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &hoster, nil
+}
+
+func (s *memoryHosterService) save(hoster *IPTVHoster) error {
+	for _, existing := range s.store.hosters {
+		if existing.Name == hoster.Name && existing.ID != hoster.ID {
+			return fmt.Errorf("hoster name %q already exists", hoster.Name)
+		}
+	}
+	s.store.assignID(&hoster.ID, &hoster.CreatedAt)
+	s.store.hosters[hoster.ID] = *hoster
+	return nil
+}
+
+func (s *memoryHosterService) Create(ctx context.Context, hoster *IPTVHoster) error {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	return s.save(hoster)
+}
+
+func (s *memoryHosterService) Update(ctx context.Context, hoster *IPTVHoster) error {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	return s.save(hoster)
+}
+
+func (s *memoryHosterService) Delete(ctx context.Context, id uint) error {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	delete(s.store.hosters, id)
+	return nil
+}
+
+type memorySubscriptionService struct{ store *memoryStore }
+
+func (s *memorySubscriptionService) List(ctx context.Context) ([]Subscription, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	subscriptions := sortedValues(s.store.subscriptions)
+	for i := range subscriptions {
+		subscriptions[i] = s.store.subscriptionWithUser(subscriptions[i], false)
+	}
+	return subscriptions, nil
+}
+
+func (s *memorySubscriptionService) Get(ctx context.Context, id uint) (*Subscription, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	subscription, ok := s.store.subscriptions[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	subscription = s.store.subscriptionWithUser(subscription, false)
+	return &subscription, nil
+}
+
+func (s *memorySubscriptionService) GetByKey(ctx context.Context, key string) (*Subscription, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	for _, subscription := range sortedValues(s.store.subscriptions) {
+		if subscription.Key == key {
+			subscription = s.store.subscriptionWithUser(subscription, true)
+			return &subscription, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *memorySubscriptionService) GetByPlaylistToken(ctx context.Context, token string) (*Subscription, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	for _, subscription := range sortedValues(s.store.subscriptions) {
+		if subscription.PlaylistToken == token {
+			subscription = s.store.subscriptionWithUser(subscription, false)
+			return &subscription, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *memorySubscriptionService) save(subscription *Subscription) {
+	if subscription.PlaylistToken == "" {
+		subscription.PlaylistToken = newPlaylistToken()
+	}
+	s.store.assignID(&subscription.ID, &subscription.CreatedAt)
+	stored := *subscription
+	stored.User = User{}
+	stored.Packages = nil
+	s.store.subscriptions[subscription.ID] = stored
+}
+
+func (s *memorySubscriptionService) Create(ctx context.Context, subscription *Subscription) error {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	s.save(subscription)
+	for _, pkg := range subscription.Packages {
+		s.store.subscriptionPkgs[subscription.ID] = append(s.store.subscriptionPkgs[subscription.ID], pkg.ID)
+	}
+	return nil
+}
+
+func (s *memorySubscriptionService) Update(ctx context.Context, subscription *Subscription) error {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	s.save(subscription)
+	return nil
+}
+
+func (s *memorySubscriptionService) Delete(ctx context.Context, id uint) error {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	delete(s.store.subscriptions, id)
+	delete(s.store.subscriptionPkgs, id)
+	return nil
+}
+
+func (s *memorySubscriptionService) CountActive(ctx context.Context, now time.Time) (int64, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	var n int64
+	for _, subscription := range s.store.subscriptions {
+		if subscription.Status(now) == statusActive {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *memorySubscriptionService) AddPackage(ctx context.Context, subscriptionID, packageID uint) error {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	if err := s.check(subscriptionID, packageID); err != nil {
+		return err
+	}
+	if !slices.Contains(s.store.subscriptionPkgs[subscriptionID], packageID) {
+		s.store.subscriptionPkgs[subscriptionID] = append(s.store.subscriptionPkgs[subscriptionID], packageID)
+	}
+	return nil
+}
+
+func (s *memorySubscriptionService) RemovePackage(ctx context.Context, subscriptionID, packageID uint) error {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	if err := s.check(subscriptionID, packageID); err != nil {
+		return err
+	}
+	s.store.subscriptionPkgs[subscriptionID] = slices.DeleteFunc(s.store.subscriptionPkgs[subscriptionID], func(p uint) bool { return p == packageID })
+	return nil
+}
+
+func (s *memorySubscriptionService) check(subscriptionID, packageID uint) error {
+	if _, ok := s.store.subscriptions[subscriptionID]; !ok {
+		return &NotFoundError{Entity: "Subscription"}
+	}
+	if _, ok := s.store.packages[packageID]; !ok {
+		return &NotFoundError{Entity: "Package"}
+	}
+	return nil
+}
+
+func (s *memorySubscriptionService) Entitlements(ctx context.Context, subscription *Subscription) ([]Package, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	ids := s.store.subscriptionPkgs[subscription.ID]
+
+	packages := []Package{}
+	for _, pkg := range sortedValues(s.store.packages) {
+		if len(ids) == 0 || slices.Contains(ids, pkg.ID) {
+			packages = append(packages, s.store.packageWithChannels(pkg))
+		}
+	}
+	return packages, nil
+}
+
+type memoryAdminService struct{ store *memoryStore }
+
+func (s *memoryAdminService) List(ctx context.Context) ([]Admin, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	return sortedValues(s.store.admins), nil
+}
+
+func (s *memoryAdminService) Get(ctx context.Context, id uint) (*Admin, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	admin, ok := s.store.admins[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	admin.RecoveryCodes = slices.Clone(admin.RecoveryCodes)
+	return &admin, nil
+}
+
+func (s *memoryAdminService) GetByUsername(ctx context.Context, username string) (*Admin, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	for _, admin := range s.store.admins {
+		if admin.Username == username {
+			admin.RecoveryCodes = slices.Clone(admin.RecoveryCodes)
+			return &admin, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *memoryAdminService) Authenticate(ctx context.Context, username, password string) (*Admin, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	for _, admin := range s.store.admins {
+		if admin.Username == username && admin.Password == password {
+			return &admin, nil
+		}
+	}
+	return nil, ErrInvalidCredentials
+}
+
+func (s *memoryAdminService) Update(ctx context.Context, admin *Admin) error {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	stored, ok := s.store.admins[admin.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	stored.IsOwner = admin.IsOwner
+	stored.TOTPSecret, stored.TOTPEnabled, stored.TOTPLastStep = admin.TOTPSecret, admin.TOTPEnabled, admin.TOTPLastStep
+	stored.RecoveryCodes = slices.Clone(admin.RecoveryCodes)
+	s.store.admins[admin.ID] = stored
+	return nil
+}
+
+func (s *memoryAdminService) EnsureDefault(ctx context.Context) error {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	for _, admin := range s.store.admins {
+		if admin.Username == defaultAdminUsername {
+			return nil
+		}
+	}
+	admin := Admin{Username: defaultAdminUsername, Password: defaultAdminPassword, IsOwner: true}
+	s.store.assignID(&admin.ID, &admin.CreatedAt)
+	s.store.admins[admin.ID] = admin
+	return nil
+}
+
+type memoryCatalogService struct{ store *memoryStore }
+
+func (s *memoryCatalogService) snapshot() ([]Channel, []Package) {
+	channels := sortedValues(s.store.channels)
+	packages := sortedValues(s.store.packages)
+	for i := range packages {
+		packages[i] = s.store.packageWithChannels(packages[i])
+	}
+	return channels, packages
+}
+
+func (s *memoryCatalogService) Export(ctx context.Context) (*Catalog, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	return buildCatalog(s.snapshot()), nil
+}
+
+func (s *memoryCatalogService) Import(ctx context.Context, catalog *Catalog, dryRun bool) (*ImportReport, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	channels, packages := s.snapshot()
+	plan := planCatalogImport(channels, packages, catalog)
+	report := &plan.report
+	report.DryRun = dryRun
+	if dryRun || report.Errors > 0 {
+		return report, nil
+	}
+
+	channelIDs := map[string]uint{}
+	for _, c := range channels {
+		channelIDs[c.ExternalID] = c.ID
+	}
+	for _, p := range plan.channels {
+		channel := Channel{LastRefreshed: time.Now()}
+		if p.existing != nil {
+			channel = *p.existing
+		}
+		channel.ExternalID = p.incoming.ExternalID
+		channel.Name = p.incoming.Name
+		channel.Logo = p.incoming.Logo
+		channel.MPD = p.incoming.MPD
+		channel.Keys = slices.Clone(p.incoming.Keys)
+		channel.Key = legacyKey(channel.Keys)
+		channel.ExpiresEvery = p.incoming.ExpiresEvery
+		channel.EPGID = p.incoming.EPGID
+		channel.Category = p.incoming.Category
+		channel.Tags = p.incoming.Tags
+		channel.StreamType = p.incoming.StreamType
+		channel.MimeType = p.incoming.MimeType
+		channel.LowLatency = p.incoming.LowLatency
+		channel.Disabled = p.incoming.Disabled
+		channel.Availability = p.incoming.Availability
+		s.store.assignID(&channel.ID, &channel.CreatedAt)
+		s.store.channels[channel.ID] = channel
+		channelIDs[channel.ExternalID] = channel.ID
+	}
+
+	for _, p := range plan.packages {
+		pkg := Package{}
+		if p.existing != nil {
+			pkg = *p.existing
+			pkg.Channels = nil
+		}
+		pkg.ExternalID = p.incoming.ExternalID
+		pkg.Name = p.incoming.Name
+		pkg.Logo = p.incoming.Logo
+		pkg.Kind = p.incoming.Kind
+		pkg.Tier = p.incoming.Tier
+		s.store.assignID(&pkg.ID, &pkg.CreatedAt)
+		s.store.packages[pkg.ID] = pkg
+
+		if p.channelsChanged {
+			s.store.setLineup(pkg.ID, p.incoming.lineup(func(id string) uint { return channelIDs[id] }))
+		}
+	}
+
+	report.Applied = true
+	return report, nil
+}
+
+type memoryPlanService struct{ store *memoryStore }
+
+func (s *memoryPlanService) List(ctx context.Context) ([]Plan, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	plans := sortedValues(s.store.plans)
+	sort.SliceStable(plans, func(i, j int) bool {
+		if plans[i].PackageID != plans[j].PackageID {
+			return plans[i].PackageID < plans[j].PackageID
+		}
+		return plans[i].Months < plans[j].Months
+	})
+	return plans, nil
+}
+
+func (s *memoryPlanService) Get(ctx context.Context, id uint) (*Plan, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	plan, ok := s.store.plans[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &plan, nil
+}
+
+func (s *memoryPlanService) save(plan *Plan) error {
+	for _, existing := range s.store.plans {
+		if existing.PackageID == plan.PackageID && existing.Months == plan.Months && existing.ID != plan.ID {
+			return fmt.Errorf("package %d already has a %d month plan", plan.PackageID, plan.Months)
+		}
+	}
+	s.store.assignID(&plan.ID, &plan.CreatedAt)
+	s.store.plans[plan.ID] = *plan
+	return nil
+}
+
+func (s *memoryPlanService) Create(ctx context.Context, plan *Plan) error {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	return s.save(plan)
+}
+
+func (s *memoryPlanService) Update(ctx context.Context, plan *Plan) error {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	return s.save(plan)
+}
+
+func (s *memoryPlanService) Delete(ctx context.Context, id uint) error {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	delete(s.store.plans, id)
+	return nil
+}
+
+type memoryBundleRuleService struct{ store *memoryStore }
+
+func (s *memoryBundleRuleService) List(ctx context.Context) ([]BundleRule, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	rules := sortedValues(s.store.bundles)
+	for i := range rules {
+		rules[i].PackageIDs = slices.Clone(rules[i].PackageIDs)
+	}
+	return rules, nil
+}
+
+func (s *memoryBundleRuleService) Get(ctx context.Context, id uint) (*BundleRule, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	rule, ok := s.store.bundles[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	rule.PackageIDs = slices.Clone(rule.PackageIDs)
+	return &rule, nil
+}
+
+func (s *memoryBundleRuleService) save(rule *BundleRule) {
+	s.store.assignID(&rule.ID, &rule.CreatedAt)
+	stored := *rule
+	stored.PackageIDs = slices.Sorted(slices.Values(rule.PackageIDs))
+	s.store.bundles[rule.ID] = stored
+}
+
+func (s *memoryBundleRuleService) Create(ctx context.Context, rule *BundleRule) error {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	s.save(rule)
+	return nil
+}
+
+func (s *memoryBundleRuleService) Update(ctx context.Context, rule *BundleRule) error {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	s.save(rule)
+	return nil
+}
+
+func (s *memoryBundleRuleService) Delete(ctx context.Context, id uint) error {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	delete(s.store.bundles, id)
+	return nil
+}
+
+type memoryEPGService struct{ store *memoryStore }
+
+func (s *memoryEPGService) Import(ctx context.Context, guide *Guide) (*EPGImportReport, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	report := &EPGImportReport{Skipped: guide.Skipped}
+	for _, cg := range planGuideImport(sortedValues(s.store.channels), guide, report) {
+		maps.DeleteFunc(s.store.programmes, func(_ uint, p Programme) bool {
+			return p.ChannelID == cg.ChannelID && p.Start.Before(cg.To) && p.Stop.After(cg.From)
+		})
+		for _, p := range cg.Programmes {
+			s.store.assignID(&p.ID, &p.CreatedAt)
+			s.store.programmes[p.ID] = p
+		}
+	}
+	return report, nil
+}
+
+func (s *memoryEPGService) Programmes(ctx context.Context, channelIDs []uint, from, to time.Time) ([]Programme, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	programmes := []Programme{}
+	for _, p := range sortedValues(s.store.programmes) {
+		if slices.Contains(channelIDs, p.ChannelID) && p.Start.Before(to) && p.Stop.After(from) {
+			programmes = append(programmes, p)
+		}
+	}
+	sort.SliceStable(programmes, func(i, j int) bool {
+		if programmes[i].ChannelID != programmes[j].ChannelID {
+			return programmes[i].ChannelID < programmes[j].ChannelID
+		}
+		return programmes[i].Start.Before(programmes[j].Start)
+	})
+	return programmes, nil
+}
+
+func (s *memoryEPGService) Prune(ctx context.Context, before time.Time) (int64, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	n := len(s.store.programmes)
+	maps.DeleteFunc(s.store.programmes, func(_ uint, p Programme) bool { return p.Stop.Before(before) })
+	return int64(n - len(s.store.programmes)), nil
+}
+
+type memoryHealthService struct{ store *memoryStore }
+
+func (s *memoryHealthService) List(ctx context.Context) ([]ChannelHealth, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	results := make([]ChannelHealth, 0, len(s.store.health))
+	for _, id := range slices.Sorted(maps.Keys(s.store.health)) {
+		results = append(results, s.store.health[id])
+	}
+	return results, nil
+}
+
+func (s *memoryHealthService) Record(ctx context.Context, health *ChannelHealth) error {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	if health.LastOKAt == nil {
+		health.LastOKAt = s.store.health[health.ChannelID].LastOKAt
+	}
+	s.store.health[health.ChannelID] = *health
+	return nil
+}
+
+type memorySourceService struct{ store *memoryStore }
+
+// sorted lists the stored sources the way the database orders them
+func (s *memorySourceService) sorted(keep func(StreamSource) bool) []StreamSource {
+	sources := []StreamSource{}
+	for _, source := range sortedValues(s.store.sources) {
+		if keep(source) {
+			sources = append(sources, source)
+		}
+	}
+	slices.SortStableFunc(sources, func(a, b StreamSource) int {
+		return cmp.Or(cmp.Compare(a.ChannelID, b.ChannelID), cmp.Compare(a.Priority, b.Priority), cmp.Compare(a.ID, b.ID))
+	})
+	return sources
+}
+
+func (s *memorySourceService) List(ctx context.Context) ([]StreamSource, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	return s.sorted(func(StreamSource) bool { return true }), nil
+}
+
+func (s *memorySourceService) ForChannel(ctx context.Context, channelID uint) ([]StreamSource, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	return s.sorted(func(source StreamSource) bool { return source.ChannelID == channelID }), nil
+}
+
+func (s *memorySourceService) Replace(ctx context.Context, channelID uint, sources []StreamSource) error {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	if _, ok := s.store.channels[channelID]; !ok {
+		return &NotFoundError{Entity: "Channel"}
+	}
+	existing := s.sorted(func(source StreamSource) bool { return source.ChannelID == channelID })
+	maps.DeleteFunc(s.store.sources, func(_ uint, source StreamSource) bool { return source.ChannelID == channelID })
+	for i := range sources {
+		sources[i] = keepSourceHealth(sources[i], existing)
+		sources[i].ID = 0
+		sources[i].ChannelID = channelID
+		s.store.assignID(&sources[i].ID, &sources[i].CreatedAt)
+		s.store.sources[sources[i].ID] = sources[i]
+	}
+	return nil
+}
+
+func (s *memorySourceService) RecordCheck(ctx context.Context, id uint, result ChannelHealth) error {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	source, ok := s.store.sources[id]
+	if !ok {
+		return &NotFoundError{Entity: "Stream source"}
+	}
+	source.recordCheck(result)
+	s.store.sources[id] = source
+	return nil
+}
+
+type memoryAuditService struct{ store *memoryStore }
+
+func (s *memoryAuditService) Record(ctx context.Context, event *AuditEvent) error {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	s.store.assignID(&event.ID, &event.CreatedAt)
+	s.store.audits[event.ID] = *event
+	return nil
+}
+
+func (s *memoryAuditService) List(ctx context.Context, filter AuditFilter) ([]AuditEvent, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	events := []AuditEvent{}
+	for _, e := range s.store.audits {
+		if filter.matches(e) {
+			events = append(events, e)
+		}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		if !events[i].CreatedAt.Equal(events[j].CreatedAt) {
+			return events[i].CreatedAt.After(events[j].CreatedAt)
+		}
+		return events[i].ID > events[j].ID
+	})
+	if filter.Offset >= len(events) {
+		return []AuditEvent{}, nil
+	}
+	events = events[filter.Offset:]
+	if filter.Limit > 0 && filter.Limit < len(events) {
+		events = events[:filter.Limit]
+	}
+	return events, nil
+}
+
+func (s *memoryAuditService) Prune(ctx context.Context, before time.Time) (int64, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	n := len(s.store.audits)
+	maps.DeleteFunc(s.store.audits, func(_ uint, e AuditEvent) bool { return e.CreatedAt.Before(before) })
+	return int64(n - len(s.store.audits)), nil
+}
+
+type memoryAPIKeyService struct{ store *memoryStore }
+
+func (s *memoryAPIKeyService) List(ctx context.Context) ([]APIKey, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	return sortedValues(s.store.apiKeys), nil
+}
+
+func (s *memoryAPIKeyService) Get(ctx context.Context, id uint) (*APIKey, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	key, ok := s.store.apiKeys[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &key, nil
+}
+
+func (s *memoryAPIKeyService) GetByPrefix(ctx context.Context, prefix string) (*APIKey, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	for _, key := range s.store.apiKeys {
+		if key.Prefix == prefix {
+			return &key, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *memoryAPIKeyService) Create(ctx context.Context, key *APIKey) error {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	s.store.assignID(&key.ID, &key.CreatedAt)
+	s.store.apiKeys[key.ID] = *key
+	return nil
+}
+
+func (s *memoryAPIKeyService) Revoke(ctx context.Context, id uint, at time.Time) error {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	key, ok := s.store.apiKeys[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if key.RevokedAt == nil {
+		key.RevokedAt = &at
+		s.store.apiKeys[id] = key
+	}
+	return nil
+}
+
+func (s *memoryAPIKeyService) Touch(ctx context.Context, id uint, at time.Time, ip string) error {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	key, ok := s.store.apiKeys[id]
+	if !ok {
+		return ErrNotFound
+	}
+	key.LastUsedAt, key.LastUsedIP = &at, ip
+	s.store.apiKeys[id] = key
+	return nil
+}
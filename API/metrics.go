@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics
+//
+// GET /metrics serves Prometheus metrics. Requests are timed per method, route
+// template and status; unmatched paths share the route "unmatched" and
+// non-standard methods the method "other", so scanners cannot blow up the
+// number of series. Active subscriptions and the database connection pool are
+// read when scraped, next to the Go runtime and process metrics. Set
+// METRICS_TOKEN to require it as a bearer token; without it anyone who can
+// reach the API can read traffic per route, validation outcomes and failed
+// logins, and a warning is logged on startup.
+
+const metricsNamespace = "streamsauce"
+
+// Metrics holds the service's instruments
+type Metrics struct {
+	registry         *prometheus.Registry
+	requests         *prometheus.HistogramVec
+	inFlight         prometheus.Gauge
+	validations      *prometheus.CounterVec
+	loginFailures    *prometheus.CounterVec
+	rateLimited      *prometheus.CounterVec
+	encryptionErrors prometheus.Counter
+	queries          *prometheus.HistogramVec
+}
+
+func newMetrics() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace, Name: "http_request_duration_seconds",
+			Help: "Time taken to answer HTTP requests.",
+		}, []string{"method", "route", "status"}),
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace, Name: "http_requests_in_flight",
+			Help: "HTTP requests being answered.",
+		}),
+		validations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Name: "subscription_validations_total",
+			Help: "Subscription validations by outcome: active, not_started, expired, not_found or rate_limited.",
+		}, []string{"outcome"}),
+		loginFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Name: "login_failures_total",
+			Help: "Failed admin logins by reason: password, two_factor or locked_out.",
+		}, []string{"reason"}),
+		rateLimited: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Name: "rate_limited_total",
+			Help: "Requests refused by rate limiting, by bucket.",
+		}, []string{"bucket"}),
+		encryptionErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Name: "encryption_errors_total",
+			Help: "Public responses that could not be encrypted.",
+		}),
+		queries: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace, Name: "db_query_duration_seconds",
+			Help: "Time taken by database queries, by outcome: ok or error.",
+		}, []string{"outcome"}),
+	}
+	m.registry.MustRegister(m.requests, m.inFlight, m.validations, m.loginFailures, m.rateLimited, m.encryptionErrors, m.queries,
+		collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	return m
+}
+
+// metrics is shared by every server in the process, like Prometheus' default registry
+var metrics = newMetrics()
+
+// standardMethods are kept as the method label; any other method is "other"
+var standardMethods = map[string]bool{
+	http.MethodGet: true, http.MethodHead: true, http.MethodPost: true, http.MethodPut: true, http.MethodPatch: true,
+	http.MethodDelete: true, http.MethodConnect: true, http.MethodOptions: true, http.MethodTrace: true,
+}
+
+// instrument times requests and counts those in flight
+func instrument() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		metrics.inFlight.Inc()
+		defer metrics.inFlight.Dec()
+		c.Next()
+
+		method := c.Request.Method
+		if !standardMethods[method] {
+			method = "other"
+		}
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		metrics.requests.WithLabelValues(method, route, strconv.Itoa(c.Writer.Status())).Observe(time.Since(start).Seconds())
+	}
+}
+
+// metricsHandler serves the shared metrics along with those of the server's
+// subscriptions and database, for Prometheus to scrape
+func (s *Server) metricsHandler() gin.HandlerFunc {
+	scraped := prometheus.NewRegistry()
+	scraped.MustRegister(activeSubscriptions{s.services.Subscriptions})
+	if s.db != nil {
+		if sqlDB, err := s.db.DB(); err == nil {
+			scraped.MustRegister(collectors.NewDBStatsCollector(sqlDB, s.db.Dialector.Name()))
+		}
+	}
+	handler := promhttp.HandlerFor(prometheus.Gatherers{metrics.registry, scraped}, promhttp.HandlerOpts{
+		ErrorLog:      slog.NewLogLogger(slog.Default().Handler(), slog.LevelError),
+		ErrorHandling: promhttp.ContinueOnError,
+	})
+
+	return func(c *gin.Context) {
+		if token := cfg.Metrics.Token; token != "" {
+			given := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				writeError(c, http.StatusUnauthorized, codeUnauthorized, "Metrics need the METRICS_TOKEN bearer token")
+				return
+			}
+		}
+		handler.ServeHTTP(c.Writer, c.Request)
+	}
+}
+
+var activeSubscriptionsDesc = prometheus.NewDesc(metricsNamespace+"_active_subscriptions",
+	"Subscriptions that have started and not yet ended.", nil, nil)
+
+// activeSubscriptions counts the active subscriptions when scraped
+type activeSubscriptions struct{ subscriptions SubscriptionService }
+
+func (a activeSubscriptions) Describe(ch chan<- *prometheus.Desc) { ch <- activeSubscriptionsDesc }
+
+func (a activeSubscriptions) Collect(ch chan<- prometheus.Metric) {
+	n, err := a.subscriptions.CountActive(context.Background(), time.Now())
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(activeSubscriptionsDesc, err)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(activeSubscriptionsDesc, prometheus.GaugeValue, float64(n))
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scrape returns the samples of /metrics by series, such as name{label="value"}
+func scrape(t *testing.T, s *Server) map[string]float64 {
+	t.Helper()
+	w := doRequest(s.router(), http.MethodGet, "/metrics", "", "")
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Fatalf("scrape: status %d, Content-Type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	samples := map[string]float64{}
+	for _, line := range strings.Split(strings.TrimSpace(w.Body.String()), "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		value, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("sample %q: %v", line, err)
+		}
+		samples[line[:i]] = value
+	}
+	return samples
+}
+
+func TestMetrics(t *testing.T) {
+	ctx := context.Background()
+	conn := openTestDB(t)
+	services := newGormServices(conn)
+	services.Admins.EnsureDefault(ctx)
+	now := time.Now()
+	services.Subscriptions.Create(ctx, &Subscription{Key: "ACTIVE", Started: now.Add(-time.Hour), End: now.Add(time.Hour)})
+	services.Subscriptions.Create(ctx, &Subscription{Key: "EXPIRED", Started: now.Add(-2 * time.Hour), End: now.Add(-time.Hour)})
+	s := newServer(services)
+	s.db = conn
+	r := s.router()
+
+	before := scrape(t, s)
+	doRequest(r, http.MethodGet, "/api/public/validate/ACTIVE", "", "")
+	doRequest(r, http.MethodGet, "/api/public/validate/EXPIRED", "", "")
+	doRequest(r, http.MethodGet, "/api/public/validate/UNKNOWN", "", "")
+	doRequest(r, http.MethodPost, "/api/login", `{"username":"admin","password":"wrong"}`, "")
+	doRequest(r, http.MethodGet, "/nowhere/"+strconv.FormatInt(now.UnixNano(), 10), "", "")
+	doRequest(r, "PROPFIND", "/api/public/validate/ACTIVE", "", "")
+	after := scrape(t, s)
+
+	for series, want := range map[string]float64{
+		`streamsauce_subscription_validations_total{outcome="active"}`:                                                 1,
+		`streamsauce_subscription_validations_total{outcome="expired"}`:                                                1,
+		`streamsauce_subscription_validations_total{outcome="not_found"}`:                                              1,
+		`streamsauce_login_failures_total{reason="password"}`:                                                          1,
+		`streamsauce_http_request_duration_seconds_count{method="GET",route="/api/public/validate/:key",status="200"}`: 2,
+		`streamsauce_http_request_duration_seconds_count{method="GET",route="/api/public/validate/:key",status="404"}`: 1,
+		`streamsauce_http_request_duration_seconds_count{method="GET",route="unmatched",status="404"}`:                 1,
+		`streamsauce_http_request_duration_seconds_count{method="other",route="unmatched",status="404"}`:               1,
+	} {
+		if got := after[series] - before[series]; got != want {
+			t.Errorf("%s grew by %v, want %v", series, got, want)
+		}
+	}
+	if after["streamsauce_active_subscriptions"] != 1 {
+		t.Errorf("active subscriptions = %v", after["streamsauce_active_subscriptions"])
+	}
+	if _, ok := after[`go_sql_open_connections{db_name="sqlite"}`]; !ok {
+		t.Error("no connection pool metrics")
+	}
+	if after[`streamsauce_http_request_duration_seconds_bucket{method="GET",route="/api/public/validate/:key",status="200",le="+Inf"}`] <
+		after[`streamsauce_http_request_duration_seconds_bucket{method="GET",route="/api/public/validate/:key",status="200",le="0.005"}`] {
+		t.Error("histogram buckets are not cumulative")
+	}
+}
+
+func TestMetricsToken(t *testing.T) {
+	previous := cfg.Metrics
+	cfg.Metrics.Token = "scraper"
+	t.Cleanup(func() { cfg.Metrics = previous })
+	r, _ := newMemoryServer(t)
+
+	if w := doRequest(r, http.MethodGet, "/metrics", "", ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("without token: status %d", w.Code)
+	}
+	if w := doRequest(r, http.MethodGet, "/metrics", "", "scraper"); w.Code != http.StatusOK {
+		t.Fatalf("with token: status %d", w.Code)
+	}
+}
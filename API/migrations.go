@@ -0,0 +1,875 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Schema migrations
+//
+// Every schema change is a numbered migration with an Up and a Down step.
+// Applied versions are recorded in the schema_migrations table. Migrations
+// declare their own local copies of the models they touch so that later
+// changes to the real models never alter what an old migration does.
+type migration struct {
+	Version int
+	Name    string
+	Up      func(tx *gorm.DB) error
+	Down    func(tx *gorm.DB) error
+}
+
+type SchemaMigration struct {
+	Version   int       `gorm:"primaryKey;autoIncrement:false"`
+	Name      string    `gorm:"not null"`
+	AppliedAt time.Time `gorm:"not null"`
+}
+
+type migrationState struct {
+	Version   int
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+}
+
+var errSchemaAhead = errors.New("database schema is newer than this binary")
+
+var migrations = []migration{
+	{
+		Version: 1,
+		Name:    "initial_schema",
+		Up: func(tx *gorm.DB) error {
+			// Snapshot of the models as they were created by AutoMigrate, so
+			// databases created before versioned migrations are picked up as-is.
+			type IPTVHoster struct {
+				ID           uint   `gorm:"primaryKey"`
+				Name         string `gorm:"unique;not null"`
+				Logo         string
+				ColorPalette string
+				CreatedAt    time.Time
+			}
+			type Subscription struct {
+				ID        uint `gorm:"primaryKey"`
+				UserID    uint
+				Started   time.Time
+				End       time.Time
+				Payed     float64
+				Key       string
+				CreatedAt time.Time
+			}
+			type User struct {
+				ID            uint   `gorm:"primaryKey"`
+				Name          string `gorm:"not null"`
+				Avatar        string
+				TeleUsername  string
+				Reference     string
+				IsAdmin       bool `gorm:"default:false"`
+				IsHoster      bool `gorm:"default:false"`
+				IPTVHosterID  *uint
+				IPTVHoster    *IPTVHoster `gorm:"foreignKey:IPTVHosterID"`
+				Subscriptions []Subscription
+				CreatedAt     time.Time
+			}
+			type Admin struct {
+				ID        uint   `gorm:"primaryKey"`
+				Username  string `gorm:"unique;not null"`
+				Password  string `gorm:"not null"`
+				CreatedAt time.Time
+			}
+			type Channel struct {
+				ID            uint   `gorm:"primaryKey"`
+				Name          string `gorm:"not null"`
+				Logo          string
+				MPD           string
+				Key           string
+				LastRefreshed time.Time
+				ExpiresEvery  int64
+				CreatedAt     time.Time
+			}
+			type Package struct {
+				ID        uint   `gorm:"primaryKey"`
+				Name      string `gorm:"unique;not null"`
+				Logo      string
+				Channels  []Channel `gorm:"many2many:package_channels;"`
+				CreatedAt time.Time
+			}
+			return tx.AutoMigrate(&IPTVHoster{}, &User{}, &Subscription{}, &Package{}, &Channel{}, &Admin{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable("package_channels", "subscriptions", "users", "ip_tv_hosters", "packages", "channels", "admins")
+		},
+	},
+	{
+		Version: 2,
+		Name:    "catalog_external_ids",
+		Up: func(tx *gorm.DB) error {
+			type Channel struct {
+				ID         uint
+				ExternalID string `gorm:"uniqueIndex"`
+			}
+			type Package struct {
+				ID         uint
+				ExternalID string `gorm:"uniqueIndex"`
+			}
+
+			if err := tx.Migrator().AddColumn(&Channel{}, "ExternalID"); err != nil {
+				return err
+			}
+			if err := tx.Migrator().AddColumn(&Package{}, "ExternalID"); err != nil {
+				return err
+			}
+
+			// Backfill existing rows so every record can be matched by a later import
+			var channels []Channel
+			if err := tx.Find(&channels).Error; err != nil {
+				return err
+			}
+			for _, c := range channels {
+				if err := tx.Model(&c).Update("external_id", fmt.Sprintf("channel-%d", c.ID)).Error; err != nil {
+					return err
+				}
+			}
+			var packages []Package
+			if err := tx.Find(&packages).Error; err != nil {
+				return err
+			}
+			for _, p := range packages {
+				if err := tx.Model(&p).Update("external_id", fmt.Sprintf("package-%d", p.ID)).Error; err != nil {
+					return err
+				}
+			}
+
+			if err := tx.Migrator().CreateIndex(&Channel{}, "ExternalID"); err != nil {
+				return err
+			}
+			return tx.Migrator().CreateIndex(&Package{}, "ExternalID")
+		},
+		Down: func(tx *gorm.DB) error {
+			type Channel struct {
+				ExternalID string `gorm:"uniqueIndex"`
+			}
+			type Package struct {
+				ExternalID string `gorm:"uniqueIndex"`
+			}
+
+			for _, model := range []any{&Channel{}, &Package{}} {
+				if err := tx.Migrator().DropIndex(model, "ExternalID"); err != nil {
+					return err
+				}
+				if err := tx.Migrator().DropColumn(model, "ExternalID"); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 3,
+		Name:    "subscription_playlists",
+		Up: func(tx *gorm.DB) error {
+			type Subscription struct {
+				ID            uint
+				PlaylistToken string `gorm:"uniqueIndex"`
+			}
+			type SubscriptionPackage struct {
+				SubscriptionID uint `gorm:"primaryKey"`
+				PackageID      uint `gorm:"primaryKey"`
+			}
+
+			if err := tx.Migrator().AddColumn(&Subscription{}, "PlaylistToken"); err != nil {
+				return err
+			}
+			var subscriptions []Subscription
+			if err := tx.Find(&subscriptions).Error; err != nil {
+				return err
+			}
+			for _, s := range subscriptions {
+				if err := tx.Model(&s).Update("playlist_token", newPlaylistToken()).Error; err != nil {
+					return err
+				}
+			}
+			if err := tx.Migrator().CreateIndex(&Subscription{}, "PlaylistToken"); err != nil {
+				return err
+			}
+			return tx.Migrator().CreateTable(&SubscriptionPackage{})
+		},
+		Down: func(tx *gorm.DB) error {
+			type Subscription struct {
+				PlaylistToken string `gorm:"uniqueIndex"`
+			}
+
+			if err := tx.Migrator().DropTable("subscription_packages"); err != nil {
+				return err
+			}
+			if err := tx.Migrator().DropIndex(&Subscription{}, "PlaylistToken"); err != nil {
+				return err
+			}
+			return tx.Migrator().DropColumn(&Subscription{}, "PlaylistToken")
+		},
+	},
+	{
+		Version: 4,
+		Name:    "epg",
+		Up: func(tx *gorm.DB) error {
+			type Channel struct {
+				EPGID string `gorm:"index"`
+			}
+			type Programme struct {
+				ID          uint      `gorm:"primaryKey"`
+				ChannelID   uint      `gorm:"index:idx_programmes_channel_start,priority:1"`
+				Start       time.Time `gorm:"index:idx_programmes_channel_start,priority:2"`
+				Stop        time.Time `gorm:"index"`
+				Title       string
+				SubTitle    string
+				Description string
+				Category    string
+				Icon        string
+				CreatedAt   time.Time
+			}
+
+			if err := tx.Migrator().AddColumn(&Channel{}, "EPGID"); err != nil {
+				return err
+			}
+			if err := tx.Migrator().CreateIndex(&Channel{}, "EPGID"); err != nil {
+				return err
+			}
+			return tx.Migrator().CreateTable(&Programme{})
+		},
+		Down: func(tx *gorm.DB) error {
+			type Channel struct {
+				EPGID string `gorm:"index"`
+			}
+
+			if err := tx.Migrator().DropTable("programmes"); err != nil {
+				return err
+			}
+			if err := tx.Migrator().DropIndex(&Channel{}, "EPGID"); err != nil {
+				return err
+			}
+			// The SQLite migrator drops columns by rebuilding the table, which would also
+			// drop the external_id index; every supported database understands this directly.
+			return tx.Exec("ALTER TABLE channels DROP COLUMN epg_id").Error
+		},
+	},
+	{
+		Version: 5,
+		Name:    "channel_lineups",
+		Up: func(tx *gorm.DB) error {
+			type Channel struct {
+				Category string `gorm:"index"`
+				Tags     string
+			}
+			type PackageChannel struct {
+				SortOrder     int `gorm:"not null;default:0"`
+				ChannelNumber int `gorm:"not null;default:0"`
+			}
+
+			for _, column := range []string{"Category", "Tags"} {
+				if err := tx.Migrator().AddColumn(&Channel{}, column); err != nil {
+					return err
+				}
+			}
+			if err := tx.Migrator().CreateIndex(&Channel{}, "Category"); err != nil {
+				return err
+			}
+			for _, column := range []string{"SortOrder", "ChannelNumber"} {
+				if err := tx.Migrator().AddColumn(&PackageChannel{}, column); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			type Channel struct {
+				Category string `gorm:"index"`
+			}
+
+			if err := tx.Migrator().DropIndex(&Channel{}, "Category"); err != nil {
+				return err
+			}
+			// Dropped directly for the same reason as in migration 4
+			for _, statement := range []string{
+				"ALTER TABLE channels DROP COLUMN category",
+				"ALTER TABLE channels DROP COLUMN tags",
+				"ALTER TABLE package_channels DROP COLUMN sort_order",
+				"ALTER TABLE package_channels DROP COLUMN channel_number",
+			} {
+				if err := tx.Exec(statement).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 6,
+		Name:    "pricing_plans",
+		Up: func(tx *gorm.DB) error {
+			type Package struct {
+				Kind string `gorm:"not null;default:base"`
+				Tier int    `gorm:"not null;default:0"`
+			}
+			type Subscription struct {
+				PlanID *uint
+			}
+			type Plan struct {
+				ID        uint `gorm:"primaryKey"`
+				PackageID uint `gorm:"uniqueIndex:idx_plans_package_months"`
+				Months    int  `gorm:"uniqueIndex:idx_plans_package_months"`
+				Price     float64
+				CreatedAt time.Time
+			}
+			type BundleRule struct {
+				ID              uint   `gorm:"primaryKey"`
+				Name            string `gorm:"not null"`
+				DiscountPercent float64
+				CreatedAt       time.Time
+			}
+			type BundleRulePackage struct {
+				BundleRuleID uint `gorm:"primaryKey"`
+				PackageID    uint `gorm:"primaryKey"`
+			}
+
+			for _, column := range []string{"Kind", "Tier"} {
+				if err := tx.Migrator().AddColumn(&Package{}, column); err != nil {
+					return err
+				}
+			}
+			if err := tx.Migrator().AddColumn(&Subscription{}, "PlanID"); err != nil {
+				return err
+			}
+			return tx.Migrator().CreateTable(&Plan{}, &BundleRule{}, &BundleRulePackage{})
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := tx.Migrator().DropTable("bundle_rule_packages", "bundle_rules", "plans"); err != nil {
+				return err
+			}
+			// Dropped directly for the same reason as in migration 4
+			for _, statement := range []string{
+				"ALTER TABLE subscriptions DROP COLUMN plan_id",
+				"ALTER TABLE packages DROP COLUMN tier",
+				"ALTER TABLE packages DROP COLUMN kind",
+			} {
+				if err := tx.Exec(statement).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 7,
+		Name:    "channel_availability",
+		Up: func(tx *gorm.DB) error {
+			type Channel struct {
+				Disabled     bool `gorm:"not null;default:false"`
+				Availability string
+			}
+
+			for _, column := range []string{"Disabled", "Availability"} {
+				if err := tx.Migrator().AddColumn(&Channel{}, column); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			// Dropped directly for the same reason as in migration 4
+			for _, statement := range []string{
+				"ALTER TABLE channels DROP COLUMN availability",
+				"ALTER TABLE channels DROP COLUMN disabled",
+			} {
+				if err := tx.Exec(statement).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 8,
+		Name:    "channel_health",
+		Up: func(tx *gorm.DB) error {
+			type ChannelHealth struct {
+				ChannelID       uint `gorm:"primaryKey;autoIncrement:false"`
+				Status          string
+				StatusCode      int
+				LatencyMS       int64
+				Representations int
+				LastError       string
+				CheckedAt       time.Time
+				LastOKAt        *time.Time
+			}
+			return tx.Table("channel_health").Migrator().CreateTable(&ChannelHealth{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable("channel_health")
+		},
+	},
+	{
+		Version: 9,
+		Name:    "stream_sources",
+		Up: func(tx *gorm.DB) error {
+			type StreamSource struct {
+				ID        uint   `gorm:"primaryKey"`
+				ChannelID uint   `gorm:"index;not null"`
+				URL       string `gorm:"not null"`
+				Format    string `gorm:"not null"`
+				Priority  int    `gorm:"not null;default:0"`
+				Weight    int    `gorm:"not null;default:1"`
+				Status    string
+				LastError string
+				LatencyMS int64
+				Failures  int
+				CheckedAt *time.Time
+				CreatedAt time.Time
+			}
+			return tx.Migrator().CreateTable(&StreamSource{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable("stream_sources")
+		},
+	},
+	{
+		Version: 10,
+		Name:    "stream_types",
+		Up: func(tx *gorm.DB) error {
+			type Channel struct {
+				StreamType string `gorm:"not null;default:dash"`
+				MimeType   string
+				LowLatency bool `gorm:"not null;default:false"`
+			}
+
+			for _, column := range []string{"StreamType", "MimeType", "LowLatency"} {
+				if err := tx.Migrator().AddColumn(&Channel{}, column); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			// Dropped directly for the same reason as in migration 4
+			for _, statement := range []string{
+				"ALTER TABLE channels DROP COLUMN low_latency",
+				"ALTER TABLE channels DROP COLUMN mime_type",
+				"ALTER TABLE channels DROP COLUMN stream_type",
+			} {
+				if err := tx.Exec(statement).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 11,
+		Name:    "subscription_key_hash",
+		Up: func(tx *gorm.DB) error {
+			type Subscription struct {
+				ID      uint
+				Key     string
+				KeyHash string `gorm:"index"`
+			}
+
+			if err := tx.Migrator().AddColumn(&Subscription{}, "KeyHash"); err != nil {
+				return err
+			}
+			if err := tx.Migrator().CreateIndex(&Subscription{}, "KeyHash"); err != nil {
+				return err
+			}
+
+			// Keys are still unencrypted unless the schema was rolled back and
+			// migrated again, so they are opened with the configured master keys
+			var rows []Subscription
+			if err := tx.Select("id", "key").Find(&rows).Error; err != nil {
+				return err
+			}
+			for _, row := range rows {
+				key, err := secrets.open(row.Key)
+				if err != nil {
+					return fmt.Errorf("subscription %d: %w", row.ID, err)
+				}
+				if err := tx.Model(&Subscription{ID: row.ID}).Update("key_hash", secrets.lookupHash(key)).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			type Subscription struct {
+				KeyHash string `gorm:"index"`
+			}
+
+			if err := tx.Migrator().DropIndex(&Subscription{}, "KeyHash"); err != nil {
+				return err
+			}
+			// Dropped directly for the same reason as in migration 4
+			return tx.Exec("ALTER TABLE subscriptions DROP COLUMN key_hash").Error
+		},
+	},
+	{
+		Version: 12,
+		Name:    "channel_keys",
+		Up: func(tx *gorm.DB) error {
+			type Channel struct {
+				ID  uint
+				Key string
+			}
+			type ChannelKey struct {
+				ID         uint   `gorm:"primaryKey"`
+				ChannelID  uint   `gorm:"index;not null"`
+				System     string `gorm:"not null;default:clearkey"`
+				KID        string
+				Key        string
+				LicenseURL string
+			}
+
+			if err := tx.Migrator().CreateTable(&ChannelKey{}); err != nil {
+				return err
+			}
+
+			// Move every "kid:key" pair into the new table; anything else was never
+			// usable by players. Keys stay encrypted when a master key is configured.
+			var channels []Channel
+			if err := tx.Select("id", "key").Find(&channels).Error; err != nil {
+				return err
+			}
+			for _, c := range channels {
+				value, err := secrets.open(c.Key)
+				if err != nil {
+					return fmt.Errorf("channel %d: %w", c.ID, err)
+				}
+				kid, key, ok := strings.Cut(value, ":")
+				if !ok || kid == "" || key == "" {
+					continue
+				}
+				if key, err = secrets.seal(key); err != nil {
+					return err
+				}
+				if err := tx.Create(&ChannelKey{ChannelID: c.ID, System: "clearkey", KID: kid, Key: key}).Error; err != nil {
+					return err
+				}
+			}
+			// Dropped directly for the same reason as in migration 4; key is quoted
+			// since MySQL reserves it
+			return tx.Exec("ALTER TABLE channels DROP COLUMN ?", clause.Column{Name: "key"}).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			type Channel struct {
+				ID  uint
+				Key string
+			}
+			type ChannelKey struct {
+				ChannelID uint
+				KID       string
+				Key       string
+			}
+
+			if err := tx.Migrator().AddColumn(&Channel{}, "Key"); err != nil {
+				return err
+			}
+			// Only the first ClearKey pair of each channel fits the old column. system
+			// is quoted since MySQL reserves it.
+			var keys []ChannelKey
+			if err := tx.Where(clause.Eq{Column: clause.Column{Name: "system"}, Value: "clearkey"}).Order("channel_id, id").Find(&keys).Error; err != nil {
+				return err
+			}
+			done := map[uint]bool{}
+			for _, k := range keys {
+				if done[k.ChannelID] {
+					continue
+				}
+				done[k.ChannelID] = true
+				key, err := secrets.open(k.Key)
+				if err != nil {
+					return fmt.Errorf("channel %d: %w", k.ChannelID, err)
+				}
+				value, err := secrets.seal(k.KID + ":" + key)
+				if err != nil {
+					return err
+				}
+				if err := tx.Model(&Channel{ID: k.ChannelID}).Update("key", value).Error; err != nil {
+					return err
+				}
+			}
+			return tx.Migrator().DropTable("channel_keys")
+		},
+	},
+	{
+		Version: 13,
+		Name:    "audit_events",
+		Up: func(tx *gorm.DB) error {
+			type AuditEvent struct {
+				ID         uint   `gorm:"primaryKey"`
+				Admin      string `gorm:"index"`
+				Action     string `gorm:"index"`
+				EntityType string `gorm:"index:idx_audit_events_entity,priority:1"`
+				EntityID   uint   `gorm:"index:idx_audit_events_entity,priority:2"`
+				Changes    string // JSON
+				IP         string
+				UserAgent  string
+				CreatedAt  time.Time `gorm:"index"`
+			}
+			return tx.Migrator().CreateTable(&AuditEvent{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable("audit_events")
+		},
+	},
+	{
+		Version: 14,
+		Name:    "admin_two_factor",
+		Up: func(tx *gorm.DB) error {
+			type Admin struct {
+				ID            uint
+				IsOwner       bool   `gorm:"not null;default:false"`
+				TOTPSecret    string // encrypted
+				TOTPEnabled   bool   `gorm:"not null;default:false"`
+				TOTPLastStep  int64
+				RecoveryCodes string // JSON list of hashes
+			}
+
+			for _, column := range []string{"IsOwner", "TOTPSecret", "TOTPEnabled", "TOTPLastStep", "RecoveryCodes"} {
+				if err := tx.Migrator().AddColumn(&Admin{}, column); err != nil {
+					return err
+				}
+			}
+			// The first admin, normally the default one, owns the installation
+			var first Admin
+			err := tx.Order("id").Limit(1).Find(&first).Error
+			if err != nil || first.ID == 0 {
+				return err
+			}
+			return tx.Model(&first).Update("is_owner", true).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			// Dropped directly for the same reason as in migration 4
+			for _, column := range []string{"recovery_codes", "totp_last_step", "totp_enabled", "totp_secret", "is_owner"} {
+				if err := tx.Exec("ALTER TABLE admins DROP COLUMN ?", clause.Column{Name: column}).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 15,
+		Name:    "api_keys",
+		Up: func(tx *gorm.DB) error {
+			type APIKey struct {
+				ID         uint   `gorm:"primaryKey"`
+				Name       string `gorm:"not null"`
+				Prefix     string `gorm:"uniqueIndex;not null"`
+				Hash       string `gorm:"not null"`
+				Scopes     string // JSON
+				AllowedIPs string // JSON
+				AdminID    uint   `gorm:"index"`
+				ExpiresAt  *time.Time
+				LastUsedAt *time.Time
+				LastUsedIP string
+				RevokedAt  *time.Time
+				CreatedAt  time.Time
+			}
+			type AuditEvent struct {
+				APIKey string
+			}
+
+			if err := tx.Migrator().CreateTable(&APIKey{}); err != nil {
+				return err
+			}
+			return tx.Migrator().AddColumn(&AuditEvent{}, "APIKey")
+		},
+		Down: func(tx *gorm.DB) error {
+			// Dropped directly for the same reason as in migration 4
+			if err := tx.Exec("ALTER TABLE audit_events DROP COLUMN api_key").Error; err != nil {
+				return err
+			}
+			return tx.Migrator().DropTable("api_keys")
+		},
+	},
+}
+
+// latestSchemaVersion returns the highest version known to this binary.
+func latestSchemaVersion() int {
+	latest := 0
+	for _, m := range migrations {
+		if m.Version > latest {
+			latest = m.Version
+		}
+	}
+	return latest
+}
+
+func sortedMigrations() []migration {
+	sorted := make([]migration, len(migrations))
+	copy(sorted, migrations)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Version < sorted[j].Version })
+	return sorted
+}
+
+func appliedMigrations(db *gorm.DB) (map[int]SchemaMigration, error) {
+	if err := db.AutoMigrate(&SchemaMigration{}); err != nil {
+		return nil, err
+	}
+
+	var rows []SchemaMigration
+	if err := db.Order("version").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	applied := make(map[int]SchemaMigration, len(rows))
+	for _, row := range rows {
+		applied[row.Version] = row
+	}
+	return applied, nil
+}
+
+// currentSchemaVersion returns the highest applied migration version.
+func currentSchemaVersion(db *gorm.DB) (int, error) {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return 0, err
+	}
+
+	current := 0
+	for version := range applied {
+		if version > current {
+			current = version
+		}
+	}
+	return current, nil
+}
+
+// checkSchemaVersion refuses to run against a database migrated by a newer binary.
+func checkSchemaVersion(db *gorm.DB) error {
+	current, err := currentSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+
+	if latest := latestSchemaVersion(); current > latest {
+		return fmt.Errorf("%w: database is at version %d, binary supports up to %d", errSchemaAhead, current, latest)
+	}
+	return nil
+}
+
+// pendingMigrations counts the migrations this binary has that the database
+// lacks, without creating the migrations table like appliedMigrations does.
+func pendingMigrations(ctx context.Context, db *gorm.DB) (int, error) {
+	var versions []int
+	if err := db.WithContext(ctx).Model(&SchemaMigration{}).Pluck("version", &versions).Error; err != nil {
+		return 0, err
+	}
+
+	applied := make(map[int]bool, len(versions))
+	for _, version := range versions {
+		if version > latestSchemaVersion() {
+			return 0, errSchemaAhead
+		}
+		applied[version] = true
+	}
+	pending := 0
+	for _, m := range migrations {
+		if !applied[m.Version] {
+			pending++
+		}
+	}
+	return pending, nil
+}
+
+func migrationStatus(db *gorm.DB) ([]migrationState, error) {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var states []migrationState
+	for _, m := range sortedMigrations() {
+		row, ok := applied[m.Version]
+		states = append(states, migrationState{
+			Version:   m.Version,
+			Name:      m.Name,
+			Applied:   ok,
+			AppliedAt: row.AppliedAt,
+		})
+	}
+	return states, nil
+}
+
+// migrateUp applies every pending migration up to and including target.
+// A target of 0 means the latest version.
+func migrateUp(db *gorm.DB, target int) ([]migration, error) {
+	if err := checkSchemaVersion(db); err != nil {
+		return nil, err
+	}
+
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+
+	if target == 0 {
+		target = latestSchemaVersion()
+	}
+
+	var done []migration
+	for _, m := range sortedMigrations() {
+		if m.Version > target {
+			break
+		}
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := m.Up(tx); err != nil {
+				return err
+			}
+			return tx.Create(&SchemaMigration{Version: m.Version, Name: m.Name, AppliedAt: time.Now()}).Error
+		})
+		if err != nil {
+			return done, fmt.Errorf("migration %d (%s) failed: %w", m.Version, m.Name, err)
+		}
+		done = append(done, m)
+	}
+	return done, nil
+}
+
+// migrateDown rolls back the given number of most recently applied migrations.
+func migrateDown(db *gorm.DB, steps int) ([]migration, error) {
+	if err := checkSchemaVersion(db); err != nil {
+		return nil, err
+	}
+
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+
+	sorted := sortedMigrations()
+	var done []migration
+	for i := len(sorted) - 1; i >= 0 && len(done) < steps; i-- {
+		m := sorted[i]
+		if _, ok := applied[m.Version]; !ok {
+			continue
+		}
+
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := m.Down(tx); err != nil {
+				return err
+			}
+			return tx.Delete(&SchemaMigration{}, m.Version).Error
+		})
+		if err != nil {
+			return done, fmt.Errorf("rollback of migration %d (%s) failed: %w", m.Version, m.Name, err)
+		}
+		done = append(done, m)
+	}
+	return done, nil
+}
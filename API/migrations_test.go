@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// useRecordedMigrations swaps in migrations that only log their steps, listed
+// out of order to check that the runner sorts them by version.
+func useRecordedMigrations(t *testing.T) *[]string {
+	t.Helper()
+	var steps []string
+	record := func(step string) func(*gorm.DB) error {
+		return func(*gorm.DB) error {
+			steps = append(steps, step)
+			return nil
+		}
+	}
+
+	previous := migrations
+	migrations = nil
+	for _, version := range []int{3, 1, 2} {
+		migrations = append(migrations, migration{
+			Version: version,
+			Name:    fmt.Sprintf("step_%d", version),
+			Up:      record(fmt.Sprintf("up %d", version)),
+			Down:    record(fmt.Sprintf("down %d", version)),
+		})
+	}
+	t.Cleanup(func() { migrations = previous })
+	return &steps
+}
+
+func openMigrationTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	conn, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "migrations.db")), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := conn.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return conn
+}
+
+func migrationVersions(done []migration) []int {
+	versions := []int{}
+	for _, m := range done {
+		versions = append(versions, m.Version)
+	}
+	return versions
+}
+
+func TestMigrationsRunInVersionOrder(t *testing.T) {
+	steps := useRecordedMigrations(t)
+	conn := openMigrationTestDB(t)
+
+	done, err := migrateUp(conn, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := migrationVersions(done); !reflect.DeepEqual(got, []int{1, 2, 3}) {
+		t.Fatalf("applied %v, want [1 2 3]", got)
+	}
+
+	done, err = migrateDown(conn, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := migrationVersions(done); !reflect.DeepEqual(got, []int{3, 2}) {
+		t.Fatalf("rolled back %v, want [3 2]", got)
+	}
+
+	want := []string{"up 1", "up 2", "up 3", "down 3", "down 2"}
+	if !reflect.DeepEqual(*steps, want) {
+		t.Fatalf("steps = %v, want %v", *steps, want)
+	}
+	if current, _ := currentSchemaVersion(conn); current != 1 {
+		t.Fatalf("current version = %d, want 1", current)
+	}
+}
+
+func TestMigrateUpSkipsAppliedMigrations(t *testing.T) {
+	steps := useRecordedMigrations(t)
+	conn := openMigrationTestDB(t)
+
+	if _, err := migrateUp(conn, 2); err != nil {
+		t.Fatal(err)
+	}
+	done, err := migrateUp(conn, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := migrationVersions(done); !reflect.DeepEqual(got, []int{3}) {
+		t.Fatalf("second run applied %v, want [3]", got)
+	}
+	if done, _ := migrateUp(conn, 0); len(done) != 0 {
+		t.Fatalf("third run applied %v", migrationVersions(done))
+	}
+
+	want := []string{"up 1", "up 2", "up 3"}
+	if !reflect.DeepEqual(*steps, want) {
+		t.Fatalf("steps = %v, want %v", *steps, want)
+	}
+}
+
+func TestPendingMigrations(t *testing.T) {
+	useRecordedMigrations(t)
+	conn := openMigrationTestDB(t)
+	ctx := context.Background()
+
+	// Without a migrations table there is nothing to count from
+	if _, err := pendingMigrations(ctx, conn); err == nil {
+		t.Fatal("pendingMigrations succeeded without a migrations table")
+	}
+	if conn.Migrator().HasTable(&SchemaMigration{}) {
+		t.Fatal("pendingMigrations created the migrations table")
+	}
+
+	for _, step := range []struct{ target, pending int }{{1, 2}, {3, 0}} {
+		if _, err := migrateUp(conn, step.target); err != nil {
+			t.Fatal(err)
+		}
+		if pending, err := pendingMigrations(ctx, conn); err != nil || pending != step.pending {
+			t.Fatalf("after migrating to %d: %d pending, %v; want %d", step.target, pending, err, step.pending)
+		}
+	}
+
+	if err := conn.Create(&SchemaMigration{Version: 4, Name: "from_the_future", AppliedAt: time.Now()}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pendingMigrations(ctx, conn); !errors.Is(err, errSchemaAhead) {
+		t.Fatalf("pendingMigrations error = %v, want errSchemaAhead", err)
+	}
+}
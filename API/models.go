@@ -0,0 +1,309 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Database models
+type IPTVHoster struct {
+	ID           uint      `json:"id" gorm:"primaryKey"`
+	Name         string    `json:"name" gorm:"unique;not null"`
+	Logo         string    `json:"logo"`
+	ColorPalette string    `json:"color_palette"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+type User struct {
+	ID            uint           `json:"id" gorm:"primaryKey"`
+	Name          string         `json:"name" gorm:"not null"`
+	Avatar        string         `json:"avatar"`
+	TeleUsername  string         `json:"tele_username"`
+	Reference     string         `json:"reference"`
+	IsAdmin       bool           `json:"is_admin" gorm:"default:false"`
+	IsHoster      bool           `json:"is_hoster" gorm:"default:false"`
+	IPTVHosterID  *uint          `json:"iptv_hoster_id"`
+	IPTVHoster    *IPTVHoster    `json:"iptv_hoster,omitempty" gorm:"foreignKey:IPTVHosterID"`
+	Subscriptions []Subscription `json:"subscriptions,omitempty"`
+	CreatedAt     time.Time      `json:"created_at"`
+}
+
+type Admin struct {
+	ID            uint      `json:"id" gorm:"primaryKey"`
+	Username      string    `json:"username" gorm:"unique;not null"`
+	Password      string    `json:"-" gorm:"not null"`                      // Hidden from JSON
+	IsOwner       bool      `json:"is_owner" gorm:"not null;default:false"` // may reset other admins' 2FA
+	TOTPSecret    string    `json:"-" gorm:"serializer:encrypted"`          // pending until TOTPEnabled
+	TOTPEnabled   bool      `json:"totp_enabled" gorm:"not null;default:false"`
+	TOTPLastStep  int64     `json:"-"`                        // last accepted time step, codes are single use
+	RecoveryCodes []string  `json:"-" gorm:"serializer:json"` // hashes of unused recovery codes
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+type Subscription struct {
+	ID            uint      `json:"id" gorm:"primaryKey"`
+	UserID        uint      `json:"user_id"`
+	User          User      `json:"user,omitempty" gorm:"foreignKey:UserID"`
+	Started       time.Time `json:"started"`
+	End           time.Time `json:"end"`
+	Payed         float64   `json:"payed"`
+	Key           string    `json:"key" gorm:"serializer:encrypted"`
+	KeyHash       string    `json:"-" gorm:"index"` // lookup hash of Key, see secretBox.lookupHash
+	PlanID        *uint     `json:"plan_id"`        // base plan the subscription was sold with, if any
+	PlaylistToken string    `json:"playlist_token" gorm:"uniqueIndex"`
+	Packages      []Package `json:"packages,omitempty" gorm:"many2many:subscription_packages;"` // empty means every package
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// Subscription status values reported by validateSubscription
+const (
+	statusActive     = "active"
+	statusNotStarted = "not_started"
+	statusExpired    = "expired"
+)
+
+func (s *Subscription) Status(now time.Time) string {
+	switch {
+	case !now.After(s.Started):
+		return statusNotStarted
+	case !now.Before(s.End):
+		return statusExpired
+	default:
+		return statusActive
+	}
+}
+
+// BeforeSave keeps the lookup hash in step with the encrypted key
+func (s *Subscription) BeforeSave(tx *gorm.DB) error {
+	s.KeyHash = secrets.lookupHash(s.Key)
+	return nil
+}
+
+func (s *Subscription) BeforeCreate(tx *gorm.DB) error {
+	if s.PlaylistToken == "" {
+		s.PlaylistToken = newPlaylistToken()
+	}
+	return nil
+}
+
+// newPlaylistToken returns the secret that authenticates a subscription's playlist URL
+func newPlaylistToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+type Package struct {
+	ID         uint      `json:"id" gorm:"primaryKey"`
+	ExternalID string    `json:"external_id" gorm:"uniqueIndex"`
+	Name       string    `json:"name" gorm:"unique;not null"`
+	Logo       string    `json:"logo"`
+	Kind       string    `json:"kind" gorm:"not null;default:base"` // base or addon
+	Tier       int       `json:"tier"`                              // ranks base packages, higher is more complete
+	Channels   []Channel `json:"channels,omitempty" gorm:"many2many:package_channels;"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// Package kinds. A subscription is sold with one base package; add-ons can only
+// be bought on top of it.
+const (
+	packageBase  = "base"
+	packageAddon = "addon"
+)
+
+// Plan is the price of a package for a subscription period
+type Plan struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	PackageID uint      `json:"package_id" gorm:"uniqueIndex:idx_plans_package_months"`
+	Months    int       `json:"months" gorm:"uniqueIndex:idx_plans_package_months"`
+	Price     float64   `json:"price"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// planDurations are the subscription periods plans can be sold for, in months
+var planDurations = []int{1, 3, 6, 12}
+
+// BundleRule discounts subscriptions that include every one of its packages
+type BundleRule struct {
+	ID              uint      `json:"id" gorm:"primaryKey"`
+	Name            string    `json:"name" gorm:"not null"`
+	DiscountPercent float64   `json:"discount_percent"`
+	PackageIDs      []uint    `json:"package_ids" gorm:"-"` // stored in bundle_rule_packages
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+type BundleRulePackage struct {
+	BundleRuleID uint `gorm:"primaryKey"`
+	PackageID    uint `gorm:"primaryKey"`
+}
+
+type Channel struct {
+	ID            uint                 `json:"id" gorm:"primaryKey"`
+	ExternalID    string               `json:"external_id" gorm:"uniqueIndex"`
+	Name          string               `json:"name" gorm:"not null"`
+	Logo          string               `json:"logo"`
+	MPD           string               `json:"mpd"`                                        // stream URL, a manifest or playlist unless progressive
+	StreamType    string               `json:"stream_type" gorm:"not null;default:dash"`   // dash, hls or progressive
+	MimeType      string               `json:"mime_type,omitempty"`                        // progressive streams only
+	LowLatency    bool                 `json:"low_latency,omitempty"`                      // low latency DASH or HLS
+	Keys          []ChannelKey         `json:"keys,omitempty" gorm:"foreignKey:ChannelID"` // DRM keys and license servers
+	Key           string               `json:"key,omitempty" gorm:"-"`                     // deprecated: first ClearKey pair as kid:key
+	LastRefreshed time.Time            `json:"last_refreshed"`
+	ExpiresEvery  int64                `json:"expires_every"`
+	EPGID         string               `json:"epg_id" gorm:"index"` // XMLTV channel id, defaults to ExternalID
+	Category      string               `json:"category" gorm:"index"`
+	Tags          []string             `json:"tags" gorm:"serializer:json"`
+	Disabled      bool                 `json:"disabled" gorm:"not null;default:false"` // hidden from subscribers
+	Availability  []AvailabilityWindow `json:"availability" gorm:"serializer:json"`    // listed only while a window is open, always when empty
+	ChannelNumber int                  `json:"channel_number,omitempty" gorm:"-"`      // set when listed as part of a package
+	Health        *ChannelHealth       `json:"health,omitempty" gorm:"-"`              // latest stream check, admin listings only
+	Sources       []PlaybackSource     `json:"sources,omitempty" gorm:"-"`             // best first, set by the public catalog
+	DRM           *DRMConfig           `json:"drm,omitempty" gorm:"-"`                 // set by the public catalog
+	Packages      []Package            `json:"packages,omitempty" gorm:"many2many:package_channels;"`
+	CreatedAt     time.Time            `json:"created_at"`
+}
+
+// PackageChannel is a channel's place in a package's lineup. Channels are listed
+// by SortOrder, then ID; ChannelNumber is the logical channel number shown to
+// viewers, 0 when unnumbered.
+type PackageChannel struct {
+	PackageID     uint `json:"-" gorm:"primaryKey"`
+	ChannelID     uint `json:"channel_id" gorm:"primaryKey"`
+	SortOrder     int  `json:"-" gorm:"not null;default:0"`
+	ChannelNumber int  `json:"channel_number" gorm:"not null;default:0"`
+}
+
+// ChannelHealth is the result of the latest check of a channel's stream manifest
+type ChannelHealth struct {
+	ChannelID       uint       `json:"channel_id" gorm:"primaryKey;autoIncrement:false"`
+	Status          string     `json:"status"`                // ok or error
+	StatusCode      int        `json:"status_code,omitempty"` // HTTP status of the manifest request
+	LatencyMS       int64      `json:"latency_ms"`
+	Representations int        `json:"representations"`
+	LastError       string     `json:"last_error,omitempty"`
+	CheckedAt       time.Time  `json:"checked_at"`
+	LastOKAt        *time.Time `json:"last_ok_at,omitempty"`
+}
+
+func (ChannelHealth) TableName() string { return "channel_health" }
+
+// StreamSource is one of the URLs a channel can be played from, with the
+// result of its latest health check
+type StreamSource struct {
+	ID        uint       `json:"id" gorm:"primaryKey"`
+	ChannelID uint       `json:"channel_id" gorm:"index;not null"`
+	URL       string     `json:"url" gorm:"not null"`
+	Format    string     `json:"format" gorm:"not null"`             // dash or hls
+	Priority  int        `json:"priority" gorm:"not null;default:0"` // lower is tried first
+	Weight    int        `json:"weight" gorm:"not null;default:1"`   // share among sources of equal priority
+	Status    string     `json:"status"`                             // ok or error, empty until checked
+	LastError string     `json:"last_error,omitempty"`
+	LatencyMS int64      `json:"latency_ms"`
+	Failures  int        `json:"failures"` // consecutive failed checks
+	CheckedAt *time.Time `json:"checked_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// ChannelKey is a DRM key of a channel: a ClearKey KID and key pair, or the
+// license server of another key system
+type ChannelKey struct {
+	ID         uint   `json:"-" gorm:"primaryKey"`
+	ChannelID  uint   `json:"-" gorm:"index;not null"`
+	System     string `json:"system" gorm:"not null;default:clearkey"`   // clearkey, widevine or playready
+	KID        string `json:"kid,omitempty"`                             // lowercase hex
+	Key        string `json:"key,omitempty" gorm:"serializer:encrypted"` // lowercase hex, ClearKey only
+	LicenseURL string `json:"license_url,omitempty"`                     // Widevine and PlayReady only
+}
+
+// GuideID is the XMLTV channel id the channel's programme guide is matched by
+func (c *Channel) GuideID() string {
+	if c.EPGID != "" {
+		return c.EPGID
+	}
+	return c.ExternalID
+}
+
+// Programme is a single programme guide entry, imported from XMLTV
+type Programme struct {
+	ID          uint      `json:"id" gorm:"primaryKey"`
+	ChannelID   uint      `json:"channel_id" gorm:"index:idx_programmes_channel_start,priority:1"`
+	Start       time.Time `json:"start" gorm:"index:idx_programmes_channel_start,priority:2"`
+	Stop        time.Time `json:"stop" gorm:"index"`
+	Title       string    `json:"title"`
+	SubTitle    string    `json:"sub_title,omitempty"`
+	Description string    `json:"description,omitempty"`
+	Category    string    `json:"category,omitempty"`
+	Icon        string    `json:"icon,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Stable identifiers used to match records across catalog imports
+func (p *Package) BeforeCreate(tx *gorm.DB) error {
+	if p.ExternalID == "" {
+		p.ExternalID = newExternalID("package")
+	}
+	if p.Kind == "" {
+		p.Kind = packageBase
+	}
+	return nil
+}
+
+func (c *Channel) BeforeCreate(tx *gorm.DB) error {
+	if c.ExternalID == "" {
+		c.ExternalID = newExternalID("channel")
+	}
+	if c.StreamType == "" {
+		c.StreamType = formatDASH
+	}
+	return nil
+}
+
+// AfterFind fills in the deprecated key field from the loaded keys
+func (c *Channel) AfterFind(tx *gorm.DB) error {
+	c.Key = legacyKey(c.Keys)
+	return nil
+}
+
+func newExternalID(prefix string) string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return prefix + "-" + hex.EncodeToString(b)
+}
+
+// APIKey is a named, scoped credential for scripts, see apikeys.go
+type APIKey struct {
+	ID         uint       `json:"id" gorm:"primaryKey"`
+	Name       string     `json:"name" gorm:"not null"`
+	Prefix     string     `json:"prefix" gorm:"uniqueIndex;not null"` // identifies the key, shown as ssk_<prefix>_...
+	Hash       string     `json:"-" gorm:"not null"`                  // SHA-256 of the whole key
+	Scopes     []string   `json:"scopes" gorm:"serializer:json"`
+	AllowedIPs []string   `json:"allowed_ips,omitempty" gorm:"serializer:json"` // addresses and CIDR ranges, any when empty
+	AdminID    uint       `json:"admin_id" gorm:"index"`                        // the admin the key acts for
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	LastUsedIP string     `json:"last_used_ip,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// AuditEvent is an admin change recorded in the audit log
+type AuditEvent struct {
+	ID         uint                   `json:"id" gorm:"primaryKey"`
+	Admin      string                 `json:"admin" gorm:"index"`
+	Action     string                 `json:"action" gorm:"index"` // create, update, delete, import or a route specific action
+	EntityType string                 `json:"entity_type" gorm:"index:idx_audit_events_entity,priority:1"`
+	EntityID   uint                   `json:"entity_id,omitempty" gorm:"index:idx_audit_events_entity,priority:2"`
+	Changes    map[string]FieldChange `json:"changes,omitempty" gorm:"serializer:json"` // secret fields redacted
+	APIKey     string                 `json:"api_key,omitempty"`                        // prefix of the API key used, if any
+	IP         string                 `json:"ip"`
+	UserAgent  string                 `json:"user_agent"`
+	CreatedAt  time.Time              `json:"created_at" gorm:"index"`
+}
+
+type LoginRequest struct {
+	Username string `json:"username" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+)
+
+// Pricing
+//
+// A subscription is sold from a plan for a base package, optionally with add-on
+// packages priced by their plan for the same number of months. Bundle rules
+// discount selections that contain all of their packages; only the best
+// matching rule applies.
+
+// QuoteLine is the price of one package in a quote
+type QuoteLine struct {
+	PackageID uint    `json:"package_id"`
+	Name      string  `json:"name"`
+	Kind      string  `json:"kind"`
+	PlanID    uint    `json:"plan_id"`
+	Price     float64 `json:"price"`
+}
+
+// QuoteBundle is the bundle rule applied to a quote
+type QuoteBundle struct {
+	ID              uint    `json:"id"`
+	Name            string  `json:"name"`
+	DiscountPercent float64 `json:"discount_percent"`
+}
+
+// Quote is the computed price of a plan and its add-ons. Amounts are rounded to cents.
+type Quote struct {
+	Months   int          `json:"months"`
+	Lines    []QuoteLine  `json:"lines"`
+	Subtotal float64      `json:"subtotal"`
+	Bundle   *QuoteBundle `json:"bundle,omitempty"`
+	Discount float64      `json:"discount"`
+	Total    float64      `json:"total"`
+}
+
+// PackageIDs lists the quoted packages, base package first
+func (q *Quote) PackageIDs() []uint {
+	ids := make([]uint, 0, len(q.Lines))
+	for _, line := range q.Lines {
+		ids = append(ids, line.PackageID)
+	}
+	return ids
+}
+
+// quoteSubscription prices a base plan with the given add-on packages. Errors
+// describe an invalid selection and are meant for the client.
+func quoteSubscription(plan Plan, addonIDs []uint, packages []Package, plans []Plan, rules []BundleRule) (*Quote, error) {
+	byID := map[uint]Package{}
+	for _, pkg := range packages {
+		byID[pkg.ID] = pkg
+	}
+	planFor := func(packageID uint) (Plan, bool) {
+		for _, p := range plans {
+			if p.PackageID == packageID && p.Months == plan.Months {
+				return p, true
+			}
+		}
+		return Plan{}, false
+	}
+
+	base, ok := byID[plan.PackageID]
+	if !ok {
+		return nil, fmt.Errorf("package %d of plan %d does not exist", plan.PackageID, plan.ID)
+	}
+	if base.Kind == packageAddon {
+		return nil, fmt.Errorf("plan %d is for add-on package %q; choose a plan for a base package", plan.ID, base.Name)
+	}
+
+	quote := &Quote{Months: plan.Months, Lines: []QuoteLine{
+		{PackageID: base.ID, Name: base.Name, Kind: packageBase, PlanID: plan.ID, Price: plan.Price},
+	}}
+	selected := map[uint]bool{base.ID: true}
+	for _, id := range addonIDs {
+		addon, ok := byID[id]
+		switch {
+		case !ok:
+			return nil, fmt.Errorf("package %d does not exist", id)
+		case selected[id]:
+			return nil, fmt.Errorf("package %q is selected more than once", addon.Name)
+		case addon.Kind != packageAddon:
+			return nil, fmt.Errorf("package %q is not an add-on", addon.Name)
+		}
+		addonPlan, ok := planFor(id)
+		if !ok {
+			return nil, fmt.Errorf("add-on %q has no %d month plan", addon.Name, plan.Months)
+		}
+		selected[id] = true
+		quote.Lines = append(quote.Lines, QuoteLine{PackageID: id, Name: addon.Name, Kind: packageAddon, PlanID: addonPlan.ID, Price: addonPlan.Price})
+	}
+
+	for _, line := range quote.Lines {
+		quote.Subtotal += line.Price
+	}
+	quote.Subtotal = roundCents(quote.Subtotal)
+
+	for _, rule := range rules {
+		if len(rule.PackageIDs) == 0 || !allSelected(rule.PackageIDs, selected) {
+			continue
+		}
+		if quote.Bundle == nil || rule.DiscountPercent > quote.Bundle.DiscountPercent {
+			quote.Bundle = &QuoteBundle{ID: rule.ID, Name: rule.Name, DiscountPercent: rule.DiscountPercent}
+		}
+	}
+	if quote.Bundle != nil {
+		quote.Discount = roundCents(quote.Subtotal * quote.Bundle.DiscountPercent / 100)
+	}
+	quote.Total = roundCents(quote.Subtotal - quote.Discount)
+	return quote, nil
+}
+
+func allSelected(ids []uint, selected map[uint]bool) bool {
+	return !slices.ContainsFunc(ids, func(id uint) bool { return !selected[id] })
+}
+
+func roundCents(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestQuoteSubscription(t *testing.T) {
+	packages := []Package{
+		{ID: 1, Name: "Basic", Kind: packageBase},
+		{ID: 2, Name: "Sport", Kind: packageAddon},
+		{ID: 3, Name: "Movies", Kind: packageAddon},
+	}
+	plans := []Plan{
+		{ID: 10, PackageID: 1, Months: 3, Price: 30},
+		{ID: 11, PackageID: 2, Months: 3, Price: 12.5},
+		{ID: 12, PackageID: 3, Months: 3, Price: 9.99},
+		{ID: 13, PackageID: 3, Months: 1, Price: 4},
+		{ID: 14, PackageID: 2, Months: 12, Price: 40},
+	}
+	rules := []BundleRule{
+		{ID: 1, Name: "Sports fan", DiscountPercent: 10, PackageIDs: []uint{1, 2}},
+		{ID: 2, Name: "Everything", DiscountPercent: 15, PackageIDs: []uint{1, 2, 3}},
+	}
+
+	quote, err := quoteSubscription(plans[0], []uint{2, 3}, packages, plans, rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if quote.Months != 3 || !slices.Equal(quote.PackageIDs(), []uint{1, 2, 3}) ||
+		quote.Subtotal != 52.49 || quote.Bundle == nil || quote.Bundle.Name != "Everything" ||
+		quote.Discount != 7.87 || quote.Total != 44.62 {
+		t.Fatalf("quote = %+v, bundle %+v", quote, quote.Bundle)
+	}
+
+	quote, err = quoteSubscription(plans[0], nil, packages, plans, rules)
+	if err != nil || quote.Bundle != nil || quote.Total != 30 {
+		t.Fatalf("base only: %+v, %v", quote, err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		plan   Plan
+		addons []uint
+		want   string
+	}{
+		{"add-on plan", plans[1], nil, "add-on package"},
+		{"base as add-on", plans[0], []uint{1}, "more than once"},
+		{"duplicate add-on", plans[0], []uint{2, 2}, "more than once"},
+		{"unknown package", plans[0], []uint{9}, "does not exist"},
+		{"no plan for duration", Plan{ID: 15, PackageID: 1, Months: 12}, []uint{3}, "no 12 month plan"},
+	} {
+		if _, err := quoteSubscription(tc.plan, tc.addons, packages, plans, rules); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: error %v, want %q", tc.name, err, tc.want)
+		}
+	}
+}
+
+// seedPricing creates a base package and an add-on with three month plans and
+// a bundle of the two, returning the base plan's ID and the add-on's ID
+func seedPricing(t *testing.T, r *gin.Engine, token string) (planID, addonID uint) {
+	t.Helper()
+	create := func(path, body string, v any) {
+		t.Helper()
+		w := doRequest(r, http.MethodPost, path, body, token)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("POST %s: status %d, body %s", path, w.Code, w.Body)
+		}
+		decodeJSON(t, w, v)
+	}
+
+	var base, addon Package
+	create("/api/admin/packages", `{"name":"Basic"}`, &base)
+	create("/api/admin/packages", `{"name":"Sport","kind":"addon"}`, &addon)
+	if base.Kind != packageBase {
+		t.Fatalf("kind defaulted to %q, want base", base.Kind)
+	}
+
+	var plan, addonPlan Plan
+	create("/api/admin/plans", fmt.Sprintf(`{"package_id":%d,"months":3,"price":30}`, base.ID), &plan)
+	create("/api/admin/plans", fmt.Sprintf(`{"package_id":%d,"months":3,"price":10}`, addon.ID), &addonPlan)
+	var rule BundleRule
+	create("/api/admin/bundles", fmt.Sprintf(`{"name":"Sports fan","discount_percent":25,"package_ids":[%d,%d]}`, base.ID, addon.ID), &rule)
+	return plan.ID, addon.ID
+}
+
+func TestSubscriptionFromPlan(t *testing.T) {
+	servers := map[string]func(t *testing.T) *gin.Engine{
+		"gorm":   func(t *testing.T) *gin.Engine { r, _ := newTestServer(t); return r },
+		"memory": func(t *testing.T) *gin.Engine { r, _ := newMemoryServer(t); return r },
+	}
+	for name, newRouter := range servers {
+		t.Run(name, func(t *testing.T) {
+			r := newRouter(t)
+			token := adminToken(t)
+			planID, addonID := seedPricing(t, r, token)
+
+			w := doRequest(r, http.MethodPost, "/api/admin/subscriptions/quote", fmt.Sprintf(`{"plan_id":%d,"addon_ids":[%d]}`, planID, addonID), token)
+			var quote Quote
+			decodeJSON(t, w, &quote)
+			if w.Code != http.StatusOK || quote.Subtotal != 40 || quote.Discount != 10 || quote.Total != 30 {
+				t.Fatalf("quote: status %d, %+v", w.Code, quote)
+			}
+
+			started := time.Date(2026, 1, 31, 12, 0, 0, 0, time.UTC)
+			body := fmt.Sprintf(`{"key":"PLAN","started":%q,"plan_id":%d,"addon_ids":[%d]}`, started.Format(time.RFC3339), planID, addonID)
+			w = doRequest(r, http.MethodPost, "/api/admin/subscriptions", body, token)
+			if w.Code != http.StatusCreated {
+				t.Fatalf("create: status %d, body %s", w.Code, w.Body)
+			}
+			var sub Subscription
+			decodeJSON(t, w, &sub)
+
+			w = doRequest(r, http.MethodGet, fmt.Sprintf("/api/admin/subscriptions/%d", sub.ID), "", token)
+			decodeJSON(t, w, &sub)
+			if !sub.End.Equal(started.AddDate(0, 3, 0)) || sub.Payed != 30 || sub.PlanID == nil || *sub.PlanID != planID || len(sub.Packages) != 2 {
+				t.Fatalf("subscription = %+v", sub)
+			}
+
+			// Add-ons need a plan, and a plan must be for a base package
+			w = doRequest(r, http.MethodPost, "/api/admin/subscriptions", fmt.Sprintf(`{"key":"X","addon_ids":[%d]}`, addonID), token)
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("add-on without plan: status %d, want 400", w.Code)
+			}
+			w = doRequest(r, http.MethodPost, "/api/admin/plans", fmt.Sprintf(`{"package_id":%d,"months":2,"price":5}`, addonID), token)
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("2 month plan: status %d, want 400", w.Code)
+			}
+			w = doRequest(r, http.MethodPost, "/api/admin/plans", fmt.Sprintf(`{"package_id":%d,"months":3,"price":5}`, addonID), token)
+			if w.Code != http.StatusConflict {
+				t.Fatalf("duplicate plan: status %d, want 409", w.Code)
+			}
+		})
+	}
+}
+
+func TestDeletingPackageRemovesItsPlans(t *testing.T) {
+	services := newMemoryServices()
+	ctx := context.Background()
+	pkg := Package{Name: "Basic"}
+	services.Packages.Create(ctx, &pkg)
+	services.Plans.Create(ctx, &Plan{PackageID: pkg.ID, Months: 1, Price: 10})
+	services.Bundles.Create(ctx, &BundleRule{Name: "B", DiscountPercent: 5, PackageIDs: []uint{pkg.ID, 99}})
+
+	services.Packages.Delete(ctx, pkg.ID)
+	plans, _ := services.Plans.List(ctx)
+	rules, _ := services.Bundles.List(ctx)
+	if len(plans) != 0 || !slices.Equal(rules[0].PackageIDs, []uint{99}) {
+		t.Fatalf("plans %+v, bundles %+v", plans, rules)
+	}
+}
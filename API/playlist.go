@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// M3U playlist export
+//
+// renderM3U writes the entitled channels as an extended M3U playlist that standard
+// IPTV players understand. Each channel is listed once, in lineup order, grouped
+// under the first package that contains it. Channels with DRM keys get the
+// KODIPROP lines used by inputstream.adaptive and compatible players: their
+// ClearKey pairs, or else the license server of the first other key system.
+// guideURL, when set, points players at the matching XMLTV guide.
+func renderM3U(packages []Package, guideURL string) string {
+	var b strings.Builder
+	if guideURL != "" {
+		fmt.Fprintf(&b, "#EXTM3U url-tvg=\"%s\"\n", m3uAttr(guideURL))
+	} else {
+		b.WriteString("#EXTM3U\n")
+	}
+
+	seen := map[uint]bool{}
+	for _, pkg := range packages {
+		for _, channel := range pkg.Channels {
+			if seen[channel.ID] || channel.MPD == "" {
+				continue
+			}
+			seen[channel.ID] = true
+
+			fmt.Fprintf(&b, "#EXTINF:-1 tvg-id=\"%s\" tvg-name=\"%s\" tvg-logo=\"%s\"", m3uAttr(channel.GuideID()), m3uAttr(channel.Name), m3uAttr(channel.Logo))
+			if channel.ChannelNumber > 0 {
+				fmt.Fprintf(&b, " tvg-chno=\"%d\"", channel.ChannelNumber)
+			}
+			fmt.Fprintf(&b, " group-title=\"%s\",%s\n", m3uAttr(pkg.Name), m3uTitle(channel.Name))
+			if licenseType, licenseKey := kodiLicense(channel.Keys); licenseType != "" {
+				fmt.Fprintf(&b, "#KODIPROP:inputstream.adaptive.manifest_type=%s\n", kodiManifestType(channel.StreamType))
+				fmt.Fprintf(&b, "#KODIPROP:inputstream.adaptive.license_type=%s\n", licenseType)
+				fmt.Fprintf(&b, "#KODIPROP:inputstream.adaptive.license_key=%s\n", m3uTitle(licenseKey))
+			}
+			b.WriteString(m3uTitle(channel.MPD) + "\n")
+		}
+	}
+	return b.String()
+}
+
+// kodiLicense returns the inputstream.adaptive license type and key for a
+// channel's keys, empty without keys
+func kodiLicense(keys []ChannelKey) (string, string) {
+	var pairs []string
+	for _, k := range keys {
+		if k.System == keySystemClearKey {
+			pairs = append(pairs, k.KID+":"+k.Key)
+		}
+	}
+	if len(pairs) > 0 {
+		return "clearkey", strings.Join(pairs, ",")
+	}
+	for _, k := range keys {
+		return keySystemIDs[k.System], k.LicenseURL
+	}
+	return "", ""
+}
+
+// kodiManifestType returns the inputstream.adaptive manifest type of a stream type
+func kodiManifestType(streamType string) string {
+	if streamType == formatHLS {
+		return "hls"
+	}
+	return "mpd"
+}
+
+// m3uAttr makes a value safe inside a double quoted EXTINF attribute
+func m3uAttr(s string) string {
+	return strings.ReplaceAll(m3uTitle(s), `"`, "'")
+}
+
+// m3uTitle keeps a value on a single line
+func m3uTitle(s string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(s)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPlaylistExport(t *testing.T) {
+	r, conn := newTestServer(t)
+	token := adminToken(t)
+
+	news := Channel{ExternalID: "news", Name: "News", Logo: "news.png", MPD: "https://cdn.example/news.mpd", Keys: []ChannelKey{{System: keySystemClearKey, KID: testKID, Key: testContentKey}}}
+	movies := Channel{ExternalID: "movies", Name: `The "Movie" Channel`, MPD: "https://cdn.example/movies.mpd"}
+	conn.Create(&news)
+	conn.Create(&movies)
+	basic := Package{Name: "Basic", Channels: []Channel{news}}
+	premium := Package{Name: "Premium", Channels: []Channel{movies, news}}
+	conn.Create(&basic)
+	conn.Create(&premium)
+
+	user := User{Name: "Eve"}
+	conn.Create(&user)
+	sub := Subscription{UserID: user.ID, Key: "EVE", Started: time.Now().Add(-time.Hour), End: time.Now().Add(time.Hour)}
+	conn.Create(&sub)
+
+	// Without explicit packages the subscription sees the whole lineup, each channel once
+	w := doRequest(r, http.MethodGet, "/api/playlist/"+sub.PlaylistToken+".m3u", "", "")
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "audio/x-mpegurl") {
+		t.Fatalf("status %d, content type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	want := `#EXTM3U url-tvg="http://example.com/api/epg/` + sub.PlaylistToken + `.xml"
+#EXTINF:-1 tvg-id="news" tvg-name="News" tvg-logo="news.png" group-title="Basic",News
+#KODIPROP:inputstream.adaptive.manifest_type=mpd
+#KODIPROP:inputstream.adaptive.license_type=clearkey
+#KODIPROP:inputstream.adaptive.license_key=` + testKID + `:` + testContentKey + `
+https://cdn.example/news.mpd
+#EXTINF:-1 tvg-id="movies" tvg-name="The 'Movie' Channel" tvg-logo="" group-title="Premium",The "Movie" Channel
+https://cdn.example/movies.mpd
+`
+	if w.Body.String() != want {
+		t.Fatalf("playlist:\n%s\nwant:\n%s", w.Body, want)
+	}
+
+	// Restricting the subscription to Premium changes the grouping
+	path := fmt.Sprintf("/api/admin/subscriptions/%d/packages/%d", sub.ID, premium.ID)
+	if w := doRequest(r, http.MethodPost, path, "", token); w.Code != http.StatusOK {
+		t.Fatalf("add package: status %d, body %s", w.Code, w.Body)
+	}
+	w = doRequest(r, http.MethodGet, "/api/playlist/"+sub.PlaylistToken, "", "")
+	if strings.Contains(w.Body.String(), `group-title="Basic"`) || strings.Count(w.Body.String(), "#EXTINF") != 2 {
+		t.Fatalf("restricted playlist:\n%s", w.Body)
+	}
+
+	// A new token invalidates the old URL
+	w = doRequest(r, http.MethodPost, fmt.Sprintf("/api/admin/subscriptions/%d/playlist-token", sub.ID), "", token)
+	var updated Subscription
+	decodeJSON(t, w, &updated)
+	if updated.PlaylistToken == "" || updated.PlaylistToken == sub.PlaylistToken {
+		t.Fatalf("token not regenerated: %q", updated.PlaylistToken)
+	}
+	if w := doRequest(r, http.MethodGet, "/api/playlist/"+sub.PlaylistToken, "", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("old token: status %d, want 404", w.Code)
+	}
+	if w := doRequest(r, http.MethodGet, "/api/playlist/"+updated.PlaylistToken, "", ""); w.Code != http.StatusOK {
+		t.Fatalf("new token: status %d, want 200", w.Code)
+	}
+}
+
+func TestPlaylistRequiresActiveSubscription(t *testing.T) {
+	r, conn := newTestServer(t)
+
+	user := User{Name: "Frank"}
+	conn.Create(&user)
+	expired := Subscription{UserID: user.ID, Key: "OLD", Started: time.Now().AddDate(0, -2, 0), End: time.Now().AddDate(0, -1, 0)}
+	conn.Create(&expired)
+
+	if w := doRequest(r, http.MethodGet, "/api/playlist/"+expired.PlaylistToken, "", ""); w.Code != http.StatusForbidden {
+		t.Fatalf("expired: status %d, want 403", w.Code)
+	}
+	if w := doRequest(r, http.MethodGet, "/api/playlist/unknown", "", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("unknown token: status %d, want 404", w.Code)
+	}
+}
+
+func TestPlaylistGuideURL(t *testing.T) {
+	conn := openTestDB(t)
+	user := User{Name: "Grace"}
+	conn.Create(&user)
+	sub := Subscription{UserID: user.ID, Key: "GRACE", Started: time.Now().Add(-time.Hour), End: time.Now().Add(time.Hour)}
+	conn.Create(&sub)
+
+	guide := func(s *Server) string {
+		req := httptest.NewRequest(http.MethodGet, "/api/playlist/"+sub.PlaylistToken+".m3u", nil)
+		req.Header.Set("X-Forwarded-Proto", "https")
+		first, _, _ := strings.Cut(serve(s.router(), req).Body.String(), "\n")
+		return first
+	}
+	path := "/api/epg/" + sub.PlaylistToken + ".xml"
+
+	// httptest requests come from 192.0.2.1, which is not trusted by default
+	s := newServer(newGormServices(conn))
+	if got, want := guide(s), `#EXTM3U url-tvg="http://example.com`+path+`"`; got != want {
+		t.Fatalf("untrusted X-Forwarded-Proto: %s, want %s", got, want)
+	}
+	s.limits.TrustedProxies = []string{"192.0.2.0/24"}
+	if got, want := guide(s), `#EXTM3U url-tvg="https://example.com`+path+`"`; got != want {
+		t.Fatalf("trusted X-Forwarded-Proto: %s, want %s", got, want)
+	}
+
+	previous := cfg.Server
+	cfg.Server.PublicURL = "https://tv.example/"
+	t.Cleanup(func() { cfg.Server = previous })
+	if got, want := guide(s), `#EXTM3U url-tvg="https://tv.example`+path+`"`; got != want {
+		t.Fatalf("PUBLIC_URL: %s, want %s", got, want)
+	}
+}
+
+func TestPlaylistHLSLicenseServer(t *testing.T) {
+	r, conn := newTestServer(t)
+	token := adminToken(t)
+
+	body := `{"name":"Cinema","mpd":"https://cdn.example/cinema.m3u8","stream_type":"hls",
+	  "keys":[{"system":"widevine","license_url":"https://license.example/wv"}]}`
+	w := doRequest(r, http.MethodPost, "/api/admin/channels", body, token)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("HLS channel with a license server: status %d, body %s", w.Code, w.Body)
+	}
+	var channel Channel
+	decodeJSON(t, w, &channel)
+	conn.Create(&Package{Name: "Films", Channels: []Channel{{ID: channel.ID}}})
+
+	user := User{Name: "Heidi"}
+	conn.Create(&user)
+	sub := Subscription{UserID: user.ID, Key: "HEIDI", Started: time.Now().Add(-time.Hour), End: time.Now().Add(time.Hour)}
+	conn.Create(&sub)
+
+	w = doRequest(r, http.MethodGet, "/api/playlist/"+sub.PlaylistToken+".m3u", "", "")
+	want := `#KODIPROP:inputstream.adaptive.manifest_type=hls
+#KODIPROP:inputstream.adaptive.license_type=com.widevine.alpha
+#KODIPROP:inputstream.adaptive.license_key=https://license.example/wv
+https://cdn.example/cinema.m3u8
+`
+	if !strings.HasSuffix(w.Body.String(), want) {
+		t.Fatalf("playlist:\n%s\nwant it to end with:\n%s", w.Body, want)
+	}
+}
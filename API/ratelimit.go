@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Rate limiting
+//
+// Login and the public endpoints taking a subscription key are limited with
+// token buckets, one per client IP and one per target (the admin username or
+// the subscription key), so neither a single client nor many clients going
+// after one target can guess freely. Admins are also locked out after repeated failed logins, for a period
+// that doubles with every further failure. The state lives in memory, or in
+// Redis or a compatible server when RATE_LIMIT_REDIS_URL is set, so that
+// several API instances share it. Limited requests get a 429 with Retry-After.
+// When the store cannot be reached requests are let through and logged.
+
+// RateLimit allows Burst requests at once, refilled evenly over Per. A zero
+// Burst disables the limit.
+type RateLimit struct {
+	Burst int
+	Per   time.Duration
+}
+
+// parseRateLimit reads a limit written as "10/1m"; "0" and "off" disable it
+func parseRateLimit(value string) (RateLimit, error) {
+	if value == "0" || value == "off" {
+		return RateLimit{}, nil
+	}
+	burst, per, ok := strings.Cut(value, "/")
+	n, err := strconv.Atoi(burst)
+	if !ok || err != nil || n < 1 {
+		return RateLimit{}, errors.New("rate limits must look like 10/1m")
+	}
+	d, err := time.ParseDuration(per)
+	if err != nil || d <= 0 {
+		return RateLimit{}, errors.New("rate limits must look like 10/1m")
+	}
+	return RateLimit{Burst: n, Per: d}, nil
+}
+
+// lockoutWindow is how long failed logins are remembered after the last one
+const lockoutWindow = 24 * time.Hour
+
+// RateLimiter stores rate limiting and lockout state by key
+type RateLimiter interface {
+	// Take takes a token from the key's bucket. It returns 0 when one was left,
+	// and otherwise how long until the next one.
+	Take(ctx context.Context, key string, limit RateLimit) (time.Duration, error)
+	// Fail counts a failure of the key, forgotten window after the latest, and
+	// returns the number of failures.
+	Fail(ctx context.Context, key string, window time.Duration) (int, error)
+	// Block blocks the key for d.
+	Block(ctx context.Context, key string, d time.Duration) error
+	// Blocked returns how long the key remains blocked, 0 when it is not.
+	Blocked(ctx context.Context, key string) (time.Duration, error)
+	// Reset forgets the key's failures and block.
+	Reset(ctx context.Context, key string) error
+}
+
+// refill returns the tokens of a bucket that had tokens elapsed ago, and how
+// long until it has one again when it has none
+func refill(tokens float64, elapsed time.Duration, limit RateLimit) (float64, time.Duration) {
+	rate := float64(limit.Burst) / float64(limit.Per)
+	tokens = math.Min(float64(limit.Burst), tokens+float64(max(elapsed, 0))*rate)
+	if tokens >= 1 {
+		return tokens, 0
+	}
+	return tokens, time.Duration(math.Ceil((1 - tokens) / rate))
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+	per     time.Duration
+}
+
+type failureCount struct {
+	n       int
+	expires time.Time
+}
+
+// memoryRateLimiter keeps rate limiting state in the process
+type memoryRateLimiter struct {
+	mu       sync.Mutex
+	now      func() time.Time
+	buckets  map[string]*tokenBucket
+	failures map[string]failureCount
+	blocks   map[string]time.Time
+	swept    time.Time
+}
+
+func newMemoryRateLimiter() *memoryRateLimiter {
+	return &memoryRateLimiter{
+		now:      time.Now,
+		buckets:  map[string]*tokenBucket{},
+		failures: map[string]failureCount{},
+		blocks:   map[string]time.Time{},
+	}
+}
+
+func (l *memoryRateLimiter) Take(ctx context.Context, key string, limit RateLimit) (time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(limit.Burst), updated: now}
+		l.buckets[key] = b
+	}
+	tokens, wait := refill(b.tokens, now.Sub(b.updated), limit)
+	b.updated, b.per = now, limit.Per
+	if wait > 0 {
+		b.tokens = tokens
+		return wait, nil
+	}
+	b.tokens = tokens - 1
+	return 0, nil
+}
+
+func (l *memoryRateLimiter) Fail(ctx context.Context, key string, window time.Duration) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+
+	f := l.failures[key]
+	if now.After(f.expires) {
+		f.n = 0
+	}
+	f.n++
+	f.expires = now.Add(window)
+	l.failures[key] = f
+	return f.n, nil
+}
+
+func (l *memoryRateLimiter) Block(ctx context.Context, key string, d time.Duration) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.blocks[key] = l.now().Add(d)
+	return nil
+}
+
+func (l *memoryRateLimiter) Blocked(ctx context.Context, key string) (time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return max(l.blocks[key].Sub(l.now()), 0), nil
+}
+
+func (l *memoryRateLimiter) Reset(ctx context.Context, key string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.failures, key)
+	delete(l.blocks, key)
+	return nil
+}
+
+// sweep drops full buckets and expired failures and blocks, at most once a minute
+func (l *memoryRateLimiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < time.Minute {
+		return
+	}
+	l.swept = now
+	for key, b := range l.buckets {
+		if now.Sub(b.updated) >= b.per {
+			delete(l.buckets, key)
+		}
+	}
+	for key, f := range l.failures {
+		if now.After(f.expires) {
+			delete(l.failures, key)
+		}
+	}
+	for key, until := range l.blocks {
+		if now.After(until) {
+			delete(l.blocks, key)
+		}
+	}
+}
+
+// tooManyRequests answers 429, telling the client when to retry
+func tooManyRequests(c *gin.Context, wait time.Duration, message string) {
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(max(wait, time.Second).Seconds()))))
+	writeError(c, http.StatusTooManyRequests, codeRateLimited, message)
+	c.Abort()
+}
+
+// allow takes a token for the key, answering 429 and returning false when
+// none is left
+func (s *Server) allow(c *gin.Context, key string, limit RateLimit) bool {
+	if limit.Burst == 0 {
+		return true
+	}
+	wait, err := s.limiter.Take(c.Request.Context(), key, limit)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "rate limiting unavailable, allowing request", "bucket", key, "error", err)
+		return true
+	}
+	if wait > 0 {
+		metrics.rateLimited.WithLabelValues(rateLimitBucket(key)).Inc()
+		tooManyRequests(c, wait, "Too many requests")
+		return false
+	}
+	return true
+}
+
+// allowKeyLookup takes tokens for a public request that looks a subscription up
+// by its key. Every such route shares the per-IP bucket, so that guessing keys
+// is no cheaper on one than on another; the per-key bucket cannot stop guessing
+// on its own since every guess is a different key.
+func (s *Server) allowKeyLookup(c *gin.Context, key string) bool {
+	// Keys are hashed so that the limiter's store never holds them
+	return s.allow(c, "validate:ip:"+c.ClientIP(), s.limits.ValidatePerIP) &&
+		s.allow(c, "validate:key:"+plainLookupHash(key), s.limits.ValidatePerKey)
+}
+
+// rateLimitBucket names the kind of bucket of a key, such as login:ip, for metrics
+func rateLimitBucket(key string) string {
+	kind, rest, _ := strings.Cut(key, ":")
+	scope, _, _ := strings.Cut(rest, ":")
+	return kind + ":" + scope
+}
+
+// lockoutKey is the limiter key of an admin's failed logins and lockout. It has
+// a prefix of its own: under "login:" a username such as "ip:192.0.2.1" would
+// share the state of that IP's login bucket.
+func lockoutKey(username string) string {
+	return "lockout:" + username
+}
+
+// lockedOut answers 429 and returns true while the admin username is locked out
+func (s *Server) lockedOut(c *gin.Context, username string) bool {
+	if s.limits.LockoutThreshold == 0 {
+		return false
+	}
+	wait, err := s.limiter.Blocked(c.Request.Context(), lockoutKey(username))
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "rate limiting unavailable, not checking lockout", "admin", username, "error", err)
+		return false
+	}
+	if wait > 0 {
+		metrics.loginFailures.WithLabelValues("locked_out").Inc()
+		tooManyRequests(c, wait, "Too many failed logins, try again later")
+		return true
+	}
+	return false
+}
+
+// loginFailed counts a failed login of the username and locks it out once the
+// failures reach the threshold, for a period doubling with each further one.
+// reason, password or two_factor, labels the failure in the metrics.
+func (s *Server) loginFailed(ctx context.Context, username, reason string) {
+	metrics.loginFailures.WithLabelValues(reason).Inc()
+	if s.limits.LockoutThreshold == 0 {
+		return
+	}
+	key := lockoutKey(username)
+	n, err := s.limiter.Fail(ctx, key, lockoutWindow)
+	if err != nil {
+		slog.ErrorContext(ctx, "rate limiting unavailable, not counting failed login", "admin", username, "error", err)
+		return
+	}
+	if n < s.limits.LockoutThreshold {
+		return
+	}
+	d := s.limits.LockoutBase
+	for i := s.limits.LockoutThreshold; i < n && d < s.limits.LockoutMax; i++ {
+		d *= 2
+	}
+	d = min(d, s.limits.LockoutMax)
+	if err := s.limiter.Block(ctx, key, d); err != nil {
+		slog.ErrorContext(ctx, "rate limiting unavailable, not locking out", "admin", username, "error", err)
+		return
+	}
+	slog.WarnContext(ctx, "admin locked out", "admin", username, "duration", d, "failed_logins", n)
+}
+
+// loginSucceeded clears the username's failed logins
+func (s *Server) loginSucceeded(ctx context.Context, username string) {
+	if s.limits.LockoutThreshold == 0 {
+		return
+	}
+	if err := s.limiter.Reset(ctx, lockoutKey(username)); err != nil {
+		slog.ErrorContext(ctx, "rate limiting unavailable, not clearing failed logins", "admin", username, "error", err)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// fakeClock lets tests move a memoryRateLimiter's time
+type fakeClock struct{ now time.Time }
+
+func (f *fakeClock) advance(d time.Duration) { f.now = f.now.Add(d) }
+
+func newTestLimiter() (*memoryRateLimiter, *fakeClock) {
+	clock := &fakeClock{now: time.Now()}
+	limiter := newMemoryRateLimiter()
+	limiter.now = func() time.Time { return clock.now }
+	return limiter, clock
+}
+
+func TestMemoryRateLimiter(t *testing.T) {
+	ctx := context.Background()
+	limiter, clock := newTestLimiter()
+	limit := RateLimit{Burst: 2, Per: time.Minute}
+
+	for i, want := range []time.Duration{0, 0, 30 * time.Second} {
+		if wait, _ := limiter.Take(ctx, "a", limit); wait != want {
+			t.Fatalf("take %d: wait %s, want %s", i+1, wait, want)
+		}
+	}
+	if wait, _ := limiter.Take(ctx, "b", limit); wait != 0 {
+		t.Fatalf("other key waits %s", wait)
+	}
+	clock.advance(30 * time.Second)
+	if wait, _ := limiter.Take(ctx, "a", limit); wait != 0 {
+		t.Fatalf("after refill: wait %s", wait)
+	}
+
+	limiter.Fail(ctx, "user", time.Hour)
+	if n, _ := limiter.Fail(ctx, "user", time.Hour); n != 2 {
+		t.Fatalf("failures = %d, want 2", n)
+	}
+	clock.advance(2 * time.Hour)
+	if n, _ := limiter.Fail(ctx, "user", time.Hour); n != 1 {
+		t.Fatalf("failures after window = %d, want 1", n)
+	}
+
+	if limit, err := parseRateLimit("5/30s"); err != nil || limit != (RateLimit{Burst: 5, Per: 30 * time.Second}) {
+		t.Fatalf("parseRateLimit = %+v, %v", limit, err)
+	}
+	if _, err := parseRateLimit("5 per minute"); err == nil {
+		t.Fatal("invalid limit accepted")
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	services := newMemoryServices()
+	services.Admins.EnsureDefault(context.Background())
+	s := newServer(services)
+	limiter, clock := newTestLimiter()
+	s.limiter = limiter
+	s.limits = RateLimitConfig{LockoutThreshold: 3, LockoutBase: time.Minute, LockoutMax: 3 * time.Minute}
+	r := s.router()
+
+	login := func(password string) (int, string) {
+		w := doRequest(r, http.MethodPost, "/api/login", `{"username":"admin","password":"`+password+`"}`, "")
+		return w.Code, w.Header().Get("Retry-After")
+	}
+	for i := 0; i < 3; i++ {
+		if code, _ := login("wrong"); code != http.StatusUnauthorized {
+			t.Fatalf("failure %d: status %d", i+1, code)
+		}
+	}
+	if _, ok := limiter.blocks["lockout:admin"]; !ok {
+		t.Fatalf("lockout not kept apart from the login buckets: %v", limiter.blocks)
+	}
+	// Locked out even with the right password, for longer after each further failure
+	if code, retry := login(defaultAdminPassword); code != http.StatusTooManyRequests || retry != "60" {
+		t.Fatalf("locked out login: status %d, Retry-After %q", code, retry)
+	}
+	clock.advance(time.Minute)
+	login("wrong")
+	if code, retry := login(defaultAdminPassword); code != http.StatusTooManyRequests || retry != "120" {
+		t.Fatalf("second lockout: status %d, Retry-After %q", code, retry)
+	}
+	clock.advance(2 * time.Minute)
+	login("wrong")
+	if _, retry := login(defaultAdminPassword); retry != "180" {
+		t.Fatalf("capped lockout: Retry-After %q", retry)
+	}
+
+	// A successful login clears the failures
+	clock.advance(3 * time.Minute)
+	if code, _ := login(defaultAdminPassword); code != http.StatusOK {
+		t.Fatalf("login after lockout: status %d", code)
+	}
+	if code, _ := login("wrong"); code != http.StatusUnauthorized {
+		t.Fatalf("failure after success: status %d", code)
+	}
+}
+
+func TestRateLimitedEndpoints(t *testing.T) {
+	s := newServer(newMemoryServices())
+	s.limits = RateLimitConfig{
+		LoginPerIP:     RateLimit{Burst: 2, Per: time.Minute},
+		ValidatePerIP:  RateLimit{Burst: 10, Per: time.Minute},
+		ValidatePerKey: RateLimit{Burst: 1, Per: time.Minute},
+	}
+	r := s.router()
+
+	for i := 0; i < 2; i++ {
+		doRequest(r, http.MethodPost, "/api/login", `{"username":"nobody","password":"x"}`, "")
+	}
+	w := doRequest(r, http.MethodPost, "/api/login", `{"username":"other","password":"x"}`, "")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "30" {
+		t.Fatalf("login over the IP limit: status %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	doRequest(r, http.MethodGet, "/api/public/validate/guess", "", "")
+	w = doRequest(r, http.MethodGet, "/api/public/validate/guess", "", "")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "60" {
+		t.Fatalf("validate over the key limit: status %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	var problem Problem
+	if decodeEncrypted(t, w, &problem); problem.Code != codeRateLimited {
+		t.Fatalf("429 body = %+v", problem)
+	}
+	if w := doRequest(r, http.MethodGet, "/api/public/validate/other", "", ""); w.Code == http.StatusTooManyRequests {
+		t.Fatal("other key limited")
+	}
+}
+
+func TestKeyLookupsShareIPLimit(t *testing.T) {
+	s := newServer(newMemoryServices())
+	s.limits = RateLimitConfig{ValidatePerIP: RateLimit{Burst: 2, Per: time.Minute}}
+	r := s.router()
+
+	doRequest(r, http.MethodGet, "/api/public/epg/guess-1/now", "", "")
+	doRequest(r, http.MethodGet, "/api/public/epg/guess-2/grid", "", "")
+	for _, path := range []string{"/api/public/validate/guess-3", "/api/public/epg/guess-4/now", "/api/public/epg/guess-5/grid"} {
+		if w := doRequest(r, http.MethodGet, path, "", ""); w.Code != http.StatusTooManyRequests {
+			t.Fatalf("%s over the IP limit: status %d", path, w.Code)
+		}
+	}
+}
+
+func TestForwardedForNeedsTrustedProxy(t *testing.T) {
+	login := func(r http.Handler, forwardedFor string) int {
+		req := httptest.NewRequest(http.MethodPost, "/api/login", strings.NewReader(`{"username":"nobody","password":"x"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		return serve(r, req).Code
+	}
+
+	// httptest requests come from 192.0.2.1, which is not trusted by default
+	s := newServer(newMemoryServices())
+	s.limits = RateLimitConfig{LoginPerIP: RateLimit{Burst: 1, Per: time.Minute}}
+	r := s.router()
+	login(r, "198.51.100.1")
+	if code := login(r, "198.51.100.2"); code != http.StatusTooManyRequests {
+		t.Fatalf("spoofed X-Forwarded-For got around the IP limit: status %d", code)
+	}
+
+	s = newServer(newMemoryServices())
+	s.limits = RateLimitConfig{LoginPerIP: RateLimit{Burst: 1, Per: time.Minute}, TrustedProxies: []string{"192.0.2.1"}}
+	r = s.router()
+	login(r, "198.51.100.1")
+	if code := login(r, "198.51.100.2"); code == http.StatusTooManyRequests {
+		t.Fatal("clients behind a trusted proxy share its IP")
+	}
+}
+
+func TestRedisRateLimiter(t *testing.T) {
+	server := miniredis.RunT(t)
+	server.RequireAuth("secret")
+	server.Select(2)
+	limiter, err := newRedisRateLimiter("redis://:secret@" + server.Addr() + "/2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { limiter.client.Close() })
+	ctx := context.Background()
+
+	limit := RateLimit{Burst: 2, Per: time.Minute}
+	for i := 0; i < 2; i++ {
+		if wait, err := limiter.Take(ctx, "login:ip:1.2.3.4", limit); err != nil || wait != 0 {
+			t.Fatalf("take %d = %s, %v", i, wait, err)
+		}
+	}
+	// One token comes back every 30s
+	if wait, err := limiter.Take(ctx, "login:ip:1.2.3.4", limit); err != nil || wait <= 29*time.Second || wait > 30*time.Second {
+		t.Fatalf("take over the limit = %s, %v", wait, err)
+	}
+	if !server.Exists("ratelimit:bucket:login:ip:1.2.3.4") || server.TTL("ratelimit:bucket:login:ip:1.2.3.4") != time.Minute {
+		t.Fatalf("bucket keys %v", server.Keys())
+	}
+
+	for want := 1; want <= 2; want++ {
+		if n, err := limiter.Fail(ctx, "lockout:admin", time.Hour); err != nil || n != want {
+			t.Fatalf("fail = %d, %v; want %d", n, err, want)
+		}
+	}
+	if blocked, err := limiter.Blocked(ctx, "lockout:admin"); err != nil || blocked != 0 {
+		t.Fatalf("blocked before Block = %s, %v", blocked, err)
+	}
+	if err := limiter.Block(ctx, "lockout:admin", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if blocked, err := limiter.Blocked(ctx, "lockout:admin"); err != nil || blocked != time.Minute {
+		t.Fatalf("blocked = %s, %v", blocked, err)
+	}
+	server.FastForward(time.Minute)
+	if blocked, err := limiter.Blocked(ctx, "lockout:admin"); err != nil || blocked != 0 {
+		t.Fatalf("blocked after it ran out = %s, %v", blocked, err)
+	}
+
+	limiter.Block(ctx, "lockout:admin", time.Minute)
+	if err := limiter.Reset(ctx, "lockout:admin"); err != nil {
+		t.Fatal(err)
+	}
+	if server.Exists("ratelimit:failures:lockout:admin") || server.Exists("ratelimit:block:lockout:admin") {
+		t.Fatalf("keys after reset %v", server.Keys())
+	}
+
+	// Requests are let through when the store is down
+	server.Close()
+	if _, err := limiter.Take(ctx, "login:ip:1.2.3.4", limit); err == nil {
+		t.Fatal("take succeeded without a server")
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisRateLimiter keeps rate limiting state in Redis or a server speaking its
+// protocol (Valkey, KeyDB, Dragonfly) so that API instances share it
+type redisRateLimiter struct {
+	client *redis.Client
+	prefix string
+}
+
+// redisTimeout bounds dialing and each command unless the URL sets
+// dial_timeout, read_timeout or write_timeout, so that requests are not held
+// up long when the store is unreachable
+const redisTimeout = 2 * time.Second
+
+// newRedisRateLimiter connects lazily to a redis:// or rediss:// URL such as
+// redis://:password@localhost:6379/0
+func newRedisRateLimiter(rawURL string) (*redisRateLimiter, error) {
+	options, err := redis.ParseURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	for _, timeout := range []*time.Duration{&options.DialTimeout, &options.ReadTimeout, &options.WriteTimeout} {
+		if *timeout == 0 {
+			*timeout = redisTimeout
+		}
+	}
+	options.ContextTimeoutEnabled = true
+	redis.SetLogger(redisLogger{})
+	return &redisRateLimiter{client: redis.NewClient(options), prefix: "ratelimit:"}, nil
+}
+
+// redisLogger sends the client's connection pool messages to slog
+type redisLogger struct{}
+
+func (redisLogger) Printf(ctx context.Context, format string, v ...any) {
+	slog.WarnContext(ctx, fmt.Sprintf(format, v...))
+}
+
+// redisTakeScript is the token bucket of refill, run atomically. The bucket
+// expires once it would be full again.
+var redisTakeScript = redis.NewScript(`
+local burst, per, now = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3])
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'updated')
+local tokens, updated = tonumber(state[1]) or burst, tonumber(state[2]) or now
+tokens = math.min(burst, tokens + math.max(now - updated, 0) * burst / per)
+local wait = 0
+if tokens >= 1 then
+  tokens = tokens - 1
+else
+  wait = math.ceil((1 - tokens) * per / burst)
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'updated', now)
+redis.call('PEXPIRE', KEYS[1], per)
+return wait`)
+
+var redisFailScript = redis.NewScript(`
+local n = redis.call('INCR', KEYS[1])
+redis.call('PEXPIRE', KEYS[1], ARGV[1])
+return n`)
+
+func (l *redisRateLimiter) Take(ctx context.Context, key string, limit RateLimit) (time.Duration, error) {
+	wait, err := redisTakeScript.Run(ctx, l.client, []string{l.prefix + "bucket:" + key},
+		limit.Burst, limit.Per.Milliseconds(), time.Now().UnixMilli()).Int64()
+	return time.Duration(wait) * time.Millisecond, err
+}
+
+func (l *redisRateLimiter) Fail(ctx context.Context, key string, window time.Duration) (int, error) {
+	return redisFailScript.Run(ctx, l.client, []string{l.prefix + "failures:" + key}, window.Milliseconds()).Int()
+}
+
+func (l *redisRateLimiter) Block(ctx context.Context, key string, d time.Duration) error {
+	// A zero expiration would block for good
+	if d <= 0 {
+		return nil
+	}
+	return l.client.Set(ctx, l.prefix+"block:"+key, "1", d).Err()
+}
+
+func (l *redisRateLimiter) Blocked(ctx context.Context, key string) (time.Duration, error) {
+	// Negative when the key does not exist
+	ttl, err := l.client.PTTL(ctx, l.prefix+"block:"+key).Result()
+	return max(ttl, 0), err
+}
+
+func (l *redisRateLimiter) Reset(ctx context.Context, key string) error {
+	return l.client.Del(ctx, l.prefix+"failures:"+key, l.prefix+"block:"+key).Err()
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+// Secrets at rest
+//
+// Sensitive columns such as DRM keys, subscription keys and TOTP secrets are
+// tagged serializer:encrypted and stored with envelope encryption: every value
+// is sealed with its own random data key, which is in turn sealed with the master
+// key from SECRETS_MASTER_KEY. Stored values name the master key they were
+// sealed with, so after a rotation values sealed with a key listed in
+// SECRETS_PREVIOUS_KEYS can still be read until `api secrets rotate` has
+// re-encrypted them. Values written before encryption was enabled are read as
+// they are. Without a master key new values are stored unencrypted too.
+
+// sealedPrefix starts every encrypted value: enc:v1:<key id>:<data key>:<ciphertext>
+const sealedPrefix = "enc:v1:"
+
+// secretBox seals and opens secrets with the configured master keys
+type secretBox struct {
+	current string            // ID of the key new values are sealed with, empty when disabled
+	keys    map[string][]byte // master keys by ID
+}
+
+// secrets is set up from the configuration when the database is opened
+var secrets = &secretBox{}
+
+func init() {
+	schema.RegisterSerializer("encrypted", encryptedSerializer{})
+}
+
+// newSecretBox loads the master key and the previous keys still accepted for reading
+func newSecretBox(c SecretsConfig) (*secretBox, error) {
+	box := &secretBox{keys: map[string][]byte{}}
+	for i, encoded := range append([]string{c.MasterKey}, c.PreviousKeys...) {
+		if encoded == "" {
+			continue
+		}
+		key, err := decodeMasterKey(encoded)
+		if err != nil {
+			return nil, err
+		}
+		id := masterKeyID(key)
+		box.keys[id] = key
+		if i == 0 {
+			box.current = id
+		}
+	}
+	if box.current == "" && len(box.keys) > 0 {
+		return nil, errors.New("SECRETS_PREVIOUS_KEYS needs SECRETS_MASTER_KEY to be set")
+	}
+	return box, nil
+}
+
+// decodeMasterKey accepts a 256-bit key in base64 or hex
+func decodeMasterKey(encoded string) ([]byte, error) {
+	encoded = strings.TrimSpace(encoded)
+	if key, err := base64.StdEncoding.DecodeString(encoded); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := hex.DecodeString(encoded); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, errors.New("master keys must be 32 bytes in base64 or hex")
+}
+
+// masterKeyID identifies a master key in stored values without revealing it
+func masterKeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:4])
+}
+
+// enabled reports whether new values are encrypted
+func (b *secretBox) enabled() bool {
+	return b.current != ""
+}
+
+// seal encrypts a value under a fresh data key wrapped by the current master key
+func (b *secretBox) seal(plaintext string) (string, error) {
+	if plaintext == "" || !b.enabled() {
+		return plaintext, nil
+	}
+	dataKey := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return "", err
+	}
+	wrapped, err := gcmSeal(b.keys[b.current], dataKey, []byte(b.current))
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := gcmSeal(dataKey, []byte(plaintext), []byte(b.current))
+	if err != nil {
+		return "", err
+	}
+	return sealedPrefix + b.current + ":" + base64.RawStdEncoding.EncodeToString(wrapped) + ":" + base64.RawStdEncoding.EncodeToString(ciphertext), nil
+}
+
+// open decrypts a stored value. Values that were never encrypted are returned as they are.
+func (b *secretBox) open(stored string) (string, error) {
+	if !strings.HasPrefix(stored, sealedPrefix) {
+		return stored, nil
+	}
+	parts := strings.Split(strings.TrimPrefix(stored, sealedPrefix), ":")
+	if len(parts) != 3 {
+		return "", errors.New("malformed encrypted value")
+	}
+	id := parts[0]
+	masterKey, ok := b.keys[id]
+	if !ok {
+		return "", fmt.Errorf("value is encrypted with unknown master key %s", id)
+	}
+	wrapped, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", errors.New("malformed encrypted value")
+	}
+	ciphertext, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", errors.New("malformed encrypted value")
+	}
+	dataKey, err := gcmOpen(masterKey, wrapped, []byte(id))
+	if err != nil {
+		return "", fmt.Errorf("cannot unwrap data key: %w", err)
+	}
+	plaintext, err := gcmOpen(dataKey, ciphertext, []byte(id))
+	if err != nil {
+		return "", fmt.Errorf("cannot decrypt value: %w", err)
+	}
+	return string(plaintext), nil
+}
+
+// isCurrent reports whether a stored value is already in the form seal produces
+// now: sealed with the current master key, or unencrypted when encryption is off
+func (b *secretBox) isCurrent(stored string) bool {
+	if stored == "" {
+		return true
+	}
+	if !b.enabled() {
+		return !strings.HasPrefix(stored, sealedPrefix)
+	}
+	return strings.HasPrefix(stored, sealedPrefix+b.current+":")
+}
+
+// lookupHash is a deterministic keyed hash of a secret, stored next to it so
+// rows can be found by the secret without decrypting every one
+func (b *secretBox) lookupHash(value string) string {
+	if value == "" {
+		return ""
+	}
+	if !b.enabled() {
+		return plainLookupHash(value)
+	}
+	return keyedLookupHash(b.keys[b.current], value)
+}
+
+// lookupHashes lists the hashes a secret may be stored under: one per
+// configured master key, and the unkeyed one of rows written without encryption
+func (b *secretBox) lookupHashes(value string) []string {
+	hashes := []string{plainLookupHash(value)}
+	for _, key := range b.keys {
+		hashes = append(hashes, keyedLookupHash(key, value))
+	}
+	return hashes
+}
+
+func plainLookupHash(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+func keyedLookupHash(masterKey []byte, value string) string {
+	// A key derived for lookups so the hash never uses the master key directly
+	derive := hmac.New(sha256.New, masterKey)
+	derive.Write([]byte("lookup"))
+	mac := hmac.New(sha256.New, derive.Sum(nil))
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// gcmSeal encrypts with AES-256-GCM and prepends the random nonce
+func gcmSeal(key, plaintext, additional []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, additional), nil
+}
+
+// gcmOpen reverses gcmSeal
+func gcmOpen(key, sealed, additional []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], additional)
+}
+
+// encryptedSerializer stores string fields sealed by the configured secretBox
+type encryptedSerializer struct{}
+
+func (encryptedSerializer) Scan(ctx context.Context, field *schema.Field, dst reflect.Value, dbValue any) error {
+	var stored string
+	switch v := dbValue.(type) {
+	case nil:
+	case []byte:
+		stored = string(v)
+	case string:
+		stored = v
+	default:
+		return fmt.Errorf("unsupported encrypted value %T for %s", dbValue, field.Name)
+	}
+	plaintext, err := secrets.open(stored)
+	if err != nil {
+		return fmt.Errorf("%s: %w", field.Name, err)
+	}
+	field.ReflectValueOf(ctx, dst).SetString(plaintext)
+	return nil
+}
+
+func (encryptedSerializer) Value(ctx context.Context, field *schema.Field, dst reflect.Value, fieldValue any) (any, error) {
+	plaintext, ok := fieldValue.(string)
+	if !ok {
+		return nil, fmt.Errorf("invalid field type %T for %s, only strings can be encrypted", fieldValue, field.Name)
+	}
+	return secrets.seal(plaintext)
+}
+
+// SecretsReport counts the values a re-encryption rewrote
+type SecretsReport struct {
+	ChannelKeys   int `json:"channel_keys"`
+	Subscriptions int `json:"subscriptions"`
+	Admins        int `json:"admins"` // TOTP secrets
+}
+
+// storedSecret is an encrypted column read without the serializer
+type storedSecret struct {
+	ID    uint
+	Value string
+}
+
+// reencryptSecrets rewrites every stored secret that is not sealed with the
+// current master key, after a rotation or when encryption is first enabled.
+// Subscription lookup hashes are recomputed along with their keys.
+func reencryptSecrets(ctx context.Context, conn *gorm.DB) (SecretsReport, error) {
+	var report SecretsReport
+	err := conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var err error
+		report.ChannelKeys, err = reencryptColumn(tx, "channel_keys", "key", func(sealed, plaintext string) map[string]any {
+			return map[string]any{"key": sealed}
+		})
+		if err != nil {
+			return err
+		}
+		report.Subscriptions, err = reencryptColumn(tx, "subscriptions", "key", func(sealed, plaintext string) map[string]any {
+			return map[string]any{"key": sealed, "key_hash": secrets.lookupHash(plaintext)}
+		})
+		if err != nil {
+			return err
+		}
+		report.Admins, err = reencryptColumn(tx, "admins", "totp_secret", func(sealed, plaintext string) map[string]any {
+			return map[string]any{"totp_secret": sealed}
+		})
+		return err
+	})
+	return report, err
+}
+
+// reencryptColumn re-seals an encrypted column of a table and returns how many rows changed
+func reencryptColumn(tx *gorm.DB, table, column string, updates func(sealed, plaintext string) map[string]any) (int, error) {
+	var rows []storedSecret
+	// The column is quoted since MySQL reserves key
+	if err := tx.Table(table).Select("id, COALESCE(?, '') AS value", clause.Column{Name: column}).Find(&rows).Error; err != nil {
+		return 0, err
+	}
+	changed := 0
+	for _, row := range rows {
+		if secrets.isCurrent(row.Value) {
+			continue
+		}
+		plaintext, err := secrets.open(row.Value)
+		if err != nil {
+			return changed, fmt.Errorf("%s %d: %w", table, row.ID, err)
+		}
+		sealed, err := secrets.seal(plaintext)
+		if err != nil {
+			return changed, err
+		}
+		if err := tx.Table(table).Where("id = ?", row.ID).Updates(updates(sealed, plaintext)).Error; err != nil {
+			return changed, err
+		}
+		changed++
+	}
+	return changed, nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useSecrets switches the master keys for the rest of the test
+func useSecrets(t *testing.T, master string, previous ...string) {
+	t.Helper()
+	box, err := newSecretBox(SecretsConfig{MasterKey: master, PreviousKeys: previous})
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := secrets
+	secrets = box
+	t.Cleanup(func() { secrets = old })
+}
+
+var (
+	testMasterKey  = base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+	testRotatedKey = strings.Repeat("ab", 32)
+)
+
+func TestSecretBox(t *testing.T) {
+	useSecrets(t, testMasterKey)
+
+	a, err := secrets.seal("kid:key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := secrets.seal("kid:key")
+	if a == b || strings.Contains(a, "kid:key") || !strings.HasPrefix(a, sealedPrefix) {
+		t.Fatalf("sealed values %q and %q", a, b)
+	}
+	if plain, err := secrets.open(a); err != nil || plain != "kid:key" {
+		t.Fatalf("open = %q, %v", plain, err)
+	}
+	if plain, err := secrets.open("legacy"); err != nil || plain != "legacy" {
+		t.Fatalf("open unencrypted = %q, %v", plain, err)
+	}
+	if _, err := secrets.open(a[:len(a)-4] + "AAAA"); err == nil {
+		t.Fatal("tampered value opened")
+	}
+
+	useSecrets(t, testRotatedKey)
+	if _, err := secrets.open(a); err == nil || !strings.Contains(err.Error(), "unknown master key") {
+		t.Fatalf("open with another master key: %v", err)
+	}
+	if _, err := newSecretBox(SecretsConfig{MasterKey: "too short"}); err == nil {
+		t.Fatal("short master key accepted")
+	}
+}
+
+func TestSecretsAtRestAndRotation(t *testing.T) {
+	conn := openTestDB(t)
+	services := newGormServices(conn)
+	ctx := context.Background()
+	// Rolling back the schema decrypts channel keys, and runs after the master keys are restored
+	t.Cleanup(func() { conn.Exec("DELETE FROM channel_keys") })
+
+	// Written before encryption was enabled
+	legacy := Channel{Name: "Legacy", Keys: []ChannelKey{{System: keySystemClearKey, KID: testKID, Key: testContentKey}}}
+	services.Channels.Create(ctx, &legacy)
+	old := Subscription{Key: "old-sub", Started: time.Now(), End: time.Now().Add(time.Hour)}
+	services.Subscriptions.Create(ctx, &old)
+
+	useSecrets(t, testMasterKey)
+	channel := Channel{Name: "News", Keys: []ChannelKey{{System: keySystemClearKey, KID: testKID, Key: testContentKey}}}
+	services.Channels.Create(ctx, &channel)
+	subscription := Subscription{Key: "secret-sub", Started: time.Now(), End: time.Now().Add(time.Hour)}
+	services.Subscriptions.Create(ctx, &subscription)
+
+	var stored string
+	conn.Table("channel_keys").Select("key").Where("channel_id = ?", channel.ID).Scan(&stored)
+	if !strings.HasPrefix(stored, sealedPrefix) {
+		t.Fatalf("channel key stored as %q", stored)
+	}
+	if got, err := services.Channels.Get(ctx, channel.ID); err != nil || got.Key != testKID+":"+testContentKey {
+		t.Fatalf("channel key read back as %+v, %v", got, err)
+	}
+	for _, key := range []string{"old-sub", "secret-sub"} {
+		if got, err := services.Subscriptions.GetByKey(ctx, key); err != nil || got.Key != key {
+			t.Fatalf("GetByKey(%s) = %+v, %v", key, got, err)
+		}
+	}
+
+	// After a rotation old values stay readable until re-encrypted
+	useSecrets(t, testRotatedKey, testMasterKey)
+	if got, err := services.Subscriptions.GetByKey(ctx, "secret-sub"); err != nil || got.ID != subscription.ID {
+		t.Fatalf("GetByKey after rotation = %+v, %v", got, err)
+	}
+	report, err := reencryptSecrets(ctx, conn)
+	if err != nil || report.ChannelKeys != 2 || report.Subscriptions != 2 {
+		t.Fatalf("reencryptSecrets = %+v, %v", report, err)
+	}
+	if report, _ := reencryptSecrets(ctx, conn); report.ChannelKeys != 0 || report.Subscriptions != 0 {
+		t.Fatalf("second run rewrote %+v", report)
+	}
+
+	useSecrets(t, testRotatedKey)
+	conn.Table("channel_keys").Select("key").Where("channel_id = ?", legacy.ID).Scan(&stored)
+	if !strings.HasPrefix(stored, sealedPrefix+secrets.current+":") {
+		t.Fatalf("legacy key stored as %q", stored)
+	}
+	for _, key := range []string{"old-sub", "secret-sub"} {
+		if _, err := services.Subscriptions.GetByKey(ctx, key); err != nil {
+			t.Fatalf("GetByKey(%s) with only the new key: %v", key, err)
+		}
+	}
+	if _, err := services.Subscriptions.GetByKey(ctx, "unknown"); err != ErrNotFound {
+		t.Fatalf("GetByKey(unknown) = %v", err)
+	}
+}
+
+func TestTwoFactorSecretRotation(t *testing.T) {
+	conn := openTestDB(t)
+	services := newGormServices(conn)
+	ctx := context.Background()
+	useSecrets(t, testMasterKey)
+	services.Admins.EnsureDefault(ctx)
+	admin, _ := services.Admins.GetByUsername(ctx, defaultAdminUsername)
+	secret := newTOTPSecret()
+	admin.TOTPSecret, admin.TOTPEnabled = secret, true
+	if err := services.Admins.Update(ctx, admin); err != nil {
+		t.Fatal(err)
+	}
+
+	useSecrets(t, testRotatedKey, testMasterKey)
+	if report, err := reencryptSecrets(ctx, conn); err != nil || report.Admins != 1 {
+		t.Fatalf("reencryptSecrets = %+v, %v", report, err)
+	}
+
+	// With the old key gone the admin still logs in with their second factor
+	useSecrets(t, testRotatedKey)
+	s := newServer(services)
+	s.limits = RateLimitConfig{}
+	r := s.router()
+	var challenge struct {
+		Challenge string `json:"challenge"`
+	}
+	w := doRequest(r, http.MethodPost, "/api/login", `{"username":"admin","password":"`+defaultAdminPassword+`"}`, "")
+	decodeJSON(t, w, &challenge)
+	if w.Code != http.StatusOK || challenge.Challenge == "" {
+		t.Fatalf("login: status %d, %s", w.Code, w.Body)
+	}
+	code, _ := totpCode(secret, time.Now().Unix()/30)
+	w = doRequest(r, http.MethodPost, "/api/login/2fa", `{"challenge":"`+challenge.Challenge+`","code":"`+code+`"}`, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("second step: status %d, %s", w.Code, w.Body)
+	}
+}
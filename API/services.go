@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Domain services
+//
+// Handlers only talk to these interfaces. gormServices backs them with the
+// database, memoryServices keeps everything in maps for unit tests.
+var (
+	ErrNotFound           = errors.New("record not found")
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// NotFoundError names the missing entity when an operation involves several.
+type NotFoundError struct {
+	Entity string
+}
+
+func (e *NotFoundError) Error() string { return e.Entity + " not found" }
+
+func (e *NotFoundError) Is(target error) bool { return target == ErrNotFound }
+
+type ChannelService interface {
+	List(ctx context.Context) ([]Channel, error)
+	Get(ctx context.Context, id uint) (*Channel, error)
+	Create(ctx context.Context, channel *Channel) error
+	Update(ctx context.Context, channel *Channel) error
+	Delete(ctx context.Context, id uint) error
+}
+
+// PackageService returns packages with their channels loaded in lineup order,
+// each carrying its channel number within the package.
+type PackageService interface {
+	List(ctx context.Context) ([]Package, error)
+	Get(ctx context.Context, id uint) (*Package, error)
+	Create(ctx context.Context, pkg *Package) error
+	Update(ctx context.Context, pkg *Package) error
+	Delete(ctx context.Context, id uint) error
+	// AddChannel appends the channel to the end of the lineup unless it is already in it.
+	AddChannel(ctx context.Context, packageID, channelID uint) error
+	RemoveChannel(ctx context.Context, packageID, channelID uint) error
+	// SetLineup replaces the package's channels with the given entries.
+	SetLineup(ctx context.Context, packageID uint, lineup []PackageChannel) error
+}
+
+// UserService returns users with their hoster and subscriptions loaded.
+type UserService interface {
+	List(ctx context.Context) ([]User, error)
+	Get(ctx context.Context, id uint) (*User, error)
+	Create(ctx context.Context, user *User) error
+	Update(ctx context.Context, user *User) error
+	Delete(ctx context.Context, id uint) error
+}
+
+type HosterService interface {
+	List(ctx context.Context) ([]IPTVHoster, error)
+	Get(ctx context.Context, id uint) (*IPTVHoster, error)
+	Create(ctx context.Context, hoster *IPTVHoster) error
+	Update(ctx context.Context, hoster *IPTVHoster) error
+	Delete(ctx context.Context, id uint) error
+}
+
+// SubscriptionService returns subscriptions with their user and packages loaded.
+// GetByKey additionally loads the user's hoster. Create also links the packages
+// set on the subscription.
+type SubscriptionService interface {
+	List(ctx context.Context) ([]Subscription, error)
+	Get(ctx context.Context, id uint) (*Subscription, error)
+	GetByKey(ctx context.Context, key string) (*Subscription, error)
+	GetByPlaylistToken(ctx context.Context, token string) (*Subscription, error)
+	Create(ctx context.Context, subscription *Subscription) error
+	Update(ctx context.Context, subscription *Subscription) error
+	Delete(ctx context.Context, id uint) error
+	AddPackage(ctx context.Context, subscriptionID, packageID uint) error
+	RemovePackage(ctx context.Context, subscriptionID, packageID uint) error
+	// Entitlements returns the packages, with channels, the subscription gives access to.
+	// A subscription without packages is entitled to every package.
+	Entitlements(ctx context.Context, subscription *Subscription) ([]Package, error)
+	// CountActive counts the subscriptions active at now.
+	CountActive(ctx context.Context, now time.Time) (int64, error)
+}
+
+type AdminService interface {
+	List(ctx context.Context) ([]Admin, error)
+	Get(ctx context.Context, id uint) (*Admin, error)
+	GetByUsername(ctx context.Context, username string) (*Admin, error)
+	Authenticate(ctx context.Context, username, password string) (*Admin, error)
+	// Update saves the admin's owner flag and two-factor state.
+	Update(ctx context.Context, admin *Admin) error
+	EnsureDefault(ctx context.Context) error
+}
+
+// CatalogService imports and exports the channel lineup. Import either applies
+// every row in a single transaction or, on dry runs and row errors, nothing at all.
+type CatalogService interface {
+	Export(ctx context.Context) (*Catalog, error)
+	Import(ctx context.Context, catalog *Catalog, dryRun bool) (*ImportReport, error)
+}
+
+// PlanService lists plans ordered by package and duration.
+type PlanService interface {
+	List(ctx context.Context) ([]Plan, error)
+	Get(ctx context.Context, id uint) (*Plan, error)
+	Create(ctx context.Context, plan *Plan) error
+	Update(ctx context.Context, plan *Plan) error
+	Delete(ctx context.Context, id uint) error
+}
+
+// BundleRuleService returns bundle rules with their package IDs loaded.
+type BundleRuleService interface {
+	List(ctx context.Context) ([]BundleRule, error)
+	Get(ctx context.Context, id uint) (*BundleRule, error)
+	Create(ctx context.Context, rule *BundleRule) error
+	Update(ctx context.Context, rule *BundleRule) error
+	Delete(ctx context.Context, id uint) error
+}
+
+// EPGService stores programme guide data
+type EPGService interface {
+	// Import replaces, for every channel matched by guide id, the stored programmes
+	// within the time range the guide covers for that channel.
+	Import(ctx context.Context, guide *Guide) (*EPGImportReport, error)
+	// Programmes returns the programmes of the given channels overlapping [from, to),
+	// ordered by channel and start time.
+	Programmes(ctx context.Context, channelIDs []uint, from, to time.Time) ([]Programme, error)
+	// Prune deletes programmes that ended before the given time.
+	Prune(ctx context.Context, before time.Time) (int64, error)
+}
+
+// HealthService stores the latest stream health check result per channel
+type HealthService interface {
+	List(ctx context.Context) ([]ChannelHealth, error)
+	// Record replaces the channel's result, keeping the last success time when the check failed.
+	Record(ctx context.Context, health *ChannelHealth) error
+}
+
+// SourceService stores channels' stream sources, ordered by channel, priority and ID
+type SourceService interface {
+	List(ctx context.Context) ([]StreamSource, error)
+	ForChannel(ctx context.Context, channelID uint) ([]StreamSource, error)
+	// Replace swaps the channel's sources for the given ones. Sources whose URL was
+	// already listed keep their health state.
+	Replace(ctx context.Context, channelID uint, sources []StreamSource) error
+	// RecordCheck stores the result of a health check of the source.
+	RecordCheck(ctx context.Context, id uint, result ChannelHealth) error
+}
+
+// AuditService stores the audit log of admin changes
+type AuditService interface {
+	Record(ctx context.Context, event *AuditEvent) error
+	// List returns the events passing the filter, newest first.
+	List(ctx context.Context, filter AuditFilter) ([]AuditEvent, error)
+	// Prune deletes events recorded before the given time.
+	Prune(ctx context.Context, before time.Time) (int64, error)
+}
+
+// APIKeyService stores API keys, including revoked ones
+type APIKeyService interface {
+	List(ctx context.Context) ([]APIKey, error)
+	Get(ctx context.Context, id uint) (*APIKey, error)
+	GetByPrefix(ctx context.Context, prefix string) (*APIKey, error)
+	Create(ctx context.Context, key *APIKey) error
+	Revoke(ctx context.Context, id uint, at time.Time) error
+	// Touch records the key's latest use.
+	Touch(ctx context.Context, id uint, at time.Time, ip string) error
+}
+
+type Services struct {
+	Channels      ChannelService
+	Packages      PackageService
+	Users         UserService
+	Hosters       HosterService
+	Subscriptions SubscriptionService
+	Admins        AdminService
+	Catalog       CatalogService
+	EPG           EPGService
+	Plans         PlanService
+	Bundles       BundleRuleService
+	Health        HealthService
+	Sources       SourceService
+	Audit         AuditService
+	APIKeys       APIKeyService
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"cmp"
+	"math/rand/v2"
+	"net/url"
+	"slices"
+	"strconv"
+)
+
+// Stream sources
+//
+// A channel can be served from several sources, for example a primary CDN and
+// a backup, of any stream type. Admins order them by priority (lowest first) and
+// spread load between sources of equal priority with weights. The health
+// checker records the state of every source, and the public catalog lists a
+// channel's sources healthiest first so players can fall back when the first
+// one fails. Channels without sources are played from their MPD URL.
+
+// PlaybackSource is a stream source as the public catalog shows it
+type PlaybackSource struct {
+	URL    string `json:"url"`
+	Format string `json:"format"`
+	Status string `json:"status,omitempty"` // ok or error, empty when not checked yet
+}
+
+// sourceRank orders health states: working sources first, unchecked ones next
+func sourceRank(s StreamSource) int {
+	switch s.Status {
+	case healthOK:
+		return 0
+	case healthError:
+		return 2
+	default:
+		return 1
+	}
+}
+
+// orderSources sorts sources by health, then priority, then weight. Among the
+// equally healthy sources of the best priority the first one is picked at
+// random in proportion to its weight; pick returns a number in [0, n).
+func orderSources(sources []StreamSource, pick func(n int) int) []StreamSource {
+	ordered := slices.Clone(sources)
+	slices.SortStableFunc(ordered, func(a, b StreamSource) int {
+		return cmp.Or(
+			cmp.Compare(sourceRank(a), sourceRank(b)),
+			cmp.Compare(a.Priority, b.Priority),
+			cmp.Compare(b.Weight, a.Weight),
+			cmp.Compare(a.ID, b.ID),
+		)
+	})
+
+	group, total := 0, 0
+	for _, s := range ordered {
+		if sourceRank(s) != sourceRank(ordered[0]) || s.Priority != ordered[0].Priority {
+			break
+		}
+		group++
+		total += s.Weight
+	}
+	if group < 2 || total <= 0 {
+		return ordered
+	}
+	n := pick(total)
+	for i := range group {
+		if n < ordered[i].Weight {
+			primary := ordered[i]
+			copy(ordered[1:i+1], ordered[:i])
+			ordered[0] = primary
+			break
+		}
+		n -= ordered[i].Weight
+	}
+	return ordered
+}
+
+// playbackSources lists where a channel can be played from, best first. The
+// legacy MPD field follows the first DASH source so older clients fail over too.
+func playbackSources(channel *Channel, sources []StreamSource, pick func(n int) int) {
+	if len(sources) == 0 {
+		if channel.MPD != "" {
+			channel.Sources = []PlaybackSource{{URL: channel.MPD, Format: channel.StreamType}}
+		}
+		return
+	}
+
+	channel.Sources = make([]PlaybackSource, 0, len(sources))
+	mpd := ""
+	for _, s := range orderSources(sources, pick) {
+		channel.Sources = append(channel.Sources, PlaybackSource{URL: s.URL, Format: s.Format, Status: s.Status})
+		if mpd == "" && s.Format == formatDASH {
+			mpd = s.URL
+		}
+	}
+	if mpd != "" {
+		channel.MPD = mpd
+	}
+}
+
+// withPlaybackSources sets the public source list of every channel
+func withPlaybackSources(channels []Channel, sources []StreamSource) {
+	byChannel := map[uint][]StreamSource{}
+	for _, s := range sources {
+		byChannel[s.ChannelID] = append(byChannel[s.ChannelID], s)
+	}
+	for i := range channels {
+		playbackSources(&channels[i], byChannel[channels[i].ID], rand.IntN)
+	}
+}
+
+// validateSources checks a channel's source list, defaults weights to 1 and
+// clears any health state sent along, which only the health checker sets
+func validateSources(sources []StreamSource) string {
+	seen := map[string]bool{}
+	for i := range sources {
+		s := &sources[i]
+		s.Status, s.LastError, s.LatencyMS, s.Failures, s.CheckedAt = "", "", 0, 0, nil
+		position := "Source " + strconv.Itoa(i+1)
+		u, err := url.Parse(s.URL)
+		switch {
+		case err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "":
+			return position + " needs an http(s) URL"
+		case !slices.Contains(streamTypes, s.Format):
+			return position + " must have format dash, hls or progressive"
+		case formatFromURL(s.URL) != "" && formatFromURL(s.URL) != s.Format:
+			return position + " looks like " + formatFromURL(s.URL) + " but is declared as " + s.Format
+		case s.Priority < 0 || s.Weight < 0:
+			return position + " cannot have a negative priority or weight"
+		case seen[s.URL]:
+			return position + " repeats " + s.URL
+		}
+		seen[s.URL] = true
+		if s.Weight == 0 {
+			s.Weight = 1
+		}
+	}
+	return ""
+}
+
+// keepSourceHealth carries the health state of an already listed URL over to
+// its replacement
+func keepSourceHealth(source StreamSource, existing []StreamSource) StreamSource {
+	for _, e := range existing {
+		if e.URL == source.URL {
+			source.Status, source.LastError, source.LatencyMS = e.Status, e.LastError, e.LatencyMS
+			source.Failures, source.CheckedAt = e.Failures, e.CheckedAt
+			break
+		}
+	}
+	return source
+}
+
+// recordCheck applies a health check result to the source
+func (s *StreamSource) recordCheck(result ChannelHealth) {
+	checked := result.CheckedAt
+	s.Status = result.Status
+	s.LastError = result.LastError
+	s.LatencyMS = result.LatencyMS
+	s.CheckedAt = &checked
+	if result.Status == healthOK {
+		s.Failures = 0
+	} else {
+		s.Failures++
+	}
+}
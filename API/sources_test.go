@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestOrderSources(t *testing.T) {
+	sources := []StreamSource{
+		{ID: 1, URL: "a", Priority: 0, Weight: 1, Status: healthError},
+		{ID: 2, URL: "b", Priority: 1, Weight: 1, Status: healthOK},
+		{ID: 3, URL: "c", Priority: 1, Weight: 3, Status: healthOK},
+		{ID: 4, URL: "d", Priority: 0, Weight: 1},
+	}
+	urls := func(ordered []StreamSource) string {
+		var s string
+		for _, source := range ordered {
+			s += source.URL
+		}
+		return s
+	}
+
+	// b and c share the best health and priority; c takes three of every four picks
+	for pick, want := range map[int]string{0: "cbda", 2: "cbda", 3: "bcda"} {
+		if got := urls(orderSources(sources, func(n int) int {
+			if n != 4 {
+				t.Fatalf("picked from %d, want the total weight 4", n)
+			}
+			return pick
+		})); got != want {
+			t.Errorf("pick %d: order %s, want %s", pick, got, want)
+		}
+	}
+}
+
+func TestChannelSourcesFailover(t *testing.T) {
+	r, conn := newTestServer(t)
+	token := adminToken(t)
+	cdn := fakeCDN(t)
+
+	channel := Channel{ExternalID: "news", Name: "News", MPD: cdn.URL + "/good.mpd"}
+	conn.Create(&channel)
+	path := fmt.Sprintf("/api/admin/channels/%d/sources", channel.ID)
+
+	for _, body := range []string{
+		`[{"url":"ftp://cdn.example/a.mpd","format":"dash"}]`,
+		`[{"url":"https://cdn.example/a.mpd","format":"smooth"}]`,
+		`[{"url":"https://cdn.example/a.mpd","format":"dash"},{"url":"https://cdn.example/a.mpd","format":"dash"}]`,
+	} {
+		if w := doRequest(r, http.MethodPut, path, body, token); w.Code != http.StatusBadRequest {
+			t.Fatalf("PUT %s: status %d, want 400", body, w.Code)
+		}
+	}
+
+	sources := fmt.Sprintf(`[
+		{"url":"%[1]s/gone.mpd","format":"dash","priority":0},
+		{"url":"%[1]s/good.mpd","format":"dash","priority":1},
+		{"url":"%[1]s/live.m3u8","format":"hls","priority":2}
+	]`, cdn.URL)
+	w := doRequest(r, http.MethodPut, path, sources, token)
+	var stored []StreamSource
+	decodeJSON(t, w, &stored)
+	if w.Code != http.StatusOK || len(stored) != 3 || stored[0].Weight != 1 {
+		t.Fatalf("PUT sources: status %d, %+v", w.Code, stored)
+	}
+
+	// Before any check the primary comes first
+	var channels []Channel
+	decodeEncrypted(t, doRequest(r, http.MethodGet, "/api/public/channels", "", ""), &channels)
+	if len(channels[0].Sources) != 3 || channels[0].Sources[0].URL != cdn.URL+"/gone.mpd" {
+		t.Fatalf("unchecked sources = %+v", channels[0].Sources)
+	}
+
+	services := newGormServices(conn)
+	if _, err := checkChannels(context.Background(), services, cdn.Client(), 2); err != nil {
+		t.Fatal(err)
+	}
+
+	// The broken primary drops to the end and the legacy mpd follows the working DASH source
+	decodeEncrypted(t, doRequest(r, http.MethodGet, "/api/public/channels", "", ""), &channels)
+	got := channels[0]
+	if len(got.Sources) != 3 || got.Sources[0].URL != cdn.URL+"/good.mpd" || got.Sources[1].Format != formatHLS ||
+		got.Sources[2].Status != healthError || got.MPD != cdn.URL+"/good.mpd" {
+		t.Fatalf("checked sources = %+v, mpd %s", got.Sources, got.MPD)
+	}
+
+	// Re-saving the same URLs keeps their health
+	doRequest(r, http.MethodPut, path, sources, token)
+	decodeJSON(t, doRequest(r, http.MethodGet, path, "", token), &stored)
+	if stored[0].Status != healthError || stored[0].Failures != 1 || stored[2].Status != healthOK || stored[2].CheckedAt == nil {
+		t.Fatalf("sources after re-saving = %+v", stored)
+	}
+}
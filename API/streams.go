@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"mime"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Stream types
+//
+// A channel declares how its stream is delivered: a DASH manifest, an HLS
+// playlist or a progressive file or transport stream played as is. The channel's
+// MPD field holds the URL whatever the type. Only DASH channels carry DRM
+// keys; progressive streams name their MIME type so players can pick a demuxer.
+const (
+	formatDASH        = "dash"
+	formatHLS         = "hls"
+	formatProgressive = "progressive"
+)
+
+var streamTypes = []string{formatDASH, formatHLS, formatProgressive}
+
+// formatFromURL guesses the stream type from the URL's file extension, empty
+// when the extension says nothing
+func formatFromURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	switch strings.ToLower(path.Ext(u.Path)) {
+	case ".mpd":
+		return formatDASH
+	case ".m3u8", ".m3u":
+		return formatHLS
+	case ".mp4", ".m4v", ".mkv", ".webm", ".ts", ".mp3", ".aac":
+		return formatProgressive
+	}
+	return ""
+}
+
+// detectFormat tells the stream type from a response's Content-Type and the
+// first bytes of its body, empty when neither is conclusive
+func detectFormat(contentType string, head []byte) string {
+	head = bytes.TrimLeft(bytes.TrimPrefix(head, []byte("\xef\xbb\xbf")), " \t\r\n")
+	switch {
+	case bytes.HasPrefix(head, []byte("#EXTM3U")):
+		return formatHLS
+	case bytes.HasPrefix(head, []byte("<")) && bytes.Contains(head, []byte("<MPD")):
+		return formatDASH
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case mediaType == "application/dash+xml":
+		return formatDASH
+	case strings.Contains(mediaType, "mpegurl"):
+		return formatHLS
+	case strings.HasPrefix(mediaType, "video/"), strings.HasPrefix(mediaType, "audio/"):
+		return formatProgressive
+	}
+	return ""
+}
+
+// validateStream checks a channel's stream type against its URL and the fields
+// that only apply to some types, and validates its DRM keys. An empty type
+// defaults to DASH.
+func validateStream(channel *Channel) string {
+	if channel.StreamType == "" {
+		channel.StreamType = formatDASH
+	}
+	switch channel.StreamType {
+	case formatDASH, formatHLS, formatProgressive:
+	default:
+		return "Stream type must be dash, hls or progressive"
+	}
+
+	if guessed := formatFromURL(channel.MPD); guessed != "" && guessed != channel.StreamType {
+		return "The stream URL looks like " + guessed + " but the channel is declared as " + channel.StreamType
+	}
+	if msg := validateKeys(channel.Keys); msg != "" {
+		return msg
+	}
+	// Players only take ClearKey pairs for DASH; license servers also serve HLS
+	for _, k := range channel.Keys {
+		if channel.StreamType == formatProgressive {
+			return "DRM keys are not supported for progressive streams"
+		}
+		if k.System == keySystemClearKey && channel.StreamType != formatDASH {
+			return "ClearKey pairs are only supported for dash streams"
+		}
+	}
+	if channel.StreamType == formatProgressive {
+		mediaType, _, err := mime.ParseMediaType(channel.MimeType)
+		if err != nil || (!strings.HasPrefix(mediaType, "video/") && !strings.HasPrefix(mediaType, "audio/")) {
+			return "Progressive streams need a video/ or audio/ mime_type"
+		}
+	} else if channel.MimeType != "" {
+		return "mime_type only applies to progressive streams"
+	}
+	if channel.LowLatency && channel.StreamType == formatProgressive {
+		return "low_latency only applies to dash and hls streams"
+	}
+	return ""
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestValidateStream(t *testing.T) {
+	for _, tc := range []struct {
+		channel Channel
+		want    string // substring of the error, empty when valid
+	}{
+		{Channel{MPD: "https://cdn.example/a.mpd", Keys: []ChannelKey{{KID: testKID, Key: testContentKey}}}, ""},
+		{Channel{MPD: "https://cdn.example/a.m3u8", StreamType: formatHLS, LowLatency: true}, ""},
+		{Channel{MPD: "https://cdn.example/live", StreamType: formatHLS}, ""},
+		{Channel{MPD: "https://cdn.example/a.ts", StreamType: formatProgressive, MimeType: "video/mp2t"}, ""},
+		{Channel{MPD: "https://cdn.example/a.m3u8"}, "looks like hls"},
+		{Channel{MPD: "https://cdn.example/a.mpd", StreamType: formatHLS}, "looks like dash"},
+		{Channel{MPD: "https://cdn.example/a.m3u8", StreamType: formatHLS, Keys: []ChannelKey{{System: keySystemWidevine, LicenseURL: "https://license.example/wv"}}}, ""},
+		{Channel{MPD: "https://cdn.example/a.m3u8", StreamType: formatHLS, Keys: []ChannelKey{{KID: testKID, Key: testContentKey}}}, "only supported for dash"},
+		{Channel{MPD: "https://cdn.example/a.mp4", StreamType: formatProgressive, MimeType: "video/mp4", Keys: []ChannelKey{{System: keySystemWidevine, LicenseURL: "https://license.example/wv"}}}, "not supported for progressive"},
+		{Channel{MPD: "https://cdn.example/a.mp4", StreamType: formatProgressive}, "mime_type"},
+		{Channel{MPD: "https://cdn.example/a.mp4", StreamType: formatProgressive, MimeType: "text/html"}, "mime_type"},
+		{Channel{MPD: "https://cdn.example/a.mpd", MimeType: "video/mp4"}, "only applies to progressive"},
+		{Channel{MPD: "https://cdn.example/a.mp4", StreamType: formatProgressive, MimeType: "video/mp4", LowLatency: true}, "low_latency"},
+		{Channel{MPD: "https://cdn.example/a", StreamType: "rtmp"}, "must be dash, hls or progressive"},
+	} {
+		got := validateStream(&tc.channel)
+		if (tc.want == "") != (got == "") || !strings.Contains(got, tc.want) {
+			t.Errorf("%+v: error %q, want %q", tc.channel, got, tc.want)
+		}
+	}
+}
+
+func TestStreamTypes(t *testing.T) {
+	r, services := newMemoryServer(t)
+	token := adminToken(t)
+	cdn := fakeCDN(t)
+
+	w := doRequest(r, http.MethodPost, "/api/admin/channels", `{"name":"Live","mpd":"`+cdn.URL+`/live.m3u8","stream_type":"hls"}`, token)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create HLS channel: status %d, body %s", w.Code, w.Body)
+	}
+	w = doRequest(r, http.MethodPost, "/api/admin/channels", `{"name":"Wrong","mpd":"`+cdn.URL+`/live.m3u8"}`, token)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("HLS URL declared as dash: status %d, want 400", w.Code)
+	}
+
+	// Channels stored before stream types were validated are caught by the health check
+	mislabelled := Channel{Name: "Mislabelled", MPD: cdn.URL + "/live.m3u8", StreamType: formatDASH}
+	services.Channels.Create(context.Background(), &mislabelled)
+	if _, err := checkChannels(context.Background(), services, cdn.Client(), 1); err != nil {
+		t.Fatal(err)
+	}
+	results, _ := services.Health.List(context.Background())
+	for _, h := range results {
+		switch {
+		case h.ChannelID == mislabelled.ID && !strings.Contains(h.LastError, "stream is hls but declared as dash"):
+			t.Errorf("mislabelled channel health = %+v", h)
+		case h.ChannelID != mislabelled.ID && (h.Status != healthOK || h.Representations != 2):
+			t.Errorf("HLS channel health = %+v", h)
+		}
+	}
+
+	var channels []Channel
+	decodeEncrypted(t, doRequest(r, http.MethodGet, "/api/public/channels", "", ""), &channels)
+	if channels[0].StreamType != formatHLS || len(channels[0].Sources) != 1 || channels[0].Sources[0].Format != formatHLS {
+		t.Fatalf("public channel = %+v", channels[0])
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Two-factor authentication
+//
+// Admins can add a TOTP authenticator (RFC 6238: SHA-1, six digits, 30 second
+// steps) to their account. Enrolment generates a secret and an otpauth:// URI
+// to show as a QR code; the secret only takes effect once a code from the app
+// confirms it, which also hands out single-use recovery codes. With 2FA on, a
+// correct password only yields a short-lived challenge token, exchanged for the
+// JWT together with a code. Each code is accepted once. Secrets are stored
+// encrypted and recovery codes hashed. Owner admins can reset another admin's
+// 2FA when they lose their device.
+
+const (
+	totpIssuer        = "streamsauce"
+	totpPeriod        = 30 * time.Second
+	totpDigits        = 6
+	totpSkew          = 1 // steps accepted either side of the current one
+	recoveryCodeCount = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// newTOTPSecret returns a random 160-bit secret in base32
+func newTOTPSecret() string {
+	b := make([]byte, 20)
+	rand.Read(b)
+	return totpEncoding.EncodeToString(b)
+}
+
+// totpURI is the provisioning URI authenticator apps read from a QR code
+func totpURI(username, secret string) string {
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", totpIssuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", fmt.Sprint(totpDigits))
+	q.Set("period", fmt.Sprint(int(totpPeriod.Seconds())))
+	label := url.PathEscape(totpIssuer + ":" + username)
+	return "otpauth://totp/" + label + "?" + q.Encode()
+}
+
+// totpCode computes the code of a time step
+func totpCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1_000_000), nil
+}
+
+// verifyTOTP checks a code against the steps around now, skipping steps up to
+// and including lastStep, which were already used. It returns the matching step.
+func verifyTOTP(secret, code string, now time.Time, lastStep int64) (int64, bool) {
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	current := now.Unix() / int64(totpPeriod.Seconds())
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		want, err := totpCode(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(want), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// newRecoveryCodes returns fresh recovery codes and the hashes to store
+func newRecoveryCodes() (codes, hashes []string) {
+	for range recoveryCodeCount {
+		b := make([]byte, 5)
+		rand.Read(b)
+		code := strings.ToLower(totpEncoding.EncodeToString(b))
+		code = code[:4] + "-" + code[4:]
+		codes = append(codes, code)
+		hashes = append(hashes, recoveryCodeHash(code))
+	}
+	return codes, hashes
+}
+
+func recoveryCodeHash(code string) string {
+	return plainLookupHash(strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", "")))
+}
+
+// useRecoveryCode removes the code from the admin's recovery codes, reporting
+// whether it was one of them
+func useRecoveryCode(admin *Admin, code string) bool {
+	hash := recoveryCodeHash(code)
+	for i, stored := range admin.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(stored), []byte(hash)) == 1 {
+			admin.RecoveryCodes = append(admin.RecoveryCodes[:i:i], admin.RecoveryCodes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// secondFactor checks a TOTP or recovery code for an admin with 2FA enabled,
+// updating the admin's replay and recovery code state, which the caller saves
+func secondFactor(admin *Admin, code, recoveryCode string, now time.Time) bool {
+	if recoveryCode != "" {
+		return useRecoveryCode(admin, recoveryCode)
+	}
+	step, ok := verifyTOTP(admin.TOTPSecret, code, now, admin.TOTPLastStep)
+	if ok {
+		admin.TOTPLastStep = step
+	}
+	return ok
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 SHA-1 test vectors, truncated to six digits
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	for unix, want := range map[int64]string{59: "287082", 1111111109: "081804", 2000000000: "279037"} {
+		if got, err := totpCode(secret, unix/30); err != nil || got != want {
+			t.Errorf("code at %d = %q, %v, want %s", unix, got, err, want)
+		}
+	}
+
+	now := time.Unix(1111111109, 0)
+	code, _ := totpCode(secret, now.Unix()/30)
+	step, ok := verifyTOTP(secret, code, now.Add(25*time.Second), 0)
+	if !ok || step != now.Unix()/30 {
+		t.Fatalf("code of the previous step rejected")
+	}
+	if _, ok := verifyTOTP(secret, code, now, step); ok {
+		t.Fatal("used code accepted again")
+	}
+	if _, ok := verifyTOTP(secret, code, now.Add(2*time.Minute), 0); ok {
+		t.Fatal("stale code accepted")
+	}
+	if uri := totpURI("admin", secret); !strings.HasPrefix(uri, "otpauth://totp/streamsauce:admin?") || !strings.Contains(uri, "secret="+secret) {
+		t.Fatalf("uri = %s", uri)
+	}
+}
+
+func TestTwoFactorLogin(t *testing.T) {
+	services := newMemoryServices()
+	services.Admins.EnsureDefault(context.Background())
+	s := newServer(services)
+	s.limits = RateLimitConfig{} // the test logs in more often than allowed
+	r := s.router()
+	token := adminToken(t)
+	step := time.Now().Unix() / 30
+
+	var enrolment struct {
+		Secret     string `json:"secret"`
+		OTPAuthURL string `json:"otpauth_url"`
+	}
+	decodeJSON(t, doRequest(r, http.MethodPost, "/api/admin/2fa/enroll", "", token), &enrolment)
+	if enrolment.Secret == "" || !strings.Contains(enrolment.OTPAuthURL, enrolment.Secret) {
+		t.Fatalf("enrolment = %+v", enrolment)
+	}
+	if w := doRequest(r, http.MethodPost, "/api/admin/2fa/confirm", `{"code":"000000"}`, token); w.Code != http.StatusBadRequest {
+		t.Fatalf("confirm with a wrong code: status %d", w.Code)
+	}
+	code := func(step int64) string {
+		c, _ := totpCode(enrolment.Secret, step)
+		return c
+	}
+	var confirmed struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	w := doRequest(r, http.MethodPost, "/api/admin/2fa/confirm", `{"code":"`+code(step-1)+`"}`, token)
+	decodeJSON(t, w, &confirmed)
+	if w.Code != http.StatusOK || len(confirmed.RecoveryCodes) != recoveryCodeCount {
+		t.Fatalf("confirm: status %d, %s", w.Code, w.Body)
+	}
+
+	// The password alone only yields a challenge, which is no admin token
+	var challenge struct {
+		Required  bool   `json:"two_factor_required"`
+		Challenge string `json:"challenge"`
+		Token     string `json:"token"`
+	}
+	login := func() {
+		w := doRequest(r, http.MethodPost, "/api/login", `{"username":"admin","password":"`+defaultAdminPassword+`"}`, "")
+		decodeJSON(t, w, &challenge)
+		if w.Code != http.StatusOK || !challenge.Required || challenge.Token != "" {
+			t.Fatalf("login: status %d, %s", w.Code, w.Body)
+		}
+	}
+	login()
+	if w := doRequest(r, http.MethodGet, "/api/admin/channels", "", challenge.Challenge); w.Code != http.StatusUnauthorized {
+		t.Fatalf("challenge used as token: status %d", w.Code)
+	}
+	secondStep := func(field, value string) *http.Response {
+		w := doRequest(r, http.MethodPost, "/api/login/2fa", `{"challenge":"`+challenge.Challenge+`","`+field+`":"`+value+`"}`, "")
+		return w.Result()
+	}
+	if res := secondStep("code", code(step-1)); res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("code used for enrolment accepted: status %d", res.StatusCode)
+	}
+	if res := secondStep("code", code(step)); res.StatusCode != http.StatusOK {
+		t.Fatalf("second step: status %d", res.StatusCode)
+	}
+	login()
+	if res := secondStep("recovery_code", strings.ToUpper(confirmed.RecoveryCodes[0])); res.StatusCode != http.StatusOK {
+		t.Fatalf("recovery code: status %d", res.StatusCode)
+	}
+	if res := secondStep("recovery_code", confirmed.RecoveryCodes[0]); res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("recovery code reused: status %d", res.StatusCode)
+	}
+
+	// Only owners reset other admins' 2FA
+	ctx := context.Background()
+	admin, _ := services.Admins.GetByUsername(ctx, defaultAdminUsername)
+	path := fmt.Sprintf("/api/admin/admins/%d/2fa", admin.ID)
+	admin.IsOwner = false
+	services.Admins.Update(ctx, admin)
+	if w := doRequest(r, http.MethodDelete, path, "", token); w.Code != http.StatusForbidden {
+		t.Fatalf("reset by a non-owner: status %d", w.Code)
+	}
+	admin.IsOwner = true
+	services.Admins.Update(ctx, admin)
+	if w := doRequest(r, http.MethodDelete, path, "", token); w.Code != http.StatusOK {
+		t.Fatalf("reset by the owner: status %d, %s", w.Code, w.Body)
+	}
+	var loggedIn struct {
+		Token string `json:"token"`
+	}
+	decodeJSON(t, doRequest(r, http.MethodPost, "/api/login", `{"username":"admin","password":"`+defaultAdminPassword+`"}`, ""), &loggedIn)
+	if loggedIn.Token == "" {
+		t.Fatal("no token after 2FA reset")
+	}
+
+	var events []AuditEvent
+	decodeJSON(t, doRequest(r, http.MethodGet, "/api/admin/audit?entity_type=admin", "", token), &events)
+	if len(events) != 2 || events[0].Action != "reset_2fa" || events[0].Changes["totp_enabled"] != (FieldChange{true, false}) ||
+		events[1].Action != "enable_2fa" || events[1].EntityID != admin.ID {
+		t.Fatalf("audit events = %+v", events)
+	}
+}
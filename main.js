@@ -43,6 +43,28 @@ function decrypt(ciphertext, key) {
   }
 }
 
+// Opens a response envelope: {"data"} for whole responses, or {"version": 2, "nonce", "chunks"}
+// for large ones, whose chunks are sealed with nonce prefix || uint32 index || last flag
+function openEnvelope(envelope, key) {
+  if (!envelope.version || envelope.version < 2) {
+    return decrypt(envelope.data, key);
+  }
+  const keyBuffer = Buffer.from(key, 'utf8');
+  const prefix = Buffer.from(envelope.nonce, 'base64');
+  const parts = envelope.chunks.map((chunk, i) => {
+    const data = Buffer.from(chunk, 'base64');
+    const nonce = Buffer.alloc(12);
+    prefix.copy(nonce, 0);
+    nonce.writeUInt32BE(i, 7);
+    nonce[11] = i === envelope.chunks.length - 1 ? 1 : 0;
+
+    const decipher = crypto.createDecipheriv('aes-256-gcm', keyBuffer, nonce);
+    decipher.setAuthTag(data.slice(-16));
+    return Buffer.concat([decipher.update(data.slice(0, -16)), decipher.final()]);
+  });
+  return Buffer.concat(parts).toString('utf8');
+}
+
 // HTTP request helper
 function makeHttpRequest(url, options = {}) {
   return new Promise((resolve, reject) => {
@@ -131,15 +153,18 @@ ipcMain.handle('validate-subscription', async (event, { subscriptionKey }) => {
     // Validate subscription using the proper endpoint
     const response = await makeHttpRequest(`http://127.0.0.1:65000/api/public/validate/${subscriptionKey}`);
 
-    if (response.status !== 200) {
-      return { success: false, message: 'Failed to validate subscription key' };
-    }
-
-    // Decrypt the validation response
+    // Decrypt the validation response; errors such as unknown keys are encrypted too
     const decryptionKey = 'EvMimti9L6yB7As37tH2VdjzLoBxYHts';
-    const decryptedData = decrypt(response.data.data, decryptionKey);
+    const decryptedData = openEnvelope(response.data, decryptionKey);
     const validationResult = JSON.parse(decryptedData);
 
+    if (response.status !== 200) {
+      const message = validationResult.code === 'subscription_not_found'
+        ? 'Invalid subscription key'
+        : validationResult.detail || 'Failed to validate subscription key';
+      return { success: false, message };
+    }
+
     console.log('Validation result:', validationResult);
 
     if (!validationResult.valid) {
@@ -149,8 +174,6 @@ ipcMain.handle('validate-subscription', async (event, { subscriptionKey }) => {
         errorMessage = 'Your subscription has expired';
       } else if (validationResult.status === 'not_started') {
         errorMessage = 'Your subscription has not started yet';
-      } else if (validationResult.error) {
-        errorMessage = validationResult.error;
       }
 
       return { success: false, message: errorMessage };
@@ -228,7 +251,7 @@ ipcMain.handle('get-packages', async () => {
     }
 
     const decryptionKey = 'EvMimti9L6yB7As37tH2VdjzLoBxYHts';
-    const decryptedData = decrypt(response.data.data, decryptionKey);
+    const decryptedData = openEnvelope(response.data, decryptionKey);
     const packages = JSON.parse(decryptedData);
     console.log(packages.channels);
     return { success: true, packages };